@@ -44,6 +44,7 @@ func servEnv(config *agent.ConfigArgs) {
 	c := os.Getenv("CRYPTO_KEY")
 	cfg := os.Getenv("CONFIG")
 	g := os.Getenv("GRPC")
+	tt := os.Getenv("TENANT_TOKEN")
 
 	if s != "" {
 		if len(strings.Split(s, ":")) == 2 {
@@ -88,6 +89,9 @@ func servEnv(config *agent.ConfigArgs) {
 	if g == "true" {
 		config.Grpc = true
 	}
+	if tt != "" {
+		config.TenantToken = tt
+	}
 }
 
 // Parse cmdline args.
@@ -101,5 +105,6 @@ func servFlags(config *agent.ConfigArgs) {
 	flag.StringVar(&config.PubKeyFile, "crypto-key", "", "path to public asymmetric key")
 	flag.StringVar(&cfgJSON, "config", "", "path to main config file (json)")
 	flag.BoolVar(&config.Grpc, "grpc", false, "enable grpc")
+	flag.StringVar(&config.TenantToken, "tenant-token", "", "bearer token of tenant")
 	flag.Parse()
 }
@@ -47,6 +47,21 @@ func servEnv(config *server.ConfigArgs) {
 	cfg := os.Getenv("CONFIG")
 	t := os.Getenv("TRUSTED_SUBNET")
 	g := os.Getenv("GRPC_SERVER")
+	w := os.Getenv("WAL_FILE")
+	ws := os.Getenv("WAL_FSYNC")
+	rt := os.Getenv("RESTORE_TOLERANT")
+	rp := os.Getenv("RETENTION")
+	dd := os.Getenv("DATA_DIR")
+	tn := os.Getenv("TENANTS")
+	iw := os.Getenv("IDEMPOTENCY_WINDOW")
+	sa := os.Getenv("STATSD_ADDRESS")
+	sf := os.Getenv("STATSD_FLUSH_INTERVAL")
+	st := os.Getenv("STATSD_TENANT")
+	ga := os.Getenv("GRAPHITE_ADDRESS")
+	gp := os.Getenv("GRAPHITE_PICKLE_ADDRESS")
+	gt := os.Getenv("GRAPHITE_TENANT")
+	ar := os.Getenv("ALERT_RULES_FILE")
+	ai := os.Getenv("ALERT_EVAL_INTERVAL")
 
 	if s != "" {
 		if len(strings.Split(s, ":")) == 2 {
@@ -78,9 +93,22 @@ func servEnv(config *server.ConfigArgs) {
 		}
 		config.Restore = b
 	}
+	if rt != "" {
+		b, err := strconv.ParseBool(rt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.RestoreTolerant = b
+	}
+	if rp != "" {
+		config.Retention = rp
+	}
 	if d != "" {
 		config.DatabaseDsn = d
 	}
+	if dd != "" {
+		config.DataDir = dd
+	}
 	if k != "" {
 		config.KeyEnc = k
 	}
@@ -96,6 +124,54 @@ func servEnv(config *server.ConfigArgs) {
 	if g != "" {
 		config.GrpcServer = g
 	}
+	if w != "" {
+		config.WALFile = w
+	}
+	if ws != "" {
+		config.WALFsync = ws
+	}
+	if tn != "" {
+		config.Tenants = tn
+	}
+	if iw != "" {
+		ii, err := strconv.Atoi(iw)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.IdempotencyWindow = ii
+	}
+	if sa != "" {
+		config.StatsdAddr = sa
+	}
+	if sf != "" {
+		ii, err := strconv.Atoi(sf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.StatsdFlushInterval = ii
+	}
+	if st != "" {
+		config.StatsdTenant = st
+	}
+	if ga != "" {
+		config.GraphiteAddr = ga
+	}
+	if gp != "" {
+		config.GraphitePickleAddr = gp
+	}
+	if gt != "" {
+		config.GraphiteTenant = gt
+	}
+	if ar != "" {
+		config.AlertRulesFile = ar
+	}
+	if ai != "" {
+		ii, err := strconv.Atoi(ai)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.AlertEvalInterval = ii
+	}
 }
 
 // Parse cmdline args.
@@ -105,13 +181,28 @@ func servFlags(config *server.ConfigArgs) {
 	flag.IntVar(&config.StoreInterval, "i", 300, "metric store interval")
 	flag.StringVar(&config.FileStoragePath, "f", "/tmp/metrics-db.json", "file storage path")
 	flag.BoolVar(&config.Restore, "r", true, "restore metric data")
+	flag.BoolVar(&config.RestoreTolerant, "restore-tolerant", false, "skip corrupt lines of metric data file on restore")
 	//dsn example: host=localhost database=monitoring
 	flag.StringVar(&config.DatabaseDsn, "d", "", "pg db connect address")
+	flag.StringVar(&config.DataDir, "data-dir", "", "embedded disk storage directory")
 	flag.StringVar(&config.KeyEnc, "k", "", "encrypted key")
 	flag.StringVar(&config.PprofAddr, "p", "", "Pprof server bind addres and port")
 	flag.StringVar(&config.PrivKeyFile, "crypto-key", "", "path to private asymmetric key")
 	flag.StringVar(&cfgJSON, "config", "", "path to main config file (json)")
 	flag.StringVar(&config.TrustedSubnets, "t", "", "allow connections from special subnets (',' separate)")
 	flag.StringVar(&config.GrpcServer, "grpc-server", "", "grpc server for agent metrics")
+	flag.StringVar(&config.WALFile, "wal", "", "write-ahead log file path for in-memory storage")
+	flag.StringVar(&config.WALFsync, "wal-fsync", "everysec", "write-ahead log and disk storage fsync mode (always, everysec, no)")
+	flag.StringVar(&config.Retention, "retention", "raw:24h,1m:30d,1h:365d", "history retention policy (resolution:keep, ',' separate, forever - keep raw history forever)")
+	flag.StringVar(&config.Tenants, "tenants", "", "tenants with bearer tokens and optional requests per second limit (name:token[:rps], ',' separate)")
+	flag.IntVar(&config.IdempotencyWindow, "idempotency-window", 300, "seconds of remembering applied batch idempotency keys (0 - disabled)")
+	flag.StringVar(&config.StatsdAddr, "statsd-address", "", "statsd listener address, udp and tcp (empty - disabled)")
+	flag.IntVar(&config.StatsdFlushInterval, "statsd-flush-interval", 10, "seconds between flushes of aggregated statsd samples")
+	flag.StringVar(&config.StatsdTenant, "statsd-tenant", "", "tenant of statsd samples (empty - default tenant, must be one of tenants, when they are set)")
+	flag.StringVar(&config.GraphiteAddr, "graphite-address", "", "graphite plaintext protocol listener address (empty - disabled)")
+	flag.StringVar(&config.GraphitePickleAddr, "graphite-pickle-address", "", "graphite pickle protocol listener address (empty - disabled)")
+	flag.StringVar(&config.GraphiteTenant, "graphite-tenant", "", "tenant of graphite datapoints (empty - default tenant, must be one of tenants, when they are set)")
+	flag.StringVar(&config.AlertRulesFile, "alert-rules-file", "", "alert rules config file, json (empty - alerting disabled)")
+	flag.IntVar(&config.AlertEvalInterval, "alert-eval-interval", 15, "seconds between alert rules evaluations")
 	flag.Parse()
 }
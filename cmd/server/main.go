@@ -4,12 +4,15 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
+	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
 	"github.com/sourcecd/monitoring/internal/server"
+	"github.com/sourcecd/monitoring/internal/storage"
 
 	"net/http"
 	// Profile module.
@@ -44,6 +47,22 @@ func main() {
 	// Parse json config
 	parseJSONconfigFile(&config)
 
+	// Run schema migrations mode (server [flags] migrate up|down|status).
+	if args := flag.Args(); len(args) > 0 && args[0] == "migrate" {
+		if config.DatabaseDsn == "" {
+			log.Fatal("migrate mode requires database dsn")
+		}
+		pgdb, err := storage.NewPgDB(config.DatabaseDsn, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer pgdb.CloseDB()
+		if err := runMigrate(ctx, pgdb, args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Enable profile server.
 	if config.PprofAddr != "" {
 		go func() {
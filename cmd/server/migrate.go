@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/sourcecd/monitoring/internal/storage"
+)
+
+// errMigrateUsage error for wrong migrate mode arguments.
+var errMigrateUsage = errors.New("usage: server [flags] migrate up|down [steps]|status")
+
+// migrator schema migrations of metrics database.
+type migrator interface {
+	MigrateUp(ctx context.Context) error                                    // apply all pending migrations
+	MigrateDown(ctx context.Context, steps int) error                       // revert last applied migrations
+	MigrationStatus(ctx context.Context) ([]storage.MigrationStatus, error) // list migrations state
+}
+
+// runMigrate run migrate mode command (args are arguments after "migrate").
+func runMigrate(ctx context.Context, m migrator, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return errMigrateUsage
+	}
+	switch args[0] {
+	case "up":
+		if len(args) != 1 {
+			return errMigrateUsage
+		}
+		return m.MigrateUp(ctx)
+	case "down":
+		steps := 1
+		if len(args) > 2 {
+			return errMigrateUsage
+		}
+		if len(args) == 2 {
+			s, err := strconv.Atoi(args[1])
+			if err != nil || s < 1 {
+				return errMigrateUsage
+			}
+			steps = s
+		}
+		return m.MigrateDown(ctx, steps)
+	case "status":
+		if len(args) != 1 {
+			return errMigrateUsage
+		}
+		status, err := m.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		for _, v := range status {
+			name := v.Name
+			if name == "" {
+				name = "(unknown)"
+			}
+			state := "pending"
+			if v.Applied {
+				state = "applied " + v.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%04d %s: %s\n", v.Version, name, state)
+		}
+		return nil
+	default:
+		return errMigrateUsage
+	}
+}
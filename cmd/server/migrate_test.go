@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sourcecd/monitoring/internal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+type testMigrator struct {
+	up    int
+	steps int
+}
+
+func (m *testMigrator) MigrateUp(ctx context.Context) error {
+	m.up++
+	return nil
+}
+
+func (m *testMigrator) MigrateDown(ctx context.Context, steps int) error {
+	m.steps += steps
+	return nil
+}
+
+func (m *testMigrator) MigrationStatus(ctx context.Context) ([]storage.MigrationStatus, error) {
+	return []storage.MigrationStatus{
+		{Version: 1, Name: "create_monitoring", Applied: true, AppliedAt: time.Unix(0, 0).UTC()},
+		{Version: 2, Name: "create_history"},
+		{Version: 3, Applied: true, AppliedAt: time.Unix(60, 0).UTC()},
+	}, nil
+}
+
+func TestRunMigrate(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	m := &testMigrator{}
+	var out bytes.Buffer
+
+	require.NoError(t, runMigrate(ctx, m, []string{"up"}, &out))
+	require.Equal(t, 1, m.up)
+	require.NoError(t, runMigrate(ctx, m, []string{"down"}, &out))
+	require.NoError(t, runMigrate(ctx, m, []string{"down", "2"}, &out))
+	require.Equal(t, 3, m.steps)
+
+	require.NoError(t, runMigrate(ctx, m, []string{"status"}, &out))
+	require.Equal(t, `0001 create_monitoring: applied 1970-01-01T00:00:00Z
+0002 create_history: pending
+0003 (unknown): applied 1970-01-01T00:01:00Z
+`, out.String())
+
+	for _, args := range [][]string{{}, {"sideways"}, {"down", "0"}, {"down", "x"}, {"up", "1"}, {"status", "all"}} {
+		require.ErrorIs(t, runMigrate(ctx, m, args, &out), errMigrateUsage)
+	}
+}
@@ -22,6 +22,11 @@ func TestServerCmdArgs(t *testing.T) {
 	os.Args = append(os.Args, "-d", "host=localhost database=monitoring")
 	os.Args = append(os.Args, "-k", "seckey")
 	os.Args = append(os.Args, "-p", "localhost:6060")
+	os.Args = append(os.Args, "-wal", "/tmp/metrics-wal.log")
+	os.Args = append(os.Args, "-wal-fsync", "always")
+	os.Args = append(os.Args, "-restore-tolerant")
+	os.Args = append(os.Args, "-retention", "raw:1h,1m:1d")
+	os.Args = append(os.Args, "-data-dir", "/tmp/metrics-data")
 
 	servFlags(&config)
 
@@ -34,6 +39,11 @@ func TestServerCmdArgs(t *testing.T) {
 	assert.Equal(t, config.DatabaseDsn, "host=localhost database=monitoring")
 	assert.Equal(t, config.KeyEnc, "seckey")
 	assert.Equal(t, config.PprofAddr, "localhost:6060")
+	assert.Equal(t, config.WALFile, "/tmp/metrics-wal.log")
+	assert.Equal(t, config.WALFsync, "always")
+	assert.Equal(t, config.RestoreTolerant, true)
+	assert.Equal(t, config.Retention, "raw:1h,1m:1d")
+	assert.Equal(t, config.DataDir, "/tmp/metrics-data")
 }
 
 func TestServerEnvArgs(t *testing.T) {
@@ -48,6 +58,9 @@ func TestServerEnvArgs(t *testing.T) {
 	os.Setenv("DATABASE_DSN", "database=monitoring")
 	os.Setenv("PPROF_SERVER_ADDRESS", "localhost:7070")
 	os.Setenv("KEY", "seckey2")
+	os.Setenv("WAL_FILE", "/home/metric-wal.log")
+	os.Setenv("WAL_FSYNC", "no")
+	os.Setenv("DATA_DIR", "/home/metrics-data")
 
 	servEnv(&config)
 
@@ -60,6 +73,9 @@ func TestServerEnvArgs(t *testing.T) {
 	assert.Equal(t, config.DatabaseDsn, "database=monitoring")
 	assert.Equal(t, config.KeyEnc, "seckey2")
 	assert.Equal(t, config.PprofAddr, "localhost:7070")
+	assert.Equal(t, config.WALFile, "/home/metric-wal.log")
+	assert.Equal(t, config.WALFsync, "no")
+	assert.Equal(t, config.DataDir, "/home/metrics-data")
 }
 
 func TestBuildOpts(t *testing.T) {
@@ -9,6 +9,7 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"os"
 	"reflect"
 	"runtime"
 	"strconv"
@@ -31,6 +32,8 @@ import (
 const (
 	workers   = 3
 	httpProto = "http"
+	// metadata is resent every metadataEvery report intervals (server may be restarted with empty registry)
+	metadataEvery = 10
 )
 
 // Sensors list for fetching monitoring metrics.
@@ -42,12 +45,14 @@ var rtMonitorSensGauge = []string{
 }
 
 type jsonSendString struct {
-	jsonString string
-	r          *resty.Request
-	crypt      *cryptandsign.AsymmetricCryptRsa
-	keyenc     string
-	pubkeypath string
-	timeout    time.Duration
+	jsonString     string
+	idempotencyKey string // key of metrics batch, retries of batch are sent with same key (empty - no key)
+	r              *resty.Request
+	crypt          *cryptandsign.AsymmetricCryptRsa
+	keyenc         string
+	pubkeypath     string
+	timeout        time.Duration
+	sendFunc       cryptandsign.AgentSendFunc
 }
 
 func (j *jsonSendString) Send(ctx context.Context, serverHost, xRealIp string) error {
@@ -59,9 +64,18 @@ func (j *jsonSendString) Send(ctx context.Context, serverHost, xRealIp string) e
 		serverHost = "http://" + serverHost
 	}
 
+	sendFunc := j.sendFunc
+	if sendFunc == nil {
+		sendFunc = send
+	}
+	// server applies batch once, lost response of applied batch isn't double-counted by retry
+	if j.idempotencyKey != "" {
+		j.r.SetHeader(models.IdempotencyKeyHeader, j.idempotencyKey)
+	}
+
 	// using retry and request sign function
 	return retry.Do(ctx2, backoff, func(ctx context.Context) error {
-		if _, err := j.crypt.AsymmetricEncryptData(cryptandsign.SignNew(send, j.keyenc), j.pubkeypath)(j.r, j.jsonString, serverHost, xRealIp); err != nil {
+		if _, err := j.crypt.AsymmetricEncryptData(cryptandsign.SignNew(sendFunc, j.keyenc), j.pubkeypath)(j.r, j.jsonString, serverHost, xRealIp); err != nil {
 			return retry.RetryableError(fmt.Errorf("retry failed: %s", err.Error()))
 		}
 		return nil
@@ -105,7 +119,17 @@ func shutdownCatcher(ctx context.Context, msg string) bool {
 
 // send function for sending monitoring requests.
 func send(r *resty.Request, send, serverHost, xRealIp string) (*resty.Response, error) {
-	resp, err := r.SetHeader("X-Real-IP", xRealIp).SetBody(send).Post(serverHost + "/updates/")
+	return postTo(r, send, serverHost+"/updates/", xRealIp)
+}
+
+// sendMetadata function for sending metadata of metrics.
+func sendMetadata(r *resty.Request, send, serverHost, xRealIp string) (*resty.Response, error) {
+	return postTo(r, send, serverHost+"/metadata/", xRealIp)
+}
+
+// postTo function for post payload to server url.
+func postTo(r *resty.Request, send, url, xRealIp string) (*resty.Response, error) {
+	resp, err := r.SetHeader("X-Real-IP", xRealIp).SetBody(send).Post(url)
 	if err != nil {
 		return nil, err
 	}
@@ -136,6 +160,7 @@ func encodeJSON(jsMetrics *metrictypes.JSONModelsMetrics, mJSON *jsonSendString)
 
 	jRes, err := json.Marshal(jsMetrics.JSONMetricsSlice)
 	mJSON.jsonString = string(jRes)
+	mJSON.idempotencyKey = models.NewIdempotencyKey()
 	return mJSON, err
 }
 
@@ -169,7 +194,7 @@ func parseRtm(rtm *MemStats, targerRtm []string, jsonMetrics *metrictypes.JSONMo
 			continue
 		}
 
-		addJSONModel(jsonMetrics, targerRtm[i], metrictypes.GaugeType, nil, &fl64)
+		addJSONModel(jsonMetrics, targerRtm[i], metrictypes.GaugeType, nil, &fl64, nil)
 	}
 
 	sysM.RLock()
@@ -177,8 +202,8 @@ func parseRtm(rtm *MemStats, targerRtm []string, jsonMetrics *metrictypes.JSONMo
 
 	pollCount := sysM.pollCount
 	randomValue := sysM.randomValue
-	addJSONModel(jsonMetrics, "PollCount", metrictypes.CounterType, (*int64)(&pollCount), nil)
-	addJSONModel(jsonMetrics, "RandomValue", metrictypes.GaugeType, nil, (*float64)(&randomValue))
+	addJSONModel(jsonMetrics, "PollCount", metrictypes.CounterType, (*int64)(&pollCount), nil, nil)
+	addJSONModel(jsonMetrics, "RandomValue", metrictypes.GaugeType, nil, (*float64)(&randomValue), nil)
 }
 
 // parseKernMetrics function for parse cpu and memory metrics and format it to pre-json struct.
@@ -188,28 +213,46 @@ func parseKernMetrics(km *kernelMetrics, j *metrictypes.JSONModelsMetrics) {
 
 	TotalMemory := km.TotalMemory
 	FreeMemory := km.FreeMemory
-	addJSONModel(j, "TotalMemory", metrictypes.GaugeType, nil, (*float64)(&TotalMemory))
-	addJSONModel(j, "FreeMemory", metrictypes.GaugeType, nil, (*float64)(&FreeMemory))
+	addJSONModel(j, "TotalMemory", metrictypes.GaugeType, nil, (*float64)(&TotalMemory), nil)
+	addJSONModel(j, "FreeMemory", metrictypes.GaugeType, nil, (*float64)(&FreeMemory), nil)
 
+	// one series per cpu, cpu index is a label
 	for i, v := range km.CPUutilization {
 		v := v
-		addJSONModel(j, fmt.Sprintf("CPUutilization%d", i), metrictypes.GaugeType, nil, (*float64)(&v))
+		addJSONModel(j, "CPUutilization", metrictypes.GaugeType, nil, (*float64)(&v), models.Labels{"cpu": strconv.Itoa(i)})
 	}
 }
 
 // addJSONModel function for collect parsed metrics to spectial metrics structure.
-func addJSONModel(g *metrictypes.JSONModelsMetrics, id, mtype string, delta *int64, value *float64) {
+func addJSONModel(g *metrictypes.JSONModelsMetrics, id, mtype string, delta *int64, value *float64, labels models.Labels) {
 	g.Lock()
 	defer g.Unlock()
 
 	g.JSONMetricsSlice = append(g.JSONMetricsSlice, models.Metrics{
-		ID:    id,
-		MType: mtype,
-		Delta: delta,
-		Value: value,
+		ID:     id,
+		MType:  mtype,
+		Delta:  delta,
+		Value:  value,
+		Labels: labels,
 	})
 }
 
+// addHostLabel function for mark all collected metrics with agent hostname label.
+func addHostLabel(g *metrictypes.JSONModelsMetrics, hostname string) {
+	if hostname == "" {
+		return
+	}
+	g.Lock()
+	defer g.Unlock()
+
+	for i := range g.JSONMetricsSlice {
+		if g.JSONMetricsSlice[i].Labels == nil {
+			g.JSONMetricsSlice[i].Labels = models.Labels{}
+		}
+		g.JSONMetricsSlice[i].Labels["host"] = hostname
+	}
+}
+
 // function for create parallel workers which send metrics to server.
 func worker(ctx context.Context, id int, jobs <-chan metrictypes.MetricSender, serverHost string, errRes chan<- error, xRealIp string) {
 	for j := range jobs {
@@ -253,6 +296,12 @@ func Run(ctx context.Context, config ConfigArgs) {
 	// outgoing ip
 	xRealIp := getOutboundIP(config.ServerAddr)
 
+	// hostname label for all metrics
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Println(err)
+	}
+
 	// ctx timeout per send
 	timeout := 30 * time.Second
 	cpuCount, _ := cpu.Counts(true)
@@ -272,6 +321,10 @@ func Run(ctx context.Context, config ConfigArgs) {
 
 	// init resty client
 	client := resty.New()
+	// tenant is authenticated by bearer token
+	if config.TenantToken != "" {
+		client.SetAuthToken(config.TenantToken)
+	}
 	r := client.R().SetHeader("Content-Type", "application/json")
 
 	mJSON := &jsonSendString{
@@ -291,6 +344,41 @@ func Run(ctx context.Context, config ConfigArgs) {
 		go worker(ctx, w, jobsQueue, config.ServerAddr, jobsErr, xRealIp)
 	}
 
+	// register metrics metadata at start and refresh it periodically
+	go func() {
+		var (
+			metaSend metrictypes.MetricSender
+			err      error
+		)
+		meta := agentMetadata()
+		if config.Grpc {
+			metaSend = agentwithgrpc.EncodeMetadataProto(meta, config.TenantToken)
+		} else {
+			metaSend, err = encodeMetadataJSON(meta, &jsonSendString{
+				r:          client.R().SetHeader("Content-Type", "application/json"),
+				crypt:      crypt,
+				keyenc:     config.KeyEnc,
+				pubkeypath: config.PubKeyFile,
+				timeout:    timeout,
+				sendFunc:   sendMetadata,
+			})
+			if err != nil {
+				log.Println(err)
+				return
+			}
+		}
+		for {
+			if err := metaSend.Send(ctx, config.ServerAddr, xRealIp); err != nil {
+				log.Printf("metadata: %s", err.Error())
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(metadataEvery * reportInterval):
+			}
+		}
+	}()
+
 	// poll runtime metrics
 	go func() {
 		open := true
@@ -324,10 +412,11 @@ func Run(ctx context.Context, config ConfigArgs) {
 		// parse kern sys metrics
 		<-startCoordChan2
 		parseKernMetrics(kernelSysMetrics, jsonMetricsModel)
+		addHostLabel(jsonMetricsModel, hostname)
 
 		// parse full json or proto
 		if config.Grpc {
-			metricSend, err = agentwithgrpc.EncodeProto(jsonMetricsModel)
+			metricSend, err = agentwithgrpc.EncodeProto(jsonMetricsModel, config.TenantToken)
 		} else {
 			metricSend, err = encodeJSON(jsonMetricsModel, mJSON)
 		}
@@ -123,6 +123,24 @@ func TestParseKernMetrics(t *testing.T) {
 
 	require.Greater(t, len(m.CPUutilization), 0)
 	require.Greater(t, len(j.JSONMetricsSlice), 0)
+
+	// cpu index is a label, not a part of metric name
+	last := j.JSONMetricsSlice[len(j.JSONMetricsSlice)-1]
+	require.Equal(t, "CPUutilization", last.ID)
+	require.Equal(t, strconv.Itoa(cpuCount-1), last.Labels["cpu"])
+}
+
+func TestAddHostLabel(t *testing.T) {
+	t.Parallel()
+	j := &metrictypes.JSONModelsMetrics{}
+	v := float64(1)
+	addJSONModel(j, "Alloc", metrictypes.GaugeType, nil, &v, nil)
+	addJSONModel(j, "CPUutilization", metrictypes.GaugeType, nil, &v, models.Labels{"cpu": "0"})
+
+	addHostLabel(j, "testhost")
+
+	require.Equal(t, models.Labels{"host": "testhost"}, j.JSONMetricsSlice[0].Labels)
+	require.Equal(t, models.Labels{"cpu": "0", "host": "testhost"}, j.JSONMetricsSlice[1].Labels)
 }
 
 func TestWorker(t *testing.T) {
@@ -151,3 +169,82 @@ func TestWorker(t *testing.T) {
 	go worker(ctx, id, ch1, ts.URL, ch2, testIP)
 	require.NoError(t, <-ch2)
 }
+
+func TestAgentMetadata(t *testing.T) {
+	t.Parallel()
+	m := &MemStats{}
+	cpuCount, _ := cpu.Counts(true)
+	km := &kernelMetrics{CPUutilization: make([]metrictypes.Gauge, cpuCount)}
+	j := &metrictypes.JSONModelsMetrics{}
+	parseRtm(m, rtMonitorSensGauge, j, &sysMon{})
+	parseKernMetrics(km, j)
+
+	// every collected metric has metadata with the same type
+	for _, v := range j.JSONMetricsSlice {
+		meta, ok := metricsMetadata[v.ID]
+		require.True(t, ok, "no metadata for %s", v.ID)
+		require.Equal(t, v.MType, meta.MType, v.ID)
+		require.NotEmpty(t, meta.Description, v.ID)
+	}
+	for _, v := range rtMonitorSensGauge {
+		require.NotEmpty(t, metricsMetadata[v].Unit, v)
+	}
+
+	meta := agentMetadata()
+	require.Len(t, meta, len(metricsMetadata))
+	require.Equal(t, "Alloc", meta[0].ID)
+	require.Equal(t, "bytes", meta[0].Unit)
+}
+
+func TestSendMetadata(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/metadata/", r.URL.Path)
+		testServerHTTPHandler(w, r)
+	}))
+	t.Cleanup(func() { ts.Close() })
+
+	mJSON, err := encodeMetadataJSON([]models.Metadata{{ID: "Alloc", MType: "gauge", Unit: "bytes"}}, &jsonSendString{
+		crypt:    cryptandsign.NewAsymmetricCryptRsa(),
+		timeout:  time.Second,
+		r:        resty.New().R(),
+		sendFunc: sendMetadata,
+	})
+	require.NoError(t, err)
+	require.Equal(t, `[{"id":"Alloc","type":"gauge","unit":"bytes"}]`, mJSON.jsonString)
+	require.NoError(t, mJSON.Send(ctx, ts.URL, "::1"))
+}
+
+func TestSendIdempotencyKey(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var keys []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(models.IdempotencyKeyHeader))
+		// response of first attempt is lost
+		if len(keys) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		testServerHTTPHandler(w, r)
+	}))
+	t.Cleanup(func() { ts.Close() })
+
+	mJSON, err := encodeJSON(&metrictypes.JSONModelsMetrics{}, &jsonSendString{
+		crypt:   cryptandsign.NewAsymmetricCryptRsa(),
+		timeout: 5 * time.Second,
+		r:       resty.New().R(),
+	})
+	require.NoError(t, err)
+	require.Len(t, mJSON.idempotencyKey, 32)
+	require.NoError(t, mJSON.Send(ctx, ts.URL, "::1"))
+	// retry is sent with key of batch
+	require.Equal(t, []string{mJSON.idempotencyKey, mJSON.idempotencyKey}, keys)
+
+	// next batch has new key
+	key := mJSON.idempotencyKey
+	mJSON, err = encodeJSON(&metrictypes.JSONModelsMetrics{}, mJSON)
+	require.NoError(t, err)
+	require.NotEqual(t, key, mJSON.idempotencyKey)
+}
@@ -10,4 +10,5 @@ type ConfigArgs struct {
 	PollInterval   int    `json:"poll_interval"`   // periodic interval between collecting metrics
 	RateLimit      int    `json:"rate_limit"`      // number of requests sending to server at the same time
 	Grpc           bool   `json:"grpc"`            // enable grpc transport
+	TenantToken    string `json:"tenant_token"`    // bearer token of tenant (empty - default tenant)
 }
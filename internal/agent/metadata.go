@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+// Units of agent metrics.
+const (
+	unitBytes       = "bytes"
+	unitCount       = "count"
+	unitNanoseconds = "nanoseconds"
+	unitRatio       = "ratio"
+	unitPercent     = "percent"
+)
+
+// metricsMetadata units and descriptions of all metrics collected by agent (ID is filled from key).
+var metricsMetadata = map[string]models.Metadata{
+	"Alloc":         {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Bytes of allocated heap objects"},
+	"BuckHashSys":   {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Bytes of memory in profiling bucket hash tables"},
+	"Frees":         {MType: metrictypes.GaugeType, Unit: unitCount, Description: "Cumulative count of heap objects freed"},
+	"GCSys":         {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Bytes of memory in garbage collection metadata"},
+	"HeapAlloc":     {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Bytes of allocated heap objects"},
+	"HeapIdle":      {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Bytes in idle (unused) heap spans"},
+	"HeapInuse":     {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Bytes in in-use heap spans"},
+	"HeapObjects":   {MType: metrictypes.GaugeType, Unit: unitCount, Description: "Number of allocated heap objects"},
+	"HeapReleased":  {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Bytes of physical memory returned to the OS"},
+	"HeapSys":       {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Bytes of heap memory obtained from the OS"},
+	"LastGC":        {MType: metrictypes.GaugeType, Unit: unitNanoseconds, Description: "Time the last garbage collection finished, since the Unix epoch"},
+	"Lookups":       {MType: metrictypes.GaugeType, Unit: unitCount, Description: "Number of pointer lookups performed by the runtime"},
+	"MCacheInuse":   {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Bytes of allocated mcache structures"},
+	"MCacheSys":     {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Bytes of memory obtained from the OS for mcache structures"},
+	"MSpanInuse":    {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Bytes of allocated mspan structures"},
+	"MSpanSys":      {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Bytes of memory obtained from the OS for mspan structures"},
+	"Mallocs":       {MType: metrictypes.GaugeType, Unit: unitCount, Description: "Cumulative count of heap objects allocated"},
+	"NextGC":        {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Target heap size of the next GC cycle"},
+	"OtherSys":      {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Bytes of memory in miscellaneous off-heap runtime allocations"},
+	"PauseTotalNs":  {MType: metrictypes.GaugeType, Unit: unitNanoseconds, Description: "Cumulative time spent in GC stop-the-world pauses"},
+	"StackInuse":    {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Bytes in stack spans"},
+	"StackSys":      {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Bytes of stack memory obtained from the OS"},
+	"Sys":           {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Total bytes of memory obtained from the OS"},
+	"TotalAlloc":    {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Cumulative bytes allocated for heap objects"},
+	"GCCPUFraction": {MType: metrictypes.GaugeType, Unit: unitRatio, Description: "Fraction of available CPU time used by the GC since the program started"},
+	"NumForcedGC":   {MType: metrictypes.GaugeType, Unit: unitCount, Description: "Number of GC cycles forced by the application"},
+	"NumGC":         {MType: metrictypes.GaugeType, Unit: unitCount, Description: "Number of completed GC cycles"},
+
+	"PollCount":   {MType: metrictypes.CounterType, Unit: unitCount, Description: "Number of metric polls since the last successful report"},
+	"RandomValue": {MType: metrictypes.GaugeType, Description: "Random value in range [0, 1)"},
+
+	"TotalMemory":    {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Total amount of RAM"},
+	"FreeMemory":     {MType: metrictypes.GaugeType, Unit: unitBytes, Description: "Amount of free RAM"},
+	"CPUutilization": {MType: metrictypes.GaugeType, Unit: unitPercent, Description: "CPU utilization per core"},
+}
+
+// agentMetadata function for collect metadata of agent metrics sorted by name.
+func agentMetadata() []models.Metadata {
+	meta := make([]models.Metadata, 0, len(metricsMetadata))
+	for id, m := range metricsMetadata {
+		m.ID = id
+		meta = append(meta, m)
+	}
+	sort.Slice(meta, func(i, j int) bool { return meta[i].ID < meta[j].ID })
+	return meta
+}
+
+// encodeMetadataJSON function for json metadata encode.
+func encodeMetadataJSON(meta []models.Metadata, mJSON *jsonSendString) (*jsonSendString, error) {
+	jRes, err := json.Marshal(meta)
+	mJSON.jsonString = string(jRes)
+	return mJSON, err
+}
@@ -12,6 +12,7 @@ import (
 	"google.golang.org/grpc/metadata"
 
 	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
 	monproto "github.com/sourcecd/monitoring/proto"
 
 	"google.golang.org/grpc/encoding/gzip" // Install the gzip compressor
@@ -23,16 +24,67 @@ var opts = []grpc_retry.CallOption{
 }
 
 type MonMetricReq struct {
-	MonProtoReq *monproto.MetricsRequest
+	MonProtoReq    *monproto.MetricsRequest
+	Token          string // bearer token of tenant (empty - default tenant)
+	IdempotencyKey string // key of metrics batch, retries of batch are sent with same key
 }
 
 func (m *MonMetricReq) Send(ctx context.Context, serverHost, xRealIp string) error {
-	_, err := protoSend(ctx, serverHost, xRealIp, m.MonProtoReq)
+	_, err := protoSend(ctx, serverHost, xRealIp, m.Token, m.IdempotencyKey, m.MonProtoReq)
 	return err
 }
 
+// tokenCredentials per-RPC credentials with bearer token of tenant.
+type tokenCredentials string
+
+// GetRequestMetadata method for add authorization metadata to request.
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+// RequireTransportSecurity method for allow token over insecure transport (as other agent requests).
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// MonMetadataReq type of metadata payload for grpc transport.
+type MonMetadataReq struct {
+	MonProtoReq *monproto.MetadataRequest
+	Token       string // bearer token of tenant (empty - default tenant)
+}
+
+// Send method for sending metadata to grpc server.
+func (m *MonMetadataReq) Send(ctx context.Context, serverHost, xRealIp string) error {
+	conn, err := grpcConnector(serverHost, m.Token)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c := monproto.NewMonitoringClient(conn)
+	md := metadata.New(map[string]string{"X-Real-IP": xRealIp})
+	_, err = c.SendMetadata(metadata.NewOutgoingContext(ctx, md), m.MonProtoReq)
+	return err
+}
+
+// EncodeMetadataProto function for protobuf metadata encode.
+func EncodeMetadataProto(meta []models.Metadata, token string) *MonMetadataReq {
+	var metaProto monproto.MetadataRequest
+	for _, v := range meta {
+		metaProto.Metadata = append(metaProto.Metadata, &monproto.MetadataRequest_Metadata{
+			Id:          v.ID,
+			Mtype:       v.MType,
+			Unit:        v.Unit,
+			Description: v.Description,
+		})
+	}
+	return &MonMetadataReq{
+		MonProtoReq: &metaProto,
+		Token:       token,
+	}
+}
+
 // EncodeProto function for protobuf metric encode.
-func EncodeProto(metrics *metrictypes.JSONModelsMetrics) (*MonMetricReq, error) {
+func EncodeProto(metrics *metrictypes.JSONModelsMetrics, token string) (*MonMetricReq, error) {
 	var metricsProto monproto.MetricsRequest
 	metrics.RLock()
 	defer metrics.RUnlock()
@@ -45,9 +97,10 @@ func EncodeProto(metrics *metrictypes.JSONModelsMetrics) (*MonMetricReq, error)
 				continue
 			}
 			metricsProto.Metric = append(metricsProto.Metric, &monproto.MetricsRequest_MetricRequest{
-				Mtype: v.MType,
-				Id:    v.ID,
-				Delta: *v.Delta,
+				Mtype:  v.MType,
+				Id:     v.ID,
+				Delta:  *v.Delta,
+				Labels: v.Labels,
 			})
 		case "gauge":
 			if v.Value == nil {
@@ -55,26 +108,49 @@ func EncodeProto(metrics *metrictypes.JSONModelsMetrics) (*MonMetricReq, error)
 				continue
 			}
 			metricsProto.Metric = append(metricsProto.Metric, &monproto.MetricsRequest_MetricRequest{
-				Mtype: v.MType,
-				Id:    v.ID,
-				Value: *v.Value,
+				Mtype:  v.MType,
+				Id:     v.ID,
+				Value:  *v.Value,
+				Labels: v.Labels,
+			})
+		case "histogram":
+			if v.Histogram == nil {
+				log.Println("nil value of metric histogram")
+				continue
+			}
+			metricsProto.Metric = append(metricsProto.Metric, &monproto.MetricsRequest_MetricRequest{
+				Mtype:  v.MType,
+				Id:     v.ID,
+				Labels: v.Labels,
+				Histogram: &monproto.Histogram{
+					Bounds: v.Histogram.Bounds,
+					Counts: v.Histogram.Counts,
+					Sum:    v.Histogram.Sum,
+					Count:  v.Histogram.Count,
+				},
 			})
 		default:
 			log.Println("unknown metric type")
 		}
 	}
 	return &MonMetricReq{
-		MonProtoReq: &metricsProto,
+		MonProtoReq:    &metricsProto,
+		Token:          token,
+		IdempotencyKey: models.NewIdempotencyKey(),
 	}, nil
 }
 
 // grpc connect method
-func grpcConnector(grpcServerHost string) (*grpc.ClientConn, error) {
-	conn, err := grpc.NewClient(grpcServerHost,
+func grpcConnector(grpcServerHost, token string) (*grpc.ClientConn, error) {
+	dialOpts := []grpc.DialOption{
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 		grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)),
 		grpc.WithUnaryInterceptor(grpc_retry.UnaryClientInterceptor(opts...)),
-	)
+	}
+	if token != "" {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(tokenCredentials(token)))
+	}
+	conn, err := grpc.NewClient(grpcServerHost, dialOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -82,14 +158,15 @@ func grpcConnector(grpcServerHost string) (*grpc.ClientConn, error) {
 }
 
 // ProtoSend send
-func protoSend(ctx context.Context, grpcServerHost, xRealIp string, metricsReq *monproto.MetricsRequest) (*monproto.MetricResponse, error) {
-	conn, err := grpcConnector(grpcServerHost)
+func protoSend(ctx context.Context, grpcServerHost, xRealIp, token, idempotencyKey string, metricsReq *monproto.MetricsRequest) (*monproto.MetricResponse, error) {
+	conn, err := grpcConnector(grpcServerHost, token)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
 	c := monproto.NewMonitoringClient(conn)
-	md := metadata.New(map[string]string{"X-Real-IP": xRealIp})
+	// retry interceptor resends same metadata, so server applies batch once
+	md := metadata.New(map[string]string{"X-Real-IP": xRealIp, models.IdempotencyKeyHeader: idempotencyKey})
 	resp, err := c.SendMetrics(metadata.NewOutgoingContext(ctx, md), metricsReq)
 	if err != nil {
 		return nil, err
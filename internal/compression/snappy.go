@@ -0,0 +1,108 @@
+package compression
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Tags of snappy block elements (two low bits of tag byte).
+const (
+	snappyTagLiteral = 0x00
+	snappyTagCopy1   = 0x01
+	snappyTagCopy2   = 0x02
+	snappyTagCopy4   = 0x03
+)
+
+var (
+	// ErrSnappyCorrupt error of snappy block, which can't be decoded.
+	ErrSnappyCorrupt = errors.New("snappy: corrupt input")
+	// ErrSnappyTooLarge error of snappy block, which decoded length is over limit.
+	ErrSnappyTooLarge = errors.New("snappy: decoded block is too large")
+)
+
+// SnappyDecodedLen return decoded length of snappy block (varint header).
+func SnappyDecodedLen(src []byte) (int, error) {
+	v, n := binary.Uvarint(src)
+	if n <= 0 || v > 0xffffffff {
+		return 0, ErrSnappyCorrupt
+	}
+	return int(v), nil
+}
+
+// SnappyDecode decode snappy block format (not framed stream), which is used by prometheus remote_write.
+// Blocks with decoded length over maxLen aren't decoded (memory is allocated by untrusted header).
+func SnappyDecode(src []byte, maxLen int) ([]byte, error) {
+	dLen, err := SnappyDecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if dLen > maxLen {
+		return nil, fmt.Errorf("%w: %d bytes", ErrSnappyTooLarge, dLen)
+	}
+	_, n := binary.Uvarint(src)
+	src = src[n:]
+	dst := make([]byte, 0, dLen)
+
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 0x03 {
+		case snappyTagLiteral:
+			x := int(tag >> 2)
+			src = src[1:]
+			// lengths over 60 are stored in next 1-4 bytes (little endian)
+			if x >= 60 {
+				size := x - 59
+				if len(src) < size {
+					return nil, ErrSnappyCorrupt
+				}
+				x = 0
+				for i := size - 1; i >= 0; i-- {
+					x = x<<8 | int(src[i])
+				}
+				src = src[size:]
+			}
+			length = x + 1
+			if length <= 0 || length > len(src) || len(dst)+length > dLen {
+				return nil, ErrSnappyCorrupt
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case snappyTagCopy1:
+			if len(src) < 2 {
+				return nil, ErrSnappyCorrupt
+			}
+			length = 4 + int(tag>>2)&0x07
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case snappyTagCopy2:
+			if len(src) < 3 {
+				return nil, ErrSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:3]))
+			src = src[3:]
+		case snappyTagCopy4:
+			if len(src) < 5 {
+				return nil, ErrSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:5]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+length > dLen {
+			return nil, ErrSnappyCorrupt
+		}
+		// copy may overlap with its own output (repeated pattern)
+		start := len(dst) - offset
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+	if len(dst) != dLen {
+		return nil, ErrSnappyCorrupt
+	}
+	return dst, nil
+}
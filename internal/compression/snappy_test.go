@@ -0,0 +1,42 @@
+package compression
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnappyDecode(t *testing.T) {
+	long := bytes.Repeat([]byte("x"), 100)
+	testCase := []struct {
+		name string
+		src  []byte
+		want []byte
+		err  error
+	}{
+		{name: "empty", src: []byte{0x00}, want: []byte{}},
+		{name: "literal", src: []byte{0x03, 0x08, 'a', 'b', 'c'}, want: []byte("abc")},
+		{name: "long-literal", src: append([]byte{0x64, 0xf0, 99}, long...), want: long},
+		{name: "copy1-overlap", src: []byte{0x0c, 0x08, 'a', 'b', 'c', 0x15, 0x03}, want: []byte("abcabcabcabc")},
+		{name: "copy2", src: []byte{0x07, 0x08, 'a', 'b', 'c', 0x0e, 0x03, 0x00}, want: []byte("abcabca")},
+		{name: "copy4", src: []byte{0x05, 0x04, 'a', 'b', 0x0b, 0x02, 0x00, 0x00, 0x00}, want: []byte("ababa")},
+		{name: "no-header", src: []byte{}, err: ErrSnappyCorrupt},
+		{name: "short-literal", src: []byte{0x03, 0x08, 'a'}, err: ErrSnappyCorrupt},
+		{name: "wrong-offset", src: []byte{0x08, 0x08, 'a', 'b', 'c', 0x05, 0x04}, err: ErrSnappyCorrupt},
+		{name: "short-output", src: []byte{0x04, 0x08, 'a', 'b', 'c'}, err: ErrSnappyCorrupt},
+		{name: "long-output", src: []byte{0x02, 0x08, 'a', 'b', 'c'}, err: ErrSnappyCorrupt},
+		{name: "too-large", src: []byte{0xff, 0xff, 0xff, 0x7f}, err: ErrSnappyTooLarge},
+	}
+	for _, v := range testCase {
+		t.Run(v.name, func(t *testing.T) {
+			got, err := SnappyDecode(v.src, 1024)
+			if v.err != nil {
+				require.ErrorIs(t, err, v.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, v.want, got)
+		})
+	}
+}
@@ -111,6 +111,51 @@ func SignCheck(h http.HandlerFunc, seckey string) http.HandlerFunc {
 	}
 }
 
+// RequestSign return signature of request checked by SignCheckRequest: hmac of method, request uri and body separated by newlines.
+func RequestSign(seckey, method, uri string, body []byte) string {
+	hm := hmac.New(sha256.New, []byte(seckey))
+	hm.Write([]byte(method + "\n" + uri + "\n"))
+	hm.Write(body)
+	return hex.EncodeToString(hm.Sum(nil))
+}
+
+// SignCheckRequest signature check for requests, which are defined by method and path (e.g. delete without body).
+// Signature covers method, request uri and body, request without signature is rejected.
+func SignCheckRequest(h http.HandlerFunc, seckey string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if seckey == "" {
+			h(w, r)
+			return
+		}
+		hashSign, err := hex.DecodeString(r.Header.Get(signHeaderType))
+		if err != nil || len(hashSign) == 0 {
+			log.Println("sign: missing or wrong request sign")
+			http.Error(w, "missing or wrong sign", http.StatusBadRequest)
+			return
+		}
+		req, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Println("sign: error read request body")
+			http.Error(w, "error read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewBuffer(req))
+		defer r.Body.Close()
+		reshm, _ := hex.DecodeString(RequestSign(seckey, r.Method, r.URL.RequestURI(), req))
+		if !hmac.Equal(hashSign, reshm) {
+			log.Println("sign: sign error")
+			http.Error(w, "sign error", http.StatusBadRequest)
+			return
+		}
+		h(&signResponseWriter{
+			wr:              w,
+			respData:        &responseData{},
+			sign:            hmac.New(sha256.New, []byte(seckey)),
+			headersSetDone:  make(chan bool, 1),
+			headersSendDone: make(chan bool, 1)}, r)
+	}
+}
+
 // SignNew main sign function for signing requests.
 func SignNew(s AgentSendFunc, seckey string) AgentSendFunc {
 	return func(r *resty.Request, send, serverHost, xRealIp string) (*resty.Response, error) {
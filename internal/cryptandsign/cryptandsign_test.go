@@ -148,3 +148,45 @@ func TestServerReqSign(t *testing.T) {
 		})
 	}
 }
+
+func TestServerRequestSign(t *testing.T) {
+	ts := httptest.NewServer(SignCheckRequest(testServerHTTPHandler, seckey))
+	t.Cleanup(func() { ts.Close() })
+
+	testCases := []struct {
+		name       string
+		method     string
+		path       string
+		sign       string
+		statusCode int
+	}{
+		{name: "correct_sign", method: http.MethodDelete, path: "/value/gauge/a", sign: RequestSign(seckey, http.MethodDelete, "/value/gauge/a", nil), statusCode: http.StatusOK},
+		{name: "other_path", method: http.MethodDelete, path: "/value/gauge/b", sign: RequestSign(seckey, http.MethodDelete, "/value/gauge/a", nil), statusCode: http.StatusBadRequest},
+		{name: "other_method", method: http.MethodPost, path: "/value/gauge/a", sign: RequestSign(seckey, http.MethodDelete, "/value/gauge/a", nil), statusCode: http.StatusBadRequest},
+		{name: "body_sign", method: http.MethodDelete, path: "/value/gauge/a", sign: etalonHmacFunc(seckey, ""), statusCode: http.StatusBadRequest},
+		{name: "missing_sign", method: http.MethodDelete, path: "/value/gauge/a", statusCode: http.StatusBadRequest},
+	}
+	for _, v := range testCases {
+		t.Run(v.name, func(t *testing.T) {
+			req, err := http.NewRequest(v.method, ts.URL+v.path, nil)
+			require.NoError(t, err)
+			if v.sign != "" {
+				req.Header.Set(signHeaderType, v.sign)
+			}
+			resp, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, v.statusCode, resp.StatusCode)
+		})
+	}
+
+	// without key requests aren't checked
+	unsigned := httptest.NewServer(SignCheckRequest(testServerHTTPHandler, ""))
+	t.Cleanup(func() { unsigned.Close() })
+	req, err := http.NewRequest(http.MethodDelete, unsigned.URL+"/value/gauge/a", nil)
+	require.NoError(t, err)
+	resp, err := unsigned.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
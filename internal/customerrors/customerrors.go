@@ -4,8 +4,17 @@ package customerrors
 import "errors"
 
 var (
-	ErrNoVal                = errors.New("no value")                // error type for "no value"
-	ErrBadMetricType        = errors.New("bad metric type")         // error type for incorrect metric type (Get)
-	ErrWrongMetricType      = errors.New("wrong metric type")       // error type for incorrect metric type (Write)
-	ErrWrongMetricValueType = errors.New("wrong metric value type") // error type for incorrect value of specified metric type
+	ErrNoVal                = errors.New("no value")                      // error type for "no value"
+	ErrBadMetricType        = errors.New("bad metric type")               // error type for incorrect metric type (Get)
+	ErrWrongMetricType      = errors.New("wrong metric type")             // error type for incorrect metric type (Write)
+	ErrWrongMetricValueType = errors.New("wrong metric value type")       // error type for incorrect value of specified metric type
+	ErrWrongHistogram       = errors.New("wrong histogram")               // error type for inconsistent histogram buckets and counts
+	ErrHistogramBounds      = errors.New("histogram bounds differ")       // error type for merge of histograms with different buckets
+	ErrWrongMetadata        = errors.New("wrong metadata")                // error type for metadata without metric name or with unknown type hint
+	ErrUnauthenticated      = errors.New("unauthenticated")               // error type for request without known tenant token
+	ErrTenantLimit          = errors.New("tenant limit exceeded")         // error type for request over tenant rate limit
+	ErrWrongIdempotencyKey  = errors.New("wrong idempotency key")         // error type for too long idempotency key of request
+	ErrBadQuery             = errors.New("bad query")                     // error type for query expression, which can't be parsed or evaluated
+	ErrWrongAlertRule       = errors.New("wrong alert rule")              // error type for alert rule config, which can't be loaded
+	ErrWebhookRejected      = errors.New("webhook rejected notification") // error type for webhook client error answer (notification isn't retried)
 )
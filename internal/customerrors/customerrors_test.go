@@ -11,4 +11,13 @@ func TestXxx(t *testing.T) {
 	require.Equal(t, ErrBadMetricType.Error(), "bad metric type")
 	require.Equal(t, ErrWrongMetricType.Error(), "wrong metric type")
 	require.Equal(t, ErrWrongMetricValueType.Error(), "wrong metric value type")
+	require.Equal(t, ErrWrongHistogram.Error(), "wrong histogram")
+	require.Equal(t, ErrHistogramBounds.Error(), "histogram bounds differ")
+	require.Equal(t, ErrWrongMetadata.Error(), "wrong metadata")
+	require.Equal(t, ErrUnauthenticated.Error(), "unauthenticated")
+	require.Equal(t, ErrTenantLimit.Error(), "tenant limit exceeded")
+	require.Equal(t, ErrWrongIdempotencyKey.Error(), "wrong idempotency key")
+	require.Equal(t, ErrBadQuery.Error(), "bad query")
+	require.Equal(t, ErrWrongAlertRule.Error(), "wrong alert rule")
+	require.Equal(t, ErrWebhookRejected.Error(), "webhook rejected notification")
 }
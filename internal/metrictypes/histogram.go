@@ -0,0 +1,165 @@
+package metrictypes
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+// DefaultBounds default buckets upper bounds for latency histograms (seconds).
+var DefaultBounds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// ReportQuantiles quantiles which are estimated on histogram read.
+var ReportQuantiles = []float64{0.5, 0.9, 0.99}
+
+// Histogram base type for histogram metric.
+// Counts has one more element than Bounds: the last bucket counts observations above the last bound (+Inf).
+type Histogram models.Histogram
+
+// NewHistogram init empty histogram with specified bucket bounds.
+func NewHistogram(bounds []float64) Histogram {
+	b := make([]float64, len(bounds))
+	copy(b, bounds)
+	return Histogram{
+		Bounds: b,
+		Counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// Validate check histogram bounds and counts consistency, bounds and sum must be finite.
+func (h *Histogram) Validate() error {
+	if len(h.Counts) != len(h.Bounds)+1 || math.IsNaN(h.Sum) || math.IsInf(h.Sum, 0) {
+		return customerrors.ErrWrongHistogram
+	}
+	for _, b := range h.Bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) {
+			return customerrors.ErrWrongHistogram
+		}
+	}
+	if !sort.SliceIsSorted(h.Bounds, func(i, j int) bool { return h.Bounds[i] < h.Bounds[j] }) {
+		return customerrors.ErrWrongHistogram
+	}
+	for i := 1; i < len(h.Bounds); i++ {
+		if h.Bounds[i] == h.Bounds[i-1] {
+			return customerrors.ErrWrongHistogram
+		}
+	}
+	var count uint64
+	for _, c := range h.Counts {
+		count += c
+	}
+	if count != h.Count {
+		return customerrors.ErrWrongHistogram
+	}
+	return nil
+}
+
+// Observe add single observation to histogram.
+func (h *Histogram) Observe(v float64) {
+	h.ObserveN(v, 1)
+}
+
+// ObserveN add n equal observations to histogram (e.g. sampled observation).
+func (h *Histogram) ObserveN(v float64, n uint64) {
+	i := sort.SearchFloat64s(h.Bounds, v)
+	h.Counts[i] += n
+	h.Count += n
+	h.Sum += v * float64(n)
+}
+
+// Merge add observations of other histogram (summing buckets), bounds must be the same.
+func (h *Histogram) Merge(other Histogram) error {
+	if len(h.Bounds) != len(other.Bounds) || len(h.Counts) != len(other.Counts) {
+		return customerrors.ErrHistogramBounds
+	}
+	for i := range h.Bounds {
+		if h.Bounds[i] != other.Bounds[i] {
+			return customerrors.ErrHistogramBounds
+		}
+	}
+	for i := range h.Counts {
+		h.Counts[i] += other.Counts[i]
+	}
+	h.Count += other.Count
+	h.Sum += other.Sum
+	return nil
+}
+
+// Clone returns deep copy of histogram.
+func (h Histogram) Clone() Histogram {
+	c := Histogram{
+		Bounds: make([]float64, len(h.Bounds)),
+		Counts: make([]uint64, len(h.Counts)),
+		Sum:    h.Sum,
+		Count:  h.Count,
+	}
+	copy(c.Bounds, h.Bounds)
+	copy(c.Counts, h.Counts)
+	return c
+}
+
+// Quantile estimate q-quantile (0 <= q <= 1) by linear interpolation inside bucket.
+// Returns NaN for empty histogram. Observations in +Inf bucket are estimated as the last bound.
+func (h Histogram) Quantile(q float64) float64 {
+	if h.Count == 0 || q < 0 || q > 1 {
+		return math.NaN()
+	}
+	rank := q * float64(h.Count)
+	var cum uint64
+	for i, c := range h.Counts {
+		if float64(cum+c) < rank || c == 0 {
+			cum += c
+			continue
+		}
+		if i == len(h.Bounds) {
+			// +Inf bucket
+			if len(h.Bounds) == 0 {
+				return math.NaN()
+			}
+			return h.Bounds[len(h.Bounds)-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = h.Bounds[i-1]
+		} else if h.Bounds[0] < 0 {
+			return h.Bounds[0]
+		}
+		return lower + (h.Bounds[i]-lower)*(rank-float64(cum))/float64(c)
+	}
+	if len(h.Bounds) == 0 {
+		return math.NaN()
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// Model returns json model of histogram with estimated quantiles (NaN quantile of histogram without bounds is encoded as string).
+func (h Histogram) Model() *models.Histogram {
+	m := models.Histogram(h.Clone())
+	if h.Count > 0 {
+		m.Quantiles = make(map[string]models.QueryValue, len(ReportQuantiles))
+		for _, q := range ReportQuantiles {
+			m.Quantiles[QuantileName(q)] = models.QueryValue(h.Quantile(q))
+		}
+	}
+	return &m
+}
+
+// QuantileName returns short quantile name, e.g. p99 for 0.99.
+func QuantileName(q float64) string {
+	return "p" + strconv.FormatFloat(q*100, 'f', -1, 64)
+}
+
+// String returns short text representation of histogram: count, sum and estimated quantiles.
+func (h Histogram) String() string {
+	s := "count=" + strconv.FormatUint(h.Count, 10) + " sum=" + strconv.FormatFloat(h.Sum, 'g', -1, 64)
+	if h.Count == 0 {
+		return s
+	}
+	for _, q := range ReportQuantiles {
+		s += " " + QuantileName(q) + "=" + strconv.FormatFloat(h.Quantile(q), 'g', -1, 64)
+	}
+	return s
+}
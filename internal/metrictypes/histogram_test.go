@@ -0,0 +1,82 @@
+package metrictypes
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{1, 2, 4})
+	require.NoError(t, h.Validate())
+	require.True(t, math.IsNaN(h.Quantile(0.5)))
+	require.Nil(t, h.Model().Quantiles)
+
+	for _, v := range []float64{0.5, 1.5, 1.5, 3, 10} {
+		h.Observe(v)
+	}
+	require.Equal(t, []uint64{1, 2, 1, 1}, h.Counts)
+	require.Equal(t, uint64(5), h.Count)
+	require.Equal(t, 16.5, h.Sum)
+	require.NoError(t, h.Validate())
+
+	// rank 2.5 is in the middle of (1, 2] bucket
+	require.InDelta(t, 1.75, h.Quantile(0.5), 1e-9)
+	// +Inf bucket estimated as the last bound
+	require.Equal(t, 4.0, h.Quantile(0.99))
+
+	other := NewHistogram([]float64{1, 2, 4})
+	other.Observe(0.1)
+	require.NoError(t, h.Merge(other))
+	require.Equal(t, []uint64{2, 2, 1, 1}, h.Counts)
+	require.Equal(t, uint64(6), h.Count)
+
+	// sampled observation
+	h.ObserveN(1.5, 10)
+	require.Equal(t, []uint64{2, 12, 1, 1}, h.Counts)
+	require.Equal(t, uint64(16), h.Count)
+	require.InDelta(t, 31.6, h.Sum, 1e-9)
+	require.NoError(t, h.Validate())
+
+	require.ErrorIs(t, h.Merge(NewHistogram([]float64{1, 3, 4})), customerrors.ErrHistogramBounds)
+	require.ErrorIs(t, h.Merge(NewHistogram([]float64{1})), customerrors.ErrHistogramBounds)
+
+	m := h.Model()
+	require.Len(t, m.Quantiles, 3)
+	require.Contains(t, m.Quantiles, "p50")
+	require.Contains(t, m.Quantiles, "p90")
+	require.Contains(t, m.Quantiles, "p99")
+
+	// clone is independent
+	c := h.Clone()
+	c.Counts[0] = 100
+	require.Equal(t, uint64(2), h.Counts[0])
+}
+
+func TestHistogramValidate(t *testing.T) {
+	wrong := []Histogram{
+		{Bounds: []float64{1, 2}, Counts: []uint64{1, 1}, Count: 2},
+		{Bounds: []float64{2, 1}, Counts: []uint64{1, 1, 0}, Count: 2},
+		{Bounds: []float64{1, 1}, Counts: []uint64{1, 1, 0}, Count: 2},
+		{Bounds: []float64{1, 2}, Counts: []uint64{1, 1, 0}, Count: 3},
+		{Bounds: []float64{1, math.NaN()}, Counts: []uint64{1, 1, 0}, Count: 2},
+		{Bounds: []float64{math.Inf(-1), 1}, Counts: []uint64{1, 1, 0}, Count: 2},
+		{Bounds: []float64{1, math.Inf(1)}, Counts: []uint64{1, 1, 0}, Count: 2},
+		{Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: math.NaN(), Count: 1},
+	}
+	for _, h := range wrong {
+		require.ErrorIs(t, h.Validate(), customerrors.ErrWrongHistogram)
+	}
+	require.Equal(t, "p99.9", QuantileName(0.999))
+
+	// histogram without bounds has no quantile estimation, model is still encoded
+	h := Histogram{Counts: []uint64{3}, Sum: 1.5, Count: 3}
+	require.NoError(t, h.Validate())
+	b, err := json.Marshal(h.Model())
+	require.NoError(t, err)
+	require.JSONEq(t, `{"quantiles":{"p50":"NaN","p90":"NaN","p99":"NaN"},"bounds":[],"counts":[3],"sum":1.5,"count":3}`, string(b))
+}
@@ -13,6 +13,8 @@ const (
 	GaugeType = "gauge"
 	// Counter.
 	CounterType = "counter"
+	// Histogram.
+	HistogramType = "histogram"
 )
 
 type (
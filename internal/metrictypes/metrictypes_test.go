@@ -15,4 +15,5 @@ func TestMetricTypes(t *testing.T) {
 
 	require.Equal(t, GaugeType, "gauge")
 	require.Equal(t, CounterType, "counter")
+	require.Equal(t, HistogramType, "histogram")
 }
@@ -0,0 +1,148 @@
+package models
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ErrWrongSeriesID error for series id, which can't be parsed.
+var ErrWrongSeriesID = errors.New("wrong series id")
+
+// Labels type of metric labels (key/value dimensions).
+type Labels map[string]string
+
+// Escaper of label values in canonical representation.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// String returns canonical representation of labels: {k1="v1",k2="v2"} sorted by key.
+// Empty label set is represented as empty string.
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(l[k]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Delimiters of series id, which metric and label names can't contain.
+const seriesIDDelimiters = `{}=," `
+
+// ValidName check metric or label name: non-empty name without series id delimiters.
+func ValidName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, seriesIDDelimiters)
+}
+
+// ValidateSeries check metric name and label names of written series, so its series id can be parsed back.
+func ValidateSeries(id string, labels Labels) error {
+	if !ValidName(id) {
+		return ErrWrongSeriesID
+	}
+	for k := range labels {
+		if !ValidName(k) {
+			return ErrWrongSeriesID
+		}
+	}
+	return nil
+}
+
+// SeriesID returns storage key of metric series: metric name with canonical labels.
+// Two series with the same name and different labels have different series ids.
+func SeriesID(id string, labels Labels) string {
+	return id + labels.String()
+}
+
+// SeriesID returns storage key of metric series.
+func (m *Metrics) SeriesID() string {
+	return SeriesID(m.ID, m.Labels)
+}
+
+// ParseSeriesID split series id to metric name and labels.
+func ParseSeriesID(series string) (string, Labels, error) {
+	start := strings.IndexByte(series, '{')
+	if start < 0 {
+		return series, nil, nil
+	}
+	if !strings.HasSuffix(series, "}") {
+		return "", nil, ErrWrongSeriesID
+	}
+	id := series[:start]
+	body := series[start+1 : len(series)-1]
+	labels := Labels{}
+
+	for len(body) > 0 {
+		eq := strings.Index(body, `="`)
+		if eq <= 0 {
+			return "", nil, ErrWrongSeriesID
+		}
+		key := body[:eq]
+		if !ValidName(key) {
+			return "", nil, ErrWrongSeriesID
+		}
+		body = body[eq+2:]
+
+		// read escaped value till closing quote
+		var val strings.Builder
+		closed := false
+		i := 0
+		for ; i < len(body); i++ {
+			c := body[i]
+			if c == '\\' && i+1 < len(body) {
+				i++
+				switch body[i] {
+				case 'n':
+					val.WriteByte('\n')
+				default:
+					val.WriteByte(body[i])
+				}
+				continue
+			}
+			if c == '"' {
+				closed = true
+				break
+			}
+			val.WriteByte(c)
+		}
+		if !closed {
+			return "", nil, ErrWrongSeriesID
+		}
+		labels[key] = val.String()
+		body = body[i+1:]
+		if len(body) > 0 {
+			if body[0] != ',' {
+				return "", nil, ErrWrongSeriesID
+			}
+			body = body[1:]
+		}
+	}
+	if len(labels) == 0 {
+		return id, nil, nil
+	}
+	return id, labels, nil
+}
+
+// CanonicalSeriesID parse series id and return it in canonical form (sorted labels).
+func CanonicalSeriesID(series string) (string, error) {
+	id, labels, err := ParseSeriesID(series)
+	if err != nil {
+		return "", err
+	}
+	return SeriesID(id, labels), nil
+}
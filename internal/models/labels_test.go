@@ -0,0 +1,60 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabels(t *testing.T) {
+	l := Labels{"host": "srv1", "cpu": "0", "quote": "a\"b\\c\nd"}
+	series := SeriesID("CPUutilization", l)
+	require.Equal(t, `CPUutilization{cpu="0",host="srv1",quote="a\"b\\c\nd"}`, series)
+	require.Equal(t, "Alloc", SeriesID("Alloc", nil))
+
+	m := Metrics{ID: "CPUutilization", Labels: l}
+	require.Equal(t, series, m.SeriesID())
+
+	id, parsed, err := ParseSeriesID(series)
+	require.NoError(t, err)
+	require.Equal(t, "CPUutilization", id)
+	require.Equal(t, l, parsed)
+
+	id, parsed, err = ParseSeriesID("Alloc")
+	require.NoError(t, err)
+	require.Equal(t, "Alloc", id)
+	require.Nil(t, parsed)
+
+	c, err := CanonicalSeriesID(`m{b="2",a="1"}`)
+	require.NoError(t, err)
+	require.Equal(t, `m{a="1",b="2"}`, c)
+	c, err = CanonicalSeriesID(`m{}`)
+	require.NoError(t, err)
+	require.Equal(t, "m", c)
+
+	for _, wrong := range []string{`m{a="1"`, `m{a=1}`, `m{a="1"b="2"}`, `m{="1"}`, `m{a="1}`} {
+		_, _, err := ParseSeriesID(wrong)
+		require.ErrorIs(t, err, ErrWrongSeriesID, wrong)
+	}
+}
+
+func TestValidateSeries(t *testing.T) {
+	require.NoError(t, ValidateSeries("cpu.usage_idle", Labels{"host": "a b,{}", "region": ""}))
+	wrong := []struct {
+		id     string
+		labels Labels
+	}{
+		{id: ""},
+		{id: "cpu usage"},
+		{id: "cpu,host=a"},
+		{id: "cpu{"},
+		{id: "cpu", labels: Labels{"": "a"}},
+		{id: "cpu", labels: Labels{"a=b": "c"}},
+		{id: "cpu", labels: Labels{"a,b": "c"}},
+		{id: "cpu", labels: Labels{"a}": "c"}},
+		{id: "cpu", labels: Labels{"a b": "c"}},
+	}
+	for _, tt := range wrong {
+		require.ErrorIs(t, ValidateSeries(tt.id, tt.labels), ErrWrongSeriesID, tt.id)
+	}
+}
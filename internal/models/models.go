@@ -1,10 +1,157 @@
 // Package models metrics model (struct).
 package models
 
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+)
+
+// IdempotencyKeyHeader http header (and grpc metadata key) of metrics batch idempotency key.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
 // Metrics type of metrics model.
 type Metrics struct {
-	Delta *int64   `json:"delta,omitempty"` // metric value if counter received
-	Value *float64 `json:"value,omitempty"` // metric value if gauge received
-	ID    string   `json:"id"`              // metric name
-	MType string   `json:"type"`            // parameter, recives value gauge or counter
+	Delta     *int64     `json:"delta,omitempty"`     // metric value if counter received
+	Value     *float64   `json:"value,omitempty"`     // metric value if gauge received
+	Histogram *Histogram `json:"histogram,omitempty"` // metric value if histogram received
+	Labels    Labels     `json:"labels,omitempty"`    // metric dimensions (host, instance, etc...)
+	ID        string     `json:"id"`                  // metric name
+	MType     string     `json:"type"`                // parameter, recives value gauge, counter or histogram
+}
+
+// Histogram type of histogram metric value (observations distribution by buckets).
+type Histogram struct {
+	Quantiles map[string]QueryValue `json:"quantiles,omitempty"` // estimated quantiles (p50, p90, p99), read only
+	Bounds    []float64             `json:"bounds"`              // upper bounds of buckets (sorted), last +Inf bucket is implicit
+	Counts    []uint64              `json:"counts"`              // observations count per bucket, len(Bounds)+1
+	Sum       float64               `json:"sum"`                 // sum of all observations
+	Count     uint64                `json:"count"`               // number of all observations
+}
+
+// Sample type of single timestamped metric value (history point).
+type Sample struct {
+	Timestamp time.Time  `json:"timestamp"`           // time when metric value was written
+	Delta     *int64     `json:"delta,omitempty"`     // counter increment written at this time
+	Value     *float64   `json:"value,omitempty"`     // gauge value written at this time (average of aggregated samples)
+	Min       *float64   `json:"min,omitempty"`       // minimal gauge value of aggregated samples
+	Max       *float64   `json:"max,omitempty"`       // maximal gauge value of aggregated samples
+	Last      *float64   `json:"last,omitempty"`      // last gauge value of aggregated samples
+	Count     uint64     `json:"count,omitempty"`     // number of raw samples in aggregated sample (rollup or downsampled)
+	Histogram *Histogram `json:"histogram,omitempty"` // histogram observations written at this time
+}
+
+// MetricsHistory type of metric history request and response (range query).
+type MetricsHistory struct {
+	From       time.Time `json:"from"`                 // begin of time range
+	To         time.Time `json:"to"`                   // end of time range
+	ID         string    `json:"id"`                   // metric name
+	MType      string    `json:"type"`                 // parameter, recives value gauge or counter
+	Labels     Labels    `json:"labels,omitempty"`     // metric dimensions
+	Step       string    `json:"step,omitempty"`       // downsampling step (go duration format, e.g. 1m)
+	Resolution string    `json:"resolution,omitempty"` // resolution of stored samples used for response: raw or rollup step (response only)
+	Samples    []Sample  `json:"samples"`              // samples of the time range (response only)
+}
+
+// Metadata type of metric metadata (shared by all series of metric name).
+type Metadata struct {
+	ID          string `json:"id"`                    // metric name
+	MType       string `json:"type,omitempty"`        // metric type hint: gauge, counter or histogram
+	Unit        string `json:"unit,omitempty"`        // unit of metric values (bytes, percent, seconds, etc...)
+	Description string `json:"description,omitempty"` // help text
+}
+
+// MetricsQuery type of query expression request and response (evaluated at single time point).
+type MetricsQuery struct {
+	Time       time.Time     `json:"time"`                  // evaluation time (response only)
+	Query      string        `json:"query"`                 // query expression
+	ResultType string        `json:"result_type,omitempty"` // result type: scalar or vector (response only)
+	Scalar     *QueryValue   `json:"scalar,omitempty"`      // result of scalar expression (response only)
+	Series     []QuerySeries `json:"series,omitempty"`      // result of vector expression (response only)
+}
+
+// QuerySeries type of single series of query result.
+type QuerySeries struct {
+	ID     string     `json:"id,omitempty"`     // metric name (empty for computed series)
+	Labels Labels     `json:"labels,omitempty"` // series labels
+	Value  QueryValue `json:"value"`            // series value
+}
+
+// QueryValue type of query result value, NaN and infinities are encoded as strings ("NaN", "+Inf", "-Inf").
+type QueryValue float64
+
+// MarshalJSON encode value as json number (or string for non-finite value).
+func (v QueryValue) MarshalJSON() ([]byte, error) {
+	f := float64(v)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return json.Marshal(strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	return json.Marshal(f)
+}
+
+// UnmarshalJSON decode value from json number or string.
+func (v *QueryValue) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return json.Unmarshal(b, (*float64)(v))
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*v = QueryValue(f)
+	return nil
+}
+
+// Alert states (rule without alerts is inactive).
+const (
+	AlertInactive = "inactive" // rule expression has no series
+	AlertPending  = "pending"  // expression series is active for less than rule for duration
+	AlertFiring   = "firing"   // expression series is active for rule for duration
+	AlertResolved = "resolved" // expression series of firing alert isn't active anymore
+)
+
+// Alert type of alert state (single series of alert rule expression).
+type Alert struct {
+	ActiveAt    time.Time            `json:"active_at"`             // time when expression series became active
+	FiredAt     *time.Time           `json:"fired_at,omitempty"`    // time when alert started firing
+	ResolvedAt  *time.Time           `json:"resolved_at,omitempty"` // time when firing alert was resolved
+	Labels      Labels               `json:"labels"`                // expression series labels with rule labels (alertname - rule name)
+	Annotations map[string]string    `json:"annotations,omitempty"` // rendered rule annotations
+	Notified    map[string]time.Time `json:"notified,omitempty"`    // time of last notification of firing alert by receiver
+	Rule        string               `json:"rule"`                  // alert rule name
+	State       string               `json:"state"`                 // pending, firing or resolved
+	Value       QueryValue           `json:"value"`                 // last value of expression series
+}
+
+// AlertRule type of alert rule status with its alerts.
+type AlertRule struct {
+	LastEvaluation time.Time         `json:"last_evaluation"`       // time of last rule evaluation
+	Labels         Labels            `json:"labels,omitempty"`      // labels added to alerts
+	Annotations    map[string]string `json:"annotations,omitempty"` // annotation templates
+	Name           string            `json:"name"`                  // rule name
+	Query          string            `json:"query"`                 // query expression (series of result are alerts)
+	For            string            `json:"for,omitempty"`         // duration of active series before alert is firing
+	State          string            `json:"state"`                 // rule state: state of most important alert or inactive
+	LastError      string            `json:"last_error,omitempty"`  // error of last evaluation
+	Alerts         []Alert           `json:"alerts"`                // alerts of rule
+}
+
+// AlertNotification type of alerts group notification (webhook payload and body template data).
+type AlertNotification struct {
+	GroupLabels Labels  `json:"group_labels"` // labels of receiver group_by, which are common for group alerts
+	Receiver    string  `json:"receiver"`     // receiver name
+	Status      string  `json:"status"`       // firing (group has firing alerts) or resolved
+	Alerts      []Alert `json:"alerts"`       // firing and just resolved alerts of group
+}
+
+// NewIdempotencyKey return random idempotency key of metrics batch (all retries of batch are sent with same key).
+func NewIdempotencyKey() string {
+	b := make([]byte, 16)
+	// crypto/rand never returns error
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
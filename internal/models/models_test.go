@@ -1,6 +1,11 @@
 package models
 
-import "testing"
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
 
 func TestXxx(t *testing.T) {
 	// check type association
@@ -12,4 +17,44 @@ func TestXxx(t *testing.T) {
 		Delta: &i,
 		Value: &f,
 	}
+	_ = Sample{
+		Timestamp: time.Now(),
+		Delta:     &i,
+		Value:     &f,
+	}
+}
+
+func TestNewIdempotencyKey(t *testing.T) {
+	k1, k2 := NewIdempotencyKey(), NewIdempotencyKey()
+	if len(k1) != 32 || k1 == k2 {
+		t.Fatalf("wrong idempotency keys: %s, %s", k1, k2)
+	}
+}
+
+func TestQueryValueJSON(t *testing.T) {
+	for _, tt := range []struct {
+		value QueryValue
+		json  string
+	}{
+		{1.5, `1.5`},
+		{QueryValue(math.Inf(1)), `"+Inf"`},
+		{QueryValue(math.Inf(-1)), `"-Inf"`},
+	} {
+		b, err := json.Marshal(tt.value)
+		if err != nil || string(b) != tt.json {
+			t.Fatalf("wrong json of %v: %s, %v", tt.value, b, err)
+		}
+		var v QueryValue
+		if err := json.Unmarshal(b, &v); err != nil || v != tt.value {
+			t.Fatalf("wrong value of %s: %v, %v", b, v, err)
+		}
+	}
+	b, err := json.Marshal(QueryValue(math.NaN()))
+	if err != nil || string(b) != `"NaN"` {
+		t.Fatalf("wrong json of NaN: %s, %v", b, err)
+	}
+	var v QueryValue
+	if err := json.Unmarshal([]byte(`"x"`), &v); err == nil {
+		t.Fatal("wrong value is decoded")
+	}
 }
@@ -0,0 +1,346 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/storage"
+)
+
+// Result types of query.
+const (
+	ScalarType = "scalar"
+	VectorType = "vector"
+)
+
+// Source metric values source of query evaluation.
+type Source interface {
+	// method for stream current metric values sorted by type, metric name and labels (see storage.StoreMetrics)
+	ScanMetrics(ctx context.Context, fn func(m models.Metrics) error) error
+	// method for fetch time ordered samples of series written between from and to (inclusive), raw samples or rollups
+	History(ctx context.Context, mType, id string, labels models.Labels, from, to time.Time) ([]models.Sample, error)
+}
+
+// Value type of query result: Scalar or Vector.
+type Value interface {
+	Type() string // result type
+}
+
+// Scalar result of number expression.
+type Scalar float64
+
+// Vector result of series expression.
+type Vector []Series
+
+// Series single series of vector.
+type Series struct {
+	Labels models.Labels // series labels
+	ID     string        // metric name (empty for computed series)
+	Value  float64       // series value
+}
+
+// Type return result type of scalar.
+func (Scalar) Type() string { return ScalarType }
+
+// Type return result type of vector.
+func (Vector) Type() string { return VectorType }
+
+// matchName match metric name with name pattern.
+func matchName(pattern, id string) bool {
+	return storage.MatchSeriesPattern(pattern, id)
+}
+
+// Eval evaluate query at time now, instant selectors return current values of series.
+func (q *Query) Eval(ctx context.Context, src Source, now time.Time) (Value, error) {
+	e := &evaluator{ctx: ctx, src: src, now: now}
+	return e.eval(q.root)
+}
+
+// evaluator state of single query evaluation.
+type evaluator struct {
+	ctx     context.Context
+	src     Source
+	now     time.Time        // evaluation time
+	current []models.Metrics // current values of gauges and counters (fetched once for all selectors)
+}
+
+// eval evaluate expression node.
+func (e *evaluator) eval(n node) (Value, error) {
+	// selecting node type
+	switch n := n.(type) {
+	case *numberNode:
+		return Scalar(n.value), nil
+	case *selectorNode:
+		return e.instant(n)
+	case *negNode:
+		v, err := e.eval(n.expr)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := v.(Scalar); ok {
+			return -s, nil
+		}
+		res := make(Vector, 0, len(v.(Vector)))
+		for _, s := range v.(Vector) {
+			res = append(res, Series{Labels: s.Labels, Value: -s.Value})
+		}
+		return res, nil
+	case *binaryNode:
+		return e.binary(n)
+	case *funcNode:
+		return e.function(n)
+	case *aggrNode:
+		v, err := e.eval(n.expr)
+		if err != nil {
+			return nil, err
+		}
+		return aggregate(n.op, n.by, v.(Vector)), nil
+	}
+	return nil, fmt.Errorf("%w: unknown expression %T", customerrors.ErrBadQuery, n)
+}
+
+// series return current values of gauges and counters.
+func (e *evaluator) series() ([]models.Metrics, error) {
+	if e.current != nil {
+		return e.current, nil
+	}
+	metrics := []models.Metrics{}
+	if err := e.src.ScanMetrics(e.ctx, func(m models.Metrics) error {
+		if m.MType == metrictypes.GaugeType || m.MType == metrictypes.CounterType {
+			metrics = append(metrics, m)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	e.current = metrics
+	return metrics, nil
+}
+
+// instant evaluate instant selector.
+func (e *evaluator) instant(n *selectorNode) (Value, error) {
+	metrics, err := e.series()
+	if err != nil {
+		return nil, err
+	}
+	res := Vector{}
+	for _, m := range metrics {
+		if !n.matches(m.ID, m.Labels) {
+			continue
+		}
+		s := Series{Labels: m.Labels, ID: m.ID}
+		if m.MType == metrictypes.CounterType {
+			s.Value = float64(*m.Delta)
+		} else {
+			s.Value = *m.Value
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// function evaluate function over samples of range selector series.
+func (e *evaluator) function(n *funcNode) (Value, error) {
+	metrics, err := e.series()
+	if err != nil {
+		return nil, err
+	}
+	f := rangeFuncs[n.name]
+	from := e.now.Add(-n.arg.window)
+	res := Vector{}
+	for _, m := range metrics {
+		if m.MType != f.mType || !n.arg.matches(m.ID, m.Labels) {
+			continue
+		}
+		samples, err := e.src.History(e.ctx, m.MType, m.ID, m.Labels, from, e.now)
+		if err != nil {
+			return nil, err
+		}
+		// all samples of window fall into single bucket
+		agg := storage.Downsample(samples, from, n.arg.window+1)
+		if len(agg) == 0 {
+			continue
+		}
+		res = append(res, Series{Labels: m.Labels, Value: f.value(agg[0], n.arg.window)})
+	}
+	return res, nil
+}
+
+// binary evaluate binary operator.
+// Series of two vectors are matched by labels, comparisons keep series (of vector operand) for which they are true.
+func (e *evaluator) binary(n *binaryNode) (Value, error) {
+	lhs, err := e.eval(n.lhs)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := e.eval(n.rhs)
+	if err != nil {
+		return nil, err
+	}
+	ls, lScalar := lhs.(Scalar)
+	rs, rScalar := rhs.(Scalar)
+	switch {
+	case lScalar && rScalar:
+		v, _ := binaryValue(n.op, float64(ls), float64(rs))
+		return Scalar(v), nil
+	case rScalar:
+		return vectorScalar(n.op, lhs.(Vector), func(v float64) (float64, bool) { return binaryValue(n.op, v, float64(rs)) }), nil
+	case lScalar:
+		return vectorScalar(n.op, rhs.(Vector), func(v float64) (float64, bool) { return binaryValue(n.op, float64(ls), v) }), nil
+	}
+	return vectorVector(n.op, lhs.(Vector), rhs.(Vector))
+}
+
+// binaryValue apply operator to values, returns false for false comparison.
+func binaryValue(op string, a, b float64) (float64, bool) {
+	// selecting operator
+	switch op {
+	case "+":
+		return a + b, true
+	case "-":
+		return a - b, true
+	case "*":
+		return a * b, true
+	case "/":
+		return a / b, true
+	case "%":
+		return math.Mod(a, b), true
+	case "==":
+		return a, a == b
+	case "!=":
+		return a, a != b
+	case ">":
+		return a, a > b
+	case "<":
+		return a, a < b
+	case ">=":
+		return a, a >= b
+	default:
+		return a, a <= b
+	}
+}
+
+// vectorScalar apply operator with scalar operand to each series of vector.
+func vectorScalar(op string, vec Vector, apply func(v float64) (float64, bool)) Vector {
+	res := make(Vector, 0, len(vec))
+	for _, s := range vec {
+		v, ok := apply(s.Value)
+		if !ok {
+			continue
+		}
+		if isComparison(op) {
+			res = append(res, s)
+			continue
+		}
+		res = append(res, Series{Labels: s.Labels, Value: v})
+	}
+	return res
+}
+
+// vectorVector apply operator to series of vectors with same labels (series without pair are dropped).
+func vectorVector(op string, lhs, rhs Vector) (Vector, error) {
+	if _, err := seriesIndex(lhs); err != nil {
+		return nil, err
+	}
+	index, err := seriesIndex(rhs)
+	if err != nil {
+		return nil, err
+	}
+	res := make(Vector, 0, len(lhs))
+	for _, l := range lhs {
+		r, ok := index[l.Labels.String()]
+		if !ok {
+			continue
+		}
+		v, ok := binaryValue(op, l.Value, r.Value)
+		if !ok {
+			continue
+		}
+		if isComparison(op) {
+			res = append(res, l)
+			continue
+		}
+		res = append(res, Series{Labels: l.Labels, Value: v})
+	}
+	return res, nil
+}
+
+// seriesIndex index series of vector operand by labels, labels must be unique.
+func seriesIndex(vec Vector) (map[string]Series, error) {
+	index := make(map[string]Series, len(vec))
+	for _, s := range vec {
+		key := s.Labels.String()
+		if _, ok := index[key]; ok {
+			return nil, fmt.Errorf("%w: many series with labels %q in operand of binary operator", customerrors.ErrBadQuery, key)
+		}
+		index[key] = s
+	}
+	return index, nil
+}
+
+// aggregateGroup accumulator of series values with same grouping labels.
+type aggregateGroup struct {
+	labels models.Labels // grouping labels of group
+	sum    float64       // sum of values
+	min    float64       // minimal value
+	max    float64       // maximal value
+	count  int           // number of series
+}
+
+// aggregate aggregate series across labels, series are grouped by values of grouping labels.
+func aggregate(op string, by []string, vec Vector) Vector {
+	groups := map[string]*aggregateGroup{}
+	for _, s := range vec {
+		var labels models.Labels
+		for _, k := range by {
+			if v, ok := s.Labels[k]; ok {
+				if labels == nil {
+					labels = models.Labels{}
+				}
+				labels[k] = v
+			}
+		}
+		key := labels.String()
+		g, ok := groups[key]
+		if !ok {
+			g = &aggregateGroup{labels: labels, min: s.Value, max: s.Value}
+			groups[key] = g
+		}
+		g.sum += s.Value
+		g.min = math.Min(g.min, s.Value)
+		g.max = math.Max(g.max, s.Value)
+		g.count++
+	}
+
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	res := make(Vector, 0, len(keys))
+	for _, k := range keys {
+		g := groups[k]
+		s := Series{Labels: g.labels}
+		// selecting aggregation operator
+		switch op {
+		case "sum":
+			s.Value = g.sum
+		case "avg":
+			s.Value = g.sum / float64(g.count)
+		case "min":
+			s.Value = g.min
+		case "max":
+			s.Value = g.max
+		default:
+			s.Value = float64(g.count)
+		}
+		res = append(res, s)
+	}
+	return res
+}
@@ -0,0 +1,199 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+// testSource query source with fixed values and history.
+type testSource struct {
+	err     error                      // error of all methods
+	metrics []models.Metrics           // current values
+	history map[string][]models.Sample // samples by type and series id
+	scans   int                        // number of ScanMetrics calls
+}
+
+func (s *testSource) ScanMetrics(_ context.Context, fn func(m models.Metrics) error) error {
+	s.scans++
+	if s.err != nil {
+		return s.err
+	}
+	for _, m := range s.metrics {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *testSource) History(_ context.Context, mType, id string, labels models.Labels, from, to time.Time) ([]models.Sample, error) {
+	res := []models.Sample{}
+	for _, v := range s.history[mType+"/"+models.SeriesID(id, labels)] {
+		if !v.Timestamp.Before(from) && !v.Timestamp.After(to) {
+			res = append(res, v)
+		}
+	}
+	return res, nil
+}
+
+func gauge(id string, labels models.Labels, v float64) models.Metrics {
+	return models.Metrics{ID: id, MType: metrictypes.GaugeType, Labels: labels, Value: &v}
+}
+
+func counter(id string, labels models.Labels, v int64) models.Metrics {
+	return models.Metrics{ID: id, MType: metrictypes.CounterType, Labels: labels, Delta: &v}
+}
+
+func gaugeSample(ts time.Time, v float64) models.Sample {
+	return models.Sample{Timestamp: ts, Value: &v}
+}
+
+func counterSample(ts time.Time, v int64) models.Sample {
+	return models.Sample{Timestamp: ts, Delta: &v}
+}
+
+func TestEval(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1700000000, 0)
+	src := &testSource{
+		metrics: []models.Metrics{
+			counter("requests", models.Labels{"host": "a", "code": "200"}, 100),
+			counter("requests", models.Labels{"host": "a", "code": "500"}, 10),
+			counter("requests", models.Labels{"host": "b", "code": "200"}, 50),
+			gauge("CPUutilization1", nil, 10),
+			gauge("CPUutilization2", nil, 30),
+			gauge("FreeMemory", nil, 256),
+			gauge("TotalMemory", nil, 1024),
+			gauge("load", models.Labels{"host": "a"}, 0.5),
+			gauge("load", models.Labels{"host": "b"}, 2),
+			{ID: "latency", MType: metrictypes.HistogramType, Histogram: &models.Histogram{}},
+		},
+		history: map[string][]models.Sample{
+			`counter/requests{code="200",host="a"}`: {
+				counterSample(now.Add(-10*time.Minute), 40),
+				counterSample(now.Add(-4*time.Minute), 30),
+				counterSample(now.Add(-time.Minute), 30),
+			},
+			`counter/requests{code="500",host="a"}`: {counterSample(now.Add(-time.Hour), 10)},
+			`counter/requests{code="200",host="b"}`: {counterSample(now.Add(-5*time.Minute), 50)},
+			`gauge/load{host="a"}`: {
+				gaugeSample(now.Add(-50*time.Minute), 1.5),
+				gaugeSample(now.Add(-30*time.Minute), 1),
+				gaugeSample(now.Add(-time.Minute), 0.5),
+			},
+		},
+	}
+
+	testCases := []struct {
+		name  string
+		query string
+		want  Value
+	}{
+		{name: "scalar", query: "-(1 + 2) * 4 % 5", want: Scalar(-2)},
+		{
+			name:  "instant",
+			query: `requests{code="200"}`,
+			want: Vector{
+				{ID: "requests", Labels: models.Labels{"host": "a", "code": "200"}, Value: 100},
+				{ID: "requests", Labels: models.Labels{"host": "b", "code": "200"}, Value: 50},
+			},
+		},
+		{name: "avg_pattern", query: "avg(CPUutilization*)", want: Vector{{Value: 20}}},
+		{name: "arithmetic_series", query: "(TotalMemory - FreeMemory) / TotalMemory * 100", want: Vector{{Value: 75}}},
+		{
+			name:  "arithmetic_scalar",
+			query: "2 * load",
+			want:  Vector{{Labels: models.Labels{"host": "a"}, Value: 1}, {Labels: models.Labels{"host": "b"}, Value: 4}},
+		},
+		{
+			name:  "rate",
+			query: `rate(requests[5m])`,
+			want: Vector{
+				{Labels: models.Labels{"host": "a", "code": "200"}, Value: 0.2},
+				{Labels: models.Labels{"host": "b", "code": "200"}, Value: 50.0 / 300},
+			},
+		},
+		{
+			name:  "sum_increase_by",
+			query: "sum by (host) (increase(requests[15m]))",
+			want:  Vector{{Labels: models.Labels{"host": "a"}, Value: 100}, {Labels: models.Labels{"host": "b"}, Value: 50}},
+		},
+		{name: "count", query: "count(requests)", want: Vector{{Value: 3}}},
+		{name: "over_time", query: `avg_over_time(load{host="a"}[1h])`, want: Vector{{Labels: models.Labels{"host": "a"}, Value: 1}}},
+		{name: "min_over_time", query: `min_over_time(load[1h])`, want: Vector{{Labels: models.Labels{"host": "a"}, Value: 0.5}}},
+		{name: "max_over_time", query: `max_over_time(load[40m])`, want: Vector{{Labels: models.Labels{"host": "a"}, Value: 1}}},
+		{name: "sum_over_time", query: `sum_over_time(load[1h])`, want: Vector{{Labels: models.Labels{"host": "a"}, Value: 3}}},
+		{name: "count_over_time", query: `count_over_time(load[1h])`, want: Vector{{Labels: models.Labels{"host": "a"}, Value: 3}}},
+		{
+			name:  "comparison_filter",
+			query: "load > 1",
+			want:  Vector{{ID: "load", Labels: models.Labels{"host": "b"}, Value: 2}},
+		},
+		{
+			name:  "comparison_series",
+			query: "max(load) by (host) <= min(load) by (host) * 2",
+			want:  Vector{{Labels: models.Labels{"host": "a"}, Value: 0.5}, {Labels: models.Labels{"host": "b"}, Value: 2}},
+		},
+		{name: "unmatched_series", query: "load - FreeMemory", want: Vector{}},
+		{name: "nothing", query: "missing*", want: Vector{}},
+		{name: "histogram_is_skipped", query: "latency", want: Vector{}},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := Parse(tt.query)
+			require.NoError(t, err)
+			v, err := q.Eval(context.Background(), src, now)
+			require.NoError(t, err)
+			if vec, ok := tt.want.(Vector); ok {
+				require.Equal(t, VectorType, v.Type())
+				require.Len(t, v, len(vec))
+				for i, s := range v.(Vector) {
+					require.Equal(t, vec[i].ID, s.ID)
+					require.Equal(t, vec[i].Labels, s.Labels)
+					require.InDelta(t, vec[i].Value, s.Value, 1e-9)
+				}
+				return
+			}
+			require.Equal(t, tt.want, v)
+		})
+	}
+
+	// current values are fetched once per evaluation
+	src.scans = 0
+	q, err := Parse("a + b + c")
+	require.NoError(t, err)
+	_, err = q.Eval(context.Background(), src, now)
+	require.NoError(t, err)
+	require.Equal(t, 1, src.scans)
+
+	q, err = Parse("1 / 0")
+	require.NoError(t, err)
+	v, err := q.Eval(context.Background(), src, now)
+	require.NoError(t, err)
+	require.True(t, math.IsInf(float64(v.(Scalar)), 1))
+}
+
+func TestEvalErrors(t *testing.T) {
+	t.Parallel()
+	src := &testSource{metrics: []models.Metrics{
+		gauge("load", models.Labels{"host": "a"}, 1),
+		gauge("load1", models.Labels{"host": "a"}, 1),
+	}}
+	q, err := Parse("load* / 2 + load")
+	require.NoError(t, err)
+	_, err = q.Eval(context.Background(), src, time.Now())
+	require.ErrorIs(t, err, customerrors.ErrBadQuery)
+
+	src.err = errors.New("connection refused")
+	_, err = q.Eval(context.Background(), src, time.Now())
+	require.ErrorIs(t, err, src.err)
+}
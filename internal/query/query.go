@@ -0,0 +1,566 @@
+// Package query metrics query expression language (parse and evaluation).
+//
+// Expression is evaluated at single time point, its result is a number (scalar) or a set of series values (vector):
+//
+//	CPUutilization*                     current values of gauges and counters matched by name pattern ('*' and '?' wildcards)
+//	load{host="a",dc=~"eu.*"}           series matched by labels (=, !=, =~ and !~ regexp matchers)
+//	rate(requests[5m])                  per second increase of counters over time window (increase for total one)
+//	avg_over_time(load[1h])             avg, min, max, sum or count of gauge samples over time window
+//	avg(CPUutilization*)                avg, min, max, sum or count of series across labels
+//	sum by (host) (rate(requests[5m]))  aggregation grouped by labels
+//	TotalMemory - FreeMemory            arithmetic (+, -, *, /, %) between series with same labels or with numbers
+//	avg(load) > 0.9                     comparison (==, !=, >, <, >=, <=) keeps series, for which it is true
+//
+// Multiplication operator must be separated from metric names by spaces, otherwise it is a wildcard of name pattern.
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+// Binary operators by precedence (lowest first), operators with common prefix are ordered longest first.
+var binaryOps = [][]string{
+	{"==", "!=", ">=", "<=", ">", "<"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// Label matcher operators, operators with common prefix are ordered longest first.
+var matcherOps = []string{"=~", "!~", "!=", "="}
+
+// Max nesting depth of parentheses, function and aggregation arguments and unary operators.
+const maxDepth = 256
+
+// Max length of query expression.
+const maxQueryLength = 64 << 10
+
+// Aggregation operators across series labels.
+var aggregations = map[string]bool{"sum": true, "avg": true, "min": true, "max": true, "count": true}
+
+// rangeFunc function over samples of range selector series.
+type rangeFunc struct {
+	mType string                                              // metric type of function series
+	value func(s models.Sample, window time.Duration) float64 // value of samples aggregated over time window
+}
+
+// Functions over range selectors by name.
+var rangeFuncs = map[string]rangeFunc{
+	"rate": {mType: metrictypes.CounterType, value: func(s models.Sample, window time.Duration) float64 {
+		return float64(*s.Delta) / window.Seconds()
+	}},
+	"increase": {mType: metrictypes.CounterType, value: func(s models.Sample, _ time.Duration) float64 {
+		return float64(*s.Delta)
+	}},
+	"avg_over_time": {mType: metrictypes.GaugeType, value: func(s models.Sample, _ time.Duration) float64 {
+		return *s.Value
+	}},
+	"min_over_time": {mType: metrictypes.GaugeType, value: func(s models.Sample, _ time.Duration) float64 {
+		return *s.Min
+	}},
+	"max_over_time": {mType: metrictypes.GaugeType, value: func(s models.Sample, _ time.Duration) float64 {
+		return *s.Max
+	}},
+	"sum_over_time": {mType: metrictypes.GaugeType, value: func(s models.Sample, _ time.Duration) float64 {
+		return *s.Value * float64(s.Count)
+	}},
+	"count_over_time": {mType: metrictypes.GaugeType, value: func(s models.Sample, _ time.Duration) float64 {
+		return float64(s.Count)
+	}},
+}
+
+// node parsed expression node.
+type node interface {
+	isVector() bool // node is evaluated to vector (otherwise to scalar)
+}
+
+// numberNode number literal.
+type numberNode struct {
+	value float64 // number value
+}
+
+// selectorNode series selector.
+type selectorNode struct {
+	name     string         // metric name or name pattern
+	matchers []labelMatcher // label matchers
+	window   time.Duration  // time window of range selector (zero for instant selector)
+}
+
+// labelMatcher matcher of series label value (missing label has empty value).
+type labelMatcher struct {
+	re    *regexp.Regexp // anchored regexp of =~ and !~ matchers
+	name  string         // label name
+	op    string         // matcher operator
+	value string         // matched value or regexp
+}
+
+// negNode unary minus.
+type negNode struct {
+	expr node // negated expression
+}
+
+// binaryNode binary operator.
+type binaryNode struct {
+	lhs node   // left operand
+	rhs node   // right operand
+	op  string // operator
+}
+
+// funcNode function over range selector.
+type funcNode struct {
+	arg  *selectorNode // range selector
+	name string        // function name
+}
+
+// aggrNode aggregation across series.
+type aggrNode struct {
+	expr node     // aggregated vector expression
+	op   string   // aggregation operator
+	by   []string // grouping labels
+}
+
+func (n *numberNode) isVector() bool   { return false }
+func (n *selectorNode) isVector() bool { return true }
+func (n *negNode) isVector() bool      { return n.expr.isVector() }
+func (n *binaryNode) isVector() bool   { return n.lhs.isVector() || n.rhs.isVector() }
+func (n *funcNode) isVector() bool     { return true }
+func (n *aggrNode) isVector() bool     { return true }
+
+// matches check that series is selected.
+func (n *selectorNode) matches(id string, labels models.Labels) bool {
+	if !matchName(n.name, id) {
+		return false
+	}
+	for _, m := range n.matchers {
+		if !m.matches(labels[m.name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// matches check label value.
+func (m labelMatcher) matches(value string) bool {
+	// selecting matcher operator
+	switch m.op {
+	case "=":
+		return value == m.value
+	case "!=":
+		return value != m.value
+	case "=~":
+		return m.re.MatchString(value)
+	default:
+		return !m.re.MatchString(value)
+	}
+}
+
+// isComparison check that binary operator is comparison.
+func isComparison(op string) bool {
+	for _, v := range binaryOps[0] {
+		if v == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Query parsed query expression.
+type Query struct {
+	root node   // expression tree
+	text string // source expression
+}
+
+// String return source expression of query.
+func (q *Query) String() string {
+	return q.text
+}
+
+// Parse parse query expression, errors wrap customerrors.ErrBadQuery.
+func Parse(s string) (*Query, error) {
+	if len(s) > maxQueryLength {
+		return nil, fmt.Errorf("%w: query is longer than %d bytes", customerrors.ErrBadQuery, maxQueryLength)
+	}
+	p := &parser{input: s}
+	root, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.eof() {
+		return nil, p.errorf("unexpected %q", p.input[p.pos:])
+	}
+	return &Query{root: root, text: s}, nil
+}
+
+// parser recursive descent parser of query expression.
+type parser struct {
+	input string // query expression
+	pos   int    // current position in expression
+	depth int    // current nesting depth
+}
+
+// enter increase nesting depth, error if expression is nested too deep.
+func (p *parser) enter() error {
+	p.depth++
+	if p.depth > maxDepth {
+		return p.errorf("expression is nested deeper than %d", maxDepth)
+	}
+	return nil
+}
+
+// leave decrease nesting depth.
+func (p *parser) leave() {
+	p.depth--
+}
+
+// errorf return parse error at current position.
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s at position %d", customerrors.ErrBadQuery, fmt.Sprintf(format, args...), p.pos)
+}
+
+// skipSpaces move position to next non space char.
+func (p *parser) skipSpaces() {
+	for p.pos < len(p.input) && strings.IndexByte(" \t\r\n", p.input[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// eof check that expression is fully parsed.
+func (p *parser) eof() bool {
+	p.skipSpaces()
+	return p.pos >= len(p.input)
+}
+
+// consume skip token, if it is next one.
+func (p *parser) consume(token string) bool {
+	p.skipSpaces()
+	if strings.HasPrefix(p.input[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+// consumeWord skip word, if it is next one (and it isn't prefix of longer name).
+func (p *parser) consumeWord(word string) bool {
+	start := p.pos
+	if p.name(false) == word {
+		return true
+	}
+	p.pos = start
+	return false
+}
+
+// peek check that token is next one without skipping it.
+func (p *parser) peek(token string) bool {
+	start := p.pos
+	ok := p.consume(token)
+	p.pos = start
+	return ok
+}
+
+// isNameChar check that char is part of metric or label name (or name pattern).
+func isNameChar(c byte, wildcards bool) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '.' || c == ':' || wildcards && (c == '*' || c == '?')
+}
+
+// isDigit check that char is decimal digit.
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// name read name (or name pattern), empty if next token isn't name.
+func (p *parser) name(wildcards bool) string {
+	p.skipSpaces()
+	start := p.pos
+	for p.pos < len(p.input) && isNameChar(p.input[p.pos], wildcards) {
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+// binary parse binary operators of precedence level and higher.
+func (p *parser) binary(level int) (node, error) {
+	if level == 0 {
+		defer p.leave()
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+	}
+	if level == len(binaryOps) {
+		return p.unary()
+	}
+	lhs, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, v := range binaryOps[level] {
+			if p.consume(v) {
+				op = v
+				break
+			}
+		}
+		if op == "" {
+			return lhs, nil
+		}
+		rhs, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		if isComparison(op) && !lhs.isVector() && !rhs.isVector() {
+			return nil, p.errorf("comparison %s of numbers", op)
+		}
+		lhs = &binaryNode{lhs: lhs, rhs: rhs, op: op}
+	}
+}
+
+// unary parse unary minus (and plus).
+func (p *parser) unary() (node, error) {
+	if p.peek("-") || p.peek("+") {
+		defer p.leave()
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+	}
+	if p.consume("-") {
+		expr, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &negNode{expr: expr}, nil
+	}
+	if p.consume("+") {
+		return p.unary()
+	}
+	return p.primary()
+}
+
+// primary parse number, parenthesized expression, function, aggregation or instant selector.
+func (p *parser) primary() (node, error) {
+	if p.eof() {
+		return nil, p.errorf("unexpected end of query")
+	}
+	c := p.input[p.pos]
+	if c == '(' {
+		p.pos++
+		expr, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		if !p.consume(")") {
+			return nil, p.errorf("missing )")
+		}
+		return expr, nil
+	}
+	if isDigit(c) || c == '.' && p.pos+1 < len(p.input) && isDigit(p.input[p.pos+1]) {
+		return p.number()
+	}
+
+	start := p.pos
+	name := p.name(true)
+	if name == "" {
+		return nil, p.errorf("unexpected %q", c)
+	}
+	if aggregations[name] && (p.peek("(") || p.peek("by")) {
+		return p.aggregation(name)
+	}
+	if p.peek("(") {
+		if _, ok := rangeFuncs[name]; !ok {
+			p.pos = start
+			return nil, p.errorf("unknown function %s", name)
+		}
+		return p.function(name)
+	}
+	sel, err := p.selector(name)
+	if err != nil {
+		return nil, err
+	}
+	if sel.window > 0 {
+		p.pos = start
+		return nil, p.errorf("range selector %s outside of function", name)
+	}
+	return sel, nil
+}
+
+// number parse number literal.
+func (p *parser) number() (node, error) {
+	start := p.pos
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		if (c == 'e' || c == 'E') && p.pos+1 < len(p.input) && (p.input[p.pos+1] == '+' || p.input[p.pos+1] == '-') {
+			p.pos += 2
+			continue
+		}
+		if !isDigit(c) && c != '.' && c != 'e' && c != 'E' {
+			break
+		}
+		p.pos++
+	}
+	value, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+	if err != nil {
+		p.pos = start
+		return nil, p.errorf("wrong number")
+	}
+	return &numberNode{value: value}, nil
+}
+
+// selector parse label matchers and time window of selector.
+func (p *parser) selector(name string) (*selectorNode, error) {
+	sel := &selectorNode{name: name}
+	if p.consume("{") {
+		for !p.consume("}") {
+			if len(sel.matchers) > 0 && !p.consume(",") {
+				return nil, p.errorf("expected , or }")
+			}
+			m, err := p.matcher()
+			if err != nil {
+				return nil, err
+			}
+			sel.matchers = append(sel.matchers, m)
+		}
+	}
+	if p.consume("[") {
+		end := strings.IndexByte(p.input[p.pos:], ']')
+		if end < 0 {
+			return nil, p.errorf("missing ]")
+		}
+		window, err := time.ParseDuration(strings.TrimSpace(p.input[p.pos : p.pos+end]))
+		if err != nil || window <= 0 {
+			return nil, p.errorf("wrong time window")
+		}
+		sel.window = window
+		p.pos += end + 1
+	}
+	return sel, nil
+}
+
+// matcher parse label matcher.
+func (p *parser) matcher() (labelMatcher, error) {
+	m := labelMatcher{name: p.name(false)}
+	if m.name == "" {
+		return m, p.errorf("expected label name")
+	}
+	for _, op := range matcherOps {
+		if p.consume(op) {
+			m.op = op
+			break
+		}
+	}
+	if m.op == "" {
+		return m, p.errorf("expected label matcher operator")
+	}
+	var err error
+	if m.value, err = p.str(); err != nil {
+		return m, err
+	}
+	if m.op == "=~" || m.op == "!~" {
+		if m.re, err = regexp.Compile("^(?:" + m.value + ")$"); err != nil {
+			return m, p.errorf("wrong regexp %q", m.value)
+		}
+	}
+	return m, nil
+}
+
+// str parse double quoted string (go escape sequences).
+func (p *parser) str() (string, error) {
+	p.skipSpaces()
+	if p.pos >= len(p.input) || p.input[p.pos] != '"' {
+		return "", p.errorf("expected string")
+	}
+	for i := p.pos + 1; i < len(p.input); i++ {
+		switch p.input[i] {
+		case '\\':
+			i++
+		case '"':
+			s, err := strconv.Unquote(p.input[p.pos : i+1])
+			if err != nil {
+				return "", p.errorf("wrong string")
+			}
+			p.pos = i + 1
+			return s, nil
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// labelList parse parenthesized list of label names.
+func (p *parser) labelList() ([]string, error) {
+	if !p.consume("(") {
+		return nil, p.errorf("expected (")
+	}
+	labels := []string{}
+	for !p.consume(")") {
+		if len(labels) > 0 && !p.consume(",") {
+			return nil, p.errorf("expected , or )")
+		}
+		label := p.name(false)
+		if label == "" {
+			return nil, p.errorf("expected label name")
+		}
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
+
+// function parse argument of function over range selector.
+func (p *parser) function(name string) (node, error) {
+	p.consume("(")
+	selName := p.name(true)
+	if selName == "" {
+		return nil, p.errorf("%s expects range selector", name)
+	}
+	sel, err := p.selector(selName)
+	if err != nil {
+		return nil, err
+	}
+	if sel.window == 0 {
+		return nil, p.errorf("%s expects range selector", name)
+	}
+	if !p.consume(")") {
+		return nil, p.errorf("missing )")
+	}
+	return &funcNode{arg: sel, name: name}, nil
+}
+
+// aggregation parse aggregation with optional grouping before or after aggregated expression.
+func (p *parser) aggregation(op string) (node, error) {
+	var (
+		by  []string
+		err error
+	)
+	if p.consumeWord("by") {
+		if by, err = p.labelList(); err != nil {
+			return nil, err
+		}
+	}
+	if !p.consume("(") {
+		return nil, p.errorf("expected (")
+	}
+	start := p.pos
+	expr, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if !expr.isVector() {
+		p.pos = start
+		return nil, p.errorf("%s of number", op)
+	}
+	if !p.consume(")") {
+		return nil, p.errorf("missing )")
+	}
+	if by == nil && p.consumeWord("by") {
+		if by, err = p.labelList(); err != nil {
+			return nil, err
+		}
+	}
+	return &aggrNode{expr: expr, op: op, by: by}, nil
+}
@@ -0,0 +1,109 @@
+package query
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name  string
+		query string
+		root  node
+	}{
+		{name: "number", query: "1.5e3", root: &numberNode{value: 1500}},
+		{name: "pattern", query: " CPUutilization* ", root: &selectorNode{name: "CPUutilization*"}},
+		{
+			name:  "matchers",
+			query: `load{host="a", dc!="eu\"1"}`,
+			root: &selectorNode{name: "load", matchers: []labelMatcher{
+				{name: "host", op: "=", value: "a"},
+				{name: "dc", op: "!=", value: `eu"1`},
+			}},
+		},
+		{
+			name:  "precedence",
+			query: "a - b * 2 > -1",
+			root: &binaryNode{
+				op:  ">",
+				lhs: &binaryNode{op: "-", lhs: &selectorNode{name: "a"}, rhs: &binaryNode{op: "*", lhs: &selectorNode{name: "b"}, rhs: &numberNode{value: 2}}},
+				rhs: &negNode{expr: &numberNode{value: 1}},
+			},
+		},
+		{
+			name:  "parentheses",
+			query: "(a - b) / 2",
+			root:  &binaryNode{op: "/", lhs: &binaryNode{op: "-", lhs: &selectorNode{name: "a"}, rhs: &selectorNode{name: "b"}}, rhs: &numberNode{value: 2}},
+		},
+		{name: "function", query: "rate(requests[5m])", root: &funcNode{name: "rate", arg: &selectorNode{name: "requests", window: 5 * time.Minute}}},
+		{name: "aggregation", query: "avg(CPUutilization*)", root: &aggrNode{op: "avg", expr: &selectorNode{name: "CPUutilization*"}}},
+		{
+			name:  "aggregation_by_before",
+			query: "sum by (host, dc) (increase(requests[1h]))",
+			root:  &aggrNode{op: "sum", by: []string{"host", "dc"}, expr: &funcNode{name: "increase", arg: &selectorNode{name: "requests", window: time.Hour}}},
+		},
+		{name: "aggregation_by_after", query: "max(load) by (host)", root: &aggrNode{op: "max", by: []string{"host"}, expr: &selectorNode{name: "load"}}},
+		{name: "metric_named_as_aggregation", query: "count + 1", root: &binaryNode{op: "+", lhs: &selectorNode{name: "count"}, rhs: &numberNode{value: 1}}},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := Parse(tt.query)
+			require.NoError(t, err)
+			require.Equal(t, tt.root, q.root)
+			require.Equal(t, tt.query, q.String())
+		})
+	}
+
+	// top level expression is nested too
+	q, err := Parse(strings.Repeat("(", maxDepth-2) + "-1" + strings.Repeat(")", maxDepth-2))
+	require.NoError(t, err)
+
+	q, err = Parse(`load{host=~"web-[0-9]+"}`)
+	require.NoError(t, err)
+	sel := q.root.(*selectorNode)
+	require.True(t, sel.matches("load", map[string]string{"host": "web-12"}))
+	require.False(t, sel.matches("load", map[string]string{"host": "web-12a"}))
+	require.False(t, sel.matches("load1", map[string]string{"host": "web-1"}))
+}
+
+func TestParseErrors(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		query string
+		err   string
+	}{
+		{query: "", err: "bad query: unexpected end of query at position 0"},
+		{query: "a b", err: `bad query: unexpected "b" at position 2`},
+		{query: "a* 2", err: `bad query: unexpected "2" at position 3`},
+		{query: "(a + 1", err: "bad query: missing ) at position 6"},
+		{query: "1 > 2", err: "bad query: comparison > of numbers at position 5"},
+		{query: "avg(1)", err: "bad query: avg of number at position 4"},
+		{query: "rate(requests)", err: "bad query: rate expects range selector at position 13"},
+		{query: "requests[5m]", err: "bad query: range selector requests outside of function at position 0"},
+		{query: "requests[5x]", err: "bad query: wrong time window at position 9"},
+		{query: "abs(load)", err: "bad query: unknown function abs at position 0"},
+		{query: `load{host}`, err: "bad query: expected label matcher operator at position 9"},
+		{query: `load{host="a"`, err: "bad query: expected , or } at position 13"},
+		{query: `load{host=~"("}`, err: `bad query: wrong regexp "(" at position 14`},
+		{query: `load{host="a}`, err: "bad query: unterminated string at position 10"},
+		{query: "sum by host (load)", err: "bad query: expected ( at position 7"},
+		{query: "@", err: `bad query: unexpected '@' at position 0`},
+		{query: strings.Repeat("(", 300) + "1" + strings.Repeat(")", 300), err: "bad query: expression is nested deeper than 256 at position 256"},
+		{query: strings.Repeat("-", 300) + "1", err: "bad query: expression is nested deeper than 256 at position 255"},
+		{query: strings.Repeat("avg(", 300) + "a" + strings.Repeat(")", 300), err: "bad query: expression is nested deeper than 256 at position 1024"},
+		{query: strings.Repeat("1+", maxQueryLength) + "1", err: "bad query: query is longer than 65536 bytes"},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.query[:min(len(tt.query), 32)], func(t *testing.T) {
+			_, err := Parse(tt.query)
+			require.ErrorIs(t, err, customerrors.ErrBadQuery)
+			require.EqualError(t, err, tt.err)
+		})
+	}
+}
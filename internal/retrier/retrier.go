@@ -31,6 +31,22 @@ type (
 	GetAllMetricsTxtType func(ctx context.Context) (string, error)
 	// GetMetricType type of function for GetMetricType method retry.
 	GetMetricType func(ctx context.Context, mType, name string) (interface{}, error)
+	// GetMetricHistoryType type of function for GetMetricHistory method retry.
+	GetMetricHistoryType func(ctx context.Context, mType, name string, from, to time.Time) ([]models.Sample, error)
+	// GetMetricRollupsType type of function for GetMetricRollups method retry.
+	GetMetricRollupsType func(ctx context.Context, mType, name string, resolution time.Duration, from, to time.Time) ([]models.Sample, error)
+	// DeleteType type of function for Delete method retry.
+	DeleteType func(ctx context.Context, mType, name string) (int, error)
+	// WriteMetadataType type of function for WriteMetadata method retry.
+	WriteMetadataType func(ctx context.Context, meta []models.Metadata) error
+	// GetMetadataType type of function for GetMetadata method retry.
+	GetMetadataType func(ctx context.Context) ([]models.Metadata, error)
+	// WriteAlertsType type of function for WriteAlerts method retry.
+	WriteAlertsType func(ctx context.Context, alerts []models.Alert) error
+	// GetAlertsType type of function for GetAlerts method retry.
+	GetAlertsType func(ctx context.Context) ([]models.Alert, error)
+	// NotifyType type of function for alert notification send retry.
+	NotifyType func(ctx context.Context, url, body string) error
 )
 
 // UseRetrierWM retry method for WriteMetric function.
@@ -127,6 +143,160 @@ func (reqRetrier *Retrier) UseRetrierGetMetric(f GetMetricType) GetMetricType {
 	}
 }
 
+// UseRetrierGetHistory retry method for GetMetricHistory function.
+func (reqRetrier *Retrier) UseRetrierGetHistory(f GetMetricHistoryType) GetMetricHistoryType {
+	bf := retry.WithMaxRetries(reqRetrier.maxRetries, retry.NewFibonacci(reqRetrier.fiboDuration))
+
+	return func(ctx context.Context, mType, name string, from, to time.Time) ([]models.Sample, error) {
+		ctx, cancel := context.WithTimeout(ctx, reqRetrier.timeout)
+		defer cancel()
+		var s []models.Sample
+		var err error
+		err = retry.Do(ctx, bf, func(ctx context.Context) error {
+			s, err = f(ctx, mType, name, from, to)
+			if errors.Is(reqRetrier.skippedErrors, err) {
+				return err
+			}
+			return retry.RetryableError(err)
+		})
+		return s, err
+	}
+}
+
+// UseRetrierGetRollups retry method for GetMetricRollups function.
+func (reqRetrier *Retrier) UseRetrierGetRollups(f GetMetricRollupsType) GetMetricRollupsType {
+	bf := retry.WithMaxRetries(reqRetrier.maxRetries, retry.NewFibonacci(reqRetrier.fiboDuration))
+
+	return func(ctx context.Context, mType, name string, resolution time.Duration, from, to time.Time) ([]models.Sample, error) {
+		ctx, cancel := context.WithTimeout(ctx, reqRetrier.timeout)
+		defer cancel()
+		var s []models.Sample
+		var err error
+		err = retry.Do(ctx, bf, func(ctx context.Context) error {
+			s, err = f(ctx, mType, name, resolution, from, to)
+			if errors.Is(reqRetrier.skippedErrors, err) {
+				return err
+			}
+			return retry.RetryableError(err)
+		})
+		return s, err
+	}
+}
+
+// UseRetrierDelete retry method for Delete function.
+func (reqRetrier *Retrier) UseRetrierDelete(f DeleteType) DeleteType {
+	bf := retry.WithMaxRetries(reqRetrier.maxRetries, retry.NewFibonacci(reqRetrier.fiboDuration))
+
+	return func(ctx context.Context, mType, name string) (int, error) {
+		ctx, cancel := context.WithTimeout(ctx, reqRetrier.timeout)
+		defer cancel()
+		var n int
+		var err error
+		err = retry.Do(ctx, bf, func(ctx context.Context) error {
+			n, err = f(ctx, mType, name)
+			if errors.Is(reqRetrier.skippedErrors, err) {
+				return err
+			}
+			return retry.RetryableError(err)
+		})
+		return n, err
+	}
+}
+
+// UseRetrierWriteMetadata retry method for WriteMetadata function.
+func (reqRetrier *Retrier) UseRetrierWriteMetadata(f WriteMetadataType) WriteMetadataType {
+	bf := retry.WithMaxRetries(reqRetrier.maxRetries, retry.NewFibonacci(reqRetrier.fiboDuration))
+
+	return func(ctx context.Context, meta []models.Metadata) error {
+		ctx, cancel := context.WithTimeout(ctx, reqRetrier.timeout)
+		defer cancel()
+		err := retry.Do(ctx, bf, func(ctx context.Context) error {
+			err := f(ctx, meta)
+			if errors.Is(reqRetrier.skippedErrors, err) {
+				return err
+			}
+			return retry.RetryableError(err)
+		})
+		return err
+	}
+}
+
+// UseRetrierGetMetadata retry method for GetMetadata function.
+func (reqRetrier *Retrier) UseRetrierGetMetadata(f GetMetadataType) GetMetadataType {
+	bf := retry.WithMaxRetries(reqRetrier.maxRetries, retry.NewFibonacci(reqRetrier.fiboDuration))
+
+	return func(ctx context.Context) ([]models.Metadata, error) {
+		ctx, cancel := context.WithTimeout(ctx, reqRetrier.timeout)
+		defer cancel()
+		var meta []models.Metadata
+		var err error
+		err = retry.Do(ctx, bf, func(ctx context.Context) error {
+			meta, err = f(ctx)
+			if errors.Is(reqRetrier.skippedErrors, err) {
+				return err
+			}
+			return retry.RetryableError(err)
+		})
+		return meta, err
+	}
+}
+
+// UseRetrierWriteAlerts retry method for WriteAlerts function.
+func (reqRetrier *Retrier) UseRetrierWriteAlerts(f WriteAlertsType) WriteAlertsType {
+	bf := retry.WithMaxRetries(reqRetrier.maxRetries, retry.NewFibonacci(reqRetrier.fiboDuration))
+
+	return func(ctx context.Context, alerts []models.Alert) error {
+		ctx, cancel := context.WithTimeout(ctx, reqRetrier.timeout)
+		defer cancel()
+		err := retry.Do(ctx, bf, func(ctx context.Context) error {
+			err := f(ctx, alerts)
+			if errors.Is(reqRetrier.skippedErrors, err) {
+				return err
+			}
+			return retry.RetryableError(err)
+		})
+		return err
+	}
+}
+
+// UseRetrierGetAlerts retry method for GetAlerts function.
+func (reqRetrier *Retrier) UseRetrierGetAlerts(f GetAlertsType) GetAlertsType {
+	bf := retry.WithMaxRetries(reqRetrier.maxRetries, retry.NewFibonacci(reqRetrier.fiboDuration))
+
+	return func(ctx context.Context) ([]models.Alert, error) {
+		ctx, cancel := context.WithTimeout(ctx, reqRetrier.timeout)
+		defer cancel()
+		var alerts []models.Alert
+		var err error
+		err = retry.Do(ctx, bf, func(ctx context.Context) error {
+			alerts, err = f(ctx)
+			if errors.Is(reqRetrier.skippedErrors, err) {
+				return err
+			}
+			return retry.RetryableError(err)
+		})
+		return alerts, err
+	}
+}
+
+// UseRetrierNotify retry method for alert notification send function.
+func (reqRetrier *Retrier) UseRetrierNotify(f NotifyType) NotifyType {
+	bf := retry.WithMaxRetries(reqRetrier.maxRetries, retry.NewFibonacci(reqRetrier.fiboDuration))
+
+	return func(ctx context.Context, url, body string) error {
+		ctx, cancel := context.WithTimeout(ctx, reqRetrier.timeout)
+		defer cancel()
+		err := retry.Do(ctx, bf, func(ctx context.Context) error {
+			err := f(ctx, url, body)
+			if errors.Is(reqRetrier.skippedErrors, err) {
+				return err
+			}
+			return retry.RetryableError(err)
+		})
+		return err
+	}
+}
+
 // SetParams set retry parameters.
 func (reqRetrier *Retrier) SetParams(fibotime, timeout time.Duration, maxretries uint64) {
 	reqRetrier.fiboDuration = fibotime
@@ -146,6 +316,11 @@ func NewRetrier() *Retrier {
 			customerrors.ErrWrongMetricType,
 			customerrors.ErrBadMetricType,
 			customerrors.ErrNoVal,
+			customerrors.ErrWrongHistogram,
+			customerrors.ErrHistogramBounds,
+			customerrors.ErrWrongMetadata,
+			models.ErrWrongSeriesID,
+			customerrors.ErrWebhookRejected,
 		),
 	}
 }
@@ -2,7 +2,14 @@ package retrier
 
 import (
 	"context"
+	"errors"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/models"
 )
 
 func TestPopRetrier(t *testing.T) {
@@ -21,3 +28,159 @@ func TestSetParams(t *testing.T) {
 	r := NewRetrier()
 	r.SetParams(1, 1, 1)
 }
+
+func TestGetHistoryRetrier(t *testing.T) {
+	t.Parallel()
+	r := NewRetrier()
+	r.SetParams(time.Millisecond, time.Second, 3)
+	ctx := context.Background()
+
+	calls := 0
+	testHistFunc := func(ctx context.Context, mType, name string, from, to time.Time) ([]models.Sample, error) {
+		calls++
+		return nil, customerrors.ErrBadMetricType
+	}
+
+	_, err := r.UseRetrierGetHistory(testHistFunc)(ctx, "wrong", "test", time.Time{}, time.Time{})
+	require.ErrorIs(t, err, customerrors.ErrBadMetricType)
+	// non-retriable error must not be retried
+	require.Equal(t, 1, calls)
+}
+
+func TestGetRollupsRetrier(t *testing.T) {
+	t.Parallel()
+	r := NewRetrier()
+	r.SetParams(time.Millisecond, time.Second, 3)
+	ctx := context.Background()
+
+	calls := 0
+	testRollupsFunc := func(ctx context.Context, mType, name string, resolution time.Duration, from, to time.Time) ([]models.Sample, error) {
+		calls++
+		if calls < 2 {
+			return nil, errors.New("temporary error")
+		}
+		return []models.Sample{{}}, nil
+	}
+
+	s, err := r.UseRetrierGetRollups(testRollupsFunc)(ctx, "gauge", "test", time.Minute, time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, s, 1)
+	require.Equal(t, 2, calls)
+}
+
+func TestDeleteRetrier(t *testing.T) {
+	t.Parallel()
+	r := NewRetrier()
+	r.SetParams(time.Millisecond, time.Second, 3)
+	ctx := context.Background()
+
+	calls := 0
+	testDeleteFunc := func(ctx context.Context, mType, name string) (int, error) {
+		calls++
+		if name == "missing" {
+			return 0, customerrors.ErrNoVal
+		}
+		if calls < 2 {
+			return 0, errors.New("temporary error")
+		}
+		return 3, nil
+	}
+
+	n, err := r.UseRetrierDelete(testDeleteFunc)(ctx, "gauge", "test*")
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.Equal(t, 2, calls)
+
+	calls = 0
+	_, err = r.UseRetrierDelete(testDeleteFunc)(ctx, "gauge", "missing")
+	require.ErrorIs(t, err, customerrors.ErrNoVal)
+	// non-retriable error must not be retried
+	require.Equal(t, 1, calls)
+}
+
+func TestMetadataRetrier(t *testing.T) {
+	t.Parallel()
+	r := NewRetrier()
+	r.SetParams(time.Millisecond, time.Second, 3)
+	ctx := context.Background()
+
+	calls := 0
+	testWriteFunc := func(ctx context.Context, meta []models.Metadata) error {
+		calls++
+		return customerrors.ErrWrongMetadata
+	}
+	require.ErrorIs(t, r.UseRetrierWriteMetadata(testWriteFunc)(ctx, nil), customerrors.ErrWrongMetadata)
+	// non-retriable error must not be retried
+	require.Equal(t, 1, calls)
+
+	calls = 0
+	testGetFunc := func(ctx context.Context) ([]models.Metadata, error) {
+		calls++
+		if calls < 2 {
+			return nil, errors.New("temporary error")
+		}
+		return []models.Metadata{{ID: "test"}}, nil
+	}
+	meta, err := r.UseRetrierGetMetadata(testGetFunc)(ctx)
+	require.NoError(t, err)
+	require.Len(t, meta, 1)
+	require.Equal(t, 2, calls)
+}
+
+func TestAlertsRetrier(t *testing.T) {
+	t.Parallel()
+	r := NewRetrier()
+	r.SetParams(time.Millisecond, time.Second, 3)
+	ctx := context.Background()
+
+	calls := 0
+	testWriteFunc := func(ctx context.Context, alerts []models.Alert) error {
+		calls++
+		if calls < 3 {
+			return errors.New("temporary error")
+		}
+		return nil
+	}
+	require.NoError(t, r.UseRetrierWriteAlerts(testWriteFunc)(ctx, nil))
+	require.Equal(t, 3, calls)
+
+	calls = 0
+	testGetFunc := func(ctx context.Context) ([]models.Alert, error) {
+		calls++
+		if calls < 2 {
+			return nil, errors.New("temporary error")
+		}
+		return []models.Alert{{Rule: "test"}}, nil
+	}
+	alerts, err := r.UseRetrierGetAlerts(testGetFunc)(ctx)
+	require.NoError(t, err)
+	require.Len(t, alerts, 1)
+	require.Equal(t, 2, calls)
+}
+
+func TestNotifyRetrier(t *testing.T) {
+	t.Parallel()
+	r := NewRetrier()
+	r.SetParams(time.Millisecond, time.Second, 3)
+	ctx := context.Background()
+
+	calls := 0
+	testNotifyFunc := func(ctx context.Context, url, body string) error {
+		calls++
+		if calls < 3 {
+			return errors.New("temporary error")
+		}
+		return nil
+	}
+	require.NoError(t, r.UseRetrierNotify(testNotifyFunc)(ctx, "http://localhost", "{}"))
+	require.Equal(t, 3, calls)
+
+	// rejected notification isn't retried
+	calls = 0
+	testRejectFunc := func(ctx context.Context, url, body string) error {
+		calls++
+		return customerrors.ErrWebhookRejected
+	}
+	require.ErrorIs(t, r.UseRetrierNotify(testRejectFunc)(ctx, "http://localhost", "{}"), customerrors.ErrWebhookRejected)
+	require.Equal(t, 1, calls)
+}
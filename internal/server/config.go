@@ -2,15 +2,30 @@ package server
 
 // ConfigArgs stores server config information.
 type ConfigArgs struct {
-	DatabaseDsn     string `json:"database_dsn"`   // database connection string
-	PprofAddr       string `json:"pprof_address"`  // address for pprof buildin server
-	KeyEnc          string `json:"key_enc_sign"`   // symmetric encryption key for signing requests
-	ServerAddr      string `json:"address"`        // server address
-	Loglevel        string `json:"log_level"`      // level of logging
-	FileStoragePath string `json:"store_file"`     // path to file, where metrics will be store
-	PrivKeyFile     string `json:"crypto_key"`     // path to private key file for asymmetric encryption
-	StoreInterval   int    `json:"store_interval"` // periodic interval before save metrics data to file
-	Restore         bool   `json:"restore"`        // a flag that indicates whether to restore saved metrics from a file when starting the server
-	TrustedSubnets  string `json:"trusted_subnet"` // allow connections from specified subnets
-	GrpcServer      string `json:"grpc_server"`    // grpc server for agent metrics
+	DatabaseDsn         string `json:"database_dsn"`            // database connection string
+	PprofAddr           string `json:"pprof_address"`           // address for pprof buildin server
+	KeyEnc              string `json:"key_enc_sign"`            // symmetric encryption key for signing requests
+	ServerAddr          string `json:"address"`                 // server address
+	Loglevel            string `json:"log_level"`               // level of logging
+	FileStoragePath     string `json:"store_file"`              // path to file, where metrics will be store
+	DataDir             string `json:"data_dir"`                // directory of embedded disk storage (used when database dsn is empty)
+	PrivKeyFile         string `json:"crypto_key"`              // path to private key file for asymmetric encryption
+	StoreInterval       int    `json:"store_interval"`          // periodic interval before save metrics data to file
+	Restore             bool   `json:"restore"`                 // a flag that indicates whether to restore saved metrics from a file when starting the server
+	TrustedSubnets      string `json:"trusted_subnet"`          // allow connections from specified subnets
+	GrpcServer          string `json:"grpc_server"`             // grpc server for agent metrics
+	WALFile             string `json:"wal_file"`                // path to write-ahead log of in-memory storage (empty - disabled)
+	WALFsync            string `json:"wal_fsync"`               // write-ahead log and disk storage fsync mode: always, everysec or no
+	RestoreTolerant     bool   `json:"restore_tolerant"`        // skip corrupt snapshot lines on restore instead of failing
+	Retention           string `json:"retention"`               // history retention policy, e.g. raw:24h,1m:30d,1h:365d (forever - keep raw history forever)
+	Tenants             string `json:"tenants"`                 // tenants with bearer tokens and request rate limits, e.g. teamA:token1:100,teamB:token2 (empty - single default tenant)
+	IdempotencyWindow   int    `json:"idempotency_window"`      // seconds of remembering applied batch idempotency keys (0 - disabled)
+	StatsdAddr          string `json:"statsd_address"`          // statsd listener address, udp and tcp (empty - disabled)
+	StatsdFlushInterval int    `json:"statsd_flush_interval"`   // seconds between flushes of aggregated statsd samples to storage
+	StatsdTenant        string `json:"statsd_tenant"`           // tenant of statsd samples (empty - default tenant, must be registered with tenants)
+	GraphiteAddr        string `json:"graphite_address"`        // graphite plaintext protocol listener address (empty - disabled)
+	GraphitePickleAddr  string `json:"graphite_pickle_address"` // graphite pickle protocol listener address (empty - disabled)
+	GraphiteTenant      string `json:"graphite_tenant"`         // tenant of graphite datapoints (empty - default tenant, must be registered with tenants)
+	AlertRulesFile      string `json:"alert_rules_file"`        // path to alert rules config file, json (empty - alerting disabled)
+	AlertEvalInterval   int    `json:"alert_eval_interval"`     // seconds between alert rules evaluations
 }
@@ -11,6 +11,7 @@ import (
 	"log"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -21,6 +22,7 @@ import (
 
 	"github.com/sourcecd/monitoring/internal/compression"
 	"github.com/sourcecd/monitoring/internal/cryptandsign"
+	"github.com/sourcecd/monitoring/internal/customerrors"
 	"github.com/sourcecd/monitoring/internal/logging"
 	"github.com/sourcecd/monitoring/internal/metrictypes"
 	"github.com/sourcecd/monitoring/internal/models"
@@ -40,10 +42,46 @@ type urlToMetric struct {
 
 // Main type for all metrics methods (get/update, etc...).
 type metricHandlers struct {
-	ctx        context.Context              // handlers context
-	storage    storage.StoreMetrics         // metric storage interface
-	reqRetrier *retrier.Retrier             // pointer to retryer type for api methods
-	crypt      cryptandsign.AsymmetricCrypt // interface for crypt/decrypt messages
+	ctx         context.Context              // handlers context
+	storage     storage.StoreMetrics         // metric storage interface
+	reqRetrier  *retrier.Retrier             // pointer to retryer type for api methods
+	crypt       cryptandsign.AsymmetricCrypt // interface for crypt/decrypt messages
+	retention   storage.RetentionPolicy      // history retention (resolution choice of range queries)
+	tenants     *tenantRegistry              // tenants by bearer token (nil - single default tenant)
+	idempotency *idempotencyCache            // recently applied idempotency keys of batches (nil - disabled)
+	alerts      *alertManager                // alert rules evaluator (nil - alerting disabled)
+}
+
+// urlParamUnescaped get url parameter value with escaped symbols decoded.
+// Chi routes by escaped path, when it differs from default encoding (e.g. labels in metric name).
+func urlParamUnescaped(r *http.Request, key string) (string, error) {
+	param := chi.URLParam(r, key)
+	if r.URL.RawPath == "" {
+		return param, nil
+	}
+	return url.PathUnescape(param)
+}
+
+// urlParamSeries get canonical series id (metric name with optional labels) from url parameter.
+func urlParamSeries(r *http.Request, key string) (string, error) {
+	param, err := urlParamUnescaped(r, key)
+	if err != nil {
+		return "", err
+	}
+	return models.CanonicalSeriesID(param)
+}
+
+// urlParamWriteSeries get canonical series id of written metric from url parameter (metric name is checked).
+func urlParamWriteSeries(r *http.Request, key string) (string, error) {
+	series, err := urlParamSeries(r, key)
+	if err != nil {
+		return "", err
+	}
+	// label names are checked by parser
+	if id, _, _ := models.ParseSeriesID(series); !models.ValidName(id) {
+		return "", models.ErrWrongSeriesID
+	}
+	return series, nil
 }
 
 // updateMetrics api method for store single plaintext metric, sending in api url parameters.
@@ -54,9 +92,15 @@ func (mh *metricHandlers) updateMetrics() http.HandlerFunc {
 			return
 		}
 
+		// metric name may contain labels: name{k1="v1",k2="v2"}
+		series, err := urlParamWriteSeries(req, "name")
+		if err != nil {
+			http.Error(resp, "can't parse metric name", http.StatusBadRequest)
+			return
+		}
 		metric := urlToMetric{
 			metricType:  chi.URLParam(req, "type"),
-			metricName:  chi.URLParam(req, "name"),
+			metricName:  series,
 			metricValue: chi.URLParam(req, "value"),
 		}
 
@@ -68,7 +112,7 @@ func (mh *metricHandlers) updateMetrics() http.HandlerFunc {
 				http.Error(resp, "can't parse gauge metric", http.StatusBadRequest)
 				return
 			}
-			if err := mh.reqRetrier.UseRetrierWM(mh.storage.WriteMetric)(mh.ctx, metric.metricType, metric.metricName, metrictypes.Gauge(fl64)); err != nil {
+			if err := mh.reqRetrier.UseRetrierWM(mh.storage.WriteMetric)(mh.requestCtx(req), metric.metricType, metric.metricName, metrictypes.Gauge(fl64)); err != nil {
 				http.Error(resp, "can't store gauge metric", http.StatusInternalServerError)
 				return
 			}
@@ -78,10 +122,13 @@ func (mh *metricHandlers) updateMetrics() http.HandlerFunc {
 				http.Error(resp, "can't parse counter metric", http.StatusBadRequest)
 				return
 			}
-			if err := mh.reqRetrier.UseRetrierWM(mh.storage.WriteMetric)(mh.ctx, metric.metricType, metric.metricName, metrictypes.Counter(i64)); err != nil {
+			if err := mh.reqRetrier.UseRetrierWM(mh.storage.WriteMetric)(mh.requestCtx(req), metric.metricType, metric.metricName, metrictypes.Counter(i64)); err != nil {
 				http.Error(resp, "can't store counter metric", http.StatusInternalServerError)
 				return
 			}
+		case metrictypes.HistogramType:
+			http.Error(resp, "histogram metric must be sent in json", http.StatusBadRequest)
+			return
 		default:
 			http.Error(resp, "metric_type not found", http.StatusBadRequest)
 			return
@@ -98,12 +145,16 @@ func (mh *metricHandlers) getMetrics() http.HandlerFunc {
 	return func(resp http.ResponseWriter, req *http.Request) {
 		resp.Header().Set("Content-Type", "text/plain")
 		mType := chi.URLParam(req, "type")
-		mVal := chi.URLParam(req, "val")
+		mVal, err := urlParamSeries(req, "val")
+		if err != nil {
+			http.Error(resp, "can't parse metric name", http.StatusBadRequest)
+			return
+		}
 
 		// selecting what type of metric (gauge/count) will be getting
 		switch mType {
 		case metrictypes.GaugeType:
-			val, err := mh.reqRetrier.UseRetrierGetMetric(mh.storage.GetMetric)(mh.ctx, metrictypes.GaugeType, mVal)
+			val, err := mh.reqRetrier.UseRetrierGetMetric(mh.storage.GetMetric)(mh.requestCtx(req), metrictypes.GaugeType, mVal)
 			if err != nil {
 				http.Error(resp, "gauge not found", http.StatusNotFound)
 				return
@@ -111,13 +162,21 @@ func (mh *metricHandlers) getMetrics() http.HandlerFunc {
 			resp.WriteHeader(http.StatusOK)
 			_, _ = io.WriteString(resp, fmt.Sprintf("%v\n", val))
 		case metrictypes.CounterType:
-			val, err := mh.reqRetrier.UseRetrierGetMetric(mh.storage.GetMetric)(mh.ctx, metrictypes.CounterType, mVal)
+			val, err := mh.reqRetrier.UseRetrierGetMetric(mh.storage.GetMetric)(mh.requestCtx(req), metrictypes.CounterType, mVal)
 			if err != nil {
 				http.Error(resp, "counter not found", http.StatusNotFound)
 				return
 			}
 			resp.WriteHeader(http.StatusOK)
 			_, _ = io.WriteString(resp, fmt.Sprintf("%v\n", val))
+		case metrictypes.HistogramType:
+			val, err := mh.reqRetrier.UseRetrierGetMetric(mh.storage.GetMetric)(mh.requestCtx(req), metrictypes.HistogramType, mVal)
+			if err != nil {
+				http.Error(resp, "histogram not found", http.StatusNotFound)
+				return
+			}
+			resp.WriteHeader(http.StatusOK)
+			_, _ = io.WriteString(resp, fmt.Sprintf("%v\n", val))
 		default:
 			http.Error(resp, "metric_type not found", http.StatusBadRequest)
 			return
@@ -125,6 +184,40 @@ func (mh *metricHandlers) getMetrics() http.HandlerFunc {
 	}
 }
 
+// deleteMetrics api method for delete series by id or pattern ('*' and '?' wildcards) with history.
+func (mh *metricHandlers) deleteMetrics() http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Content-Type", "text/plain")
+		mType := chi.URLParam(req, "type")
+		// patterns are matched by storage, so name isn't converted to series id here
+		name, err := urlParamUnescaped(req, "val")
+		if err != nil || name == "" {
+			http.Error(resp, "can't parse metric name", http.StatusBadRequest)
+			return
+		}
+
+		n, err := mh.reqRetrier.UseRetrierDelete(mh.storage.Delete)(mh.requestCtx(req), mType, name)
+		switch {
+		case err == nil:
+		case errors.Is(err, customerrors.ErrNoVal):
+			http.Error(resp, "metric not found", http.StatusNotFound)
+			return
+		case errors.Is(err, customerrors.ErrBadMetricType):
+			http.Error(resp, "metric_type not found", http.StatusBadRequest)
+			return
+		case errors.Is(err, models.ErrWrongSeriesID):
+			http.Error(resp, "can't parse metric name", http.StatusBadRequest)
+			return
+		default:
+			log.Println(err)
+			http.Error(resp, "can't delete metric", http.StatusInternalServerError)
+			return
+		}
+		resp.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(resp, fmt.Sprintf("%d\n", n))
+	}
+}
+
 // getAll method for fetching all metrics on single html page.
 // Using go html template package.
 func (mh *metricHandlers) getAll() http.HandlerFunc {
@@ -144,11 +237,17 @@ func (mh *metricHandlers) getAll() http.HandlerFunc {
 </pre>
 </body>
 </html>`)
-		res, err := mh.reqRetrier.UseRetrierGetAllM(mh.storage.GetAllMetricsTxt)(mh.ctx)
+		res, err := mh.reqRetrier.UseRetrierGetAllM(mh.storage.GetAllMetricsTxt)(mh.requestCtx(r))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		meta, err := mh.reqRetrier.UseRetrierGetMetadata(mh.storage.GetMetadata)(mh.requestCtx(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res += formatMetadataTxt(meta)
 		w.WriteHeader(http.StatusOK)
 		_ = tmpl.Execute(w, res)
 	}
@@ -173,19 +272,39 @@ func (mh *metricHandlers) updateMetricsJSON() http.HandlerFunc {
 		}
 		enc := json.NewEncoder(w)
 
+		if resultParsedJSON.ID != "" && models.ValidateSeries(resultParsedJSON.ID, resultParsedJSON.Labels) != nil {
+			http.Error(w, "wrong metric or label name", http.StatusBadRequest)
+			return
+		}
+
 		// selecting metric type (gauge/count) for store metric
 		if resultParsedJSON.MType == metrictypes.GaugeType && resultParsedJSON.Value != nil && resultParsedJSON.ID != "" {
-			if err := mh.reqRetrier.UseRetrierWM(mh.storage.WriteMetric)(mh.ctx, resultParsedJSON.MType, resultParsedJSON.ID, metrictypes.Gauge(*resultParsedJSON.Value)); err != nil {
+			if err := mh.reqRetrier.UseRetrierWM(mh.storage.WriteMetric)(mh.requestCtx(r), resultParsedJSON.MType, resultParsedJSON.SeriesID(), metrictypes.Gauge(*resultParsedJSON.Value)); err != nil {
 				log.Println(err)
 				http.Error(w, "can't store gauge metric", http.StatusInternalServerError)
 				return
 			}
 		} else if resultParsedJSON.MType == metrictypes.CounterType && resultParsedJSON.Delta != nil && resultParsedJSON.ID != "" {
-			if err := mh.reqRetrier.UseRetrierWM(mh.storage.WriteMetric)(mh.ctx, resultParsedJSON.MType, resultParsedJSON.ID, metrictypes.Counter(*resultParsedJSON.Delta)); err != nil {
+			if err := mh.reqRetrier.UseRetrierWM(mh.storage.WriteMetric)(mh.requestCtx(r), resultParsedJSON.MType, resultParsedJSON.SeriesID(), metrictypes.Counter(*resultParsedJSON.Delta)); err != nil {
 				log.Println(err)
 				http.Error(w, "can't store counter metric", http.StatusInternalServerError)
 				return
 			}
+		} else if resultParsedJSON.MType == metrictypes.HistogramType && resultParsedJSON.Histogram != nil && resultParsedJSON.ID != "" {
+			h := metrictypes.Histogram(*resultParsedJSON.Histogram)
+			if err := h.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := mh.reqRetrier.UseRetrierWM(mh.storage.WriteMetric)(mh.requestCtx(r), resultParsedJSON.MType, resultParsedJSON.SeriesID(), h.Clone()); err != nil {
+				log.Println(err)
+				if errors.Is(err, customerrors.ErrHistogramBounds) {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				http.Error(w, "can't store histogram metric", http.StatusInternalServerError)
+				return
+			}
 		} else {
 			http.Error(w, "bad metric type or no metric value or id is empty", http.StatusBadRequest)
 			return
@@ -217,7 +336,7 @@ func (mh *metricHandlers) getMetricsJSON() http.HandlerFunc {
 		}
 		enc := json.NewEncoder(w)
 
-		res, err := mh.reqRetrier.UseRetrierGetMetric(mh.storage.GetMetric)(mh.ctx, resultParsedJSON.MType, resultParsedJSON.ID)
+		res, err := mh.reqRetrier.UseRetrierGetMetric(mh.storage.GetMetric)(mh.requestCtx(r), resultParsedJSON.MType, resultParsedJSON.SeriesID())
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
@@ -228,6 +347,8 @@ func (mh *metricHandlers) getMetricsJSON() http.HandlerFunc {
 			resultParsedJSON.Value = (*float64)(&g)
 		} else if c, ok := res.(metrictypes.Counter); ok {
 			resultParsedJSON.Delta = (*int64)(&c)
+		} else if h, ok := res.(metrictypes.Histogram); ok {
+			resultParsedJSON.Histogram = h.Model()
 		} else {
 			http.Error(w, "bad metric type", http.StatusNotFound)
 			return
@@ -260,7 +381,7 @@ func (mh *metricHandlers) updateBatchMetricsJSON() http.HandlerFunc {
 		}
 		enc := json.NewEncoder(w)
 
-		if err := mh.reqRetrier.UseRetrierWMB(mh.storage.WriteBatchMetrics)(mh.ctx, batchMettricsJSON); err != nil {
+		if err := mh.reqRetrier.UseRetrierWMB(mh.storage.WriteBatchMetrics)(mh.requestCtx(r), batchMettricsJSON); err != nil {
 			log.Println(err)
 			http.Error(w, "error to store batch metrics", http.StatusInternalServerError)
 			return
@@ -335,19 +456,48 @@ func chiRouter(mh *metricHandlers, keyenc, privkeypath string, subnets []netip.P
 	// filter ip access
 	r.Use(mh.checkIP(subnets))
 
+	//ping
+	r.Get("/ping", logging.WriteLogging(compression.GzipCompDecomp(mh.dbPing())))
+
+	// all metric methods are scoped by tenant
+	r.Group(func(r chi.Router) {
+		r.Use(mh.tenantCheck())
+		tenantRoutes(r, mh, keyenc, privkeypath)
+	})
+
+	return r
+}
+
+// tenantRoutes register metric api methods.
+func tenantRoutes(r chi.Router, mh *metricHandlers, keyenc, privkeypath string) {
 	r.Post("/update/{type}/{name}/{value}", logging.WriteLogging(compression.GzipCompDecomp(cryptandsign.SignCheck(mh.crypt.AsymmetricDencryptData(mh.updateMetrics(), privkeypath), keyenc))))
 	r.Get("/value/{type}/{val}", logging.WriteLogging(compression.GzipCompDecomp(mh.getMetrics())))
+	r.Delete("/value/{type}/{val}", logging.WriteLogging(compression.GzipCompDecomp(cryptandsign.SignCheckRequest(mh.crypt.AsymmetricDencryptData(mh.deleteMetrics(), privkeypath), keyenc))))
 	r.Get("/", logging.WriteLogging(compression.GzipCompDecomp(mh.getAll())))
+	r.Get("/history/{type}/{name}", logging.WriteLogging(compression.GzipCompDecomp(mh.getHistory())))
+	r.Get("/query", logging.WriteLogging(compression.GzipCompDecomp(mh.getQuery())))
+	r.Get("/alerts", logging.WriteLogging(compression.GzipCompDecomp(mh.getAlerts())))
+	r.Get("/rules", logging.WriteLogging(compression.GzipCompDecomp(mh.getAlertRules())))
 
 	//json
 	r.Post("/update/", logging.WriteLogging(compression.GzipCompDecomp(cryptandsign.SignCheck(mh.crypt.AsymmetricDencryptData(mh.updateMetricsJSON(), privkeypath), keyenc))))
 	r.Post("/value/", logging.WriteLogging(compression.GzipCompDecomp(mh.getMetricsJSON())))
-	r.Post("/updates/", logging.WriteLogging(compression.GzipCompDecomp(cryptandsign.SignCheck(mh.crypt.AsymmetricDencryptData(mh.updateBatchMetricsJSON(), privkeypath), keyenc))))
-
-	//ping
-	r.Get("/ping", logging.WriteLogging(compression.GzipCompDecomp(mh.dbPing())))
-
-	return r
+	r.Post("/history/", logging.WriteLogging(compression.GzipCompDecomp(mh.getHistoryJSON())))
+	r.Post("/query/", logging.WriteLogging(compression.GzipCompDecomp(mh.getQueryJSON())))
+	r.Post("/updates/", logging.WriteLogging(compression.GzipCompDecomp(cryptandsign.SignCheck(mh.crypt.AsymmetricDencryptData(mh.idempotent(mh.updateBatchMetricsJSON()), privkeypath), keyenc))))
+	r.Post("/metadata/", logging.WriteLogging(compression.GzipCompDecomp(cryptandsign.SignCheck(mh.crypt.AsymmetricDencryptData(mh.updateMetadataJSON(), privkeypath), keyenc))))
+	r.Get("/metadata/", logging.WriteLogging(compression.GzipCompDecomp(mh.getMetadataJSON())))
+
+	// prometheus scrape and remote_write (snappy compressed, prometheus can't sign requests)
+	r.Get("/metrics", logging.WriteLogging(compression.GzipCompDecomp(mh.getPrometheusMetrics())))
+	r.Post("/api/v1/write", logging.WriteLogging(mh.remoteWrite()))
+
+	// influxdb v1/v2 line protocol (telegraf can't sign requests)
+	r.Post("/write", logging.WriteLogging(compression.GzipCompDecomp(mh.influxWrite())))
+	r.Post("/api/v2/write", logging.WriteLogging(compression.GzipCompDecomp(mh.influxWrite())))
+
+	// opentelemetry OTLP/HTTP metrics export (protobuf or json)
+	r.Post("/v1/metrics", logging.WriteLogging(compression.GzipCompDecomp(mh.otlpMetrics())))
 }
 
 // saveToFile function for periodic save in-memory storage metrics.
@@ -363,6 +513,26 @@ func saveToFile(m *storage.MemStorage, fname string, duration int) {
 	}
 }
 
+// restoreFromFile function for load saved in-memory storage metrics.
+func restoreFromFile(m *storage.MemStorage, fname string, tolerant bool) {
+	if !tolerant {
+		if err := m.ReadFromFile(fname); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	report, err := m.ReadFromFileTolerant(fname)
+	if err != nil {
+		log.Println(err)
+	}
+	for _, v := range report.Skipped {
+		log.Printf("restore: skip line %d of %s: %s", v.Line, fname, v.Err.Error())
+	}
+	if report.ChecksumMismatch {
+		log.Printf("restore: checksum mismatch of %s, restored %d metrics", fname, report.Restored)
+	}
+}
+
 // parse subnets
 func parseSubnetPrefixes(subnets string) ([]netip.Prefix, error) {
 	var prefixes []netip.Prefix
@@ -398,8 +568,9 @@ func Run(ctx context.Context, config ConfigArgs) {
 	// main context timeout (default 30 sec)
 	reqRetrier.SetParams(1*time.Second, 30*time.Second, 3)
 
-	// select db engine as metric storage (postgres or in-memory)
-	if config.DatabaseDsn != "" {
+	// select db engine as metric storage (postgres, disk or in-memory)
+	switch {
+	case config.DatabaseDsn != "":
 		pgdb, err := storage.NewPgDB(config.DatabaseDsn, nil)
 		if err != nil {
 			log.Fatal(err)
@@ -411,20 +582,42 @@ func Run(ctx context.Context, config ConfigArgs) {
 		}
 
 		store = pgdb
-	} else {
+	case config.DataDir != "":
+		disk, err := storage.OpenDiskStorage(config.DataDir, config.WALFsync)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer disk.Close()
+
+		store = disk
+	default:
 		m := storage.NewMemStorage()
 
-		if config.Restore {
-			if err := m.ReadFromFile(config.FileStoragePath); err != nil {
-				log.Println(err)
+		// write-ahead log keeps writes between snapshots
+		if config.WALFile != "" {
+			if err := m.EnableWAL(config.WALFile, config.WALFsync); err != nil {
+				log.Fatal(err)
+			}
+			// saved data is not restored, so logged writes are dropped too
+			if !config.Restore {
+				if err := m.TruncateWAL(); err != nil {
+					log.Fatal(err)
+				}
 			}
 		}
 
+		if config.Restore {
+			restoreFromFile(m, config.FileStoragePath, config.RestoreTolerant)
+		}
+
 		// save metrics result on shutdown (in-memory storage)
 		g.Go(func() error {
 			<-ctx.Done()
 			fmt.Println("Saving file")
 			saveToFile(m, config.FileStoragePath, 0)
+			if err := m.CloseWAL(); err != nil {
+				log.Println(err)
+			}
 			fmt.Println("Exiting...")
 			return nil
 		})
@@ -435,12 +628,47 @@ func Run(ctx context.Context, config ConfigArgs) {
 		store = m
 	}
 
+	// history retention policy
+	retention, err := storage.ParseRetention(config.Retention)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(retention) > 0 {
+		go compactHistory(ctx, store, retention, compactInterval)
+	}
+
+	// tenants auth and limits
+	tenants, err := parseTenants(config.Tenants)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// init metric handlers
 	mh := &metricHandlers{
-		ctx:        ctx,
-		storage:    store,
-		reqRetrier: reqRetrier,
-		crypt:      cryptandsign.NewAsymmetricCryptRsa(),
+		ctx:         ctx,
+		storage:     store,
+		reqRetrier:  reqRetrier,
+		crypt:       cryptandsign.NewAsymmetricCryptRsa(),
+		retention:   retention,
+		tenants:     tenants,
+		idempotency: newIdempotencyCache(config.IdempotencyWindow),
+	}
+
+	// alert rules evaluator
+	if config.AlertRulesFile != "" {
+		rules, receivers, err := loadAlertRules(config.AlertRulesFile, tenants)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mh.alerts = newAlertManager(mh, rules, receivers)
+		interval := time.Duration(config.AlertEvalInterval) * time.Second
+		if interval <= 0 {
+			interval = defaultAlertEvalInterval
+		}
+		g.Go(func() error {
+			logging.Log.Info("Starting alert rules evaluator", zap.String("rules_file", config.AlertRulesFile), zap.Int("rules", len(rules)), zap.Int("receivers", len(receivers)))
+			return mh.alerts.run(ctx, interval)
+		})
 	}
 
 	// parse net prefixes
@@ -462,6 +690,28 @@ func Run(ctx context.Context, config ConfigArgs) {
 		})
 	}
 
+	// statsd listener
+	if config.StatsdAddr != "" {
+		if err := tenants.checkTenant(config.StatsdTenant); err != nil {
+			log.Fatalf("statsd listener: %v", err)
+		}
+		g.Go(func() error {
+			logging.Log.Info("Starting statsd listener on", zap.String("address", config.StatsdAddr), zap.String("tenant", config.StatsdTenant))
+			return ListenStatsd(config.StatsdAddr, time.Duration(config.StatsdFlushInterval)*time.Second, config.StatsdTenant, subnets, mh)
+		})
+	}
+
+	// graphite receiver
+	if config.GraphiteAddr != "" || config.GraphitePickleAddr != "" {
+		if err := tenants.checkTenant(config.GraphiteTenant); err != nil {
+			log.Fatalf("graphite receiver: %v", err)
+		}
+		g.Go(func() error {
+			logging.Log.Info("Starting graphite receiver on", zap.String("address", config.GraphiteAddr), zap.String("pickle_address", config.GraphitePickleAddr), zap.String("tenant", config.GraphiteTenant))
+			return ListenGraphite(config.GraphiteAddr, config.GraphitePickleAddr, config.GraphiteTenant, subnets, mh)
+		})
+	}
+
 	// starting http server
 	g.Go(func() error {
 		logging.Log.Info("Starting server on", zap.String("address", config.ServerAddr))
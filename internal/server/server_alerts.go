@@ -0,0 +1,509 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/query"
+	"github.com/sourcecd/monitoring/internal/storage"
+)
+
+// Default interval of alert rules evaluation.
+const defaultAlertEvalInterval = 15 * time.Second
+
+// Time of keeping resolved alerts in state (and in alerts list).
+const resolvedAlertRetention = 15 * time.Minute
+
+// Label with name of rule in alert labels.
+const alertNameLabel = "alertname"
+
+// Label with metric name of alert series (instant selector results keep metric name).
+const alertMetricLabel = "metric"
+
+// Allowed operators of threshold rules.
+var thresholdOps = map[string]struct{}{">": {}, ">=": {}, "<": {}, "<=": {}, "==": {}, "!=": {}}
+
+// Priority of alert states for rule state (the most important alert state is rule state).
+var alertStatePriority = map[string]int{
+	models.AlertInactive: 0,
+	models.AlertResolved: 1,
+	models.AlertPending:  2,
+	models.AlertFiring:   3,
+}
+
+// alertRulesConfig type of alert rules config file (json).
+type alertRulesConfig struct {
+	Rules     []alertRuleConfig     `json:"rules"`     // alert rules
+	Receivers []alertReceiverConfig `json:"receivers"` // webhook receivers of alert notifications
+}
+
+// alertRuleConfig type of alert rule in config file.
+// Rule condition is query expression or threshold of metric (metric op threshold).
+type alertRuleConfig struct {
+	Threshold   *float64          `json:"threshold,omitempty"`   // threshold of metric value
+	Labels      models.Labels     `json:"labels,omitempty"`      // labels added to alerts
+	Annotations map[string]string `json:"annotations,omitempty"` // annotation templates ({{ .Labels.host }}, {{ .Value }})
+	Name        string            `json:"name"`                  // rule name (unique of tenant)
+	Tenant      string            `json:"tenant,omitempty"`      // tenant of evaluated metrics (empty - default tenant, registered tenant is required, when tenants are set)
+	Expr        string            `json:"expr,omitempty"`        // query expression, series of result are alerts
+	Metric      string            `json:"metric,omitempty"`      // metric selector of threshold rule
+	Op          string            `json:"op,omitempty"`          // comparison operator of threshold rule (default >)
+	For         string            `json:"for,omitempty"`         // duration of active series before alert is firing (empty - fire at once)
+}
+
+// alertRule type of loaded alert rule with its alerts state.
+type alertRule struct {
+	cfg         alertRuleConfig               // rule config
+	query       *query.Query                  // parsed rule expression
+	annotations map[string]*template.Template // parsed annotation templates
+	forDuration time.Duration                 // duration of active series before alert is firing
+	alerts      map[string]*models.Alert      // alerts by labels
+	lastEval    time.Time                     // time of last evaluation
+	lastError   error                         // error of last evaluation
+}
+
+// alertTemplateData data of annotation templates.
+type alertTemplateData struct {
+	Labels models.Labels // alert labels
+	Value  float64       // alert series value
+}
+
+// newAlertRule parse and check rule config (tenant of rule must be registered, when tenants are set).
+func newAlertRule(cfg alertRuleConfig, tenants *tenantRegistry) (*alertRule, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("%w: empty rule name", customerrors.ErrWrongAlertRule)
+	}
+	if err := tenants.checkTenant(cfg.Tenant); err != nil {
+		return nil, fmt.Errorf("%w: rule %s: %w", customerrors.ErrWrongAlertRule, cfg.Name, err)
+	}
+	switch {
+	case cfg.Expr != "" && (cfg.Metric != "" || cfg.Threshold != nil):
+		return nil, fmt.Errorf("%w: rule %s: expr and threshold are both specified", customerrors.ErrWrongAlertRule, cfg.Name)
+	case cfg.Expr == "" && (cfg.Metric == "" || cfg.Threshold == nil):
+		return nil, fmt.Errorf("%w: rule %s: expr or metric with threshold expected", customerrors.ErrWrongAlertRule, cfg.Name)
+	case cfg.Expr == "":
+		if cfg.Op == "" {
+			cfg.Op = ">"
+		}
+		if _, ok := thresholdOps[cfg.Op]; !ok {
+			return nil, fmt.Errorf("%w: rule %s: wrong threshold operator: %s", customerrors.ErrWrongAlertRule, cfg.Name, cfg.Op)
+		}
+		cfg.Expr = fmt.Sprintf("%s %s %s", cfg.Metric, cfg.Op, strconv.FormatFloat(*cfg.Threshold, 'g', -1, 64))
+	}
+	q, err := query.Parse(cfg.Expr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: rule %s: %w", customerrors.ErrWrongAlertRule, cfg.Name, err)
+	}
+	rule := &alertRule{
+		cfg:         cfg,
+		query:       q,
+		annotations: make(map[string]*template.Template, len(cfg.Annotations)),
+		alerts:      make(map[string]*models.Alert),
+	}
+	if cfg.For != "" {
+		rule.forDuration, err = time.ParseDuration(cfg.For)
+		if err != nil || rule.forDuration < 0 {
+			return nil, fmt.Errorf("%w: rule %s: wrong for duration: %s", customerrors.ErrWrongAlertRule, cfg.Name, cfg.For)
+		}
+	}
+	for k, v := range cfg.Annotations {
+		rule.annotations[k], err = template.New(k).Option("missingkey=zero").Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("%w: rule %s: annotation %s: %w", customerrors.ErrWrongAlertRule, cfg.Name, k, err)
+		}
+	}
+	return rule, nil
+}
+
+// parseAlertRules parse alert rules config (json) with rules and webhook receivers of tenants (nil - any tenant).
+func parseAlertRules(data []byte, tenants *tenantRegistry) ([]*alertRule, []*alertReceiver, error) {
+	var cfg alertRulesConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", customerrors.ErrWrongAlertRule, err)
+	}
+	rules := make([]*alertRule, 0, len(cfg.Rules))
+	names := make(map[string]struct{}, len(cfg.Rules))
+	for _, v := range cfg.Rules {
+		rule, err := newAlertRule(v, tenants)
+		if err != nil {
+			return nil, nil, err
+		}
+		key := v.Tenant + "/" + v.Name
+		if _, ok := names[key]; ok {
+			return nil, nil, fmt.Errorf("%w: duplicate rule name: %s", customerrors.ErrWrongAlertRule, v.Name)
+		}
+		names[key] = struct{}{}
+		rules = append(rules, rule)
+	}
+	receivers := make([]*alertReceiver, 0, len(cfg.Receivers))
+	names = make(map[string]struct{}, len(cfg.Receivers))
+	for _, v := range cfg.Receivers {
+		rcv, err := newAlertReceiver(v, tenants)
+		if err != nil {
+			return nil, nil, err
+		}
+		key := v.Tenant + "/" + v.Name
+		if _, ok := names[key]; ok {
+			return nil, nil, fmt.Errorf("%w: duplicate receiver name: %s", customerrors.ErrWrongAlertRule, v.Name)
+		}
+		names[key] = struct{}{}
+		receivers = append(receivers, rcv)
+	}
+	return rules, receivers, nil
+}
+
+// loadAlertRules load alert rules and webhook receivers of tenants from config file.
+func loadAlertRules(fname string, tenants *tenantRegistry) ([]*alertRule, []*alertReceiver, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseAlertRules(data, tenants)
+}
+
+// alertLabels labels of alert: series labels, rule labels and rule name.
+func (rule *alertRule) alertLabels(s query.Series) models.Labels {
+	labels := make(models.Labels, len(s.Labels)+len(rule.cfg.Labels)+2)
+	for k, v := range s.Labels {
+		labels[k] = v
+	}
+	if s.ID != "" {
+		labels[alertMetricLabel] = s.ID
+	}
+	for k, v := range rule.cfg.Labels {
+		labels[k] = v
+	}
+	labels[alertNameLabel] = rule.cfg.Name
+	return labels
+}
+
+// renderAnnotations render annotation templates of alert (failed template is kept as is).
+func (rule *alertRule) renderAnnotations(labels models.Labels, value float64) map[string]string {
+	if len(rule.annotations) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(rule.annotations))
+	for k, tmpl := range rule.annotations {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, alertTemplateData{Labels: labels, Value: value}); err != nil {
+			res[k] = rule.cfg.Annotations[k]
+			continue
+		}
+		res[k] = buf.String()
+	}
+	return res
+}
+
+// update apply evaluated series to alerts state, true if state is changed.
+// New series is pending, pending series is firing after for duration,
+// firing series without value is resolved and dropped after retention.
+func (rule *alertRule) update(vec query.Vector, now time.Time) bool {
+	changed := false
+	active := make(map[string]struct{}, len(vec))
+	for _, s := range vec {
+		labels := rule.alertLabels(s)
+		key := labels.String()
+		active[key] = struct{}{}
+		a, ok := rule.alerts[key]
+		if !ok || a.State == models.AlertResolved {
+			a = &models.Alert{ActiveAt: now, Labels: labels, Rule: rule.cfg.Name, State: models.AlertPending}
+			rule.alerts[key] = a
+			changed = true
+		}
+		a.Value = models.QueryValue(s.Value)
+		a.Annotations = rule.renderAnnotations(labels, s.Value)
+		if a.State == models.AlertPending && now.Sub(a.ActiveAt) >= rule.forDuration {
+			firedAt := now
+			a.State, a.FiredAt = models.AlertFiring, &firedAt
+			changed = true
+		}
+	}
+	for key, a := range rule.alerts {
+		if _, ok := active[key]; ok {
+			continue
+		}
+		// selecting alert state
+		switch a.State {
+		case models.AlertPending:
+			delete(rule.alerts, key)
+			changed = true
+		case models.AlertFiring:
+			resolvedAt := now
+			a.State, a.ResolvedAt = models.AlertResolved, &resolvedAt
+			changed = true
+		case models.AlertResolved:
+			if a.ResolvedAt == nil || now.Sub(*a.ResolvedAt) >= resolvedAlertRetention {
+				delete(rule.alerts, key)
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// sortedAlerts alerts of rule sorted by labels, optionally filtered by state.
+func (rule *alertRule) sortedAlerts(state string) []models.Alert {
+	keys := make([]string, 0, len(rule.alerts))
+	for k, a := range rule.alerts {
+		if state == "" || a.State == state {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	res := make([]models.Alert, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, *rule.alerts[k])
+	}
+	return res
+}
+
+// status rule status with its alerts.
+func (rule *alertRule) status() models.AlertRule {
+	st := models.AlertRule{
+		LastEvaluation: rule.lastEval,
+		Labels:         rule.cfg.Labels,
+		Annotations:    rule.cfg.Annotations,
+		Name:           rule.cfg.Name,
+		Query:          rule.query.String(),
+		For:            rule.cfg.For,
+		State:          models.AlertInactive,
+		Alerts:         rule.sortedAlerts(""),
+	}
+	if rule.lastError != nil {
+		st.LastError = rule.lastError.Error()
+	}
+	for _, a := range st.Alerts {
+		if alertStatePriority[a.State] > alertStatePriority[st.State] {
+			st.State = a.State
+		}
+	}
+	return st
+}
+
+// alertManager periodic evaluator of alert rules, alerts state is saved in storage.
+// Changed alerts are sent to webhook receivers after evaluation (in background).
+type alertManager struct {
+	mu        sync.Mutex       // guards rules state and dirty tenants
+	saveMu    sync.Mutex       // serializes saves of alerts state
+	mh        *metricHandlers  // handlers with storage of metrics and alerts state
+	rules     []*alertRule     // alert rules in config order
+	receivers []*alertReceiver // webhook receivers (state is owned by holder of sending)
+	client    *resty.Client    // http client of webhook receivers
+	now       func() time.Time // clock
+	sending   chan struct{}    // held while notifications are sent
+	restored  map[string]bool  // tenants with restored alerts state (evaluator only)
+	dirty     map[string]bool  // tenants with unsaved alerts state
+}
+
+// newAlertManager init alert manager of rules and webhook receivers.
+func newAlertManager(mh *metricHandlers, rules []*alertRule, receivers []*alertReceiver) *alertManager {
+	return &alertManager{
+		mh:        mh,
+		rules:     rules,
+		receivers: receivers,
+		client:    resty.New().SetTimeout(webhookRequestTimeout),
+		now:       time.Now,
+		sending:   make(chan struct{}, 1),
+		restored:  make(map[string]bool),
+		dirty:     make(map[string]bool),
+	}
+}
+
+// tenants sorted tenants of rules.
+func (am *alertManager) tenants() []string {
+	set := make(map[string]struct{})
+	for _, rule := range am.rules {
+		set[rule.cfg.Tenant] = struct{}{}
+	}
+	res := make([]string, 0, len(set))
+	for k := range set {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// run evaluate rules every interval until context is done.
+func (am *alertManager) run(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		am.evalRules(ctx)
+		select {
+		case <-ctx.Done():
+			am.waitNotifications()
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// evalRules evaluate all rules, save changed alerts state and start notifications of restored tenants.
+// Rules of tenant are not evaluated, until saved state of tenant is restored.
+func (am *alertManager) evalRules(ctx context.Context) {
+	now := am.now()
+	var tenants []string
+	for _, tenant := range am.tenants() {
+		tctx := storage.WithTenant(ctx, tenant)
+		if !am.restored[tenant] {
+			if err := am.restore(tctx, tenant); err != nil {
+				log.Println(err)
+				continue
+			}
+		}
+		for _, rule := range am.rules {
+			if rule.cfg.Tenant == tenant {
+				am.evalRule(tctx, rule, now)
+			}
+		}
+		if err := am.save(tctx, tenant); err != nil {
+			log.Println(err)
+		}
+		tenants = append(tenants, tenant)
+	}
+	am.notify(ctx, tenants, now)
+}
+
+// evalRule evaluate rule expression and update alerts of rule (on error state is kept).
+func (am *alertManager) evalRule(ctx context.Context, rule *alertRule, now time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, am.mh.reqRetrier.GetTimeoutCtx())
+	res, err := rule.query.Eval(ctx, querySource{mh: am.mh}, now)
+	cancel()
+	vec, ok := res.(query.Vector)
+	if err == nil && !ok {
+		err = fmt.Errorf("%w: result of rule %s is %s, expected vector", customerrors.ErrBadQuery, rule.cfg.Name, res.Type())
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	rule.lastEval, rule.lastError = now, err
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if rule.update(vec, now) {
+		am.dirty[rule.cfg.Tenant] = true
+	}
+}
+
+// restore load saved alerts state of tenant, alerts of unknown rules are dropped.
+// Notified groups of tenant receivers are restored from notification times of alerts.
+func (am *alertManager) restore(ctx context.Context, tenant string) error {
+	alerts, err := am.mh.reqRetrier.UseRetrierGetAlerts(am.mh.storage.GetAlerts)(ctx)
+	if err != nil {
+		return err
+	}
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	for i := range alerts {
+		for _, rule := range am.rules {
+			if rule.cfg.Tenant == tenant && rule.cfg.Name == alerts[i].Rule {
+				rule.alerts[alerts[i].Labels.String()] = &alerts[i]
+			}
+		}
+	}
+	// receivers of not restored tenant aren't notified, so their groups aren't sent
+	for _, rcv := range am.receivers {
+		if rcv.cfg.Tenant == tenant {
+			rcv.restoreGroups(alerts)
+		}
+	}
+	am.restored[tenant] = true
+	return nil
+}
+
+// save write alerts state of tenant to storage, if it is changed since last save.
+func (am *alertManager) save(ctx context.Context, tenant string) error {
+	am.saveMu.Lock()
+	defer am.saveMu.Unlock()
+	am.mu.Lock()
+	dirty := am.dirty[tenant]
+	am.dirty[tenant] = false
+	am.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	alerts := am.alerts(tenant, "")
+	if err := am.mh.reqRetrier.UseRetrierWriteAlerts(am.mh.storage.WriteAlerts)(ctx, alerts); err != nil {
+		am.mu.Lock()
+		am.dirty[tenant] = true
+		am.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// alerts alerts of tenant rules, optionally filtered by state.
+func (am *alertManager) alerts(tenant, state string) []models.Alert {
+	res := []models.Alert{}
+	if am == nil {
+		return res
+	}
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	for _, rule := range am.rules {
+		if rule.cfg.Tenant == tenant {
+			res = append(res, rule.sortedAlerts(state)...)
+		}
+	}
+	return res
+}
+
+// ruleStatuses statuses of tenant rules.
+func (am *alertManager) ruleStatuses(tenant string) []models.AlertRule {
+	res := []models.AlertRule{}
+	if am == nil {
+		return res
+	}
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	for _, rule := range am.rules {
+		if rule.cfg.Tenant == tenant {
+			res = append(res, rule.status())
+		}
+	}
+	return res
+}
+
+// writeJSON write json response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, "can't encode json", http.StatusInternalServerError)
+		return
+	}
+}
+
+// getAlerts api method for list current alerts of tenant (optional state url parameter).
+func (mh *metricHandlers) getAlerts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state := r.URL.Query().Get("state")
+		if _, ok := alertStatePriority[state]; state != "" && (!ok || state == models.AlertInactive) {
+			http.Error(w, fmt.Sprintf("wrong alert state: %s", state), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, mh.alerts.alerts(storage.TenantFromContext(r.Context()), state))
+	}
+}
+
+// getAlertRules api method for list alert rules of tenant with their state.
+func (mh *metricHandlers) getAlertRules() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, mh.alerts.ruleStatuses(storage.TenantFromContext(r.Context())))
+	}
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/cryptandsign"
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/retrier"
+	"github.com/sourcecd/monitoring/internal/storage"
+	"github.com/sourcecd/monitoring/mocks"
+)
+
+const testAlertRules = `{"rules": [
+	{
+		"name": "HighLoad",
+		"metric": "load",
+		"threshold": 1,
+		"for": "1m",
+		"labels": {"severity": "page"},
+		"annotations": {"summary": "{{ .Labels.host }} load is {{ .Value }}"}
+	},
+	{"name": "LowMemory", "expr": "FreeMemory / TotalMemory * 100 < 10"},
+	{"name": "HighLoad", "tenant": "teamA", "metric": "load", "op": ">=", "threshold": 5}
+], "receivers": [
+	{"name": "ops", "url": "http://localhost:9093/hook", "group_by": ["alertname"], "repeat_interval": "1h"},
+	{"name": "ops", "tenant": "teamA", "url": "https://localhost/hook", "send_resolved": false, "template": "{{ .Status }}", "content_type": "text/plain"}
+]}`
+
+func TestParseAlertRules(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(fname, []byte(testAlertRules), 0o600))
+	rules, receivers, err := loadAlertRules(fname, nil)
+	require.NoError(t, err)
+	require.Len(t, rules, 3)
+	require.Equal(t, "load > 1", rules[0].query.String())
+	require.Equal(t, time.Minute, rules[0].forDuration)
+	require.Equal(t, "FreeMemory / TotalMemory * 100 < 10", rules[1].query.String())
+	require.Equal(t, "load >= 5", rules[2].query.String())
+	require.Equal(t, "teamA", rules[2].cfg.Tenant)
+	require.Len(t, receivers, 2)
+	require.Equal(t, time.Hour, receivers[0].repeatInterval)
+	require.True(t, receivers[0].sendResolved)
+	require.Nil(t, receivers[0].body)
+	require.Equal(t, defaultWebhookContentType, receivers[0].cfg.ContentType)
+	require.Equal(t, defaultRepeatInterval, receivers[1].repeatInterval)
+	require.False(t, receivers[1].sendResolved)
+	require.NotNil(t, receivers[1].body)
+
+	_, _, err = loadAlertRules(filepath.Join(t.TempDir(), "missing.json"), nil)
+	require.Error(t, err)
+
+	// with tenants rules and receivers of default or unknown tenant are rejected
+	tenants, err := parseTenants("teamA:tokenA")
+	require.NoError(t, err)
+	for _, cfg := range []string{
+		testAlertRules,
+		`{"rules": [{"name": "a", "expr": "load > 1", "tenant": "teamB"}]}`,
+		`{"receivers": [{"name": "a", "url": "http://localhost/hook"}]}`,
+	} {
+		_, _, err = parseAlertRules([]byte(cfg), tenants)
+		require.ErrorIs(t, err, customerrors.ErrWrongAlertRule, cfg)
+	}
+	rules, receivers, err = parseAlertRules([]byte(`{
+		"rules": [{"name": "a", "expr": "load > 1", "tenant": "teamA"}],
+		"receivers": [{"name": "a", "url": "http://localhost/hook", "tenant": "teamA"}]}`), tenants)
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	require.Len(t, receivers, 1)
+
+	testCases := []struct {
+		name string
+		cfg  string
+	}{
+		{name: "json", cfg: `{"rules": [`},
+		{name: "no_name", cfg: `{"rules": [{"expr": "load > 1"}]}`},
+		{name: "no_condition", cfg: `{"rules": [{"name": "a"}]}`},
+		{name: "no_threshold", cfg: `{"rules": [{"name": "a", "metric": "load"}]}`},
+		{name: "expr_and_threshold", cfg: `{"rules": [{"name": "a", "expr": "load > 1", "metric": "load", "threshold": 1}]}`},
+		{name: "wrong_op", cfg: `{"rules": [{"name": "a", "metric": "load", "op": "+", "threshold": 1}]}`},
+		{name: "wrong_expr", cfg: `{"rules": [{"name": "a", "expr": "load >"}]}`},
+		{name: "wrong_for", cfg: `{"rules": [{"name": "a", "expr": "load > 1", "for": "5"}]}`},
+		{name: "negative_for", cfg: `{"rules": [{"name": "a", "expr": "load > 1", "for": "-1m"}]}`},
+		{name: "wrong_template", cfg: `{"rules": [{"name": "a", "expr": "load > 1", "annotations": {"summary": "{{ .Value"}}]}`},
+		{name: "wrong_tenant", cfg: `{"rules": [{"name": "a", "expr": "load > 1", "tenant": "team A"}]}`},
+		{name: "duplicate", cfg: `{"rules": [{"name": "a", "expr": "load > 1"}, {"name": "a", "expr": "load > 2"}]}`},
+		{name: "receiver_no_name", cfg: `{"receivers": [{"url": "http://localhost/hook"}]}`},
+		{name: "receiver_wrong_url", cfg: `{"receivers": [{"name": "a", "url": "localhost/hook"}]}`},
+		{name: "receiver_wrong_repeat", cfg: `{"receivers": [{"name": "a", "url": "http://localhost/hook", "repeat_interval": "0s"}]}`},
+		{name: "receiver_wrong_template", cfg: `{"receivers": [{"name": "a", "url": "http://localhost/hook", "template": "{{ .Status"}]}`},
+		{name: "receiver_wrong_tenant", cfg: `{"receivers": [{"name": "a", "url": "http://localhost/hook", "tenant": "team A"}]}`},
+		{name: "receiver_duplicate", cfg: `{"receivers": [{"name": "a", "url": "http://localhost/a"}, {"name": "a", "url": "http://localhost/b"}]}`},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := parseAlertRules([]byte(tt.cfg), nil)
+			require.ErrorIs(t, err, customerrors.ErrWrongAlertRule)
+		})
+	}
+}
+
+func TestAlertManager(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	testStorage := storage.NewMemStorage()
+	mh := &metricHandlers{ctx: ctx, storage: testStorage, reqRetrier: retrier.NewRetrier()}
+	rules, _, err := parseAlertRules([]byte(testAlertRules), nil)
+	require.NoError(t, err)
+	am := newAlertManager(mh, rules, nil)
+	now := time.Unix(1700000000, 0)
+	am.now = func() time.Time { return now }
+
+	require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.GaugeType, `load{host="a"}`, metrictypes.Gauge(2)))
+	require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.GaugeType, `load{host="b"}`, metrictypes.Gauge(0.5)))
+
+	// new series is pending
+	am.evalRules(ctx)
+	alerts := am.alerts("", "")
+	require.Len(t, alerts, 1)
+	require.Equal(t, models.AlertPending, alerts[0].State)
+	require.Equal(t, models.Labels{"host": "a", "metric": "load", "severity": "page", "alertname": "HighLoad"}, alerts[0].Labels)
+	require.Equal(t, map[string]string{"summary": "a load is 2"}, alerts[0].Annotations)
+	require.Equal(t, now, alerts[0].ActiveAt)
+	require.Nil(t, alerts[0].FiredAt)
+
+	// pending state is saved, so for duration continues after restart
+	saved, err := testStorage.GetAlerts(ctx)
+	require.NoError(t, err)
+	require.Equal(t, alerts, saved)
+	rules, _, err = parseAlertRules([]byte(testAlertRules), nil)
+	require.NoError(t, err)
+	am = newAlertManager(mh, rules, nil)
+	am.now = func() time.Time { return now }
+
+	// firing after for duration
+	now = now.Add(time.Minute)
+	require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.GaugeType, `load{host="a"}`, metrictypes.Gauge(3)))
+	am.evalRules(ctx)
+	alerts = am.alerts("", models.AlertFiring)
+	require.Len(t, alerts, 1)
+	require.Equal(t, now.Add(-time.Minute), alerts[0].ActiveAt)
+	require.Equal(t, now, *alerts[0].FiredAt)
+	require.Equal(t, models.QueryValue(3), alerts[0].Value)
+	require.Equal(t, map[string]string{"summary": "a load is 3"}, alerts[0].Annotations)
+	st := am.ruleStatuses("")
+	require.Len(t, st, 2)
+	require.Equal(t, models.AlertFiring, st[0].State)
+	require.Equal(t, models.AlertInactive, st[1].State)
+	require.Empty(t, st[1].Alerts)
+	require.Equal(t, now, st[1].LastEvaluation)
+	require.Empty(t, st[1].LastError)
+
+	// other tenant is evaluated on its own metrics
+	require.Empty(t, am.alerts("teamA", ""))
+	require.NoError(t, testStorage.WriteMetric(storage.WithTenant(ctx, "teamA"), metrictypes.GaugeType, "load", metrictypes.Gauge(5)))
+	am.evalRules(ctx)
+	require.Len(t, am.alerts("teamA", models.AlertFiring), 1)
+	require.Len(t, am.alerts("", ""), 1)
+
+	// firing series without value is resolved
+	now = now.Add(time.Minute)
+	require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.GaugeType, `load{host="a"}`, metrictypes.Gauge(1)))
+	am.evalRules(ctx)
+	alerts = am.alerts("", "")
+	require.Len(t, alerts, 1)
+	require.Equal(t, models.AlertResolved, alerts[0].State)
+	require.Equal(t, now, *alerts[0].ResolvedAt)
+	require.Equal(t, models.AlertResolved, am.ruleStatuses("")[0].State)
+	saved, err = testStorage.GetAlerts(ctx)
+	require.NoError(t, err)
+	require.Equal(t, alerts, saved)
+
+	// resolved series, which is active again, is pending
+	require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.GaugeType, `load{host="a"}`, metrictypes.Gauge(2)))
+	am.evalRules(ctx)
+	alerts = am.alerts("", "")
+	require.Len(t, alerts, 1)
+	require.Equal(t, models.AlertPending, alerts[0].State)
+	require.Nil(t, alerts[0].ResolvedAt)
+
+	// pending series without value is dropped
+	require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.GaugeType, `load{host="a"}`, metrictypes.Gauge(0)))
+	am.evalRules(ctx)
+	require.Empty(t, am.alerts("", ""))
+
+	// resolved alert is dropped after retention
+	am.evalRules(ctx)
+	require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.GaugeType, `load{host="a"}`, metrictypes.Gauge(2)))
+	now = now.Add(time.Minute)
+	am.evalRules(ctx)
+	now = now.Add(time.Minute)
+	am.evalRules(ctx)
+	require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.GaugeType, `load{host="a"}`, metrictypes.Gauge(0)))
+	am.evalRules(ctx)
+	require.Len(t, am.alerts("", models.AlertResolved), 1)
+	now = now.Add(resolvedAlertRetention)
+	am.evalRules(ctx)
+	require.Empty(t, am.alerts("", ""))
+	saved, err = testStorage.GetAlerts(ctx)
+	require.NoError(t, err)
+	require.Empty(t, saved)
+}
+
+func TestAlertManagerErrors(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	mDB := mocks.NewMockStoreMetrics(ctrl)
+	reqRetrier := retrier.NewRetrier()
+	reqRetrier.SetParams(time.Millisecond, time.Second, 0)
+	mh := &metricHandlers{ctx: ctx, storage: mDB, reqRetrier: reqRetrier}
+	rules, _, err := parseAlertRules([]byte(`{"rules": [{"name": "a", "expr": "load > 1"}, {"name": "b", "expr": "1 + 1"}]}`), nil)
+	require.NoError(t, err)
+	am := newAlertManager(mh, rules, nil)
+
+	load := 2.0
+	scan := func(_ context.Context, fn func(m models.Metrics) error) error {
+		return fn(models.Metrics{ID: "load", MType: metrictypes.GaugeType, Value: &load})
+	}
+	saved := []models.Alert{{Rule: "a", State: models.AlertFiring, Labels: models.Labels{"metric": "load", "alertname": "a"}}}
+	gomock.InOrder(
+		// rules are not evaluated, until state is restored
+		mDB.EXPECT().GetAlerts(gomock.Any()).Return(nil, errors.New("connection refused")),
+		mDB.EXPECT().GetAlerts(gomock.Any()).Return(append(saved, models.Alert{Rule: "unknown"}), nil),
+		mDB.EXPECT().ScanMetrics(gomock.Any(), gomock.Any()).DoAndReturn(scan),
+		// failed evaluation keeps state
+		mDB.EXPECT().ScanMetrics(gomock.Any(), gomock.Any()).Return(errors.New("connection refused")),
+		// unsaved state is saved at next evaluation
+		mDB.EXPECT().ScanMetrics(gomock.Any(), gomock.Any()).Return(nil),
+		mDB.EXPECT().WriteAlerts(gomock.Any(), gomock.Any()).Return(errors.New("connection refused")),
+		mDB.EXPECT().ScanMetrics(gomock.Any(), gomock.Any()).Return(nil),
+		mDB.EXPECT().WriteAlerts(gomock.Any(), gomock.Any()).Return(nil),
+	)
+
+	am.evalRules(ctx)
+	require.Empty(t, am.alerts("", ""))
+	am.evalRules(ctx)
+	require.Len(t, am.alerts("", models.AlertFiring), 1)
+	am.evalRules(ctx)
+	require.Len(t, am.alerts("", models.AlertFiring), 1)
+	st := am.ruleStatuses("")
+	require.Contains(t, st[0].LastError, "connection refused")
+	require.ErrorIs(t, rules[1].lastError, customerrors.ErrBadQuery)
+	am.evalRules(ctx)
+	require.Len(t, am.alerts("", models.AlertResolved), 1)
+	require.True(t, am.dirty[""])
+	am.evalRules(ctx)
+	require.False(t, am.dirty[""])
+}
+
+func TestAlertHandlers(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	testStorage := storage.NewMemStorage()
+	mh := &metricHandlers{
+		ctx:        ctx,
+		storage:    testStorage,
+		reqRetrier: retrier.NewRetrier(),
+		crypt:      cryptandsign.NewAsymmetricCryptRsa(),
+	}
+	ts := httptest.NewServer(chiRouter(mh, "", "", nil))
+	t.Cleanup(func() { ts.Close() })
+
+	get := func(path string, v any) int {
+		resp, err := ts.Client().Get(ts.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+		}
+		return resp.StatusCode
+	}
+
+	// alerting is disabled
+	var alerts []models.Alert
+	require.Equal(t, http.StatusOK, get("/alerts", &alerts))
+	require.Equal(t, []models.Alert{}, alerts)
+
+	rules, _, err := parseAlertRules([]byte(testAlertRules), nil)
+	require.NoError(t, err)
+	mh.alerts = newAlertManager(mh, rules, nil)
+	require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.GaugeType, `load{host="a"}`, metrictypes.Gauge(2)))
+	require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.GaugeType, "FreeMemory", metrictypes.Gauge(10)))
+	require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.GaugeType, "TotalMemory", metrictypes.Gauge(1000)))
+	mh.alerts.evalRules(ctx)
+
+	require.Equal(t, http.StatusOK, get("/alerts", &alerts))
+	require.Len(t, alerts, 2)
+	require.Equal(t, "HighLoad", alerts[0].Rule)
+	require.Equal(t, models.AlertPending, alerts[0].State)
+	require.Equal(t, models.Labels{"alertname": "LowMemory"}, alerts[1].Labels)
+	require.Equal(t, models.QueryValue(1), alerts[1].Value)
+
+	require.Equal(t, http.StatusOK, get("/alerts?state=firing", &alerts))
+	require.Len(t, alerts, 1)
+	require.Equal(t, "LowMemory", alerts[0].Rule)
+	require.Equal(t, http.StatusBadRequest, get("/alerts?state=inactive", &alerts))
+	require.Equal(t, http.StatusBadRequest, get("/alerts?state=unknown", &alerts))
+
+	var st []models.AlertRule
+	require.Equal(t, http.StatusOK, get("/rules", &st))
+	require.Len(t, st, 2)
+	require.Equal(t, "HighLoad", st[0].Name)
+	require.Equal(t, "load > 1", st[0].Query)
+	require.Equal(t, "1m", st[0].For)
+	require.Equal(t, models.AlertPending, st[0].State)
+	require.Len(t, st[0].Alerts, 1)
+	require.Equal(t, models.AlertFiring, st[1].State)
+}
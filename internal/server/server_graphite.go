@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/storage"
+)
+
+const (
+	// Max length of plaintext protocol line.
+	graphiteMaxLine = 64 << 10
+	// Max size of pickle protocol frame.
+	graphiteMaxFrame = 1 << 20
+	// Max number of datapoints in batch write.
+	graphiteBatchSize = 1000
+	// Interval of batch write of received datapoints.
+	graphiteFlushInterval = time.Second
+	// Number of received datapoints, which wait for batch write (receivers are blocked, when queue is full).
+	graphiteQueueSize = 10 * graphiteBatchSize
+)
+
+// graphiteServer graphite (carbon) receiver of plaintext and pickle protocols over tcp.
+type graphiteServer struct {
+	mh      *metricHandlers     // storage and retrier
+	tenant  string              // tenant of written datapoints
+	subnets []netip.Prefix      // allowed source subnets (nil - all)
+	queue   chan models.Metrics // received datapoints
+	conns   tcpConns            // tcp connections
+}
+
+// newGraphiteServer init graphite receiver of metric handlers storage, datapoints are written to tenant.
+func newGraphiteServer(mh *metricHandlers, tenant string, subnets []netip.Prefix) *graphiteServer {
+	return &graphiteServer{
+		mh:      mh,
+		tenant:  tenant,
+		subnets: subnets,
+		queue:   make(chan models.Metrics, graphiteQueueSize),
+	}
+}
+
+// graphiteMetric return gauge of graphite path: dotted path is metric name, tags of tagged path (name;tag=value...) are labels.
+func graphiteMetric(path string, value float64) (models.Metrics, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return models.Metrics{}, fmt.Errorf("path %s: wrong value %v", path, value)
+	}
+	parts := strings.Split(path, ";")
+	m := models.Metrics{ID: parts[0], MType: metrictypes.GaugeType, Value: &value}
+	if m.ID == "" || strings.ContainsAny(m.ID, "{} ") {
+		return m, fmt.Errorf("wrong path %s", path)
+	}
+	if len(parts) > 1 {
+		m.Labels = make(models.Labels, len(parts)-1)
+		for _, tag := range parts[1:] {
+			k, v, ok := strings.Cut(tag, "=")
+			// tag names are label names of series id
+			if !ok || k == "" || v == "" || strings.ContainsAny(k, `{}=," !^`) {
+				return m, fmt.Errorf("path %s: wrong tag %s", path, tag)
+			}
+			m.Labels[k] = v
+		}
+	}
+	return m, nil
+}
+
+// parseGraphiteLine parse plaintext protocol line: path value [timestamp].
+// Timestamp is checked, but stored samples have time of write.
+func parseGraphiteLine(line string) (models.Metrics, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return models.Metrics{}, fmt.Errorf("wrong line %q", line)
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return models.Metrics{}, fmt.Errorf("path %s: wrong value %s", fields[0], fields[1])
+	}
+	if len(fields) == 3 {
+		if _, err := strconv.ParseFloat(fields[2], 64); err != nil {
+			return models.Metrics{}, fmt.Errorf("path %s: wrong timestamp %s", fields[0], fields[2])
+		}
+	}
+	return graphiteMetric(fields[0], value)
+}
+
+// pickleNumber return float value of pickled number.
+func pickleNumber(v any) (float64, bool) {
+	// selecting number type
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// pickleItems return items of pickled list or tuple.
+func pickleItems(v any) ([]any, bool) {
+	// selecting sequence type
+	switch s := v.(type) {
+	case *pickleListValue:
+		return s.items, true
+	case []any:
+		return s, true
+	}
+	return nil, false
+}
+
+// parseGraphitePickle parse pickle frame: list of (path, (timestamp, value)) datapoints.
+// Wrong datapoints are skipped, their errors are returned.
+func parseGraphitePickle(frame []byte) ([]models.Metrics, []error, error) {
+	v, err := unpickle(frame)
+	if err != nil {
+		return nil, nil, err
+	}
+	datapoints, ok := pickleItems(v)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: datapoints aren't list", errPickle)
+	}
+	var (
+		metrics []models.Metrics
+		invalid []error
+	)
+	for _, dp := range datapoints {
+		m, err := graphitePickleDatapoint(dp)
+		if err != nil {
+			invalid = append(invalid, err)
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, invalid, nil
+}
+
+// graphitePickleDatapoint return gauge of pickled (path, (timestamp, value)) datapoint.
+func graphitePickleDatapoint(dp any) (models.Metrics, error) {
+	items, ok := pickleItems(dp)
+	if !ok || len(items) != 2 {
+		return models.Metrics{}, fmt.Errorf("%w: wrong datapoint", errPickle)
+	}
+	path, ok := items[0].(string)
+	if !ok {
+		return models.Metrics{}, fmt.Errorf("%w: wrong datapoint path", errPickle)
+	}
+	point, ok := pickleItems(items[1])
+	if !ok || len(point) != 2 {
+		return models.Metrics{}, fmt.Errorf("%w: wrong datapoint of %s", errPickle, path)
+	}
+	if _, ok := pickleNumber(point[0]); !ok {
+		return models.Metrics{}, fmt.Errorf("path %s: wrong timestamp", path)
+	}
+	value, ok := pickleNumber(point[1])
+	if !ok {
+		return models.Metrics{}, fmt.Errorf("path %s: wrong value", path)
+	}
+	return graphiteMetric(path, value)
+}
+
+// enqueue method for send datapoints to batch writer (blocked, while storage is slow and queue is full).
+func (s *graphiteServer) enqueue(metrics ...models.Metrics) {
+	for _, m := range metrics {
+		s.queue <- m
+	}
+}
+
+// servePlain method for read plaintext protocol lines of connection.
+func (s *graphiteServer) servePlain(conn net.Conn) {
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, 4096), graphiteMaxLine)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		m, err := parseGraphiteLine(line)
+		if err != nil {
+			log.Printf("graphite: %v: %v", conn.RemoteAddr(), err)
+			continue
+		}
+		s.enqueue(m)
+	}
+	if err := sc.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("graphite: connection %v: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// servePickle method for read pickle protocol frames (4 bytes big endian length and pickle data) of connection.
+func (s *graphiteServer) servePickle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("graphite: connection %v: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size > graphiteMaxFrame {
+			log.Printf("graphite: connection %v: frame of %d bytes is too large", conn.RemoteAddr(), size)
+			return
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			log.Printf("graphite: connection %v: %v", conn.RemoteAddr(), err)
+			return
+		}
+		metrics, invalid, err := parseGraphitePickle(frame)
+		if err != nil {
+			log.Printf("graphite: connection %v: %v", conn.RemoteAddr(), err)
+			continue
+		}
+		if len(invalid) > 0 {
+			log.Printf("graphite: %d invalid datapoints from %v: %v", len(invalid), conn.RemoteAddr(), invalid[0])
+		}
+		s.enqueue(metrics...)
+	}
+}
+
+// writeBatches method for write queued datapoints by batches (full batch or on interval) till queue is closed.
+// Failed batches are dropped (graphite protocols have no acknowledgements).
+func (s *graphiteServer) writeBatches(flushInterval time.Duration) {
+	// server context is done before last batch, storage methods have own timeout
+	ctx := storage.WithTenant(context.WithoutCancel(s.mh.ctx), s.tenant)
+	batch := make([]models.Metrics, 0, graphiteBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.mh.reqRetrier.UseRetrierWMB(s.mh.storage.WriteBatchMetrics)(ctx, batch); err != nil {
+			log.Println(err)
+		}
+		batch = make([]models.Metrics, 0, graphiteBatchSize)
+	}
+	t := time.NewTicker(flushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case m, ok := <-s.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, m)
+			if len(batch) >= graphiteBatchSize {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		}
+	}
+}
+
+// serve method for serve plaintext and pickle listeners (nil - disabled) till server context is done.
+// Datapoints received before shutdown are written after listeners are closed.
+func (s *graphiteServer) serve(plain, pickle net.Listener, flushInterval time.Duration) error {
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		s.writeBatches(flushInterval)
+	}()
+
+	g, ctx := errgroup.WithContext(s.mh.ctx)
+	for _, v := range []struct {
+		l      net.Listener
+		handle func(conn net.Conn)
+	}{{plain, s.servePlain}, {pickle, s.servePickle}} {
+		if v.l == nil {
+			continue
+		}
+		g.Go(func() error {
+			return s.conns.serve(v.l, s.subnets, v.handle)
+		})
+	}
+	g.Go(func() error {
+		<-ctx.Done()
+		for _, l := range []net.Listener{plain, pickle} {
+			if l != nil {
+				l.Close()
+			}
+		}
+		s.conns.close()
+		return nil
+	})
+	err := g.Wait()
+	s.conns.wait()
+
+	close(s.queue)
+	<-written
+	return err
+}
+
+// ListenGraphite start graphite receiver of plaintext and pickle protocols (empty address - disabled).
+// Datapoints are gauges of tenant (empty - default tenant), they are written by periodic batches.
+func ListenGraphite(plainAddr, pickleAddr, tenant string, subnets []netip.Prefix, mh *metricHandlers) error {
+	var plain, pickle net.Listener
+	if plainAddr != "" {
+		l, err := net.Listen("tcp", plainAddr)
+		if err != nil {
+			return err
+		}
+		plain = l
+	}
+	if pickleAddr != "" {
+		l, err := net.Listen("tcp", pickleAddr)
+		if err != nil {
+			if plain != nil {
+				plain.Close()
+			}
+			return err
+		}
+		pickle = l
+	}
+	return newGraphiteServer(mh, tenant, subnets).serve(plain, pickle, graphiteFlushInterval)
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/retrier"
+	"github.com/sourcecd/monitoring/internal/storage"
+)
+
+func TestParseGraphiteLine(t *testing.T) {
+	t.Parallel()
+	value := func(v float64) *float64 { return &v }
+	testCases := []struct {
+		name   string
+		line   string
+		metric models.Metrics
+		err    string
+	}{
+		{name: "plain", line: "servers.a.cpu 1.5 1700000000", metric: models.Metrics{ID: "servers.a.cpu", MType: "gauge", Value: value(1.5)}},
+		{name: "without_timestamp", line: "servers.a.cpu -3", metric: models.Metrics{ID: "servers.a.cpu", MType: "gauge", Value: value(-3)}},
+		{
+			name:   "tagged",
+			line:   "disk.used;host=a;dc=eu 42 -1",
+			metric: models.Metrics{ID: "disk.used", MType: "gauge", Value: value(42), Labels: models.Labels{"host": "a", "dc": "eu"}},
+		},
+		{name: "missing_value", line: "servers.a.cpu", err: `wrong line "servers.a.cpu"`},
+		{name: "bad_value", line: "servers.a.cpu abc 1700000000", err: "path servers.a.cpu: wrong value abc"},
+		{name: "nan", line: "servers.a.cpu nan 1700000000", err: "path servers.a.cpu: wrong value NaN"},
+		{name: "bad_timestamp", line: "servers.a.cpu 1 now", err: "path servers.a.cpu: wrong timestamp now"},
+		{name: "bad_tag", line: "disk.used;host 1 1", err: "path disk.used;host: wrong tag host"},
+		{name: "empty_name", line: ";host=a 1 1", err: "wrong path ;host=a"},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := parseGraphiteLine(tt.line)
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.metric, m)
+		})
+	}
+}
+
+func TestParseGraphitePickle(t *testing.T) {
+	t.Parallel()
+	b, err := hex.DecodeString(testPickledDatapoints["protocol_2"])
+	require.NoError(t, err)
+	metrics, invalid, err := parseGraphitePickle(b)
+	require.NoError(t, err)
+	require.Len(t, invalid, 1)
+	require.EqualError(t, invalid[0], "path bad: wrong value")
+	require.Len(t, metrics, 3)
+	require.Equal(t, "disk.used", metrics[1].ID)
+	require.Equal(t, models.Labels{"host": "a", "dc": "eu"}, metrics[1].Labels)
+	require.Equal(t, float64(1<<40), *metrics[2].Value)
+
+	// python dict isn't supported
+	_, _, err = parseGraphitePickle([]byte{0x80, 0x02, '}', '.'})
+	require.ErrorIs(t, err, errPickle)
+}
+
+func TestGraphiteServe(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	testStorage := storage.NewMemStorage()
+	s := newGraphiteServer(&metricHandlers{ctx: ctx, storage: testStorage, reqRetrier: retrier.NewRetrier()}, "", nil)
+
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pickle, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() { done <- s.serve(plain, pickle, 10*time.Millisecond) }()
+
+	conn, err := net.Dial("tcp", plain.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("servers.a.cpu 1.5 1700000000\nwrong\nservers.a.mem;host=a 10 1700000000\n"))
+	require.NoError(t, err)
+
+	// batches are written on interval
+	require.Eventually(t, func() bool {
+		v, err := testStorage.GetMetric(context.Background(), metrictypes.GaugeType, `servers.a.mem{host="a"}`)
+		return err == nil && v == metrictypes.Gauge(10)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	frame, err := hex.DecodeString(testPickledDatapoints["protocol_4"])
+	require.NoError(t, err)
+	pconn, err := net.Dial("tcp", pickle.Addr().String())
+	require.NoError(t, err)
+	defer pconn.Close()
+	_, err = pconn.Write(binary.BigEndian.AppendUint32(nil, uint32(len(frame))))
+	require.NoError(t, err)
+	_, err = pconn.Write(frame)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		v, err := testStorage.GetMetric(context.Background(), metrictypes.GaugeType, "big")
+		return err == nil && v == metrictypes.Gauge(1<<40)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("graphite receiver isn't stopped")
+	}
+	v, err := testStorage.GetMetric(context.Background(), metrictypes.GaugeType, "servers.a.cpu")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(1.5), v)
+}
+
+func TestGraphiteTenant(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	testStorage := storage.NewMemStorage()
+	s := newGraphiteServer(&metricHandlers{ctx: ctx, storage: testStorage, reqRetrier: retrier.NewRetrier()}, "teamA", nil)
+	m, err := parseGraphiteLine("servers.a.cpu 1.5 1700000000")
+	require.NoError(t, err)
+	s.enqueue(m)
+	close(s.queue)
+	s.writeBatches(time.Hour)
+
+	// datapoints are written to receiver tenant
+	v, err := testStorage.GetMetric(storage.WithTenant(ctx, "teamA"), metrictypes.GaugeType, "servers.a.cpu")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(1.5), v)
+	_, err = testStorage.GetMetric(ctx, metrictypes.GaugeType, "servers.a.cpu")
+	require.Error(t, err)
+}
+
+func TestGraphiteBackpressure(t *testing.T) {
+	t.Parallel()
+	s := &graphiteServer{queue: make(chan models.Metrics, 1)}
+	enqueued := make(chan struct{})
+	go func() {
+		s.enqueue(models.Metrics{ID: "a"}, models.Metrics{ID: "b"})
+		close(enqueued)
+	}()
+
+	// receiver waits for batch writer, while queue is full
+	select {
+	case <-enqueued:
+		t.Fatal("datapoints are enqueued to full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.Equal(t, "a", (<-s.queue).ID)
+	<-enqueued
+	require.Equal(t, "b", (<-s.queue).ID)
+}
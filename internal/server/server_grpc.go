@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net"
 	"net/netip"
@@ -17,7 +18,9 @@ import (
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
+	"github.com/sourcecd/monitoring/internal/customerrors"
 	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/storage"
 	monproto "github.com/sourcecd/monitoring/proto"
 )
 
@@ -27,46 +30,194 @@ type MonitoringServer struct {
 	subnets []netip.Prefix
 }
 
+// checkSubnet check that source ip (x-real-ip metadata) belongs to allowed subnets.
+func (m *MonitoringServer) checkSubnet(xrealip []string) error {
+	if m.subnets == nil {
+		return nil
+	}
+	if len(xrealip) == 0 {
+		return status.Error(codes.PermissionDenied, "cant' find src ip")
+	}
+	ip, err := netip.ParseAddr(xrealip[0])
+	if err != nil {
+		return status.Error(codes.PermissionDenied, "error parse src ip")
+	}
+	for _, v := range m.subnets {
+		if v.Contains(ip) {
+			return nil
+		}
+	}
+	return status.Error(codes.PermissionDenied, "src ip not allowed")
+}
+
+// tenantContext authenticate tenant by bearer token of authorization metadata, return handlers context of tenant.
+func (m *MonitoringServer) tenantContext(ctx context.Context) (context.Context, error) {
+	var auth string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("authorization"); len(v) > 0 {
+			auth = v[0]
+		}
+	}
+	name, err := m.mh.tenants.authenticate(bearerToken(auth))
+	if err != nil {
+		if errors.Is(err, customerrors.ErrTenantLimit) {
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		}
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return storage.WithTenant(m.mh.ctx, name), nil
+}
+
 // SendMetrics grpc method for send metrics
 func (m *MonitoringServer) SendMetrics(ctx context.Context, in *monproto.MetricsRequest) (*monproto.MetricResponse, error) {
-	var (
-		xrealip []string
-		metrics []models.Metrics
-	)
+	var xrealip []string
 	if md, ok := metadata.FromIncomingContext(ctx); ok {
 		xrealip = md.Get("x-real-ip")
 		grpc_ctxtags.Extract(ctx).Set("grpc-accept-encoding", md.Get("grpc-accept-encoding"))
 		grpc_ctxtags.Extract(ctx).Set("x-real-ip", xrealip)
 	}
-	if m.subnets != nil {
-		if len(xrealip) == 0 {
-			return nil, status.Error(codes.PermissionDenied, "cant' find src ip")
-		}
-		ip, err := netip.ParseAddr(xrealip[0])
-		if err != nil {
-			return nil, status.Error(codes.PermissionDenied, "error parse src ip")
+	if err := m.checkSubnet(xrealip); err != nil {
+		return nil, err
+	}
+	tctx, err := m.tenantContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.idempotentCall(ctx, tctx, func() (*monproto.MetricResponse, bool) {
+		return m.writeMetrics(tctx, in)
+	})
+}
+
+// writeMetrics write metrics of request to storage, return response and true if metrics are stored.
+func (m *MonitoringServer) writeMetrics(ctx context.Context, in *monproto.MetricsRequest) (*monproto.MetricResponse, bool) {
+	var metrics []models.Metrics
+	for _, metric := range in.Metric {
+		mt := models.Metrics{
+			ID:     metric.Id,
+			Value:  &metric.Value,
+			Delta:  &metric.Delta,
+			MType:  metric.Mtype,
+			Labels: metric.Labels,
 		}
-		isIPtrue := false
-		for _, v := range m.subnets {
-			if v.Contains(ip) {
-				isIPtrue = true
-				break
+		if h := metric.GetHistogram(); h != nil {
+			mt.Histogram = &models.Histogram{
+				Bounds: h.Bounds,
+				Counts: h.Counts,
+				Sum:    h.Sum,
+				Count:  h.Count,
 			}
 		}
-		if !isIPtrue {
-			return nil, status.Error(codes.PermissionDenied, "src ip not allowed")
+		metrics = append(metrics, mt)
+	}
+	if err := m.mh.reqRetrier.UseRetrierWMB(m.mh.storage.WriteBatchMetrics)(ctx, metrics); err != nil {
+		log.Println(err)
+		return &monproto.MetricResponse{
+			Error: "OK",
+		}, false
+	}
+	return &monproto.MetricResponse{
+		Error: "OK",
+	}, true
+}
+
+// idempotentCall apply call once per idempotency key of request metadata (tenant is taken from tctx).
+// Duplicates get response of applied call, requests without key are applied as is.
+func (m *MonitoringServer) idempotentCall(ctx, tctx context.Context, call func() (*monproto.MetricResponse, bool)) (*monproto.MetricResponse, error) {
+	var key string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(models.IdempotencyKeyHeader); len(v) > 0 {
+			key = v[0]
 		}
 	}
-	for _, metric := range in.Metric {
-		metrics = append(metrics, models.Metrics{
-			ID:    metric.Id,
-			Value: &metric.Value,
-			Delta: &metric.Delta,
-			MType: metric.Mtype,
+	if m.mh.idempotency == nil || key == "" {
+		resp, _ := call()
+		return resp, nil
+	}
+	scoped, err := idempotencyScope(tctx, "grpc", key)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	e, apply, err := m.mh.idempotency.acquire(ctx, scoped)
+	if err != nil {
+		return nil, status.FromContextError(err).Err()
+	}
+	if !apply {
+		return e.result.(*monproto.MetricResponse), nil
+	}
+	var (
+		resp    *monproto.MetricResponse
+		applied bool
+	)
+	// call isn't applied, if it panics
+	defer func() {
+		m.mh.idempotency.finish(scoped, e, resp, applied)
+	}()
+	resp, applied = call()
+	return resp, nil
+}
+
+// DeleteMetrics grpc method for delete series by id or pattern
+func (m *MonitoringServer) DeleteMetrics(ctx context.Context, in *monproto.DeleteRequest) (*monproto.DeleteResponse, error) {
+	var xrealip []string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		xrealip = md.Get("x-real-ip")
+		grpc_ctxtags.Extract(ctx).Set("x-real-ip", xrealip)
+	}
+	if err := m.checkSubnet(xrealip); err != nil {
+		return nil, err
+	}
+	tctx, err := m.tenantContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if in.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty metric id")
+	}
+	n, err := m.mh.reqRetrier.UseRetrierDelete(m.mh.storage.Delete)(tctx, in.Mtype, models.SeriesID(in.Id, in.Labels))
+	switch {
+	case err == nil:
+	case errors.Is(err, customerrors.ErrNoVal):
+		return nil, status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, customerrors.ErrBadMetricType), errors.Is(err, models.ErrWrongSeriesID):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	default:
+		log.Println(err)
+		return nil, status.Error(codes.Internal, "can't delete metric")
+	}
+	return &monproto.DeleteResponse{
+		Deleted: int64(n),
+	}, nil
+}
+
+// SendMetadata grpc method for register metadata of metric names
+func (m *MonitoringServer) SendMetadata(ctx context.Context, in *monproto.MetadataRequest) (*monproto.MetricResponse, error) {
+	var xrealip []string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		xrealip = md.Get("x-real-ip")
+		grpc_ctxtags.Extract(ctx).Set("x-real-ip", xrealip)
+	}
+	if err := m.checkSubnet(xrealip); err != nil {
+		return nil, err
+	}
+	tctx, err := m.tenantContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	meta := make([]models.Metadata, 0, len(in.Metadata))
+	for _, v := range in.Metadata {
+		meta = append(meta, models.Metadata{
+			ID:          v.Id,
+			MType:       v.Mtype,
+			Unit:        v.Unit,
+			Description: v.Description,
 		})
 	}
-	if err := m.mh.reqRetrier.UseRetrierWMB(m.mh.storage.WriteBatchMetrics)(m.mh.ctx, metrics); err != nil {
+	if err := m.mh.reqRetrier.UseRetrierWriteMetadata(m.mh.storage.WriteMetadata)(tctx, meta); err != nil {
+		if errors.Is(err, customerrors.ErrWrongMetadata) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
 		log.Println(err)
+		return nil, status.Error(codes.Internal, "can't store metadata")
 	}
 	return &monproto.MetricResponse{
 		Error: "OK",
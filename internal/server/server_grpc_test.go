@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/retrier"
+	"github.com/sourcecd/monitoring/internal/storage"
+	monproto "github.com/sourcecd/monitoring/proto"
+)
+
+func TestDeleteMetricsGrpc(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	testStorage := storage.NewMemStorage()
+	subnets, err := parseSubnetPrefixes("10.0.0.0/8")
+	require.NoError(t, err)
+	m := &MonitoringServer{
+		mh: &metricHandlers{
+			ctx:        ctx,
+			storage:    testStorage,
+			reqRetrier: retrier.NewRetrier(),
+		},
+		subnets: subnets,
+	}
+	require.NoError(t, testStorage.WriteMetric(ctx, "gauge", "CPUutilization1", metrictypes.Gauge(1)))
+	require.NoError(t, testStorage.WriteMetric(ctx, "gauge", `Load{host="old"}`, metrictypes.Gauge(1)))
+
+	allowed := metadata.NewIncomingContext(ctx, metadata.Pairs("x-real-ip", "10.0.0.1"))
+	denied := metadata.NewIncomingContext(ctx, metadata.Pairs("x-real-ip", "192.168.0.1"))
+
+	_, err = m.DeleteMetrics(denied, &monproto.DeleteRequest{Mtype: "gauge", Id: "CPUutilization*"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	resp, err := m.DeleteMetrics(allowed, &monproto.DeleteRequest{Mtype: "gauge", Id: "CPUutilization*"})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), resp.Deleted)
+	resp, err = m.DeleteMetrics(allowed, &monproto.DeleteRequest{Mtype: "gauge", Id: "Load", Labels: map[string]string{"host": "old"}})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), resp.Deleted)
+
+	_, err = m.DeleteMetrics(allowed, &monproto.DeleteRequest{Mtype: "gauge", Id: "CPUutilization1"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = m.DeleteMetrics(allowed, &monproto.DeleteRequest{Mtype: "wrong", Id: "CPUutilization1"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = m.DeleteMetrics(allowed, &monproto.DeleteRequest{Mtype: "gauge"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestSendMetadataGrpc(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	testStorage := storage.NewMemStorage()
+	subnets, err := parseSubnetPrefixes("10.0.0.0/8")
+	require.NoError(t, err)
+	m := &MonitoringServer{
+		mh: &metricHandlers{
+			ctx:        ctx,
+			storage:    testStorage,
+			reqRetrier: retrier.NewRetrier(),
+		},
+		subnets: subnets,
+	}
+	allowed := metadata.NewIncomingContext(ctx, metadata.Pairs("x-real-ip", "10.0.0.1"))
+	denied := metadata.NewIncomingContext(ctx, metadata.Pairs("x-real-ip", "192.168.0.1"))
+	req := &monproto.MetadataRequest{Metadata: []*monproto.MetadataRequest_Metadata{
+		{Id: "TotalMemory", Mtype: "gauge", Unit: "bytes", Description: "Total amount of RAM"},
+	}}
+
+	_, err = m.SendMetadata(denied, req)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = m.SendMetadata(allowed, req)
+	require.NoError(t, err)
+	meta, err := testStorage.GetMetadata(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []models.Metadata{{ID: "TotalMemory", MType: "gauge", Unit: "bytes", Description: "Total amount of RAM"}}, meta)
+
+	_, err = m.SendMetadata(allowed, &monproto.MetadataRequest{Metadata: []*monproto.MetadataRequest_Metadata{{Id: "TotalMemory", Mtype: "wrong"}}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestTenantGrpc(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	testStorage := storage.NewMemStorage()
+	tenants, err := parseTenants("teamA:tokenA,teamB:tokenB:1")
+	require.NoError(t, err)
+	m := &MonitoringServer{
+		mh: &metricHandlers{
+			ctx:        ctx,
+			storage:    testStorage,
+			reqRetrier: retrier.NewRetrier(),
+			tenants:    tenants,
+		},
+	}
+	req := &monproto.MetricsRequest{Metric: []*monproto.MetricsRequest_MetricRequest{{Id: "Alloc", Mtype: "gauge", Value: 1}}}
+	withToken := func(token string) context.Context {
+		return metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))
+	}
+
+	_, err = m.SendMetrics(ctx, req)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = m.SendMetrics(withToken("wrong"), req)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = m.SendMetrics(withToken("tokenA"), req)
+	require.NoError(t, err)
+	_, err = m.DeleteMetrics(withToken("tokenB"), &monproto.DeleteRequest{Mtype: "gauge", Id: "Alloc"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = m.SendMetadata(withToken("tokenB"), &monproto.MetadataRequest{})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	g, err := testStorage.GetMetric(storage.WithTenant(ctx, "teamA"), "gauge", "Alloc")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(1), g)
+	_, err = testStorage.GetMetric(ctx, "gauge", "Alloc")
+	require.Error(t, err)
+}
+
+func TestIdempotentSendMetricsGrpc(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	testStorage := storage.NewMemStorage()
+	m := &MonitoringServer{
+		mh: &metricHandlers{
+			ctx:         ctx,
+			storage:     testStorage,
+			reqRetrier:  retrier.NewRetrier(),
+			idempotency: newIdempotencyCache(60),
+		},
+	}
+	req := &monproto.MetricsRequest{Metric: []*monproto.MetricsRequest_MetricRequest{{Id: "PollCount", Mtype: "counter", Delta: 5}}}
+	withKey := func(key string) context.Context {
+		return metadata.NewIncomingContext(ctx, metadata.Pairs(models.IdempotencyKeyHeader, key))
+	}
+
+	for range 2 {
+		resp, err := m.SendMetrics(withKey("batch1"), req)
+		require.NoError(t, err)
+		require.Equal(t, "OK", resp.Error)
+	}
+	c, err := testStorage.GetMetric(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(5), c)
+
+	_, err = m.SendMetrics(withKey("batch2"), req)
+	require.NoError(t, err)
+	_, err = m.SendMetrics(ctx, req)
+	require.NoError(t, err)
+	c, err = testStorage.GetMetric(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(15), c)
+
+	_, err = m.SendMetrics(withKey(strings.Repeat("k", maxIdempotencyKey+1)), req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
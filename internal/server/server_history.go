@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/storage"
+)
+
+// Default time range of history query, when begin of range is not specified.
+const defaultHistoryRange = time.Hour
+
+// Interval of history compaction (rollups build and expired samples drop).
+const compactInterval = time.Minute
+
+// Resolution name of raw samples in history response.
+const rawResolution = "raw"
+
+// compactHistory function for periodic history compaction by retention policy.
+func compactHistory(ctx context.Context, store storage.StoreMetrics, policy storage.RetentionPolicy, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := store.Compact(ctx, policy, time.Now()); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// parseHistoryTime parse time parameter in unix seconds or RFC3339 format.
+func parseHistoryTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// parseHistoryStep parse downsampling step in go duration format or in seconds.
+func parseHistoryStep(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	step, err := time.ParseDuration(s)
+	if sec, errSec := strconv.ParseInt(s, 10, 64); errSec == nil {
+		step, err = time.Duration(sec)*time.Second, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if step < 0 {
+		return 0, errors.New("negative step")
+	}
+	return step, nil
+}
+
+// fetchHistory get metric samples from storage and downsample it to step.
+// Raw samples or rollups are used, depending on retention of range begin and step.
+func (mh *metricHandlers) fetchHistory(ctx context.Context, hist *models.MetricsHistory, step time.Duration) error {
+	var (
+		samples []models.Sample
+		err     error
+	)
+	series := models.SeriesID(hist.ID, hist.Labels)
+	resolution := mh.retention.Resolution(hist.MType, hist.From, time.Now(), step)
+	if resolution == 0 {
+		hist.Resolution = rawResolution
+		samples, err = mh.reqRetrier.UseRetrierGetHistory(mh.storage.GetMetricHistory)(ctx, hist.MType, series, hist.From, hist.To)
+	} else {
+		hist.Resolution = resolution.String()
+		samples, err = mh.reqRetrier.UseRetrierGetRollups(mh.storage.GetMetricRollups)(ctx, hist.MType, series, resolution, hist.From, hist.To)
+	}
+	if err != nil {
+		return err
+	}
+	hist.Samples = storage.Downsample(samples, hist.From, step)
+	return nil
+}
+
+// getHistory api method for get metric samples in time range (url parameters).
+func (mh *metricHandlers) getHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// metric name may contain labels: name{k1="v1",k2="v2"}
+		name, err := urlParamUnescaped(r, "name")
+		if err != nil {
+			http.Error(w, "can't parse metric name", http.StatusBadRequest)
+			return
+		}
+		id, labels, err := models.ParseSeriesID(name)
+		if err != nil {
+			http.Error(w, "can't parse metric name", http.StatusBadRequest)
+			return
+		}
+		hist := models.MetricsHistory{
+			ID:     id,
+			Labels: labels,
+			MType:  chi.URLParam(r, "type"),
+			Step:   r.URL.Query().Get("step"),
+		}
+
+		if hist.To, err = parseHistoryTime(r.URL.Query().Get("to"), time.Now()); err != nil {
+			http.Error(w, "can't parse to parameter", http.StatusBadRequest)
+			return
+		}
+		if hist.From, err = parseHistoryTime(r.URL.Query().Get("from"), hist.To.Add(-defaultHistoryRange)); err != nil {
+			http.Error(w, "can't parse from parameter", http.StatusBadRequest)
+			return
+		}
+		step, err := parseHistoryStep(hist.Step)
+		if err != nil {
+			http.Error(w, "can't parse step parameter", http.StatusBadRequest)
+			return
+		}
+		if hist.From.After(hist.To) {
+			http.Error(w, "wrong time range", http.StatusBadRequest)
+			return
+		}
+
+		if err := mh.fetchHistory(mh.requestCtx(r), &hist, step); err != nil {
+			if errors.Is(err, customerrors.ErrBadMetricType) {
+				http.Error(w, "metric_type not found", http.StatusBadRequest)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(&hist); err != nil {
+			http.Error(w, "can't encode json", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// getHistoryJSON api method for get metric samples in time range (json request).
+func (mh *metricHandlers) getHistoryJSON() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var hist models.MetricsHistory
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, fmt.Sprintf("wrong content type: %s", r.Header.Get("Content-Type")), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+
+		dec := json.NewDecoder(r.Body)
+
+		if err := dec.Decode(&hist); err != nil {
+			http.Error(w, "error to pasrse json request", http.StatusBadRequest)
+			return
+		}
+		enc := json.NewEncoder(w)
+
+		if hist.To.IsZero() {
+			hist.To = time.Now()
+		}
+		if hist.From.IsZero() {
+			hist.From = hist.To.Add(-defaultHistoryRange)
+		}
+		step, err := parseHistoryStep(hist.Step)
+		if err != nil {
+			http.Error(w, "can't parse step parameter", http.StatusBadRequest)
+			return
+		}
+		if hist.From.After(hist.To) {
+			http.Error(w, "wrong time range", http.StatusBadRequest)
+			return
+		}
+
+		if err := mh.fetchHistory(mh.requestCtx(r), &hist, step); err != nil {
+			if errors.Is(err, customerrors.ErrBadMetricType) {
+				http.Error(w, "metric_type not found", http.StatusBadRequest)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		if err := enc.Encode(&hist); err != nil {
+			http.Error(w, "can't encode json", http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/cryptandsign"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/retrier"
+	"github.com/sourcecd/monitoring/internal/storage"
+)
+
+func TestHistoryHandlers(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	reqRetrier := retrier.NewRetrier()
+
+	var keyenc, privkeypath string
+	testStorage := storage.NewMemStorage()
+
+	mh := &metricHandlers{
+		ctx:        ctx,
+		storage:    testStorage,
+		reqRetrier: reqRetrier,
+		crypt:      cryptandsign.NewAsymmetricCryptRsa(),
+	}
+
+	ts := httptest.NewServer(chiRouter(mh, keyenc, privkeypath, nil))
+	t.Cleanup(func() { ts.Close() })
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.GaugeType, "testGauge", metrictypes.Gauge(i)))
+		require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.CounterType, "testCounter", metrictypes.Counter(i)))
+	}
+
+	testCase := []struct {
+		name        string
+		method      string
+		request     string
+		requestBody string
+		statusCode  int
+		samples     int
+	}{
+		{
+			name:       "gauge-raw",
+			method:     http.MethodGet,
+			request:    "/history/gauge/testGauge",
+			statusCode: http.StatusOK,
+			samples:    3,
+		},
+		{
+			name:       "counter-step",
+			method:     http.MethodGet,
+			request:    "/history/counter/testCounter?from=0&step=87600h",
+			statusCode: http.StatusOK,
+			samples:    1,
+		},
+		{
+			name:       "empty-range",
+			method:     http.MethodGet,
+			request:    "/history/gauge/testGauge?from=0&to=1",
+			statusCode: http.StatusOK,
+			samples:    0,
+		},
+		{
+			name:       "wrong-type",
+			method:     http.MethodGet,
+			request:    "/history/qwe/testGauge",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "wrong-range",
+			method:     http.MethodGet,
+			request:    "/history/gauge/testGauge?from=10&to=1",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "wrong-step",
+			method:     http.MethodGet,
+			request:    "/history/gauge/testGauge?step=qwe",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:        "json-gauge",
+			method:      http.MethodPost,
+			request:     "/history/",
+			requestBody: `{"id": "testGauge", "type": "gauge", "from": "2000-01-01T00:00:00Z", "step": "1h"}`,
+			statusCode:  http.StatusOK,
+			samples:     1,
+		},
+		{
+			name:        "json-wrong-type",
+			method:      http.MethodPost,
+			request:     "/history/",
+			requestBody: `{"id": "testGauge", "type": "qwe"}`,
+			statusCode:  http.StatusBadRequest,
+		},
+	}
+
+	for _, v := range testCase {
+		t.Run(v.name, func(t *testing.T) {
+			req, err := http.NewRequest(v.method, ts.URL+v.request, strings.NewReader(v.requestBody))
+			require.NoError(t, err)
+			if v.method == http.MethodPost {
+				req.Header.Set("Content-Type", "application/json")
+			}
+
+			resp, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			require.Equal(t, v.statusCode, resp.StatusCode)
+			if v.statusCode != http.StatusOK {
+				return
+			}
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			var hist models.MetricsHistory
+			require.NoError(t, json.Unmarshal(body, &hist))
+			require.Len(t, hist.Samples, v.samples)
+		})
+	}
+}
+
+func TestHistoryDownsampleValues(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	testStorage := storage.NewMemStorage()
+	mh := metricHandlers{
+		ctx:        ctx,
+		storage:    testStorage,
+		reqRetrier: retrier.NewRetrier(),
+		crypt:      cryptandsign.NewAsymmetricCryptRsa(),
+	}
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.CounterType, "testCounter", metrictypes.Counter(i)))
+	}
+
+	hist := models.MetricsHistory{
+		ID:    "testCounter",
+		MType: metrictypes.CounterType,
+		From:  time.Now().Add(-time.Hour),
+		To:    time.Now(),
+	}
+	require.NoError(t, mh.fetchHistory(ctx, &hist, 2*time.Hour))
+	require.Len(t, hist.Samples, 1)
+	require.Equal(t, int64(6), *hist.Samples[0].Delta)
+}
+
+func TestHistoryRetention(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	testStorage := storage.NewMemStorage()
+	retention, err := storage.ParseRetention("raw:1h,1m:24h")
+	require.NoError(t, err)
+	mh := metricHandlers{
+		ctx:        ctx,
+		storage:    testStorage,
+		reqRetrier: retrier.NewRetrier(),
+		crypt:      cryptandsign.NewAsymmetricCryptRsa(),
+		retention:  retention,
+	}
+	require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.GaugeType, "testGauge", metrictypes.Gauge(1)))
+
+	// recent range - raw samples
+	hist := models.MetricsHistory{
+		ID:    "testGauge",
+		MType: metrictypes.GaugeType,
+		From:  time.Now().Add(-time.Hour / 2),
+		To:    time.Now(),
+	}
+	require.NoError(t, mh.fetchHistory(ctx, &hist, 0))
+	require.Equal(t, "raw", hist.Resolution)
+	require.Len(t, hist.Samples, 1)
+
+	// raw samples are expired for older range, sample isn't rolled up yet
+	hist.From = time.Now().Add(-2 * time.Hour)
+	require.NoError(t, mh.fetchHistory(ctx, &hist, 0))
+	require.Equal(t, "1m0s", hist.Resolution)
+	require.Empty(t, hist.Samples)
+
+	require.NoError(t, testStorage.Compact(ctx, retention, time.Now().Add(time.Minute)))
+	require.NoError(t, mh.fetchHistory(ctx, &hist, 0))
+	require.Len(t, hist.Samples, 1)
+	require.Equal(t, 1.0, *hist.Samples[0].Max)
+}
+
+func TestParseHistoryParams(t *testing.T) {
+	t.Parallel()
+	def := time.Unix(5, 0)
+
+	tm, err := parseHistoryTime("", def)
+	require.NoError(t, err)
+	require.Equal(t, def, tm)
+	tm, err = parseHistoryTime("100", def)
+	require.NoError(t, err)
+	require.Equal(t, time.Unix(100, 0), tm)
+	tm, err = parseHistoryTime("2024-01-01T00:00:00Z", def)
+	require.NoError(t, err)
+	require.Equal(t, int64(1704067200), tm.Unix())
+	_, err = parseHistoryTime("qwe", def)
+	require.Error(t, err)
+
+	step, err := parseHistoryStep("60")
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, step)
+	step, err = parseHistoryStep("5m")
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Minute, step)
+	_, err = parseHistoryStep("-5m")
+	require.Error(t, err)
+}
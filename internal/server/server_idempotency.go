@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/storage"
+)
+
+const (
+	// Max length of idempotency key.
+	maxIdempotencyKey = 128
+	// Max number of remembered keys (oldest keys are forgotten before end of window).
+	maxIdempotencyKeys = 100000
+)
+
+// idempotencyEntry result of request with idempotency key.
+type idempotencyEntry struct {
+	done    chan struct{} // closed when request is finished
+	applied bool          // request is applied, result is replayed for duplicates
+	result  any           // result of request (recorded http response or grpc response)
+}
+
+// idempotencyExpire expiration of applied key.
+type idempotencyExpire struct {
+	key     string            // scoped key
+	entry   *idempotencyEntry // entry of key
+	expires time.Time         // end of window
+}
+
+// idempotencyCache recently applied idempotency keys (in-memory, per server instance).
+type idempotencyCache struct {
+	sync.Mutex
+	window  time.Duration                // time of remembering applied keys
+	entries map[string]*idempotencyEntry // entries by scoped key
+	queue   []idempotencyExpire          // applied keys in expiration order
+	now     func() time.Time             // clock
+}
+
+// recordedResponse http response of applied request.
+type recordedResponse struct {
+	code        int    // status code
+	contentType string // content type of body
+	body        []byte // response body
+}
+
+// responseRecorder middleware type for record response of request with idempotency key.
+type responseRecorder struct {
+	http.ResponseWriter
+	code int          // status code
+	body bytes.Buffer // response body
+}
+
+// newIdempotencyCache init cache of window seconds (window <= 0 - disabled, nil cache).
+func newIdempotencyCache(window int) *idempotencyCache {
+	if window <= 0 {
+		return nil
+	}
+	return &idempotencyCache{
+		window:  time.Duration(window) * time.Second,
+		entries: make(map[string]*idempotencyEntry),
+		now:     time.Now,
+	}
+}
+
+// idempotencyScope return key scoped by transport and tenant of context.
+func idempotencyScope(ctx context.Context, transport, key string) (string, error) {
+	if len(key) > maxIdempotencyKey {
+		return "", fmt.Errorf("%w: longer than %d", customerrors.ErrWrongIdempotencyKey, maxIdempotencyKey)
+	}
+	return transport + "\x00" + storage.TenantFromContext(ctx) + "\x00" + key, nil
+}
+
+// purge forget expired keys (caller must hold lock).
+func (c *idempotencyCache) purge() {
+	now := c.now()
+	n := 0
+	for n < len(c.queue) && (now.After(c.queue[n].expires) || len(c.queue)-n > maxIdempotencyKeys) {
+		if c.entries[c.queue[n].key] == c.queue[n].entry {
+			delete(c.entries, c.queue[n].key)
+		}
+		n++
+	}
+	c.queue = c.queue[n:]
+}
+
+// acquire return entry of key and true, if request must be applied by caller (caller must finish it).
+// Duplicate of request in progress waits for it, duplicate of failed request is applied again.
+func (c *idempotencyCache) acquire(ctx context.Context, key string) (*idempotencyEntry, bool, error) {
+	for {
+		c.Lock()
+		c.purge()
+		e, ok := c.entries[key]
+		if !ok {
+			e = &idempotencyEntry{done: make(chan struct{})}
+			c.entries[key] = e
+			c.Unlock()
+			return e, true, nil
+		}
+		c.Unlock()
+
+		select {
+		case <-e.done:
+			if e.applied {
+				return e, false, nil
+			}
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// finish store result of applied request (failed request is forgotten, so it may be retried).
+func (c *idempotencyCache) finish(key string, e *idempotencyEntry, result any, applied bool) {
+	c.Lock()
+	defer c.Unlock()
+	e.result = result
+	e.applied = applied
+	if applied {
+		c.queue = append(c.queue, idempotencyExpire{key: key, entry: e, expires: c.now().Add(c.window)})
+	} else if c.entries[key] == e {
+		delete(c.entries, key)
+	}
+	close(e.done)
+}
+
+// WriteHeader method for record status code.
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Write method for record response body.
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotent middleware for apply request with idempotency key once per window.
+// Duplicates get response of applied request, requests without key are applied as is.
+func (mh *metricHandlers) idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(models.IdempotencyKeyHeader)
+		if mh.idempotency == nil || key == "" {
+			h(w, r)
+			return
+		}
+		scoped, err := idempotencyScope(r.Context(), "http", key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		e, apply, err := mh.idempotency.acquire(r.Context(), scoped)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestTimeout)
+			return
+		}
+		if !apply {
+			resp := e.result.(*recordedResponse)
+			w.Header().Set("Content-Type", resp.contentType)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(resp.code)
+			if _, err := w.Write(resp.body); err != nil {
+				log.Printf("idempotency key %q: can't write replayed response: %v", key, err)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		// request isn't applied, if handler panics
+		applied := false
+		defer func() {
+			mh.idempotency.finish(scoped, e, &recordedResponse{code: rec.code, contentType: w.Header().Get("Content-Type"), body: rec.body.Bytes()}, applied)
+		}()
+		h(rec, r)
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		// only successful requests are remembered (failed ones are applied by retry)
+		applied = rec.code < http.StatusBadRequest
+	}
+}
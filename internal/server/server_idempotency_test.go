@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/cryptandsign"
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/retrier"
+	"github.com/sourcecd/monitoring/internal/storage"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	require.Nil(t, newIdempotencyCache(0))
+	c := newIdempotencyCache(60)
+	ts := time.Unix(1000, 0)
+	c.now = func() time.Time { return ts }
+
+	// failed request is forgotten
+	e, apply, err := c.acquire(ctx, "k1")
+	require.NoError(t, err)
+	require.True(t, apply)
+	c.finish("k1", e, "failed", false)
+	e, apply, err = c.acquire(ctx, "k1")
+	require.NoError(t, err)
+	require.True(t, apply)
+
+	// duplicate of request in progress waits for result
+	res := make(chan any)
+	go func() {
+		e, apply, err := c.acquire(ctx, "k1")
+		if err != nil || apply {
+			res <- nil
+			return
+		}
+		res <- e.result
+	}()
+	c.finish("k1", e, "applied", true)
+	require.Equal(t, "applied", <-res)
+
+	// key is forgotten after window
+	ts = ts.Add(time.Minute + time.Second)
+	_, apply, err = c.acquire(ctx, "k1")
+	require.NoError(t, err)
+	require.True(t, apply)
+
+	// waiting is canceled with context
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = c.acquire(cctx, "k1")
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = idempotencyScope(ctx, "http", strings.Repeat("k", maxIdempotencyKey+1))
+	require.ErrorIs(t, err, customerrors.ErrWrongIdempotencyKey)
+	k1, err := idempotencyScope(ctx, "http", "k1")
+	require.NoError(t, err)
+	k2, err := idempotencyScope(storage.WithTenant(ctx, "teamA"), "http", "k1")
+	require.NoError(t, err)
+	require.NotEqual(t, k1, k2)
+}
+
+func TestIdempotentBatchAPI(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var keyenc, privkeypath string
+	testStorage := storage.NewMemStorage()
+	mh := &metricHandlers{
+		ctx:         ctx,
+		storage:     testStorage,
+		reqRetrier:  retrier.NewRetrier(),
+		crypt:       cryptandsign.NewAsymmetricCryptRsa(),
+		idempotency: newIdempotencyCache(60),
+	}
+	ts := httptest.NewServer(chiRouter(mh, keyenc, privkeypath, nil))
+	t.Cleanup(func() { ts.Close() })
+
+	post := func(key, body string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/updates/", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set(models.IdempotencyKeyHeader, key)
+		}
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(b)
+	}
+	batch := `[{"id":"PollCount","type":"counter","delta":5}]`
+
+	resp, body := post("batch1", batch)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("Idempotent-Replayed"))
+	// retry of applied batch isn't double-counted and gets original response
+	resp, replayed := post("batch1", batch)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	require.Equal(t, body, replayed)
+	c, err := testStorage.GetMetric(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(5), c)
+
+	// new batch and batch without key are applied
+	resp, _ = post("batch2", batch)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = post("", batch)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	c, err = testStorage.GetMetric(ctx, "counter", "PollCount")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(15), c)
+
+	// failed batch isn't remembered
+	resp, _ = post("batch3", `[{`)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = post("batch3", batch)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("Idempotent-Replayed"))
+
+	resp, _ = post(strings.Repeat("k", maxIdempotencyKey+1), batch)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
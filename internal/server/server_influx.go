@@ -0,0 +1,356 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/storage"
+)
+
+const (
+	// Max size of decompressed line protocol request.
+	maxInfluxBody = 32 << 20
+	// Max number of line errors in response (all lines are checked).
+	maxInfluxLineErrors = 100
+	// Escaped chars of measurement, tag and field names.
+	influxEscaped = `,= \`
+)
+
+// Types of line protocol field values.
+const (
+	influxFloat = iota
+	influxInteger
+	influxBoolean
+	influxString
+)
+
+// influxPrecisions timestamp units of precision parameter (influxdb v1 and v2 names).
+var influxPrecisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"n":  time.Nanosecond,
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// influxField field of line protocol point.
+type influxField struct {
+	key   string  // field name
+	kind  int     // value type
+	value float64 // value of float and boolean (0 or 1) field
+	delta int64   // value of integer field
+}
+
+// influxPoint parsed line of line protocol.
+type influxPoint struct {
+	measurement string        // measurement name
+	tags        models.Labels // tags of point
+	fields      []influxField // fields of point
+	timestamp   time.Time     // time of point (server time, if line has no timestamp)
+}
+
+// influxLineError parse error of line in response.
+type influxLineError struct {
+	Line  int    `json:"line"`  // line number (from 1)
+	Error string `json:"error"` // parse error
+}
+
+// influxWriteError response of request with rejected lines (influxdb v1 clients read error, v2 clients read message).
+type influxWriteError struct {
+	Code    string            `json:"code"`    // influxdb error code
+	Message string            `json:"message"` // error summary
+	Error   string            `json:"error"`   // error summary
+	Lines   []influxLineError `json:"lines"`   // errors of rejected lines
+}
+
+// influxState state of line protocol receiver (shared by requests, guarded by lock).
+// Integer fields are cumulative, storage counters are sums of deltas, so last value of series is kept for delta.
+type influxState struct {
+	sync.Mutex
+	last   map[string]int64 // last cumulative values of integer fields by tenant and series id
+	expiry *seriesExpiry    // update times of integer field series
+}
+
+// newInfluxState init empty line protocol receiver state.
+func newInfluxState() *influxState {
+	return &influxState{
+		last:   make(map[string]int64),
+		expiry: newSeriesExpiry(cumulativeSeriesTTL),
+	}
+}
+
+// scanInfluxToken read token till one of unescaped stop chars, return unescaped token and rest of line.
+func scanInfluxToken(line, stops string) (string, string) {
+	var b strings.Builder
+	i := 0
+	for ; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) && strings.IndexByte(influxEscaped, line[i+1]) >= 0 {
+			i++
+			b.WriteByte(line[i])
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), line[i:]
+}
+
+// parseInfluxFieldValue parse field value, return field and rest of line.
+func parseInfluxFieldValue(key, line string) (influxField, string, error) {
+	f := influxField{key: key}
+	// string value is quoted, quotes and backslashes are escaped
+	if strings.HasPrefix(line, `"`) {
+		f.kind = influxString
+		for i := 1; i < len(line); i++ {
+			switch line[i] {
+			case '\\':
+				i++
+			case '"':
+				return f, line[i+1:], nil
+			}
+		}
+		return f, "", fmt.Errorf("field %s: unterminated string", key)
+	}
+
+	end := strings.IndexAny(line, ", ")
+	if end < 0 {
+		end = len(line)
+	}
+	raw, rest := line[:end], line[end:]
+	switch {
+	case raw == "":
+		return f, rest, fmt.Errorf("field %s: missing value", key)
+	case strings.HasSuffix(raw, "i"):
+		v, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return f, rest, fmt.Errorf("field %s: wrong integer %s", key, raw)
+		}
+		f.kind, f.delta = influxInteger, v
+	case strings.HasSuffix(raw, "u"):
+		v, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		if err != nil || v > math.MaxInt64 {
+			return f, rest, fmt.Errorf("field %s: wrong unsigned integer %s", key, raw)
+		}
+		f.kind, f.delta = influxInteger, int64(v)
+	case raw == "t" || raw == "T" || raw == "true" || raw == "True" || raw == "TRUE":
+		f.kind, f.value = influxBoolean, 1
+	case raw == "f" || raw == "F" || raw == "false" || raw == "False" || raw == "FALSE":
+		f.kind, f.value = influxBoolean, 0
+	default:
+		v, err := strconv.ParseFloat(raw, 64)
+		// line protocol has no NaN and Inf values
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return f, rest, fmt.Errorf("field %s: wrong float %s", key, raw)
+		}
+		f.kind, f.value = influxFloat, v
+	}
+	return f, rest, nil
+}
+
+// parseInfluxLine parse line of influxdb line protocol: measurement[,tag=value...] field=value[,field=value...] [timestamp].
+func parseInfluxLine(line string, precision time.Duration, now time.Time) (influxPoint, error) {
+	var p influxPoint
+	p.measurement, line = scanInfluxToken(line, ", ")
+	if p.measurement == "" {
+		return p, errors.New("missing measurement")
+	}
+	if strings.ContainsAny(p.measurement, "{}") {
+		return p, fmt.Errorf("wrong measurement %s", p.measurement)
+	}
+
+	p.tags = make(models.Labels)
+	for strings.HasPrefix(line, ",") {
+		var key, value string
+		key, line = scanInfluxToken(line[1:], ",= ")
+		if !strings.HasPrefix(line, "=") {
+			return p, fmt.Errorf("tag %s: missing value", key)
+		}
+		value, line = scanInfluxToken(line[1:], ",= ")
+		// tag names are label names of series id
+		if key == "" || value == "" || strings.ContainsAny(key, `{}=," `) {
+			return p, fmt.Errorf("wrong tag %s=%s", key, value)
+		}
+		p.tags[key] = value
+	}
+	if !strings.HasPrefix(line, " ") {
+		return p, fmt.Errorf("unexpected %q after tags", line)
+	}
+
+	line = strings.TrimLeft(line, " ")
+	for {
+		var key string
+		key, line = scanInfluxToken(line, ",= ")
+		if key == "" || !strings.HasPrefix(line, "=") {
+			return p, fmt.Errorf("wrong field %s", key)
+		}
+		if strings.ContainsAny(key, "{}") {
+			return p, fmt.Errorf("wrong field %s", key)
+		}
+		f, rest, err := parseInfluxFieldValue(key, line[1:])
+		if err != nil {
+			return p, err
+		}
+		p.fields = append(p.fields, f)
+		line = rest
+		if !strings.HasPrefix(line, ",") {
+			break
+		}
+		line = line[1:]
+	}
+
+	p.timestamp = now
+	if line = strings.TrimSpace(line); line != "" {
+		ts, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("wrong timestamp %s", line)
+		}
+		if ts > math.MaxInt64/int64(precision) || ts < math.MinInt64/int64(precision) {
+			return p, fmt.Errorf("timestamp %s is out of range", line)
+		}
+		p.timestamp = time.Unix(0, ts*int64(precision))
+	}
+	return p, nil
+}
+
+// metrics return metrics of point fields: measurement_field series with tags as labels.
+// Integer fields are counters with cumulative value in delta (telegraf integers are cumulative),
+// float and boolean fields are gauges, string fields are skipped.
+func (p *influxPoint) metrics() []models.Metrics {
+	res := make([]models.Metrics, 0, len(p.fields))
+	for _, f := range p.fields {
+		m := models.Metrics{ID: p.measurement + "_" + f.key, Labels: p.tags}
+		// selecting field type
+		switch f.kind {
+		case influxInteger:
+			delta := f.delta
+			m.MType, m.Delta = metrictypes.CounterType, &delta
+		case influxFloat, influxBoolean:
+			value := f.value
+			m.MType, m.Value = metrictypes.GaugeType, &value
+		default:
+			continue
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
+// influxWrite api method for influxdb v1/v2 line protocol write (telegraf influxdb outputs).
+// Valid lines are written, rejected lines are reported in response with status 400.
+// Timestamps are parsed and order points of request (last gauge value wins), stored samples have time of write.
+// Integer fields are written as counter deltas of cumulative values.
+func (mh *metricHandlers) influxWrite() http.HandlerFunc {
+	state := newInfluxState()
+	return func(w http.ResponseWriter, r *http.Request) {
+		precision, ok := influxPrecisions[r.URL.Query().Get("precision")]
+		if !ok {
+			http.Error(w, fmt.Sprintf("wrong precision: %s", r.URL.Query().Get("precision")), http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxInfluxBody))
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "can't read request", http.StatusBadRequest)
+			return
+		}
+
+		var (
+			points   []influxPoint
+			lineErrs []influxLineError
+			rejected int
+		)
+		now := time.Now()
+		for i, line := range bytes.Split(body, []byte("\n")) {
+			line = bytes.TrimSpace(line)
+			if len(line) == 0 || line[0] == '#' {
+				continue
+			}
+			p, err := parseInfluxLine(string(line), precision, now)
+			if err != nil {
+				rejected++
+				if len(lineErrs) < maxInfluxLineErrors {
+					lineErrs = append(lineErrs, influxLineError{Line: i + 1, Error: err.Error()})
+				}
+				continue
+			}
+			points = append(points, p)
+		}
+
+		ctx := mh.requestCtx(r)
+		tenant := storage.TenantFromContext(ctx)
+
+		// counter deltas depend on previous requests
+		state.Lock()
+		defer state.Unlock()
+
+		sort.SliceStable(points, func(i, j int) bool { return points[i].timestamp.Before(points[j].timestamp) })
+		var metrics []models.Metrics
+		last := make(map[string]int64)
+		for _, p := range points {
+			for _, m := range p.metrics() {
+				if m.MType == metrictypes.CounterType {
+					series := models.SeriesID(m.ID, m.Labels)
+					delta, err := mh.counterDelta(ctx, state.last, last, tenant+"\x00"+series, series, *m.Delta)
+					if err != nil {
+						log.Println(err)
+						http.Error(w, "error to get counter", http.StatusInternalServerError)
+						return
+					}
+					m.Delta = &delta
+				}
+				metrics = append(metrics, m)
+			}
+		}
+		if len(metrics) > 0 {
+			if err := mh.reqRetrier.UseRetrierWMB(mh.storage.WriteBatchMetrics)(ctx, metrics); err != nil {
+				log.Println(err)
+				http.Error(w, "error to store batch metrics", http.StatusInternalServerError)
+				return
+			}
+		}
+		// last values are changed only with stored deltas
+		now = time.Now()
+		for k, v := range last {
+			state.last[k] = v
+			state.expiry.touch(k, now)
+		}
+		for _, k := range state.expiry.expired(now) {
+			delete(state.last, k)
+		}
+
+		if rejected > 0 {
+			msg := fmt.Sprintf("partial write: %d of %d lines rejected", rejected, rejected+len(points))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			if err := json.NewEncoder(w).Encode(influxWriteError{Code: "invalid", Message: msg, Error: msg, Lines: lineErrs}); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
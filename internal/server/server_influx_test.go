@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/cryptandsign"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/retrier"
+	"github.com/sourcecd/monitoring/internal/storage"
+)
+
+func TestParseInfluxLine(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(100, 0)
+	testCases := []struct {
+		name      string
+		line      string
+		precision time.Duration
+		point     influxPoint
+		err       string
+	}{
+		{
+			name: "tags_and_timestamp",
+			line: `cpu,host=server01,region=us-west usage_idle=98.5,procs=12i,running=t 1465839830100400200`,
+			point: influxPoint{
+				measurement: "cpu",
+				tags:        models.Labels{"host": "server01", "region": "us-west"},
+				fields: []influxField{
+					{key: "usage_idle", kind: influxFloat, value: 98.5},
+					{key: "procs", kind: influxInteger, delta: 12},
+					{key: "running", kind: influxBoolean, value: 1},
+				},
+				timestamp: time.Unix(0, 1465839830100400200),
+			},
+		},
+		{
+			name:      "precision_without_tags",
+			line:      `mem used=1024u,status="ok, \"fine\"" 1465839830`,
+			precision: time.Second,
+			point: influxPoint{
+				measurement: "mem",
+				tags:        models.Labels{},
+				fields: []influxField{
+					{key: "used", kind: influxInteger, delta: 1024},
+					{key: "status", kind: influxString},
+				},
+				timestamp: time.Unix(1465839830, 0),
+			},
+		},
+		{
+			name: "escapes_without_timestamp",
+			line: `disk\ io,path=/mnt\,data,dev=sd\ a read\ bytes=-1.5e3`,
+			point: influxPoint{
+				measurement: "disk io",
+				tags:        models.Labels{"path": "/mnt,data", "dev": "sd a"},
+				fields:      []influxField{{key: "read bytes", kind: influxFloat, value: -1500}},
+				timestamp:   now,
+			},
+		},
+		{name: "no_fields", line: `cpu,host=a`, err: `unexpected "" after tags`},
+		{name: "tag_without_value", line: `cpu,host value=1`, err: "tag host: missing value"},
+		{name: "bad_tag_name", line: `cpu,ho"st=a value=1`, err: `wrong tag ho"st=a`},
+		{name: "escaped_tag_name", line: `cpu,ho\=st=a value=1`, err: "wrong tag ho=st=a"},
+		{name: "bad_integer", line: `cpu value=1.5i`, err: "field value: wrong integer 1.5i"},
+		{name: "nan", line: `cpu value=NaN`, err: "field value: wrong float NaN"},
+		{name: "unterminated_string", line: `cpu value="abc`, err: "field value: unterminated string"},
+		{name: "missing_value", line: `cpu value=,a=1`, err: "field value: missing value"},
+		{name: "bad_timestamp", line: `cpu value=1 12:00`, err: "wrong timestamp 12:00"},
+		{name: "timestamp_overflow", line: `cpu value=1 9223372036854775807`, precision: time.Hour, err: "timestamp 9223372036854775807 is out of range"},
+		{name: "braces", line: `cpu{a} value=1`, err: "wrong measurement cpu{a}"},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			precision := tt.precision
+			if precision == 0 {
+				precision = time.Nanosecond
+			}
+			p, err := parseInfluxLine(tt.line, precision, now)
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.point.measurement, p.measurement)
+			require.Equal(t, tt.point.tags, p.tags)
+			require.Equal(t, tt.point.fields, p.fields)
+			require.True(t, tt.point.timestamp.Equal(p.timestamp))
+		})
+	}
+}
+
+func TestInfluxWrite(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	testStorage := storage.NewMemStorage()
+	mh := &metricHandlers{
+		ctx:        ctx,
+		storage:    testStorage,
+		reqRetrier: retrier.NewRetrier(),
+		crypt:      cryptandsign.NewAsymmetricCryptRsa(),
+	}
+	ts := httptest.NewServer(chiRouter(mh, "", "", nil))
+	t.Cleanup(func() { ts.Close() })
+
+	write := func(path, body string) (*http.Response, []byte) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write([]byte(body))
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		req, err := http.NewRequest(http.MethodPost, ts.URL+path, &buf)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		req.Header.Set("Content-Encoding", "gzip")
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var res bytes.Buffer
+		_, err = res.ReadFrom(resp.Body)
+		require.NoError(t, err)
+		return resp, res.Bytes()
+	}
+
+	resp, _ := write("/write?db=telegraf&precision=s", strings.Join([]string{
+		"# telegraf",
+		"cpu,host=a usage=10.5,procs=3i 1700000001",
+		"cpu,host=a usage=20.5,procs=2i 1700000000",
+		"",
+	}, "\n"))
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	// gauge keeps value of latest point, counter sums deltas of cumulative values
+	g, err := testStorage.GetMetric(ctx, metrictypes.GaugeType, `cpu_usage{host="a"}`)
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(10.5), g)
+	c, err := testStorage.GetMetric(ctx, metrictypes.CounterType, `cpu_procs{host="a"}`)
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(3), c)
+	// next request continues cumulative value, reset of value starts from zero
+	resp, _ = write("/write?precision=s", "cpu,host=a procs=7i 1700000002\ncpu,host=a procs=2i 1700000003")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	c, err = testStorage.GetMetric(ctx, metrictypes.CounterType, `cpu_procs{host="a"}`)
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(9), c)
+	// series of stored counter, which isn't seen since start, is base of next deltas
+	restarted := httptest.NewServer(chiRouter(mh, "", "", nil))
+	t.Cleanup(func() { restarted.Close() })
+	for _, v := range []string{"10i", "12i"} {
+		req, err := http.NewRequest(http.MethodPost, restarted.URL+"/write", strings.NewReader("cpu,host=a procs="+v))
+		require.NoError(t, err)
+		resp, err := restarted.Client().Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+	c, err = testStorage.GetMetric(ctx, metrictypes.CounterType, `cpu_procs{host="a"}`)
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(11), c)
+
+	resp, body := write("/api/v2/write?org=o&bucket=b", "mem free=1i\ncpu,host value=1\nmem used=5\r\nmem total=1.5.5\n")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	var writeErr influxWriteError
+	require.NoError(t, json.Unmarshal(body, &writeErr))
+	require.Equal(t, influxWriteError{
+		Code:    "invalid",
+		Message: "partial write: 2 of 4 lines rejected",
+		Error:   "partial write: 2 of 4 lines rejected",
+		Lines: []influxLineError{
+			{Line: 2, Error: "tag host: missing value"},
+			{Line: 4, Error: "field total: wrong float 1.5.5"},
+		},
+	}, writeErr)
+	// valid lines of request are written
+	c, err = testStorage.GetMetric(ctx, metrictypes.CounterType, "mem_free")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(1), c)
+	g, err = testStorage.GetMetric(ctx, metrictypes.GaugeType, "mem_used")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(5), g)
+
+	resp, _ = write("/write?precision=d", "mem used=5")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
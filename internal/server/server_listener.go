@@ -0,0 +1,96 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// tcpConns active connections of tcp listeners (statsd, graphite), which are closed on shutdown.
+type tcpConns struct {
+	sync.Mutex
+	wg     sync.WaitGroup        // handlers of connections
+	active map[net.Conn]struct{} // active connections
+	closed bool                  // listeners are shut down, new connections are closed
+}
+
+// allowedAddr check that source address belongs to allowed subnets (nil - all addresses).
+func allowedAddr(addr net.Addr, subnets []netip.Prefix) bool {
+	if subnets == nil {
+		return true
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	for _, v := range subnets {
+		if v.Contains(ap.Addr().Unmap()) {
+			return true
+		}
+	}
+	log.Printf("wrong client ip %v", ap.Addr())
+	return false
+}
+
+// serve method for accept connections from allowed subnets till listener is closed, each connection is handled by own goroutine.
+// Panic of handler closes its connection only.
+func (c *tcpConns) serve(l net.Listener, subnets []netip.Prefix, handle func(conn net.Conn)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !allowedAddr(conn.RemoteAddr(), subnets) {
+			conn.Close()
+			continue
+		}
+		c.Lock()
+		if c.closed {
+			c.Unlock()
+			conn.Close()
+			continue
+		}
+		if c.active == nil {
+			c.active = make(map[net.Conn]struct{})
+		}
+		c.active[conn] = struct{}{}
+		c.wg.Add(1)
+		c.Unlock()
+		go func() {
+			defer c.wg.Done()
+			defer func() {
+				c.Lock()
+				delete(c.active, conn)
+				c.Unlock()
+				conn.Close()
+			}()
+			// handler panic on malformed data drops only its connection
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("connection %v: handler panic: %v", conn.RemoteAddr(), r)
+				}
+			}()
+			handle(conn)
+		}()
+	}
+}
+
+// close method for close active connections on shutdown (handlers get read errors).
+func (c *tcpConns) close() {
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
+	for conn := range c.active {
+		conn.Close()
+	}
+}
+
+// wait method for wait finish of connection handlers.
+func (c *tcpConns) wait() {
+	c.wg.Wait()
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowedAddr(t *testing.T) {
+	t.Parallel()
+	subnets := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	require.True(t, allowedAddr(&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 8125}, subnets))
+	require.True(t, allowedAddr(&net.UDPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 8125}, subnets))
+	require.False(t, allowedAddr(&net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 2003}, subnets))
+	require.True(t, allowedAddr(&net.UDPAddr{IP: net.ParseIP("192.168.0.1")}, nil))
+}
+
+func TestTCPConns(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var conns tcpConns
+	lines := make(chan string)
+	done := make(chan error)
+	go func() {
+		done <- conns.serve(l, nil, func(conn net.Conn) {
+			sc := bufio.NewScanner(conn)
+			for sc.Scan() {
+				lines <- sc.Text()
+			}
+		})
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", <-lines)
+
+	// shutdown closes listener and active connections
+	l.Close()
+	require.NoError(t, <-done)
+	conns.close()
+	conns.wait()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestTCPConnsPanic(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var conns tcpConns
+	done := make(chan error)
+	go func() {
+		done <- conns.serve(l, nil, func(conn net.Conn) {
+			panic("malformed data")
+		})
+	}()
+
+	// connection of panicked handler is closed, listener keeps serving
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err = conn.Read(make([]byte, 1))
+		require.Error(t, err)
+		require.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+		conn.Close()
+	}
+
+	l.Close()
+	require.NoError(t, <-done)
+	conns.close()
+	conns.wait()
+}
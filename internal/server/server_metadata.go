@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+// formatMetadataTxt format metadata section of metrics page: name (type, unit): description.
+func formatMetadataTxt(meta []models.Metadata) string {
+	if len(meta) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("---Metadata---\n")
+	for _, v := range meta {
+		b.WriteString(v.ID)
+		var hints []string
+		for _, h := range []string{v.MType, v.Unit} {
+			if h != "" {
+				hints = append(hints, h)
+			}
+		}
+		if len(hints) > 0 {
+			fmt.Fprintf(&b, " (%s)", strings.Join(hints, ", "))
+		}
+		if v.Description != "" {
+			fmt.Fprintf(&b, ": %s", v.Description)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// updateMetadataJSON api method for register metadata (unit, description, type hint) of metric names.
+func (mh *metricHandlers) updateMetadataJSON() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var meta []models.Metadata
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, fmt.Sprintf("wrong content type: %s", r.Header.Get("Content-Type")), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+			http.Error(w, "error to pasrse json request", http.StatusBadRequest)
+			return
+		}
+
+		if err := mh.reqRetrier.UseRetrierWriteMetadata(mh.storage.WriteMetadata)(mh.requestCtx(r), meta); err != nil {
+			if errors.Is(err, customerrors.ErrWrongMetadata) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Println(err)
+			http.Error(w, "error to store metadata", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(meta); err != nil {
+			http.Error(w, "can't encode json", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// getMetadataJSON api method for get metadata of all metric names.
+func (mh *metricHandlers) getMetadataJSON() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		meta, err := mh.reqRetrier.UseRetrierGetMetadata(mh.storage.GetMetadata)(mh.requestCtx(r))
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "can't get metadata", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(meta); err != nil {
+			http.Error(w, "can't encode json", http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/cryptandsign"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/retrier"
+	"github.com/sourcecd/monitoring/internal/storage"
+)
+
+func TestFormatMetadataTxt(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, "", formatMetadataTxt(nil))
+	require.Equal(t, "---Metadata---\nAlloc (gauge, bytes): Bytes of allocated heap objects\nPollCount (count)\nRandomValue\n",
+		formatMetadataTxt([]models.Metadata{
+			{ID: "Alloc", MType: "gauge", Unit: "bytes", Description: "Bytes of allocated heap objects"},
+			{ID: "PollCount", Unit: "count"},
+			{ID: "RandomValue"},
+		}))
+}
+
+func TestMetadataAPI(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var keyenc, privkeypath string
+	testStorage := storage.NewMemStorage()
+	mh := &metricHandlers{
+		ctx:        ctx,
+		storage:    testStorage,
+		reqRetrier: retrier.NewRetrier(),
+		crypt:      cryptandsign.NewAsymmetricCryptRsa(),
+	}
+	ts := httptest.NewServer(chiRouter(mh, keyenc, privkeypath, nil))
+	t.Cleanup(func() { ts.Close() })
+
+	testCase := []struct {
+		name        string
+		contentType string
+		request     string
+		response    string
+		statusCode  int
+	}{
+		{
+			name:        "register",
+			contentType: "application/json",
+			request:     `[{"id":"Alloc","type":"gauge","unit":"bytes","description":"Bytes of allocated heap objects"},{"id":"PollCount","unit":"count"}]`,
+			response:    `[{"id":"Alloc","type":"gauge","unit":"bytes","description":"Bytes of allocated heap objects"},{"id":"PollCount","unit":"count"}]` + "\n",
+			statusCode:  http.StatusOK,
+		},
+		{name: "wrong-type", contentType: "application/json", request: `[{"id":"Alloc","type":"wrong"}]`, statusCode: http.StatusBadRequest},
+		{name: "empty-id", contentType: "application/json", request: `[{"unit":"bytes"}]`, statusCode: http.StatusBadRequest},
+		{name: "bad-json", contentType: "application/json", request: `{`, statusCode: http.StatusBadRequest},
+		{name: "content-type", contentType: "text/plain", request: `[]`, statusCode: http.StatusBadRequest},
+	}
+	for _, v := range testCase {
+		t.Run(v.name, func(t *testing.T) {
+			resp, err := ts.Client().Post(ts.URL+"/metadata/", v.contentType, strings.NewReader(v.request))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, v.statusCode, resp.StatusCode)
+			if v.response != "" {
+				b, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				require.Equal(t, v.response, string(b))
+			}
+		})
+	}
+
+	resp, err := ts.Client().Get(ts.URL + "/metadata/")
+	require.NoError(t, err)
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, `[{"id":"Alloc","type":"gauge","unit":"bytes","description":"Bytes of allocated heap objects"},{"id":"PollCount","unit":"count"}]`+"\n", string(b))
+
+	// metadata is rendered on metrics page
+	require.NoError(t, testStorage.WriteMetric(ctx, "gauge", "Alloc", metrictypes.Gauge(1)))
+	resp, err = ts.Client().Get(ts.URL + "/")
+	require.NoError(t, err)
+	b, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Contains(t, string(b), "---Metadata---\nAlloc (gauge, bytes): Bytes of allocated heap objects\nPollCount (count)\n")
+}
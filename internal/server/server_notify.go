@@ -0,0 +1,376 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/sourcecd/monitoring/internal/cryptandsign"
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/retrier"
+	"github.com/sourcecd/monitoring/internal/storage"
+)
+
+// Default interval of repeated notifications of firing alerts group.
+const defaultRepeatInterval = 4 * time.Hour
+
+// Default content type of webhook notifications.
+const defaultWebhookContentType = "application/json"
+
+// Timeout of single webhook request (retries are limited by retrier timeout).
+const webhookRequestTimeout = 10 * time.Second
+
+// alertReceiverConfig type of webhook receiver in alert rules config file.
+type alertReceiverConfig struct {
+	SendResolved   *bool             `json:"send_resolved,omitempty"`   // send notification of resolved alerts (default true)
+	Match          map[string]string `json:"match,omitempty"`           // labels of alerts sent to receiver (empty - all alerts of tenant)
+	GroupBy        []string          `json:"group_by,omitempty"`        // labels of alerts grouping (empty - single group)
+	Name           string            `json:"name"`                      // receiver name (unique of tenant)
+	Tenant         string            `json:"tenant,omitempty"`          // tenant of alerts (empty - default tenant, registered tenant is required, when tenants are set)
+	URL            string            `json:"url"`                       // webhook url
+	Key            string            `json:"key,omitempty"`             // hmac key of HashSHA256 header (empty - unsigned)
+	Template       string            `json:"template,omitempty"`        // body template (empty - json of notification)
+	ContentType    string            `json:"content_type,omitempty"`    // body content type (default application/json)
+	RepeatInterval string            `json:"repeat_interval,omitempty"` // interval of repeated notification of firing group (default 4h)
+}
+
+// alertReceiver type of loaded webhook receiver with its groups state (groups are saved as notification times of alerts).
+type alertReceiver struct {
+	cfg            alertReceiverConfig    // receiver config
+	body           *template.Template     // parsed body template (nil - json of notification)
+	repeatInterval time.Duration          // interval of repeated notification of firing group
+	sendResolved   bool                   // send notification of resolved alerts
+	groups         map[string]*alertGroup // notified groups by group labels
+}
+
+// alertGroup type of notified alerts group state.
+type alertGroup struct {
+	lastSent time.Time           // time of last sent notification
+	notified map[string]struct{} // firing alerts of last sent notification by labels
+}
+
+// newAlertReceiver parse and check receiver config (tenant of receiver must be registered, when tenants are set).
+func newAlertReceiver(cfg alertReceiverConfig, tenants *tenantRegistry) (*alertReceiver, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("%w: empty receiver name", customerrors.ErrWrongAlertRule)
+	}
+	if err := tenants.checkTenant(cfg.Tenant); err != nil {
+		return nil, fmt.Errorf("%w: receiver %s: %w", customerrors.ErrWrongAlertRule, cfg.Name, err)
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: receiver %s: wrong url: %s", customerrors.ErrWrongAlertRule, cfg.Name, cfg.URL)
+	}
+	if cfg.ContentType == "" {
+		cfg.ContentType = defaultWebhookContentType
+	}
+	rcv := &alertReceiver{
+		cfg:            cfg,
+		repeatInterval: defaultRepeatInterval,
+		sendResolved:   cfg.SendResolved == nil || *cfg.SendResolved,
+		groups:         make(map[string]*alertGroup),
+	}
+	if cfg.RepeatInterval != "" {
+		rcv.repeatInterval, err = time.ParseDuration(cfg.RepeatInterval)
+		if err != nil || rcv.repeatInterval <= 0 {
+			return nil, fmt.Errorf("%w: receiver %s: wrong repeat interval: %s", customerrors.ErrWrongAlertRule, cfg.Name, cfg.RepeatInterval)
+		}
+	}
+	if cfg.Template != "" {
+		rcv.body, err = template.New(cfg.Name).Option("missingkey=zero").Parse(cfg.Template)
+		if err != nil {
+			return nil, fmt.Errorf("%w: receiver %s: template: %w", customerrors.ErrWrongAlertRule, cfg.Name, err)
+		}
+	}
+	return rcv, nil
+}
+
+// matches check labels of alert by receiver match labels.
+func (rcv *alertReceiver) matches(a models.Alert) bool {
+	for k, v := range rcv.cfg.Match {
+		if a.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// groupLabels group_by labels of alert.
+func (rcv *alertReceiver) groupLabels(a models.Alert) models.Labels {
+	labels := make(models.Labels, len(rcv.cfg.GroupBy))
+	for _, k := range rcv.cfg.GroupBy {
+		if v, ok := a.Labels[k]; ok {
+			labels[k] = v
+		}
+	}
+	return labels
+}
+
+// render render notification body by template or json.
+func (rcv *alertReceiver) render(n models.AlertNotification) (string, error) {
+	var buf bytes.Buffer
+	if rcv.body == nil {
+		if err := json.NewEncoder(&buf).Encode(n); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+	if err := rcv.body.Execute(&buf, n); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// notifications group alerts of receiver and return groups, which need notification.
+// Group is notified, when its firing alerts are changed (new firing or resolved alert)
+// and every repeat interval while it has firing alerts. Group state of not notified
+// groups is updated in place, notified groups are updated by sent after delivery.
+func (rcv *alertReceiver) notifications(alerts []models.Alert, now time.Time) map[string]models.AlertNotification {
+	type groupAlerts struct {
+		labels   models.Labels
+		firing   []models.Alert
+		resolved []models.Alert
+	}
+	current := make(map[string]*groupAlerts)
+	for _, a := range alerts {
+		if !rcv.matches(a) || (a.State != models.AlertFiring && a.State != models.AlertResolved) {
+			continue
+		}
+		labels := rcv.groupLabels(a)
+		key := labels.String()
+		g, ok := current[key]
+		if !ok {
+			g = &groupAlerts{labels: labels}
+			current[key] = g
+		}
+		if a.State == models.AlertFiring {
+			g.firing = append(g.firing, a)
+			continue
+		}
+		// resolved alert is notified once, if its firing was notified
+		if state, ok := rcv.groups[key]; ok {
+			if _, ok := state.notified[a.Labels.String()]; ok {
+				g.resolved = append(g.resolved, a)
+			}
+		}
+	}
+	// group without alerts has nothing to notify
+	for key := range rcv.groups {
+		if _, ok := current[key]; !ok {
+			delete(rcv.groups, key)
+		}
+	}
+
+	res := make(map[string]models.AlertNotification)
+	for key, g := range current {
+		state, ok := rcv.groups[key]
+		if !ok {
+			state = &alertGroup{notified: make(map[string]struct{})}
+		}
+		changed := len(g.resolved) > 0 || len(g.firing) != len(state.notified)
+		for _, a := range g.firing {
+			if _, ok := state.notified[a.Labels.String()]; !ok {
+				changed = true
+			}
+		}
+		switch {
+		case len(g.firing) > 0 && (changed || now.Sub(state.lastSent) >= rcv.repeatInterval):
+			n := models.AlertNotification{GroupLabels: g.labels, Receiver: rcv.cfg.Name, Status: models.AlertFiring, Alerts: g.firing}
+			if rcv.sendResolved {
+				n.Alerts = append(n.Alerts, g.resolved...)
+			}
+			res[key] = n
+		case len(g.firing) == 0 && len(g.resolved) > 0 && rcv.sendResolved:
+			res[key] = models.AlertNotification{GroupLabels: g.labels, Receiver: rcv.cfg.Name, Status: models.AlertResolved, Alerts: g.resolved}
+		case len(g.firing) == 0:
+			delete(rcv.groups, key)
+		}
+	}
+	return res
+}
+
+// sent update group state by delivered notification.
+func (rcv *alertReceiver) sent(key string, n models.AlertNotification, now time.Time) {
+	state := &alertGroup{lastSent: now, notified: make(map[string]struct{})}
+	for _, a := range n.Alerts {
+		if a.State == models.AlertFiring {
+			state.notified[a.Labels.String()] = struct{}{}
+		}
+	}
+	if len(state.notified) == 0 {
+		delete(rcv.groups, key)
+		return
+	}
+	rcv.groups[key] = state
+}
+
+// restoreGroups restore notified groups by saved notification times of alerts.
+func (rcv *alertReceiver) restoreGroups(alerts []models.Alert) {
+	for _, a := range alerts {
+		sent, ok := a.Notified[rcv.cfg.Name]
+		if !ok || !rcv.matches(a) {
+			continue
+		}
+		key := rcv.groupLabels(a).String()
+		state, ok := rcv.groups[key]
+		if !ok {
+			state = &alertGroup{notified: make(map[string]struct{})}
+			rcv.groups[key] = state
+		}
+		state.notified[a.Labels.String()] = struct{}{}
+		if sent.After(state.lastSent) {
+			state.lastSent = sent
+		}
+	}
+}
+
+// postWebhook post notification to webhook url, client error answer isn't retried.
+func postWebhook(r *resty.Request, send, url, _ string) (*resty.Response, error) {
+	resp, err := r.SetBody(send).Post(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() >= http.StatusBadRequest && resp.StatusCode() < http.StatusInternalServerError && resp.StatusCode() != http.StatusTooManyRequests {
+		return nil, customerrors.ErrWebhookRejected
+	}
+	if !resp.IsSuccess() {
+		return nil, fmt.Errorf("ans: %d, %s", resp.StatusCode(), resp.Body())
+	}
+	return resp, nil
+}
+
+// webhookSender send function of receiver, body is signed by receiver key.
+func (rcv *alertReceiver) webhookSender(client *resty.Client) retrier.NotifyType {
+	return func(ctx context.Context, url, body string) error {
+		r := client.R().SetContext(ctx).SetHeader("Content-Type", rcv.cfg.ContentType)
+		_, err := cryptandsign.SignNew(postWebhook, rcv.cfg.Key)(r, body, url, "")
+		return err
+	}
+}
+
+// alertDelivery notification of receiver group.
+type alertDelivery struct {
+	rcv    *alertReceiver           // receiver of notification
+	tenant string                   // tenant of receiver
+	key    string                   // group key
+	n      models.AlertNotification // notification of group
+}
+
+// notify start sending of notifications of tenants alerts to tenant receivers in background.
+// Evaluation doesn't wait for delivery: while previous notifications are sent, groups aren't checked
+// (they are checked after next evaluation). Failed notification is sent again after next evaluation.
+func (am *alertManager) notify(ctx context.Context, tenants []string, now time.Time) {
+	select {
+	case am.sending <- struct{}{}:
+	default:
+		return
+	}
+	var deliveries []alertDelivery
+	for _, tenant := range tenants {
+		var alerts []models.Alert
+		for _, rcv := range am.receivers {
+			if rcv.cfg.Tenant != tenant {
+				continue
+			}
+			if alerts == nil {
+				alerts = am.alerts(tenant, "")
+				// notification times are receivers state, not part of notification
+				for i := range alerts {
+					alerts[i].Notified = nil
+				}
+			}
+			groups := rcv.notifications(alerts, now)
+			keys := make([]string, 0, len(groups))
+			for k := range groups {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				deliveries = append(deliveries, alertDelivery{rcv: rcv, tenant: tenant, key: key, n: groups[key]})
+			}
+		}
+	}
+	if len(deliveries) == 0 {
+		<-am.sending
+		return
+	}
+	go func() {
+		defer func() { <-am.sending }()
+		am.deliver(ctx, deliveries, now)
+	}()
+}
+
+// deliver send notifications and save notified groups with alerts state of tenants.
+func (am *alertManager) deliver(ctx context.Context, deliveries []alertDelivery, now time.Time) {
+	var tenants []string
+	for _, d := range deliveries {
+		body, err := d.rcv.render(d.n)
+		if err == nil {
+			err = am.mh.reqRetrier.UseRetrierNotify(d.rcv.webhookSender(am.client))(ctx, d.rcv.cfg.URL, body)
+		}
+		if err != nil {
+			log.Printf("receiver %s: %v", d.rcv.cfg.Name, err)
+			continue
+		}
+		d.rcv.sent(d.key, d.n, now)
+		am.notified(d.rcv, d.tenant, d.key, now)
+		if len(tenants) == 0 || tenants[len(tenants)-1] != d.tenant {
+			tenants = append(tenants, d.tenant)
+		}
+	}
+	for _, tenant := range tenants {
+		if err := am.save(storage.WithTenant(ctx, tenant), tenant); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// notified set notification times of receiver in alerts of notified group (alerts maps are replaced, not changed,
+// because copies of alerts share them).
+func (am *alertManager) notified(rcv *alertReceiver, tenant, key string, now time.Time) {
+	state := rcv.groups[key]
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	for _, rule := range am.rules {
+		if rule.cfg.Tenant != tenant {
+			continue
+		}
+		for _, a := range rule.alerts {
+			if !rcv.matches(*a) || rcv.groupLabels(*a).String() != key {
+				continue
+			}
+			notified := make(map[string]time.Time, len(a.Notified)+1)
+			for k, v := range a.Notified {
+				if k != rcv.cfg.Name {
+					notified[k] = v
+				}
+			}
+			if state != nil {
+				if _, ok := state.notified[a.Labels.String()]; ok {
+					notified[rcv.cfg.Name] = now
+				}
+			}
+			if len(notified) == 0 {
+				notified = nil
+			}
+			a.Notified = notified
+		}
+	}
+	am.dirty[tenant] = true
+}
+
+// waitNotifications wait until notifications are sent.
+func (am *alertManager) waitNotifications() {
+	am.sending <- struct{}{}
+	<-am.sending
+}
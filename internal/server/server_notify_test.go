@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/retrier"
+	"github.com/sourcecd/monitoring/internal/storage"
+)
+
+// webhookRequest received webhook notification.
+type webhookRequest struct {
+	path        string
+	body        string
+	sign        string
+	contentType string
+}
+
+// webhookReceiver test webhook server with answers by path.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	requests []webhookRequest // received notifications
+	answers  map[string][]int // queued answer codes by path (empty - 200)
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := io.ReadAll(r.Body)
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.requests = append(wr.requests, webhookRequest{
+		path:        r.URL.Path,
+		body:        string(b),
+		sign:        r.Header.Get("HashSHA256"),
+		contentType: r.Header.Get("Content-Type"),
+	})
+	code := http.StatusOK
+	if len(wr.answers[r.URL.Path]) > 0 {
+		code, wr.answers[r.URL.Path] = wr.answers[r.URL.Path][0], wr.answers[r.URL.Path][1:]
+	}
+	w.WriteHeader(code)
+}
+
+// answer queue answer codes of path.
+func (wr *webhookReceiver) answer(path string, codes ...int) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.answers[path] = codes
+}
+
+// take return received notifications and forget them.
+func (wr *webhookReceiver) take() []webhookRequest {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	res := wr.requests
+	wr.requests = nil
+	return res
+}
+
+func TestAlertNotifications(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	wr := &webhookReceiver{answers: make(map[string][]int)}
+	ts := httptest.NewServer(wr)
+	t.Cleanup(func() { ts.Close() })
+
+	testStorage := storage.NewMemStorage()
+	reqRetrier := retrier.NewRetrier()
+	reqRetrier.SetParams(time.Millisecond, 5*time.Second, 3)
+	mh := &metricHandlers{ctx: ctx, storage: testStorage, reqRetrier: reqRetrier}
+	rules, receivers, err := parseAlertRules([]byte(fmt.Sprintf(`{
+		"rules": [{"name": "HighLoad", "metric": "load", "threshold": 1}],
+		"receivers": [
+			{"name": "ops", "url": "%[1]s/ops", "key": "secret", "group_by": ["alertname"], "repeat_interval": "1h"},
+			{
+				"name": "chat",
+				"url": "%[1]s/chat",
+				"match": {"host": "a"},
+				"send_resolved": false,
+				"content_type": "text/plain",
+				"template": "{{ .Status }}:{{ range .Alerts }} {{ .Labels.host }}={{ .Value }}{{ end }}"
+			}
+		]}`, ts.URL)), nil)
+	require.NoError(t, err)
+	am := newAlertManager(mh, rules, receivers)
+	now := time.Unix(1700000000, 0)
+	am.now = func() time.Time { return now }
+	// notifications are sent in background
+	eval := func() {
+		am.evalRules(ctx)
+		am.waitNotifications()
+	}
+
+	setLoad := func(host string, v float64) {
+		require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.GaugeType, `load{host="`+host+`"}`, metrictypes.Gauge(v)))
+	}
+	// ops notification is signed json of alerts group
+	opsNotification := func(req webhookRequest) models.AlertNotification {
+		require.Equal(t, "/ops", req.path)
+		require.Equal(t, "application/json", req.contentType)
+		hm := hmac.New(sha256.New, []byte("secret"))
+		hm.Write([]byte(req.body))
+		require.Equal(t, hex.EncodeToString(hm.Sum(nil)), req.sign)
+		var n models.AlertNotification
+		require.NoError(t, json.Unmarshal([]byte(req.body), &n))
+		require.Equal(t, "ops", n.Receiver)
+		require.Equal(t, models.Labels{"alertname": "HighLoad"}, n.GroupLabels)
+		return n
+	}
+	alertStates := func(n models.AlertNotification) map[string]string {
+		res := make(map[string]string, len(n.Alerts))
+		for _, a := range n.Alerts {
+			res[a.Labels["host"]] = a.State
+		}
+		return res
+	}
+
+	// firing alerts are grouped
+	setLoad("a", 2)
+	setLoad("b", 3)
+	eval()
+	reqs := wr.take()
+	require.Len(t, reqs, 2)
+	n := opsNotification(reqs[0])
+	require.Equal(t, models.AlertFiring, n.Status)
+	require.Equal(t, map[string]string{"a": models.AlertFiring, "b": models.AlertFiring}, alertStates(n))
+	require.Equal(t, webhookRequest{path: "/chat", body: "firing: a=2", contentType: "text/plain"}, reqs[1])
+
+	// unchanged group isn't notified until repeat interval
+	now = now.Add(time.Minute)
+	eval()
+	require.Empty(t, wr.take())
+	now = now.Add(time.Hour)
+	eval()
+	reqs = wr.take()
+	require.Len(t, reqs, 1)
+	require.Equal(t, "/ops", reqs[0].path)
+
+	// resolved alert is sent with firing alerts of group
+	setLoad("b", 0)
+	eval()
+	reqs = wr.take()
+	require.Len(t, reqs, 1)
+	n = opsNotification(reqs[0])
+	require.Equal(t, models.AlertFiring, n.Status)
+	require.Equal(t, map[string]string{"a": models.AlertFiring, "b": models.AlertResolved}, alertStates(n))
+	eval()
+	require.Empty(t, wr.take())
+
+	// resolved group
+	setLoad("a", 0)
+	eval()
+	reqs = wr.take()
+	require.Len(t, reqs, 1)
+	n = opsNotification(reqs[0])
+	require.Equal(t, models.AlertResolved, n.Status)
+	require.Equal(t, map[string]string{"a": models.AlertResolved}, alertStates(n))
+	eval()
+	require.Empty(t, wr.take())
+
+	// failed notification is retried
+	wr.answer("/ops", http.StatusInternalServerError, http.StatusTooManyRequests)
+	setLoad("b", 2)
+	eval()
+	reqs = wr.take()
+	require.Len(t, reqs, 3)
+	n = opsNotification(reqs[2])
+	require.Equal(t, map[string]string{"b": models.AlertFiring}, alertStates(n))
+
+	// rejected notification isn't retried, it is sent again after next evaluation
+	wr.answer("/chat", http.StatusBadRequest)
+	setLoad("a", 2)
+	eval()
+	reqs = wr.take()
+	require.Len(t, reqs, 2)
+	require.Equal(t, "/chat", reqs[1].path)
+	eval()
+	reqs = wr.take()
+	require.Len(t, reqs, 1)
+	require.Equal(t, "firing: a=2", reqs[0].body)
+	eval()
+	require.Empty(t, wr.take())
+	// notified groups are restored after restart: unchanged groups aren't notified, resolved alerts are sent
+	rules, receivers, err = parseAlertRules([]byte(fmt.Sprintf(`{
+		"rules": [{"name": "HighLoad", "metric": "load", "threshold": 1}],
+		"receivers": [{"name": "ops", "url": "%[1]s/ops", "key": "secret", "group_by": ["alertname"], "repeat_interval": "1h"}]}`, ts.URL)), nil)
+	require.NoError(t, err)
+	restarted := newAlertManager(mh, rules, receivers)
+	restarted.now = func() time.Time { return now }
+	restarted.evalRules(ctx)
+	restarted.waitNotifications()
+	require.Empty(t, wr.take())
+	setLoad("b", 0)
+	restarted.evalRules(ctx)
+	restarted.waitNotifications()
+	reqs = wr.take()
+	require.Len(t, reqs, 1)
+	n = opsNotification(reqs[0])
+	require.Equal(t, map[string]string{"a": models.AlertFiring, "b": models.AlertResolved}, alertStates(n))
+	for _, a := range n.Alerts {
+		require.Nil(t, a.Notified)
+	}
+	saved, err := testStorage.GetAlerts(ctx)
+	require.NoError(t, err)
+	for _, a := range saved {
+		_, notified := a.Notified["ops"]
+		require.Equal(t, a.State == models.AlertFiring, notified, a.Labels.String())
+	}
+}
@@ -0,0 +1,484 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/storage"
+	"github.com/sourcecd/monitoring/proto/otlp"
+)
+
+const (
+	// Max size of decompressed OTLP request.
+	maxOTLPBody = 32 << 20
+	// Content types of OTLP/HTTP encodings.
+	otlpProtobufContentType = "application/x-protobuf"
+	otlpJSONContentType     = "application/json"
+)
+
+// Chars of attribute keys, which aren't allowed in label names.
+var otlpKeyReplacer = strings.NewReplacer("{", "_", "}", "_", "=", "_", ",", "_", `"`, "_", " ", "_")
+
+// otlpState state of OTLP receiver (shared by requests, guarded by lock).
+// OTLP sums and histograms are cumulative by default, storage keeps sums of deltas, so last values of series are kept.
+type otlpState struct {
+	sync.Mutex
+	counters   map[string]int64                 // last cumulative values of counter series by tenant and series id
+	histograms map[string]metrictypes.Histogram // last cumulative histograms by tenant and series id
+	starts     map[string]uint64                // start times of cumulative series (changed start time is reset)
+	expiry     *seriesExpiry                    // update times of cumulative series
+}
+
+// otlpBatch metrics of export request and pending cumulative values, which are committed after write.
+type otlpBatch struct {
+	state      *otlpState                       // receiver state
+	tenant     string                           // tenant of request
+	metrics    []models.Metrics                 // metrics for write
+	meta       map[string]models.Metadata       // metadata of metric names
+	counters   map[string]int64                 // pending cumulative counter values
+	histograms map[string]metrictypes.Histogram // pending cumulative histograms
+	starts     map[string]uint64                // pending start times
+	rejected   int64                            // number of rejected data points
+	firstErr   error                            // reason of first rejected data point
+}
+
+// newOTLPState init empty OTLP receiver state.
+func newOTLPState() *otlpState {
+	return &otlpState{
+		counters:   make(map[string]int64),
+		histograms: make(map[string]metrictypes.Histogram),
+		starts:     make(map[string]uint64),
+		expiry:     newSeriesExpiry(cumulativeSeriesTTL),
+	}
+}
+
+// newBatch init batch of tenant request.
+func (s *otlpState) newBatch(tenant string) *otlpBatch {
+	return &otlpBatch{
+		state:      s,
+		tenant:     tenant,
+		meta:       make(map[string]models.Metadata),
+		counters:   make(map[string]int64),
+		histograms: make(map[string]metrictypes.Histogram),
+		starts:     make(map[string]uint64),
+	}
+}
+
+// otlpValue return go value of attribute value (nested values are converted for json).
+func otlpValue(v *otlp.AnyValue) any {
+	// selecting value type
+	switch x := v.GetValue().(type) {
+	case *otlp.AnyValue_StringValue:
+		return x.StringValue
+	case *otlp.AnyValue_BoolValue:
+		return x.BoolValue
+	case *otlp.AnyValue_IntValue:
+		return x.IntValue
+	case *otlp.AnyValue_DoubleValue:
+		return x.DoubleValue
+	case *otlp.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(x.BytesValue)
+	case *otlp.AnyValue_ArrayValue:
+		res := make([]any, 0, len(x.ArrayValue.GetValues()))
+		for _, v := range x.ArrayValue.GetValues() {
+			res = append(res, otlpValue(v))
+		}
+		return res
+	case *otlp.AnyValue_KvlistValue:
+		res := make(map[string]any, len(x.KvlistValue.GetValues()))
+		for _, kv := range x.KvlistValue.GetValues() {
+			res[kv.Key] = otlpValue(kv.Value)
+		}
+		return res
+	}
+	return nil
+}
+
+// otlpValueString return label value of attribute value: scalars as text, arrays and maps as json.
+func otlpValueString(v *otlp.AnyValue) string {
+	// selecting value type
+	switch x := otlpValue(v).(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case bool:
+		return strconv.FormatBool(x)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	default:
+		b, err := json.Marshal(x)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+}
+
+// otlpLabels return labels of attributes, attributes of later sets override earlier ones (resource, scope, data point).
+func otlpLabels(sets ...[]*otlp.KeyValue) models.Labels {
+	labels := make(models.Labels)
+	for _, set := range sets {
+		for _, kv := range set {
+			if kv.Key == "" {
+				continue
+			}
+			// empty value is absence of label
+			if v := otlpValueString(kv.Value); v != "" {
+				labels[otlpKeyReplacer.Replace(kv.Key)] = v
+			} else {
+				delete(labels, otlpKeyReplacer.Replace(kv.Key))
+			}
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// reject method for count rejected data points.
+func (b *otlpBatch) reject(n int, err error) {
+	if n == 0 {
+		return
+	}
+	if b.rejected == 0 {
+		b.firstErr = err
+	}
+	b.rejected += int64(n)
+}
+
+// reset method for check reset of cumulative series by changed start time.
+func (b *otlpBatch) reset(key string, start uint64) bool {
+	prev, ok := b.starts[key]
+	if !ok {
+		prev, ok = b.state.starts[key]
+	}
+	b.starts[key] = start
+	return ok && start != 0 && prev != start
+}
+
+// histogramDelta return delta of cumulative histogram (reset of histogram or changed bounds start from zero).
+// Last histogram is taken from pending or committed histograms. Stored histogram is sum of deltas,
+// so first histogram of stored series, which isn't seen since start of server (or is forgotten),
+// is only base of next deltas (empty delta is returned).
+func (b *otlpBatch) histogramDelta(ctx context.Context, mh *metricHandlers, key, series string, h metrictypes.Histogram, reset bool) (metrictypes.Histogram, error) {
+	prev, ok := b.histograms[key]
+	if !ok {
+		prev, ok = b.state.histograms[key]
+	}
+	if !ok {
+		v, err := mh.reqRetrier.UseRetrierGetMetric(mh.storage.GetMetric)(ctx, metrictypes.HistogramType, series)
+		if err != nil && !errors.Is(err, customerrors.ErrNoVal) {
+			return h, err
+		}
+		if stored, isHist := v.(metrictypes.Histogram); isHist && !reset && sameBounds(stored.Bounds, h.Bounds) {
+			b.histograms[key] = h.Clone()
+			return metrictypes.NewHistogram(h.Bounds), nil
+		}
+	}
+	b.histograms[key] = h.Clone()
+
+	delta := h.Clone()
+	if !ok || reset || prev.Count > h.Count || !sameBounds(prev.Bounds, h.Bounds) {
+		return delta, nil
+	}
+	for i := range delta.Counts {
+		if prev.Counts[i] > delta.Counts[i] {
+			return h.Clone(), nil
+		}
+		delta.Counts[i] -= prev.Counts[i]
+	}
+	delta.Count -= prev.Count
+	delta.Sum -= prev.Sum
+	return delta, nil
+}
+
+// sameBounds check that histogram bucket bounds are equal.
+func sameBounds(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// addNumbers method for add gauge or sum data points.
+func (b *otlpBatch) addNumbers(ctx context.Context, mh *metricHandlers, m *otlp.Metric, base []*otlp.KeyValue, counter, cumulative bool) error {
+	points := m.GetGauge().GetDataPoints()
+	if m.GetSum() != nil {
+		points = m.GetSum().GetDataPoints()
+	}
+	for _, p := range points {
+		if p.Flags&uint32(otlp.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK) != 0 {
+			continue
+		}
+		value := p.GetAsDouble()
+		if v, ok := p.GetValue().(*otlp.NumberDataPoint_AsInt); ok {
+			value = float64(v.AsInt)
+		}
+		labels := otlpLabels(base, p.Attributes)
+		if !counter {
+			metric := models.Metrics{ID: m.Name, MType: metrictypes.GaugeType, Value: &value, Labels: labels}
+			b.metrics = append(b.metrics, metric)
+			continue
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) || !cumulative && value < 0 {
+			b.reject(1, fmt.Errorf("metric %s: wrong counter value %v", m.Name, value))
+			continue
+		}
+		delta := int64(math.Round(value))
+		if cumulative {
+			series := models.SeriesID(m.Name, labels)
+			key := b.tenant + "\x00" + series
+			if b.reset(key, p.StartTimeUnixNano) {
+				b.counters[key] = delta
+			} else {
+				var err error
+				if delta, err = mh.counterDelta(ctx, b.state.counters, b.counters, key, series, delta); err != nil {
+					return err
+				}
+			}
+		}
+		b.metrics = append(b.metrics, models.Metrics{ID: m.Name, MType: metrictypes.CounterType, Delta: &delta, Labels: labels})
+	}
+	return nil
+}
+
+// addHistograms method for add explicit bucket histogram data points.
+func (b *otlpBatch) addHistograms(ctx context.Context, mh *metricHandlers, m *otlp.Metric, base []*otlp.KeyValue) error {
+	cumulative := m.GetHistogram().GetAggregationTemporality() == otlp.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+	for _, p := range m.GetHistogram().GetDataPoints() {
+		if p.Flags&uint32(otlp.DataPointFlags_DATA_POINT_FLAGS_NO_RECORDED_VALUE_MASK) != 0 {
+			continue
+		}
+		h := metrictypes.Histogram{Bounds: p.ExplicitBounds, Counts: p.BucketCounts, Sum: p.GetSum(), Count: p.Count}
+		// histogram without buckets has single +Inf bucket
+		if len(h.Counts) == 0 {
+			h.Counts = []uint64{p.Count}
+		}
+		if err := h.Validate(); err != nil {
+			b.reject(1, fmt.Errorf("metric %s: %w", m.Name, err))
+			continue
+		}
+		labels := otlpLabels(base, p.Attributes)
+		if cumulative {
+			series := models.SeriesID(m.Name, labels)
+			key := b.tenant + "\x00" + series
+			var err error
+			if h, err = b.histogramDelta(ctx, mh, key, series, h, b.reset(key, p.StartTimeUnixNano)); err != nil {
+				return err
+			}
+		}
+		value := models.Histogram(h)
+		b.metrics = append(b.metrics, models.Metrics{ID: m.Name, MType: metrictypes.HistogramType, Histogram: &value, Labels: labels})
+	}
+	return nil
+}
+
+// addMetric method for add data points of metric: monotonic sums are counters, gauges and non-monotonic cumulative sums
+// are gauges, explicit bucket histograms are histograms. Other data points are rejected.
+func (b *otlpBatch) addMetric(ctx context.Context, mh *metricHandlers, m *otlp.Metric, base []*otlp.KeyValue) error {
+	if m.Name == "" || strings.ContainsAny(m.Name, "{}") {
+		b.reject(otlpPoints(m), fmt.Errorf("wrong metric name %q", m.Name))
+		return nil
+	}
+	var mType string
+	// selecting metric data type
+	switch data := m.GetData().(type) {
+	case *otlp.Metric_Gauge:
+		mType = metrictypes.GaugeType
+		if err := b.addNumbers(ctx, mh, m, base, false, false); err != nil {
+			return err
+		}
+	case *otlp.Metric_Sum:
+		cumulative := data.Sum.AggregationTemporality == otlp.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+		if !data.Sum.IsMonotonic && !cumulative {
+			b.reject(otlpPoints(m), fmt.Errorf("metric %s: delta non-monotonic sum isn't supported", m.Name))
+			return nil
+		}
+		mType = metrictypes.GaugeType
+		if data.Sum.IsMonotonic {
+			mType = metrictypes.CounterType
+		}
+		if err := b.addNumbers(ctx, mh, m, base, data.Sum.IsMonotonic, cumulative); err != nil {
+			return err
+		}
+	case *otlp.Metric_Histogram:
+		mType = metrictypes.HistogramType
+		if err := b.addHistograms(ctx, mh, m, base); err != nil {
+			return err
+		}
+	default:
+		b.reject(otlpPoints(m), fmt.Errorf("metric %s: data type isn't supported", m.Name))
+		return nil
+	}
+	if m.Description != "" || m.Unit != "" {
+		b.meta[m.Name] = models.Metadata{ID: m.Name, MType: mType, Unit: m.Unit, Description: m.Description}
+	}
+	return nil
+}
+
+// commit method for keep last cumulative values of written batch and forget series, which aren't updated for ttl.
+func (b *otlpBatch) commit() {
+	now := time.Now()
+	for k, v := range b.counters {
+		b.state.counters[k] = v
+		b.state.expiry.touch(k, now)
+	}
+	for k, v := range b.histograms {
+		b.state.histograms[k] = v
+		b.state.expiry.touch(k, now)
+	}
+	for k, v := range b.starts {
+		b.state.starts[k] = v
+		b.state.expiry.touch(k, now)
+	}
+	for _, k := range b.state.expiry.expired(now) {
+		delete(b.state.counters, k)
+		delete(b.state.histograms, k)
+		delete(b.state.starts, k)
+	}
+}
+
+// otlpPoints return number of data points of metric.
+func otlpPoints(m *otlp.Metric) int {
+	return len(m.GetGauge().GetDataPoints()) + len(m.GetSum().GetDataPoints()) + len(m.GetHistogram().GetDataPoints()) +
+		len(m.GetExponentialHistogram().GetDataPoints()) + len(m.GetSummary().GetDataPoints())
+}
+
+// writeOTLPResponse write response message in encoding of request.
+func writeOTLPResponse(w http.ResponseWriter, jsonEnc bool, code int, msg proto.Message) {
+	var (
+		b   []byte
+		err error
+	)
+	if jsonEnc {
+		w.Header().Set("Content-Type", otlpJSONContentType)
+		b, err = protojson.Marshal(msg)
+	} else {
+		w.Header().Set("Content-Type", otlpProtobufContentType)
+		b, err = proto.Marshal(msg)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "can't encode response", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(code)
+	if _, err := w.Write(b); err != nil {
+		log.Println(err)
+	}
+}
+
+// writeOTLPError write error status in encoding of request.
+func writeOTLPError(w http.ResponseWriter, jsonEnc bool, code int, grpcCode codes.Code, msg string) {
+	writeOTLPResponse(w, jsonEnc, code, &otlp.Status{Code: int32(grpcCode), Message: msg})
+}
+
+// otlpMetrics api method for OTLP/HTTP metrics export (protobuf or json ExportMetricsServiceRequest).
+// Resource, scope and data point attributes are labels, cumulative sums and histograms are converted to deltas,
+// data point timestamps aren't kept (history timestamp is time of write). Unsupported data points are reported by partial success.
+func (mh *metricHandlers) otlpMetrics() http.HandlerFunc {
+	state := newOTLPState()
+	return func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != otlpProtobufContentType && mediaType != otlpJSONContentType {
+			http.Error(w, fmt.Sprintf("unsupported content type: %q", r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+			return
+		}
+		jsonEnc := mediaType == otlpJSONContentType
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxOTLPBody))
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				writeOTLPError(w, jsonEnc, http.StatusRequestEntityTooLarge, codes.ResourceExhausted, err.Error())
+				return
+			}
+			writeOTLPError(w, jsonEnc, http.StatusBadRequest, codes.InvalidArgument, "can't read request")
+			return
+		}
+		var req otlp.ExportMetricsServiceRequest
+		if jsonEnc {
+			err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, &req)
+		} else {
+			err = proto.Unmarshal(body, &req)
+		}
+		if err != nil {
+			writeOTLPError(w, jsonEnc, http.StatusBadRequest, codes.InvalidArgument, err.Error())
+			return
+		}
+
+		ctx := mh.requestCtx(r)
+		// cumulative deltas depend on previous requests
+		state.Lock()
+		defer state.Unlock()
+
+		batch := state.newBatch(storage.TenantFromContext(ctx))
+		for _, rm := range req.ResourceMetrics {
+			for _, sm := range rm.ScopeMetrics {
+				base := append(append([]*otlp.KeyValue{}, rm.GetResource().GetAttributes()...), sm.GetScope().GetAttributes()...)
+				for _, m := range sm.Metrics {
+					if err := batch.addMetric(ctx, mh, m, base); err != nil {
+						log.Println(err)
+						writeOTLPError(w, jsonEnc, http.StatusInternalServerError, codes.Internal, "error to get metric")
+						return
+					}
+				}
+			}
+		}
+
+		if len(batch.meta) > 0 {
+			meta := make([]models.Metadata, 0, len(batch.meta))
+			for _, v := range batch.meta {
+				meta = append(meta, v)
+			}
+			if err := mh.reqRetrier.UseRetrierWriteMetadata(mh.storage.WriteMetadata)(ctx, meta); err != nil {
+				log.Println(err)
+				writeOTLPError(w, jsonEnc, http.StatusInternalServerError, codes.Internal, "error to store metadata")
+				return
+			}
+		}
+		if len(batch.metrics) > 0 {
+			if err := mh.reqRetrier.UseRetrierWMB(mh.storage.WriteBatchMetrics)(ctx, batch.metrics); err != nil {
+				log.Println(err)
+				writeOTLPError(w, jsonEnc, http.StatusInternalServerError, codes.Internal, "error to store batch metrics")
+				return
+			}
+		}
+		// last values are changed only with stored deltas (failed request is retried by exporter)
+		batch.commit()
+
+		resp := &otlp.ExportMetricsServiceResponse{}
+		if batch.rejected > 0 {
+			resp.PartialSuccess = &otlp.ExportMetricsPartialSuccess{RejectedDataPoints: batch.rejected, ErrorMessage: batch.firstErr.Error()}
+		}
+		writeOTLPResponse(w, jsonEnc, http.StatusOK, resp)
+	}
+}
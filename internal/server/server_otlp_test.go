@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/sourcecd/monitoring/internal/cryptandsign"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/retrier"
+	"github.com/sourcecd/monitoring/internal/storage"
+	"github.com/sourcecd/monitoring/proto/otlp"
+)
+
+// otlpString attribute with string value.
+func otlpString(key, value string) *otlp.KeyValue {
+	return &otlp.KeyValue{Key: key, Value: &otlp.AnyValue{Value: &otlp.AnyValue_StringValue{StringValue: value}}}
+}
+
+// otlpRequest export request of service metrics.
+func otlpRequest(metrics ...*otlp.Metric) *otlp.ExportMetricsServiceRequest {
+	return &otlp.ExportMetricsServiceRequest{ResourceMetrics: []*otlp.ResourceMetrics{{
+		Resource: &otlp.Resource{Attributes: []*otlp.KeyValue{otlpString("service.name", "api")}},
+		ScopeMetrics: []*otlp.ScopeMetrics{{
+			Scope:   &otlp.InstrumentationScope{Name: "meter", Attributes: []*otlp.KeyValue{otlpString("scope", "http")}},
+			Metrics: metrics,
+		}},
+	}}}
+}
+
+// otlpCounter cumulative monotonic sum with single int data point.
+func otlpCounter(name string, start uint64, value int64) *otlp.Metric {
+	return &otlp.Metric{Name: name, Unit: "1", Data: &otlp.Metric_Sum{Sum: &otlp.Sum{
+		IsMonotonic:            true,
+		AggregationTemporality: otlp.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		DataPoints: []*otlp.NumberDataPoint{{
+			Attributes:        []*otlp.KeyValue{otlpString("code", "200")},
+			StartTimeUnixNano: start,
+			Value:             &otlp.NumberDataPoint_AsInt{AsInt: value},
+		}},
+	}}}
+}
+
+// otlpHistogram cumulative histogram with single data point.
+func otlpHistogram(name string, counts []uint64, sum float64) *otlp.Metric {
+	var count uint64
+	for _, v := range counts {
+		count += v
+	}
+	return &otlp.Metric{Name: name, Data: &otlp.Metric_Histogram{Histogram: &otlp.Histogram{
+		AggregationTemporality: otlp.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		DataPoints: []*otlp.HistogramDataPoint{{
+			StartTimeUnixNano: 1,
+			ExplicitBounds:    []float64{0.1, 1},
+			BucketCounts:      counts,
+			Count:             count,
+			Sum:               &sum,
+		}},
+	}}}
+}
+
+func TestOTLPLabels(t *testing.T) {
+	t.Parallel()
+	labels := otlpLabels(
+		[]*otlp.KeyValue{
+			otlpString("service.name", "api"),
+			otlpString("host name", "a"),
+			{Key: "pid", Value: &otlp.AnyValue{Value: &otlp.AnyValue_IntValue{IntValue: 42}}},
+			{Key: "args", Value: &otlp.AnyValue{Value: &otlp.AnyValue_ArrayValue{ArrayValue: &otlp.ArrayValue{Values: []*otlp.AnyValue{
+				{Value: &otlp.AnyValue_StringValue{StringValue: "-v"}},
+				{Value: &otlp.AnyValue_BoolValue{BoolValue: true}},
+			}}}}},
+		},
+		[]*otlp.KeyValue{otlpString("service.name", "worker"), otlpString("pid", ""), {Key: "ratio", Value: &otlp.AnyValue{Value: &otlp.AnyValue_DoubleValue{DoubleValue: 0.5}}}},
+	)
+	require.Equal(t, models.Labels{"service.name": "worker", "host_name": "a", "args": `["-v",true]`, "ratio": "0.5"}, labels)
+	require.Nil(t, otlpLabels(nil))
+}
+
+func TestOTLPMetrics(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	testStorage := storage.NewMemStorage()
+	mh := &metricHandlers{
+		ctx:        ctx,
+		storage:    testStorage,
+		reqRetrier: retrier.NewRetrier(),
+		crypt:      cryptandsign.NewAsymmetricCryptRsa(),
+	}
+	ts := httptest.NewServer(chiRouter(mh, "", "", nil))
+	t.Cleanup(func() { ts.Close() })
+
+	post := func(contentType string, body []byte) (*http.Response, []byte) {
+		resp, err := ts.Client().Post(ts.URL+"/v1/metrics", contentType, bytes.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, b
+	}
+	export := func(req *otlp.ExportMetricsServiceRequest) *otlp.ExportMetricsServiceResponse {
+		b, err := proto.Marshal(req)
+		require.NoError(t, err)
+		resp, body := post("application/x-protobuf", b)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "application/x-protobuf", resp.Header.Get("Content-Type"))
+		var res otlp.ExportMetricsServiceResponse
+		require.NoError(t, proto.Unmarshal(body, &res))
+		return &res
+	}
+	series := `http.requests{code="200",scope="http",service.name="api"}`
+	getCounter := func() metrictypes.Counter {
+		c, err := testStorage.GetMetric(ctx, metrictypes.CounterType, series)
+		require.NoError(t, err)
+		return c.(metrictypes.Counter)
+	}
+	getHistogram := func() metrictypes.Histogram {
+		h, err := testStorage.GetMetric(ctx, metrictypes.HistogramType, `http.duration{scope="http",service.name="api"}`)
+		require.NoError(t, err)
+		return h.(metrictypes.Histogram)
+	}
+
+	res := export(otlpRequest(
+		otlpCounter("http.requests", 1, 10),
+		&otlp.Metric{Name: "memory.usage", Description: "Memory usage", Unit: "By", Data: &otlp.Metric_Gauge{Gauge: &otlp.Gauge{
+			DataPoints: []*otlp.NumberDataPoint{{Value: &otlp.NumberDataPoint_AsDouble{AsDouble: 1024.5}}},
+		}}},
+		&otlp.Metric{Name: "queue.size", Data: &otlp.Metric_Sum{Sum: &otlp.Sum{
+			AggregationTemporality: otlp.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			DataPoints:             []*otlp.NumberDataPoint{{Value: &otlp.NumberDataPoint_AsInt{AsInt: -3}}},
+		}}},
+		otlpHistogram("http.duration", []uint64{1, 2, 0}, 1.5),
+		&otlp.Metric{Name: "latency", Data: &otlp.Metric_ExponentialHistogram{ExponentialHistogram: &otlp.ExponentialHistogram{
+			DataPoints: []*otlp.ExponentialHistogramDataPoint{{}, {}},
+		}}},
+	))
+	require.Equal(t, int64(2), res.GetPartialSuccess().GetRejectedDataPoints())
+	require.Equal(t, "metric latency: data type isn't supported", res.GetPartialSuccess().GetErrorMessage())
+	require.Equal(t, metrictypes.Counter(10), getCounter())
+	g, err := testStorage.GetMetric(ctx, metrictypes.GaugeType, `memory.usage{scope="http",service.name="api"}`)
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(1024.5), g)
+	g, err = testStorage.GetMetric(ctx, metrictypes.GaugeType, `queue.size{scope="http",service.name="api"}`)
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(-3), g)
+	require.Equal(t, []uint64{1, 2, 0}, getHistogram().Counts)
+	meta, err := testStorage.GetMetadata(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []models.Metadata{
+		{ID: "http.requests", MType: "counter", Unit: "1"},
+		{ID: "memory.usage", MType: "gauge", Unit: "By", Description: "Memory usage"},
+	}, meta)
+
+	// cumulative values are converted to deltas
+	res = export(otlpRequest(otlpCounter("http.requests", 1, 15), otlpHistogram("http.duration", []uint64{2, 3, 1}, 3)))
+	require.Nil(t, res.PartialSuccess)
+	require.Equal(t, metrictypes.Counter(15), getCounter())
+	h := getHistogram()
+	require.Equal(t, []uint64{2, 3, 1}, h.Counts)
+	require.Equal(t, uint64(6), h.Count)
+	require.InDelta(t, 3, h.Sum, 1e-9)
+
+	// changed start time is reset of counter
+	export(otlpRequest(otlpCounter("http.requests", 2, 20)))
+	require.Equal(t, metrictypes.Counter(35), getCounter())
+
+	// json encoding: 64-bit integers are strings, field names are lower camel case
+	resp, body := post("application/json", []byte(`{"resourceMetrics":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"api"}}]},
+		"scopeMetrics":[{"scope":{"name":"meter","attributes":[{"key":"scope","value":{"stringValue":"http"}}]},
+		"metrics":[{"name":"http.requests","unit":"1","sum":{"aggregationTemporality":2,"isMonotonic":true,
+		"dataPoints":[{"attributes":[{"key":"code","value":{"stringValue":"200"}}],"startTimeUnixNano":"2","timeUnixNano":"1700000000000000000","asInt":"25","exemplars":[]}]}}]}]}]}`))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	require.JSONEq(t, `{}`, string(body))
+	require.Equal(t, metrictypes.Counter(40), getCounter())
+
+	// first values of stored series after restart of receiver are base of next deltas
+	restarted := httptest.NewServer(chiRouter(mh, "", "", nil))
+	t.Cleanup(func() { restarted.Close() })
+	for _, v := range []uint64{30, 33} {
+		b, err := proto.Marshal(otlpRequest(otlpCounter("http.requests", 2, int64(v)), otlpHistogram("http.duration", []uint64{v, 3, 1}, 3)))
+		require.NoError(t, err)
+		resp, err := restarted.Client().Post(restarted.URL+"/v1/metrics", "application/x-protobuf", bytes.NewReader(b))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	require.Equal(t, metrictypes.Counter(43), getCounter())
+	require.Equal(t, []uint64{5, 3, 1}, getHistogram().Counts)
+
+	resp, body = post("application/json", []byte(`{"resourceMetrics":`))
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	var status otlp.Status
+	require.NoError(t, protojson.Unmarshal(body, &status))
+	require.Equal(t, int32(3), status.Code)
+
+	resp, _ = post("application/x-protobuf", []byte{0xff})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = post("text/plain", []byte("x"))
+	require.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+}
@@ -0,0 +1,431 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Opcodes of python pickle protocols 0-4, which are used for lists of graphite datapoints.
+const (
+	pickleMark           = '('
+	pickleStop           = '.'
+	picklePop            = '0'
+	pickleFloat          = 'F'
+	pickleInt            = 'I'
+	pickleBinInt         = 'J'
+	pickleBinInt1        = 'K'
+	pickleLong           = 'L'
+	pickleBinInt2        = 'M'
+	pickleNone           = 'N'
+	pickleString         = 'S'
+	pickleBinString      = 'T'
+	pickleShortBinString = 'U'
+	pickleUnicode        = 'V'
+	pickleBinUnicode     = 'X'
+	pickleAppend         = 'a'
+	pickleGet            = 'g'
+	pickleBinGet         = 'h'
+	pickleLongBinGet     = 'j'
+	pickleList           = 'l'
+	pickleEmptyList      = ']'
+	picklePut            = 'p'
+	pickleBinPut         = 'q'
+	pickleLongBinPut     = 'r'
+	pickleTuple          = 't'
+	pickleEmptyTuple     = ')'
+	pickleAppends        = 'e'
+	pickleBinFloat       = 'G'
+	pickleBinBytes       = 'B'
+	pickleShortBinBytes  = 'C'
+	pickleProto          = 0x80
+	pickleTuple1         = 0x85
+	pickleTuple2         = 0x86
+	pickleTuple3         = 0x87
+	pickleNewTrue        = 0x88
+	pickleNewFalse       = 0x89
+	pickleLong1          = 0x8a
+	pickleShortBinUni    = 0x8c
+	pickleBinUnicode8    = 0x8d
+	pickleMemoize        = 0x94
+	pickleFrame          = 0x95
+)
+
+// errPickle error of pickle data, which can't be decoded.
+var errPickle = errors.New("pickle: wrong data")
+
+// pickleListValue mutable python list (memo references the same list).
+type pickleListValue struct {
+	items []any // list items
+}
+
+// unpickler decoder of python pickle data: lists, tuples, strings, numbers, booleans and none.
+// Opcodes of objects construction (global, reduce, build, etc...) aren't supported, so untrusted data is safe.
+type unpickler struct {
+	data  []byte      // rest of data
+	stack []any       // stack of values
+	marks []int       // stack positions of marks
+	memo  map[int]any // memo values by index
+}
+
+// unpickle decode single pickled value: tuples are []any, lists are *pickleListValue,
+// integers are int64, floats are float64, strings and bytes are string.
+func unpickle(data []byte) (any, error) {
+	u := &unpickler{data: data, memo: make(map[int]any)}
+	return u.decode()
+}
+
+// read method for read n bytes of data.
+func (u *unpickler) read(n int) ([]byte, error) {
+	if n < 0 || n > len(u.data) {
+		return nil, fmt.Errorf("%w: unexpected end of data", errPickle)
+	}
+	b := u.data[:n]
+	u.data = u.data[n:]
+	return b, nil
+}
+
+// readLine method for read argument of text opcode (till newline).
+func (u *unpickler) readLine() (string, error) {
+	i := bytes.IndexByte(u.data, '\n')
+	if i < 0 {
+		return "", fmt.Errorf("%w: unexpected end of data", errPickle)
+	}
+	line := string(u.data[:i])
+	u.data = u.data[i+1:]
+	return line, nil
+}
+
+// readUint method for read little endian unsigned integer of n bytes.
+func (u *unpickler) readUint(n int) (uint64, error) {
+	b, err := u.read(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for i := n - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, nil
+}
+
+// readString method for read string with little endian length of n bytes.
+func (u *unpickler) readString(n int) (string, error) {
+	l, err := u.readUint(n)
+	if err != nil {
+		return "", err
+	}
+	if l > uint64(len(u.data)) {
+		return "", fmt.Errorf("%w: unexpected end of data", errPickle)
+	}
+	b, err := u.read(int(l))
+	return string(b), err
+}
+
+// push method for push value to stack.
+func (u *unpickler) push(v any) {
+	u.stack = append(u.stack, v)
+}
+
+// pop method for pop value from stack.
+func (u *unpickler) pop() (any, error) {
+	if len(u.stack) == 0 || len(u.marks) > 0 && len(u.stack) <= u.marks[len(u.marks)-1] {
+		return nil, fmt.Errorf("%w: stack underflow", errPickle)
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return v, nil
+}
+
+// top method for get value on top of stack.
+func (u *unpickler) top() (any, error) {
+	if len(u.stack) == 0 {
+		return nil, fmt.Errorf("%w: stack underflow", errPickle)
+	}
+	return u.stack[len(u.stack)-1], nil
+}
+
+// popMark method for pop values pushed after last mark.
+func (u *unpickler) popMark() ([]any, error) {
+	if len(u.marks) == 0 {
+		return nil, fmt.Errorf("%w: missing mark", errPickle)
+	}
+	m := u.marks[len(u.marks)-1]
+	u.marks = u.marks[:len(u.marks)-1]
+	if m > len(u.stack) {
+		return nil, fmt.Errorf("%w: stack underflow", errPickle)
+	}
+	items := make([]any, len(u.stack)-m)
+	copy(items, u.stack[m:])
+	u.stack = u.stack[:m]
+	return items, nil
+}
+
+// appendItems method for append items to list on top of stack.
+func (u *unpickler) appendItems(items ...any) error {
+	v, err := u.top()
+	if err != nil {
+		return err
+	}
+	l, ok := v.(*pickleListValue)
+	if !ok {
+		return fmt.Errorf("%w: append to %T", errPickle, v)
+	}
+	l.items = append(l.items, items...)
+	return nil
+}
+
+// tuple method for push tuple of n values from stack (values before last mark aren't used).
+func (u *unpickler) tuple(n int) error {
+	if len(u.stack) < n || len(u.marks) > 0 && len(u.stack)-n < u.marks[len(u.marks)-1] {
+		return fmt.Errorf("%w: stack underflow", errPickle)
+	}
+	t := make([]any, n)
+	copy(t, u.stack[len(u.stack)-n:])
+	u.stack = u.stack[:len(u.stack)-n]
+	u.push(t)
+	return nil
+}
+
+// get method for push memo value.
+func (u *unpickler) get(i uint64) error {
+	v, ok := u.memo[int(i)]
+	if !ok {
+		return fmt.Errorf("%w: missing memo %d", errPickle, i)
+	}
+	u.push(v)
+	return nil
+}
+
+// put method for store top value in memo.
+func (u *unpickler) put(i uint64) error {
+	v, err := u.top()
+	if err != nil {
+		return err
+	}
+	u.memo[int(i)] = v
+	return nil
+}
+
+// parseLong parse text integer of protocol 0 (with optional L suffix).
+func parseLong(s string) (int64, error) {
+	v, err := strconv.ParseInt(strings.TrimSuffix(s, "L"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: wrong integer %s", errPickle, s)
+	}
+	return v, nil
+}
+
+// decode method for execute opcodes till stop.
+func (u *unpickler) decode() (any, error) {
+	for len(u.data) > 0 {
+		op := u.data[0]
+		u.data = u.data[1:]
+		var err error
+		// selecting opcode
+		switch op {
+		case pickleProto:
+			_, err = u.read(1)
+		case pickleFrame:
+			_, err = u.read(8)
+		case pickleStop:
+			if len(u.stack) != 1 || len(u.marks) != 0 {
+				return nil, fmt.Errorf("%w: unexpected stop", errPickle)
+			}
+			return u.stack[0], nil
+		case pickleMark:
+			u.marks = append(u.marks, len(u.stack))
+		case picklePop:
+			_, err = u.pop()
+		case pickleNone:
+			u.push(nil)
+		case pickleNewTrue:
+			u.push(true)
+		case pickleNewFalse:
+			u.push(false)
+		case pickleEmptyList:
+			u.push(&pickleListValue{})
+		case pickleList:
+			var items []any
+			if items, err = u.popMark(); err == nil {
+				u.push(&pickleListValue{items: items})
+			}
+		case pickleAppend:
+			var v any
+			if v, err = u.pop(); err == nil {
+				err = u.appendItems(v)
+			}
+		case pickleAppends:
+			var items []any
+			if items, err = u.popMark(); err == nil {
+				err = u.appendItems(items...)
+			}
+		case pickleEmptyTuple:
+			u.push([]any{})
+		case pickleTuple:
+			var items []any
+			if items, err = u.popMark(); err == nil {
+				u.push(items)
+			}
+		case pickleTuple1, pickleTuple2, pickleTuple3:
+			err = u.tuple(int(op-pickleTuple1) + 1)
+		case pickleBinInt:
+			var v uint64
+			if v, err = u.readUint(4); err == nil {
+				u.push(int64(int32(v)))
+			}
+		case pickleBinInt1:
+			var v uint64
+			if v, err = u.readUint(1); err == nil {
+				u.push(int64(v))
+			}
+		case pickleBinInt2:
+			var v uint64
+			if v, err = u.readUint(2); err == nil {
+				u.push(int64(v))
+			}
+		case pickleLong1:
+			err = u.long1()
+		case pickleInt:
+			var line string
+			if line, err = u.readLine(); err != nil {
+				break
+			}
+			// protocol 0 booleans
+			switch line {
+			case "00":
+				u.push(false)
+			case "01":
+				u.push(true)
+			default:
+				var v int64
+				if v, err = parseLong(line); err == nil {
+					u.push(v)
+				}
+			}
+		case pickleLong:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var v int64
+				if v, err = parseLong(line); err == nil {
+					u.push(v)
+				}
+			}
+		case pickleFloat:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var v float64
+				if v, err = strconv.ParseFloat(line, 64); err != nil {
+					err = fmt.Errorf("%w: wrong float %s", errPickle, line)
+					break
+				}
+				u.push(v)
+			}
+		case pickleBinFloat:
+			var b []byte
+			if b, err = u.read(8); err == nil {
+				u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+			}
+		case pickleString:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				if len(line) < 2 || line[0] != line[len(line)-1] || line[0] != '\'' && line[0] != '"' {
+					err = fmt.Errorf("%w: wrong string %s", errPickle, line)
+					break
+				}
+				u.push(line[1 : len(line)-1])
+			}
+		case pickleUnicode:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				u.push(line)
+			}
+		case pickleShortBinString, pickleShortBinBytes, pickleShortBinUni:
+			var s string
+			if s, err = u.readString(1); err == nil {
+				u.push(s)
+			}
+		case pickleBinString, pickleBinBytes, pickleBinUnicode:
+			var s string
+			if s, err = u.readString(4); err == nil {
+				u.push(s)
+			}
+		case pickleBinUnicode8:
+			var s string
+			if s, err = u.readString(8); err == nil {
+				u.push(s)
+			}
+		case pickleGet:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var i uint64
+				if i, err = strconv.ParseUint(line, 10, 31); err != nil {
+					err = fmt.Errorf("%w: wrong memo %s", errPickle, line)
+					break
+				}
+				err = u.get(i)
+			}
+		case pickleBinGet, pickleLongBinGet:
+			var i uint64
+			if i, err = u.readUint(memoIndexSize(op)); err == nil {
+				err = u.get(i)
+			}
+		case picklePut:
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var i uint64
+				if i, err = strconv.ParseUint(line, 10, 31); err != nil {
+					err = fmt.Errorf("%w: wrong memo %s", errPickle, line)
+					break
+				}
+				err = u.put(i)
+			}
+		case pickleBinPut, pickleLongBinPut:
+			var i uint64
+			if i, err = u.readUint(memoIndexSize(op)); err == nil {
+				err = u.put(i)
+			}
+		case pickleMemoize:
+			err = u.put(uint64(len(u.memo)))
+		default:
+			return nil, fmt.Errorf("%w: unsupported opcode 0x%02x", errPickle, op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: missing stop", errPickle)
+}
+
+// memoIndexSize return size of binary memo index of get and put opcodes.
+func memoIndexSize(op byte) int {
+	if op == pickleLongBinGet || op == pickleLongBinPut {
+		return 4
+	}
+	return 1
+}
+
+// long1 method for push little endian two's complement integer of 1 byte length.
+func (u *unpickler) long1() error {
+	n, err := u.readUint(1)
+	if err != nil {
+		return err
+	}
+	if n > 8 {
+		return fmt.Errorf("%w: integer overflow", errPickle)
+	}
+	v, err := u.readUint(int(n))
+	if err != nil {
+		return err
+	}
+	// sign extension of negative value
+	if n > 0 && n < 8 && v&(1<<(8*n-1)) != 0 {
+		v |= ^uint64(0) << (8 * n)
+	}
+	u.push(int64(v))
+	return nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Graphite datapoints pickled by python: [("servers.a.cpu", (1700000000, 1.5)), ("disk.used;host=a;dc=eu", (1700000000.5, 42)),
+// ("bad", (1, "x")), ("big", (1, 2**40))].
+var testPickledDatapoints = map[string]string{
+	"protocol_0": "286c70300a2856736572766572732e612e6370750a70310a2849313730303030303030300a46312e350a7470320a7470330a6128566469736b2e757365643b686f73743d613b64633d65750a70340a2846313730303030303030302e350a4934320a7470350a7470360a6128566261640a70370a2849310a56780a70380a7470390a747031300a6128566269670a7031310a2849310a4c313039393531313632373737364c0a747031320a747031330a612e",
+	"protocol_2": "80025d710028580d000000736572766572732e612e63707571014a00f15365473ff800000000000086710286710358160000006469736b2e757365643b686f73743d613b64633d657571044741d954fc402000004b2a867105867106580300000062616471074b01580100000078710886710986710a5803000000626967710b4b018a0600000000000186710c86710d652e",
+	"protocol_4": "80049573000000000000005d94288c0d736572766572732e612e637075944a00f15365473ff8000000000000869486948c166469736b2e757365643b686f73743d613b64633d6575944741d954fc402000004b2a869486948c03626164944b018c017894869486948c03626967944b018a0600000000000186948694652e",
+}
+
+func TestUnpickle(t *testing.T) {
+	t.Parallel()
+	for name, data := range testPickledDatapoints {
+		t.Run(name, func(t *testing.T) {
+			b, err := hex.DecodeString(data)
+			require.NoError(t, err)
+			v, err := unpickle(b)
+			require.NoError(t, err)
+			list, ok := v.(*pickleListValue)
+			require.True(t, ok)
+			require.Equal(t, []any{
+				[]any{"servers.a.cpu", []any{int64(1700000000), 1.5}},
+				[]any{"disk.used;host=a;dc=eu", []any{1700000000.5, int64(42)}},
+				[]any{"bad", []any{int64(1), "x"}},
+				[]any{"big", []any{int64(1), int64(1 << 40)}},
+			}, list.items)
+		})
+	}
+
+	// (-1, -2**40, 255, 65535, True, None, False) of protocol 2
+	b, err := hex.DecodeString("8002284affffffff8a060000000000ff4bff4dffff884e897471002e")
+	require.NoError(t, err)
+	v, err := unpickle(b)
+	require.NoError(t, err)
+	require.Equal(t, []any{int64(-1), int64(-1 << 40), int64(255), int64(65535), true, nil, false}, v)
+
+	// b"ab" of protocol 3
+	b, err = hex.DecodeString("80034302616271002e")
+	require.NoError(t, err)
+	v, err = unpickle(b)
+	require.NoError(t, err)
+	require.Equal(t, "ab", v)
+
+	for name, data := range map[string]string{
+		"global_reduce": "800263706f7369780a73797374656d0a71002e", // os.system
+		"missing_stop":  "80025d7100284b014b0265",
+		"truncated":     "8002580d000000736572",
+		"append":        "80024b014b01612e",
+		"tuple_mark":    "4e4e28866c2e", // NN(\x86l.
+		"tuple1_mark":   "4e28856c2e",
+		"empty":         "",
+	} {
+		b, err := hex.DecodeString(data)
+		require.NoError(t, err)
+		_, err = unpickle(b)
+		require.ErrorIs(t, err, errPickle, name)
+	}
+}
+
+func FuzzUnpickle(f *testing.F) {
+	for _, data := range testPickledDatapoints {
+		b, err := hex.DecodeString(data)
+		require.NoError(f, err)
+		f.Add(b)
+	}
+	f.Add([]byte("NN(\x86l."))
+	f.Add([]byte("(((]a(e0t."))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v, err := unpickle(data)
+		if err != nil {
+			require.ErrorIs(t, err, errPickle)
+			require.Nil(t, v)
+		}
+	})
+}
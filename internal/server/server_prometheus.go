@@ -0,0 +1,288 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+// Content types of exposition formats.
+const (
+	promTextContentType    = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+var (
+	// Escaper of label values.
+	promLabelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	// Escaper of help text in prometheus text format.
+	promHelpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+// promWriter type of streaming writer of metric families in prometheus text or openmetrics format.
+// Metrics must be written grouped by type and metric name (see storage ScanMetrics).
+type promWriter struct {
+	w           *bufio.Writer              // buffered response
+	openMetrics bool                       // openmetrics format
+	meta        map[string]models.Metadata // metadata by metric name
+	mType       string                     // type of last written metric
+	id          string                     // name of last written metric
+	family      string                     // exposed name of current family
+	familyType  string                     // type of current family
+	skip        bool                       // current family is skipped (name conflicts with written family)
+	written     map[string]struct{}        // exposed names of written families
+}
+
+// lazyHeaderWriter middleware type for send response status with first written data.
+type lazyHeaderWriter struct {
+	w       http.ResponseWriter // response
+	started bool                // status is sent
+}
+
+// Write method for send status before first data.
+func (l *lazyHeaderWriter) Write(b []byte) (int, error) {
+	if !l.started {
+		l.started = true
+		l.w.WriteHeader(http.StatusOK)
+	}
+	return l.w.Write(b)
+}
+
+// newPromWriter init writer of metric families with help and unit from metadata.
+func newPromWriter(w io.Writer, openMetrics bool, meta []models.Metadata) *promWriter {
+	pw := &promWriter{
+		w:           bufio.NewWriterSize(w, 32*1024),
+		openMetrics: openMetrics,
+		meta:        make(map[string]models.Metadata, len(meta)),
+		written:     make(map[string]struct{}),
+	}
+	for _, v := range meta {
+		pw.meta[v.ID] = v
+	}
+	return pw
+}
+
+// acceptsOpenMetrics check that client negotiates openmetrics format by accept header.
+func acceptsOpenMetrics(accept string) bool {
+	for _, v := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil || mediaType != "application/openmetrics-text" {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(q, 64); err != nil || f <= 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// sanitizeMetricName replace symbols, which aren't allowed in prometheus metric name, with '_'.
+func sanitizeMetricName(name string) string {
+	return sanitizeName(name, true)
+}
+
+// sanitizeLabelName replace symbols, which aren't allowed in prometheus label name, with '_'.
+func sanitizeLabelName(name string) string {
+	return sanitizeName(name, false)
+}
+
+// sanitizeName replace not allowed symbols of name ([a-zA-Z_][a-zA-Z0-9_]*, ':' in metric names) with '_'.
+func sanitizeName(name string, colon bool) string {
+	if name == "" {
+		return "_"
+	}
+	b := []byte(name)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c >= '0' && c <= '9' && i > 0 || c == ':' && colon) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// formatPromFloat format value as prometheus float (+Inf, -Inf, NaN are allowed).
+func formatPromFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// familyName return exposed name of metric family.
+// Openmetrics counter family name has no _total suffix (it is added to samples).
+func (pw *promWriter) familyName(mType, id string) string {
+	name := sanitizeMetricName(id)
+	if pw.openMetrics && mType == metrictypes.CounterType {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	return name
+}
+
+// writeHeader write type, help and unit lines of family.
+func (pw *promWriter) writeHeader(mType, id, family string) {
+	if meta, ok := pw.meta[id]; ok {
+		if meta.Description != "" {
+			help := promHelpEscaper.Replace(meta.Description)
+			if pw.openMetrics {
+				help = promLabelValueEscaper.Replace(meta.Description)
+			}
+			pw.w.WriteString("# HELP " + family + " " + help + "\n")
+		}
+		// openmetrics family name must have unit suffix
+		if unit := sanitizeLabelName(meta.Unit); pw.openMetrics && meta.Unit != "" && strings.HasSuffix(family, "_"+unit) {
+			pw.w.WriteString("# UNIT " + family + " " + unit + "\n")
+		}
+	}
+	pw.w.WriteString("# TYPE " + family + " " + mType + "\n")
+}
+
+// writeSample write sample line with labels (extra label is appended, if name isn't empty).
+func (pw *promWriter) writeSample(name string, labels models.Labels, extraName, extraValue, value string) {
+	pw.w.WriteString(name)
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) > 0 || extraName != "" {
+		pw.w.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				pw.w.WriteByte(',')
+			}
+			pw.w.WriteString(sanitizeLabelName(k) + `="` + promLabelValueEscaper.Replace(labels[k]) + `"`)
+		}
+		if extraName != "" {
+			if len(keys) > 0 {
+				pw.w.WriteByte(',')
+			}
+			pw.w.WriteString(extraName + `="` + extraValue + `"`)
+		}
+		pw.w.WriteByte('}')
+	}
+	pw.w.WriteString(" " + value + "\n")
+}
+
+// write method for write metric series, family header is written before first series of family.
+func (pw *promWriter) write(m models.Metrics) error {
+	if m.MType != pw.mType || m.ID != pw.id {
+		pw.mType, pw.id = m.MType, m.ID
+		family := pw.familyName(m.MType, m.ID)
+		// series of other metric name of the same type with the same sanitized name continue family
+		if family != pw.family || m.MType != pw.familyType || pw.skip {
+			if _, ok := pw.written[family]; ok {
+				log.Printf("metric %s %s: exposed name %s conflicts with other metric, skipped", m.MType, m.ID, family)
+				pw.skip = true
+				return nil
+			}
+			pw.skip = false
+			pw.family, pw.familyType = family, m.MType
+			pw.written[family] = struct{}{}
+			pw.writeHeader(m.MType, m.ID, family)
+		}
+	}
+	if pw.skip {
+		return nil
+	}
+
+	// selecting metric type
+	switch m.MType {
+	case metrictypes.GaugeType:
+		if m.Value != nil {
+			pw.writeSample(pw.family, m.Labels, "", "", formatPromFloat(*m.Value))
+		}
+	case metrictypes.CounterType:
+		if m.Delta != nil {
+			name := pw.family
+			if pw.openMetrics {
+				name += "_total"
+			}
+			pw.writeSample(name, m.Labels, "", "", strconv.FormatInt(*m.Delta, 10))
+		}
+	case metrictypes.HistogramType:
+		if m.Histogram != nil {
+			pw.writeHistogram(m.Labels, m.Histogram)
+		}
+	}
+	// empty write returns error of previous flush (e.g. client is gone), it stops scan
+	_, err := pw.w.Write(nil)
+	return err
+}
+
+// writeHistogram write cumulative buckets, sum and count of histogram series.
+func (pw *promWriter) writeHistogram(labels models.Labels, h *models.Histogram) {
+	// le is bucket label of histogram samples
+	if v, ok := labels["le"]; ok {
+		l := make(models.Labels, len(labels))
+		for k, v := range labels {
+			l[k] = v
+		}
+		delete(l, "le")
+		l["exported_le"] = v
+		labels = l
+	}
+	var cumulative uint64
+	for i, b := range h.Bounds {
+		if i < len(h.Counts) {
+			cumulative += h.Counts[i]
+		}
+		pw.writeSample(pw.family+"_bucket", labels, "le", formatPromFloat(b), strconv.FormatUint(cumulative, 10))
+	}
+	pw.writeSample(pw.family+"_bucket", labels, "le", "+Inf", strconv.FormatUint(h.Count, 10))
+	pw.writeSample(pw.family+"_sum", labels, "", "", formatPromFloat(h.Sum))
+	pw.writeSample(pw.family+"_count", labels, "", "", strconv.FormatUint(h.Count, 10))
+}
+
+// close method for finish exposition (openmetrics end marker) and flush buffer.
+func (pw *promWriter) close() error {
+	if pw.openMetrics {
+		pw.w.WriteString("# EOF\n")
+	}
+	return pw.w.Flush()
+}
+
+// getPrometheusMetrics api method for scrape all metrics in prometheus text format (openmetrics, if negotiated).
+// Metrics are streamed from storage, help and unit are taken from metadata.
+func (mh *metricHandlers) getPrometheusMetrics() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := mh.requestCtx(r)
+		meta, err := mh.reqRetrier.UseRetrierGetMetadata(mh.storage.GetMetadata)(ctx)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "can't get metadata", http.StatusInternalServerError)
+			return
+		}
+
+		openMetrics := acceptsOpenMetrics(r.Header.Get("Accept"))
+		if openMetrics {
+			w.Header().Set("Content-Type", openMetricsContentType)
+		} else {
+			w.Header().Set("Content-Type", promTextContentType)
+		}
+		lw := &lazyHeaderWriter{w: w}
+		pw := newPromWriter(lw, openMetrics, meta)
+		// streamed response can't be retried, storage errors after first sent data truncate response
+		if err := mh.storage.ScanMetrics(ctx, pw.write); err != nil {
+			log.Println(err)
+			if !lw.started {
+				http.Error(w, "can't get metrics", http.StatusInternalServerError)
+			}
+			return
+		}
+		if err := pw.close(); err != nil {
+			log.Println(err)
+			return
+		}
+		if !lw.started {
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+}
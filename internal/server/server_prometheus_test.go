@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/cryptandsign"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/retrier"
+	"github.com/sourcecd/monitoring/internal/storage"
+	"github.com/sourcecd/monitoring/mocks"
+)
+
+func TestSanitizeName(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, "go_gc:duration_seconds", sanitizeMetricName("go_gc:duration_seconds"))
+	require.Equal(t, "cpu_usage_percent", sanitizeMetricName("cpu.usage-percent"))
+	require.Equal(t, "_xx", sanitizeMetricName("1xx"))
+	require.Equal(t, "_", sanitizeMetricName(""))
+	require.Equal(t, "host_name", sanitizeLabelName("host:name"))
+}
+
+func TestAcceptsOpenMetrics(t *testing.T) {
+	t.Parallel()
+	require.False(t, acceptsOpenMetrics(""))
+	require.False(t, acceptsOpenMetrics("text/plain;version=0.0.4"))
+	require.True(t, acceptsOpenMetrics("application/openmetrics-text;version=1.0.0;q=0.5,text/plain;version=0.0.4;q=0.3,*/*;q=0.1"))
+	require.False(t, acceptsOpenMetrics("application/openmetrics-text;q=0,text/plain"))
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var keyenc, privkeypath string
+	testStorage := storage.NewMemStorage()
+	mh := &metricHandlers{
+		ctx:        ctx,
+		storage:    testStorage,
+		reqRetrier: retrier.NewRetrier(),
+		crypt:      cryptandsign.NewAsymmetricCryptRsa(),
+	}
+	ts := httptest.NewServer(chiRouter(mh, keyenc, privkeypath, nil))
+	t.Cleanup(func() { ts.Close() })
+
+	h := metrictypes.NewHistogram([]float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+	require.NoError(t, testStorage.WriteMetric(ctx, "gauge", "Alloc_bytes", metrictypes.Gauge(1024)))
+	require.NoError(t, testStorage.WriteMetric(ctx, "gauge", `CPUutilization{cpu="0"}`, metrictypes.Gauge(0.5)))
+	require.NoError(t, testStorage.WriteMetric(ctx, "gauge", `CPUutilization{cpu="1",host="a\"b"}`, metrictypes.Gauge(1.5)))
+	require.NoError(t, testStorage.WriteMetric(ctx, "gauge", "cpu.load", metrictypes.Gauge(2)))
+	require.NoError(t, testStorage.WriteMetric(ctx, "counter", "PollCount", metrictypes.Counter(5)))
+	require.NoError(t, testStorage.WriteMetric(ctx, "histogram", `Latency_seconds{le="x"}`, h))
+	// conflicts with counter PollCount, which is written first
+	require.NoError(t, testStorage.WriteMetric(ctx, "gauge", "PollCount", metrictypes.Gauge(1)))
+	require.NoError(t, testStorage.WriteMetadata(ctx, []models.Metadata{
+		{ID: "Alloc_bytes", Unit: "bytes", Description: "Bytes of allocated \"heap\" objects\nin use"},
+		{ID: "PollCount", Unit: "count", Description: "Count of polls"},
+	}))
+
+	scrape := func(accept string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/metrics", nil)
+		require.NoError(t, err)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(b)
+	}
+
+	resp, body := scrape("")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, promTextContentType, resp.Header.Get("Content-Type"))
+	require.Equal(t, `# HELP PollCount Count of polls
+# TYPE PollCount counter
+PollCount 5
+# HELP Alloc_bytes Bytes of allocated "heap" objects\nin use
+# TYPE Alloc_bytes gauge
+Alloc_bytes 1024
+# TYPE CPUutilization gauge
+CPUutilization{cpu="0"} 0.5
+CPUutilization{cpu="1",host="a\"b"} 1.5
+# TYPE cpu_load gauge
+cpu_load 2
+# TYPE Latency_seconds histogram
+Latency_seconds_bucket{exported_le="x",le="0.1"} 1
+Latency_seconds_bucket{exported_le="x",le="1"} 2
+Latency_seconds_bucket{exported_le="x",le="+Inf"} 3
+Latency_seconds_sum{exported_le="x"} 5.55
+Latency_seconds_count{exported_le="x"} 3
+`, body)
+
+	resp, body = scrape("application/openmetrics-text; version=1.0.0")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, openMetricsContentType, resp.Header.Get("Content-Type"))
+	require.Equal(t, `# HELP PollCount Count of polls
+# TYPE PollCount counter
+PollCount_total 5
+# HELP Alloc_bytes Bytes of allocated \"heap\" objects\nin use
+# UNIT Alloc_bytes bytes
+# TYPE Alloc_bytes gauge
+Alloc_bytes 1024
+# TYPE CPUutilization gauge
+CPUutilization{cpu="0"} 0.5
+CPUutilization{cpu="1",host="a\"b"} 1.5
+# TYPE cpu_load gauge
+cpu_load 2
+# TYPE Latency_seconds histogram
+Latency_seconds_bucket{exported_le="x",le="0.1"} 1
+Latency_seconds_bucket{exported_le="x",le="1"} 2
+Latency_seconds_bucket{exported_le="x",le="+Inf"} 3
+Latency_seconds_sum{exported_le="x"} 5.55
+Latency_seconds_count{exported_le="x"} 3
+# EOF
+`, body)
+}
+
+func TestPrometheusMetricsError(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	mDB := mocks.NewMockStoreMetrics(ctrl)
+	mh := &metricHandlers{
+		ctx:        ctx,
+		storage:    mDB,
+		reqRetrier: retrier.NewRetrier(),
+		crypt:      cryptandsign.NewAsymmetricCryptRsa(),
+	}
+	ts := httptest.NewServer(chiRouter(mh, "", "", nil))
+	t.Cleanup(func() { ts.Close() })
+
+	mDB.EXPECT().GetMetadata(gomock.Any()).Return(nil, nil)
+	mDB.EXPECT().ScanMetrics(gomock.Any(), gomock.Any()).Return(errors.New("connection refused"))
+	resp, err := ts.Client().Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
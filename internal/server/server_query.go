@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/query"
+)
+
+// Max size of decompressed json query request.
+const maxQueryBody = 1 << 20
+
+// querySource query evaluation source of metric handlers storage (history is read with retention resolution).
+type querySource struct {
+	mh *metricHandlers
+}
+
+// ScanMetrics implementation ScanMetrics method of query source.
+func (s querySource) ScanMetrics(ctx context.Context, fn func(m models.Metrics) error) error {
+	return s.mh.storage.ScanMetrics(ctx, fn)
+}
+
+// History implementation History method of query source.
+func (s querySource) History(ctx context.Context, mType, id string, labels models.Labels, from, to time.Time) ([]models.Sample, error) {
+	hist := models.MetricsHistory{ID: id, Labels: labels, MType: mType, From: from, To: to}
+	if err := s.mh.fetchHistory(ctx, &hist, 0); err != nil {
+		return nil, err
+	}
+	return hist.Samples, nil
+}
+
+// evalQuery parse and evaluate query expression of request at current time.
+func (mh *metricHandlers) evalQuery(ctx context.Context, req *models.MetricsQuery) error {
+	q, err := query.Parse(req.Query)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, mh.reqRetrier.GetTimeoutCtx())
+	defer cancel()
+	req.Time = time.Now()
+	res, err := q.Eval(ctx, querySource{mh: mh}, req.Time)
+	if err != nil {
+		return err
+	}
+	req.ResultType = res.Type()
+	// selecting result type
+	switch res := res.(type) {
+	case query.Scalar:
+		v := models.QueryValue(res)
+		req.Scalar = &v
+	case query.Vector:
+		req.Series = make([]models.QuerySeries, 0, len(res))
+		for _, s := range res {
+			req.Series = append(req.Series, models.QuerySeries{ID: s.ID, Labels: s.Labels, Value: models.QueryValue(s.Value)})
+		}
+	}
+	return nil
+}
+
+// writeQueryResult write evaluated query or evaluation error.
+func writeQueryResult(w http.ResponseWriter, req *models.MetricsQuery, err error) {
+	if err != nil {
+		if errors.Is(err, customerrors.ErrBadQuery) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "can't evaluate query", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(req); err != nil {
+		http.Error(w, "can't encode json", http.StatusInternalServerError)
+		return
+	}
+}
+
+// getQuery api method for evaluate query expression (query url parameter).
+func (mh *metricHandlers) getQuery() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := models.MetricsQuery{Query: r.URL.Query().Get("query")}
+		writeQueryResult(w, &req, mh.evalQuery(mh.requestCtx(r), &req))
+	}
+}
+
+// getQueryJSON api method for evaluate query expression (json request).
+func (mh *metricHandlers) getQueryJSON() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req models.MetricsQuery
+
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, fmt.Sprintf("wrong content type: %s", r.Header.Get("Content-Type")), http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxQueryBody)).Decode(&req); err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "error to pasrse json request", http.StatusBadRequest)
+			return
+		}
+		writeQueryResult(w, &req, mh.evalQuery(mh.requestCtx(r), &req))
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/cryptandsign"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/retrier"
+	"github.com/sourcecd/monitoring/internal/storage"
+	"github.com/sourcecd/monitoring/mocks"
+)
+
+func TestQueryHandlers(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	testStorage := storage.NewMemStorage()
+	mh := &metricHandlers{
+		ctx:        ctx,
+		storage:    testStorage,
+		reqRetrier: retrier.NewRetrier(),
+		crypt:      cryptandsign.NewAsymmetricCryptRsa(),
+	}
+	ts := httptest.NewServer(chiRouter(mh, "", "", nil))
+	t.Cleanup(func() { ts.Close() })
+
+	require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.GaugeType, "CPUutilization1", metrictypes.Gauge(10)))
+	require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.GaugeType, "CPUutilization2", metrictypes.Gauge(30)))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.CounterType, `PollCount{host="a"}`, metrictypes.Counter(5)))
+	}
+
+	testCases := []struct {
+		name       string
+		method     string
+		query      string
+		statusCode int
+		resultType string
+		scalar     string
+		series     []models.QuerySeries
+	}{
+		{
+			name:       "avg_pattern",
+			method:     http.MethodGet,
+			query:      "avg(CPUutilization*)",
+			statusCode: http.StatusOK,
+			resultType: "vector",
+			series:     []models.QuerySeries{{Value: 20}},
+		},
+		{
+			name:       "increase_json",
+			method:     http.MethodPost,
+			query:      "increase(PollCount[1h]) * 2",
+			statusCode: http.StatusOK,
+			resultType: "vector",
+			series:     []models.QuerySeries{{Labels: models.Labels{"host": "a"}, Value: 30}},
+		},
+		{
+			name:       "instant",
+			method:     http.MethodGet,
+			query:      `CPUutilization* > 20`,
+			statusCode: http.StatusOK,
+			resultType: "vector",
+			series:     []models.QuerySeries{{ID: "CPUutilization2", Value: 30}},
+		},
+		{
+			name:       "scalar_inf",
+			method:     http.MethodPost,
+			query:      "1 / 0",
+			statusCode: http.StatusOK,
+			resultType: "scalar",
+			scalar:     `"+Inf"`,
+		},
+		{name: "syntax_error", method: http.MethodGet, query: "avg(", statusCode: http.StatusBadRequest},
+		{name: "empty", method: http.MethodPost, query: "", statusCode: http.StatusBadRequest},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				resp *http.Response
+				err  error
+			)
+			if tt.method == http.MethodGet {
+				resp, err = ts.Client().Get(ts.URL + "/query?query=" + url.QueryEscape(tt.query))
+			} else {
+				body, _ := json.Marshal(models.MetricsQuery{Query: tt.query})
+				resp, err = ts.Client().Post(ts.URL+"/query/", "application/json", strings.NewReader(string(body)))
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.statusCode, resp.StatusCode, string(b))
+			if tt.statusCode != http.StatusOK {
+				require.Contains(t, string(b), "bad query")
+				return
+			}
+
+			var res models.MetricsQuery
+			require.NoError(t, json.Unmarshal(b, &res))
+			require.Equal(t, tt.query, res.Query)
+			require.False(t, res.Time.IsZero())
+			require.Equal(t, tt.resultType, res.ResultType)
+			require.Equal(t, tt.series, res.Series)
+			if tt.scalar != "" {
+				var raw map[string]json.RawMessage
+				require.NoError(t, json.Unmarshal(b, &raw))
+				require.Equal(t, tt.scalar, string(raw["scalar"]))
+			}
+		})
+	}
+
+	resp, err := ts.Client().Post(ts.URL+"/query/", "text/plain", strings.NewReader("avg(load)"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// deep nesting is rejected by parser
+	body, _ := json.Marshal(models.MetricsQuery{Query: strings.Repeat("(", 100000) + "1" + strings.Repeat(")", 100000)})
+	resp, err = ts.Client().Post(ts.URL+"/query/", "application/json", strings.NewReader(string(body)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	body, _ = json.Marshal(models.MetricsQuery{Query: strings.Repeat("(", maxQueryBody)})
+	resp, err = ts.Client().Post(ts.URL+"/query/", "application/json", strings.NewReader(string(body)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func TestQueryStorageError(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	mDB := mocks.NewMockStoreMetrics(ctrl)
+	mDB.EXPECT().ScanMetrics(gomock.Any(), gomock.Any()).Return(errors.New("connection refused"))
+	mh := &metricHandlers{ctx: context.Background(), storage: mDB, reqRetrier: retrier.NewRetrier(), crypt: cryptandsign.NewAsymmetricCryptRsa()}
+
+	ts := httptest.NewServer(chiRouter(mh, "", "", nil))
+	t.Cleanup(func() { ts.Close() })
+	resp, err := ts.Client().Get(ts.URL + "/query?query=" + url.QueryEscape("sum(load)"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
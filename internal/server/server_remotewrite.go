@@ -0,0 +1,283 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/sourcecd/monitoring/internal/compression"
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/storage"
+	"github.com/sourcecd/monitoring/proto/prompb"
+)
+
+const (
+	// Max size of compressed remote_write request.
+	maxRemoteWriteBody = 32 << 20
+	// Max size of decoded remote_write request.
+	maxRemoteWriteDecoded = 128 << 20
+	// Bits of prometheus staleness marker (NaN), which marks end of series.
+	promStaleNaN = 0x7ff0000000000002
+	// Time after which last cumulative value of not updated series is forgotten.
+	cumulativeSeriesTTL = time.Hour
+)
+
+// remoteWriteState state of remote_write receiver (shared by requests, guarded by lock).
+// Prometheus counters are cumulative, storage counters are sums of deltas, so last value of series is kept for delta.
+type remoteWriteState struct {
+	sync.Mutex
+	types  map[string]prompb.MetricMetadata_MetricType // metric family types by tenant and family name
+	last   map[string]int64                            // last cumulative values of counter series by tenant and series id
+	expiry *seriesExpiry                               // update times of counter series
+}
+
+// seriesExpiry last update times of cumulative series, series which aren't updated for ttl are forgotten.
+type seriesExpiry struct {
+	ttl       time.Duration        // time after which not updated series is forgotten
+	seen      map[string]time.Time // last update time by series key
+	lastCheck time.Time            // time of last check of expired series
+}
+
+// newRemoteWriteState init empty remote_write receiver state.
+func newRemoteWriteState() *remoteWriteState {
+	return &remoteWriteState{
+		types:  make(map[string]prompb.MetricMetadata_MetricType),
+		last:   make(map[string]int64),
+		expiry: newSeriesExpiry(cumulativeSeriesTTL),
+	}
+}
+
+// newSeriesExpiry init empty update times of series.
+func newSeriesExpiry(ttl time.Duration) *seriesExpiry {
+	return &seriesExpiry{ttl: ttl, seen: make(map[string]time.Time)}
+}
+
+// touch method for set update time of series.
+func (e *seriesExpiry) touch(key string, now time.Time) {
+	e.seen[key] = now
+}
+
+// expired return and forget series, which aren't updated for ttl (series are checked once per quarter of ttl).
+func (e *seriesExpiry) expired(now time.Time) []string {
+	if now.Sub(e.lastCheck) < e.ttl/4 {
+		return nil
+	}
+	e.lastCheck = now
+	var res []string
+	for k, seen := range e.seen {
+		if now.Sub(seen) >= e.ttl {
+			res = append(res, k)
+			delete(e.seen, k)
+		}
+	}
+	return res
+}
+
+// checkRemoteWriteHeaders check content encoding and type of remote_write (v1) request.
+func checkRemoteWriteHeaders(r *http.Request) error {
+	if enc := r.Header.Get("Content-Encoding"); enc != "snappy" {
+		return fmt.Errorf("unsupported content encoding: %q", enc)
+	}
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return nil
+	}
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if err != nil || mediaType != "application/x-protobuf" {
+		return fmt.Errorf("unsupported content type: %q", ct)
+	}
+	if p, ok := params["proto"]; ok && p != "prometheus.WriteRequest" {
+		return fmt.Errorf("unsupported remote write protobuf message: %q", p)
+	}
+	return nil
+}
+
+// readRemoteWrite read and decode remote_write request, return http status of error.
+func readRemoteWrite(w http.ResponseWriter, r *http.Request) (*prompb.WriteRequest, int, error) {
+	if err := checkRemoteWriteHeaders(r); err != nil {
+		return nil, http.StatusUnsupportedMediaType, err
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRemoteWriteBody))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, http.StatusRequestEntityTooLarge, err
+		}
+		return nil, http.StatusBadRequest, err
+	}
+	data, err := compression.SnappyDecode(body, maxRemoteWriteDecoded)
+	if err != nil {
+		if errors.Is(err, compression.ErrSnappyTooLarge) {
+			return nil, http.StatusRequestEntityTooLarge, err
+		}
+		return nil, http.StatusBadRequest, err
+	}
+	var req prompb.WriteRequest
+	if err := proto.Unmarshal(data, &req); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return &req, http.StatusOK, nil
+}
+
+// remoteWriteMetadata return metadata of metric families (type hint only for gauges and counters) and remember family types.
+func (s *remoteWriteState) remoteWriteMetadata(tenant string, meta []*prompb.MetricMetadata) []models.Metadata {
+	res := make([]models.Metadata, 0, len(meta))
+	for _, v := range meta {
+		if v.MetricFamilyName == "" || strings.ContainsAny(v.MetricFamilyName, "{}") {
+			continue
+		}
+		s.types[tenant+"\x00"+v.MetricFamilyName] = v.Type
+		m := models.Metadata{ID: v.MetricFamilyName, Unit: v.Unit, Description: v.Help}
+		// selecting metric type
+		switch v.Type {
+		case prompb.MetricMetadata_COUNTER:
+			m.MType = metrictypes.CounterType
+		case prompb.MetricMetadata_GAUGE:
+			m.MType = metrictypes.GaugeType
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
+// isCounter check that series of metric name are counters: by family type from metadata or by _total suffix.
+func (s *remoteWriteState) isCounter(tenant, name string) bool {
+	for _, family := range []string{name, strings.TrimSuffix(name, "_total")} {
+		if t, ok := s.types[tenant+"\x00"+family]; ok {
+			return t == prompb.MetricMetadata_COUNTER
+		}
+	}
+	return strings.HasSuffix(name, "_total")
+}
+
+// counterDelta return delta of cumulative counter value (reset of counter starts from zero).
+// Last value is taken from pending values of request or committed values of stored requests.
+// Stored counter is sum of deltas, not last cumulative value, so first value of stored series,
+// which isn't seen since start of server (or is forgotten), is only base of next deltas.
+// Value is added to pending values.
+func (mh *metricHandlers) counterDelta(ctx context.Context, committed, pending map[string]int64, key, series string, value int64) (int64, error) {
+	prev, ok := pending[key]
+	if !ok {
+		prev, ok = committed[key]
+	}
+	if !ok {
+		_, err := mh.reqRetrier.UseRetrierGetMetric(mh.storage.GetMetric)(ctx, metrictypes.CounterType, series)
+		if err != nil && !errors.Is(err, customerrors.ErrNoVal) {
+			return 0, err
+		}
+		if err == nil {
+			pending[key] = value
+			return 0, nil
+		}
+	}
+	pending[key] = value
+	if value < prev {
+		return value, nil
+	}
+	return value - prev, nil
+}
+
+// remoteWrite api method for prometheus remote_write (v1) protocol: snappy compressed protobuf WriteRequest.
+// Samples are written as gauges, series of counter families as counter deltas, sample timestamps aren't kept
+// (history timestamp is time of write). Responds 204 on success, 4xx for requests, which mustn't be retried.
+func (mh *metricHandlers) remoteWrite() http.HandlerFunc {
+	state := newRemoteWriteState()
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, code, err := readRemoteWrite(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			return
+		}
+		ctx := mh.requestCtx(r)
+		tenant := storage.TenantFromContext(ctx)
+
+		// counter deltas depend on previous requests
+		state.Lock()
+		defer state.Unlock()
+
+		if meta := state.remoteWriteMetadata(tenant, req.Metadata); len(meta) > 0 {
+			if err := mh.reqRetrier.UseRetrierWriteMetadata(mh.storage.WriteMetadata)(ctx, meta); err != nil {
+				log.Println(err)
+				http.Error(w, "error to store metadata", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		var (
+			metrics []models.Metrics
+			invalid int
+		)
+		last := make(map[string]int64)
+		for _, ts := range req.Timeseries {
+			var name string
+			labels := make(models.Labels, len(ts.Labels))
+			for _, l := range ts.Labels {
+				if l.Name == "__name__" {
+					name = l.Value
+					continue
+				}
+				labels[l.Name] = l.Value
+			}
+			if name == "" || strings.ContainsAny(name, "{}") {
+				invalid++
+				continue
+			}
+			series := models.SeriesID(name, labels)
+			counter := state.isCounter(tenant, name)
+			for _, v := range ts.Samples {
+				if math.Float64bits(v.Value) == promStaleNaN {
+					continue
+				}
+				if !counter {
+					value := v.Value
+					metrics = append(metrics, models.Metrics{ID: name, MType: metrictypes.GaugeType, Value: &value, Labels: labels})
+					continue
+				}
+				if math.IsNaN(v.Value) || math.IsInf(v.Value, 0) {
+					continue
+				}
+				delta, err := mh.counterDelta(ctx, state.last, last, tenant+"\x00"+series, series, int64(math.Round(v.Value)))
+				if err != nil {
+					log.Println(err)
+					http.Error(w, "error to get counter", http.StatusInternalServerError)
+					return
+				}
+				metrics = append(metrics, models.Metrics{ID: name, MType: metrictypes.CounterType, Delta: &delta, Labels: labels})
+			}
+		}
+
+		if len(metrics) > 0 {
+			if err := mh.reqRetrier.UseRetrierWMB(mh.storage.WriteBatchMetrics)(ctx, metrics); err != nil {
+				log.Println(err)
+				http.Error(w, "error to store batch metrics", http.StatusInternalServerError)
+				return
+			}
+		}
+		// last values are changed only with stored deltas (failed request is retried by prometheus)
+		now := time.Now()
+		for k, v := range last {
+			state.last[k] = v
+			state.expiry.touch(k, now)
+		}
+		for _, k := range state.expiry.expired(now) {
+			delete(state.last, k)
+		}
+		if invalid > 0 {
+			http.Error(w, fmt.Sprintf("%d series without metric name", invalid), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/sourcecd/monitoring/internal/cryptandsign"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/retrier"
+	"github.com/sourcecd/monitoring/internal/storage"
+	"github.com/sourcecd/monitoring/proto/prompb"
+)
+
+// snappyEncodeLiteral encode snappy block of literals only (valid block without compression).
+func snappyEncodeLiteral(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+	for len(src) > 0 {
+		n := min(len(src), 1<<16)
+		dst = append(dst, 61<<2, byte(n-1), byte((n-1)>>8))
+		dst = append(dst, src[:n]...)
+		src = src[n:]
+	}
+	return dst
+}
+
+// promSeries build remote_write series with samples.
+func promSeries(name string, labels map[string]string, values ...float64) *prompb.TimeSeries {
+	ts := &prompb.TimeSeries{Labels: []*prompb.Label{{Name: "__name__", Value: name}}}
+	for k, v := range labels {
+		ts.Labels = append(ts.Labels, &prompb.Label{Name: k, Value: v})
+	}
+	for i, v := range values {
+		ts.Samples = append(ts.Samples, &prompb.Sample{Value: v, Timestamp: int64(i)})
+	}
+	return ts
+}
+
+func TestRemoteWrite(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	testStorage := storage.NewMemStorage()
+	mh := &metricHandlers{
+		ctx:        ctx,
+		storage:    testStorage,
+		reqRetrier: retrier.NewRetrier(),
+		crypt:      cryptandsign.NewAsymmetricCryptRsa(),
+	}
+	ts := httptest.NewServer(chiRouter(mh, "", "", nil))
+	t.Cleanup(func() { ts.Close() })
+
+	post := func(body []byte, encoding string) int {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/write", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Content-Encoding", encoding)
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	write := func(req *prompb.WriteRequest) int {
+		b, err := proto.Marshal(req)
+		require.NoError(t, err)
+		return post(snappyEncodeLiteral(b), "snappy")
+	}
+	getCounter := func(series string) metrictypes.Counter {
+		c, err := testStorage.GetMetric(ctx, "counter", series)
+		require.NoError(t, err)
+		return c.(metrictypes.Counter)
+	}
+
+	require.Equal(t, http.StatusNoContent, write(&prompb.WriteRequest{
+		Metadata: []*prompb.MetricMetadata{
+			{Type: prompb.MetricMetadata_COUNTER, MetricFamilyName: "process_cpu_seconds", Help: "CPU time", Unit: "seconds"},
+			{Type: prompb.MetricMetadata_GAUGE, MetricFamilyName: "up"},
+		},
+		Timeseries: []*prompb.TimeSeries{
+			promSeries("up", map[string]string{"job": "node"}, 1),
+			promSeries("http_requests_total", map[string]string{"code": "200"}, 10, 15),
+			promSeries("process_cpu_seconds", nil, 3),
+			promSeries("temperature", nil, 20, math.Float64frombits(promStaleNaN)),
+		},
+	}))
+	g, err := testStorage.GetMetric(ctx, "gauge", `up{job="node"}`)
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(1), g)
+	g, err = testStorage.GetMetric(ctx, "gauge", "temperature")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(20), g)
+	require.Equal(t, metrictypes.Counter(15), getCounter(`http_requests_total{code="200"}`))
+	require.Equal(t, metrictypes.Counter(3), getCounter("process_cpu_seconds"))
+	meta, err := testStorage.GetMetadata(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []models.Metadata{
+		{ID: "process_cpu_seconds", MType: "counter", Unit: "seconds", Description: "CPU time"},
+		{ID: "up", MType: "gauge"},
+	}, meta)
+
+	// cumulative values are converted to deltas, reset of counter starts from zero
+	require.Equal(t, http.StatusNoContent, write(&prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{
+		promSeries("http_requests_total", map[string]string{"code": "200"}, 20, 2),
+	}}))
+	require.Equal(t, metrictypes.Counter(22), getCounter(`http_requests_total{code="200"}`))
+
+	// series without name are rejected, other series are written
+	require.Equal(t, http.StatusBadRequest, write(&prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{
+		{Labels: []*prompb.Label{{Name: "job", Value: "node"}}, Samples: []*prompb.Sample{{Value: 1}}},
+		promSeries("process_cpu_seconds", nil, 4),
+	}}))
+	require.Equal(t, metrictypes.Counter(4), getCounter("process_cpu_seconds"))
+
+	// first value of stored counter after restart of receiver is base of next deltas
+	restarted := httptest.NewServer(chiRouter(mh, "", "", nil))
+	t.Cleanup(func() { restarted.Close() })
+	var b []byte
+	for _, v := range []float64{6, 9} {
+		var err error
+		b, err = proto.Marshal(&prompb.WriteRequest{
+			Metadata:   []*prompb.MetricMetadata{{Type: prompb.MetricMetadata_COUNTER, MetricFamilyName: "process_cpu_seconds"}},
+			Timeseries: []*prompb.TimeSeries{promSeries("process_cpu_seconds", nil, v)},
+		})
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPost, restarted.URL+"/api/v1/write", bytes.NewReader(snappyEncodeLiteral(b)))
+		require.NoError(t, err)
+		req.Header.Set("Content-Encoding", "snappy")
+		resp, err := restarted.Client().Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+	require.Equal(t, metrictypes.Counter(7), getCounter("process_cpu_seconds"))
+
+	require.Equal(t, http.StatusUnsupportedMediaType, post(snappyEncodeLiteral(b), "gzip"))
+	require.Equal(t, http.StatusBadRequest, post([]byte{0x10, 0x00}, "snappy"))
+	require.Equal(t, http.StatusBadRequest, post(snappyEncodeLiteral([]byte{0xff, 0xff}), "snappy"))
+	require.Equal(t, http.StatusRequestEntityTooLarge, post([]byte{0xff, 0xff, 0xff, 0xff, 0x0f}, "snappy"))
+}
+
+func TestRemoteWriteTrustedSubnet(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	mh := &metricHandlers{
+		ctx:        ctx,
+		storage:    storage.NewMemStorage(),
+		reqRetrier: retrier.NewRetrier(),
+		crypt:      cryptandsign.NewAsymmetricCryptRsa(),
+	}
+	ts := httptest.NewServer(chiRouter(mh, "", "", []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}))
+	t.Cleanup(func() { ts.Close() })
+
+	b, err := proto.Marshal(&prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{promSeries("up", nil, 1)}})
+	require.NoError(t, err)
+	for ip, code := range map[string]int{"192.168.0.1": http.StatusForbidden, "10.0.0.1": http.StatusNoContent} {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/write", bytes.NewReader(snappyEncodeLiteral(b)))
+		require.NoError(t, err)
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Real-IP", ip)
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, code, resp.StatusCode)
+	}
+}
+
+func TestCheckRemoteWriteHeaders(t *testing.T) {
+	t.Parallel()
+	for ct, ok := range map[string]bool{
+		"":                       true,
+		"application/x-protobuf": true,
+		"application/x-protobuf;proto=prometheus.WriteRequest":        true,
+		"application/x-protobuf;proto=io.prometheus.write.v2.Request": false,
+		"application/json": false,
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/write", nil)
+		r.Header.Set("Content-Encoding", "snappy")
+		r.Header.Set("Content-Type", ct)
+		require.Equal(t, ok, checkRemoteWriteHeaders(r) == nil, ct)
+	}
+}
+
+func TestSeriesExpiry(t *testing.T) {
+	e := newSeriesExpiry(time.Hour)
+	now := time.Unix(1700000000, 0)
+	e.touch("a", now)
+	e.touch("b", now)
+	require.Empty(t, e.expired(now))
+
+	e.touch("b", now.Add(50*time.Minute))
+	require.Equal(t, []string{"a"}, e.expired(now.Add(61*time.Minute)))
+
+	// series are checked once per quarter of ttl
+	e.touch("c", now)
+	require.Empty(t, e.expired(now.Add(70*time.Minute)))
+	require.Equal(t, []string{"c"}, e.expired(now.Add(77*time.Minute)))
+	require.Equal(t, []string{"b"}, e.expired(now.Add(111*time.Minute)))
+	require.Empty(t, e.seen)
+}
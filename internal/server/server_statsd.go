@@ -0,0 +1,346 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/storage"
+)
+
+const (
+	// Max size of statsd udp packet.
+	statsdMaxPacket = 65535
+	// Max length of statsd line of tcp stream.
+	statsdMaxLine = 64 << 10
+)
+
+// Statsd metric types.
+const (
+	statsdCounter = "c"
+	statsdGauge   = "g"
+	statsdTimer   = "ms"
+)
+
+// statsdSample parsed statsd line: name:value|type[|@rate][|#tag:value,...].
+type statsdSample struct {
+	name     string        // metric name
+	labels   models.Labels // dogstatsd tags
+	mType    string        // statsd metric type
+	value    float64       // sample value
+	relative bool          // gauge value is change of current value (+/- sign)
+	rate     float64       // sample rate (0, 1]
+}
+
+// statsdEntry aggregated samples of series between flushes.
+type statsdEntry struct {
+	id        string                 // metric name
+	labels    models.Labels          // metric labels
+	set       bool                   // absolute gauge value is received
+	value     float64                // counter sum or last absolute gauge value
+	delta     float64                // sum of relative gauge changes after last absolute value
+	histogram *metrictypes.Histogram // timer observations (seconds)
+}
+
+// statsdAggregator samples aggregated in memory between flushes to storage.
+type statsdAggregator struct {
+	sync.Mutex
+	counters map[string]*statsdEntry // counters by series id
+	gauges   map[string]*statsdEntry // gauges by series id
+	timers   map[string]*statsdEntry // timers by series id
+}
+
+// statsdServer statsd listener of udp packets and tcp streams.
+type statsdServer struct {
+	mh      *metricHandlers   // storage and retrier
+	tenant  string            // tenant of written samples
+	subnets []netip.Prefix    // allowed source subnets (nil - all)
+	agg     *statsdAggregator // samples of current flush interval
+	conns   tcpConns          // tcp connections
+}
+
+// newStatsdAggregator init empty aggregator.
+func newStatsdAggregator() *statsdAggregator {
+	return &statsdAggregator{
+		counters: make(map[string]*statsdEntry),
+		gauges:   make(map[string]*statsdEntry),
+		timers:   make(map[string]*statsdEntry),
+	}
+}
+
+// newStatsdServer init statsd listener of metric handlers storage, samples are written to tenant.
+func newStatsdServer(mh *metricHandlers, tenant string, subnets []netip.Prefix) *statsdServer {
+	return &statsdServer{
+		mh:      mh,
+		tenant:  tenant,
+		subnets: subnets,
+		agg:     newStatsdAggregator(),
+	}
+}
+
+// parseStatsdLine parse statsd line with optional sample rate and dogstatsd tags.
+func parseStatsdLine(line string) (statsdSample, error) {
+	s := statsdSample{rate: 1}
+	parts := strings.Split(line, "|")
+	if len(parts) < 2 {
+		return s, errors.New("missing metric type")
+	}
+	i := strings.LastIndexByte(parts[0], ':')
+	if i <= 0 {
+		return s, fmt.Errorf("missing value of metric %s", parts[0])
+	}
+	name, raw := parts[0][:i], parts[0][i+1:]
+	if strings.ContainsAny(name, "{}") {
+		return s, fmt.Errorf("wrong metric name %s", name)
+	}
+	s.name, s.mType = name, parts[1]
+	// selecting metric type
+	switch s.mType {
+	case statsdCounter, statsdGauge, statsdTimer:
+	default:
+		return s, fmt.Errorf("metric %s: unsupported type %s", name, s.mType)
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return s, fmt.Errorf("metric %s: wrong value %s", name, raw)
+	}
+	s.value = v
+	// signed gauge value changes current value
+	s.relative = s.mType == statsdGauge && (raw[0] == '+' || raw[0] == '-')
+
+	// unknown extensions (e.g. dogstatsd container id) are ignored
+	for _, p := range parts[2:] {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			rate, err := strconv.ParseFloat(p[1:], 64)
+			if err != nil || !(rate > 0 && rate <= 1) {
+				return s, fmt.Errorf("metric %s: wrong sample rate %s", name, p[1:])
+			}
+			s.rate = rate
+		case strings.HasPrefix(p, "#"):
+			s.labels = make(models.Labels)
+			for _, tag := range strings.Split(p[1:], ",") {
+				k, v, ok := strings.Cut(tag, ":")
+				// tag names are label names of series id
+				if !ok || k == "" || v == "" || strings.ContainsAny(k, `{}=," `) {
+					return s, fmt.Errorf("metric %s: wrong tag %s", name, tag)
+				}
+				s.labels[k] = v
+			}
+		}
+	}
+	return s, nil
+}
+
+// entry return aggregated entry of sample series (new entry is added).
+func (a *statsdAggregator) entry(entries map[string]*statsdEntry, s statsdSample) *statsdEntry {
+	series := models.SeriesID(s.name, s.labels)
+	e, ok := entries[series]
+	if !ok {
+		e = &statsdEntry{id: s.name, labels: s.labels}
+		entries[series] = e
+	}
+	return e
+}
+
+// add method for aggregate sample: counters are summed (scaled by sample rate), the last gauge value wins
+// (relative changes are summed), timers are observed by histogram of seconds.
+func (a *statsdAggregator) add(s statsdSample) {
+	a.Lock()
+	defer a.Unlock()
+	// selecting metric type
+	switch s.mType {
+	case statsdCounter:
+		e := a.entry(a.counters, s)
+		e.value += s.value / s.rate
+	case statsdGauge:
+		e := a.entry(a.gauges, s)
+		if s.relative {
+			e.delta += s.value
+		} else {
+			e.set, e.value, e.delta = true, s.value, 0
+		}
+	case statsdTimer:
+		e := a.entry(a.timers, s)
+		if e.histogram == nil {
+			h := metrictypes.NewHistogram(metrictypes.DefaultBounds)
+			e.histogram = &h
+		}
+		e.histogram.ObserveN(s.value/1000, uint64(math.Round(1/s.rate)))
+	}
+}
+
+// take method for get aggregated samples and reset aggregator.
+func (a *statsdAggregator) take() (counters, gauges, timers map[string]*statsdEntry) {
+	a.Lock()
+	defer a.Unlock()
+	counters, gauges, timers = a.counters, a.gauges, a.timers
+	a.counters = make(map[string]*statsdEntry)
+	a.gauges = make(map[string]*statsdEntry)
+	a.timers = make(map[string]*statsdEntry)
+	return counters, gauges, timers
+}
+
+// flush method for write aggregated samples to storage (samples of failed flush are dropped).
+// Relative gauge changes without absolute value are applied to stored gauge value of listener tenant.
+func (s *statsdServer) flush(ctx context.Context) error {
+	ctx = storage.WithTenant(ctx, s.tenant)
+	counters, gauges, timers := s.agg.take()
+	metrics := make([]models.Metrics, 0, len(counters)+len(gauges)+len(timers))
+	for _, e := range counters {
+		delta := int64(math.Round(e.value))
+		metrics = append(metrics, models.Metrics{ID: e.id, MType: metrictypes.CounterType, Delta: &delta, Labels: e.labels})
+	}
+	for series, e := range gauges {
+		value := e.value
+		if !e.set {
+			v, err := s.mh.reqRetrier.UseRetrierGetMetric(s.mh.storage.GetMetric)(ctx, metrictypes.GaugeType, series)
+			if err != nil && !errors.Is(err, customerrors.ErrNoVal) {
+				return err
+			}
+			if g, ok := v.(metrictypes.Gauge); ok {
+				value = float64(g)
+			}
+		}
+		value += e.delta
+		metrics = append(metrics, models.Metrics{ID: e.id, MType: metrictypes.GaugeType, Value: &value, Labels: e.labels})
+	}
+	for _, e := range timers {
+		h := models.Histogram(*e.histogram)
+		metrics = append(metrics, models.Metrics{ID: e.id, MType: metrictypes.HistogramType, Histogram: &h, Labels: e.labels})
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
+	return s.mh.reqRetrier.UseRetrierWMB(s.mh.storage.WriteBatchMetrics)(ctx, metrics)
+}
+
+// handleLines method for aggregate lines of packet or stream, invalid lines are skipped.
+func (s *statsdServer) handleLines(lines [][]byte, addr net.Addr) {
+	var (
+		invalid  int
+		firstErr error
+	)
+	for _, line := range lines {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		sample, err := parseStatsdLine(string(line))
+		if err != nil {
+			if invalid == 0 {
+				firstErr = err
+			}
+			invalid++
+			continue
+		}
+		s.agg.add(sample)
+	}
+	if invalid > 0 {
+		log.Printf("statsd: %d invalid lines from %v: %v", invalid, addr, firstErr)
+	}
+}
+
+// serveUDP method for read statsd packets till connection is closed.
+func (s *statsdServer) serveUDP(pc net.PacketConn) error {
+	buf := make([]byte, statsdMaxPacket)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !allowedAddr(addr, s.subnets) {
+			continue
+		}
+		s.handleLines(bytes.Split(buf[:n], []byte("\n")), addr)
+	}
+}
+
+// serveConn method for read newline separated statsd lines of tcp connection.
+func (s *statsdServer) serveConn(conn net.Conn) {
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, 4096), statsdMaxLine)
+	for sc.Scan() {
+		s.handleLines([][]byte{sc.Bytes()}, conn.RemoteAddr())
+	}
+	if err := sc.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("statsd: connection %v: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// serve method for serve udp and tcp listeners with periodic flush till server context is done.
+// Samples received before shutdown are flushed after listeners are closed.
+func (s *statsdServer) serve(pc net.PacketConn, l net.Listener, flushInterval time.Duration) error {
+	g, ctx := errgroup.WithContext(s.mh.ctx)
+	g.Go(func() error {
+		return s.serveUDP(pc)
+	})
+	g.Go(func() error {
+		return s.conns.serve(l, s.subnets, s.serveConn)
+	})
+	g.Go(func() error {
+		<-ctx.Done()
+		pc.Close()
+		l.Close()
+		s.conns.close()
+		return nil
+	})
+	g.Go(func() error {
+		t := time.NewTicker(flushInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-t.C:
+				if err := s.flush(s.mh.ctx); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	})
+	err := g.Wait()
+	s.conns.wait()
+
+	// server context is done, storage methods have own timeout
+	if ferr := s.flush(context.WithoutCancel(s.mh.ctx)); ferr != nil {
+		log.Println(ferr)
+	}
+	return err
+}
+
+// ListenStatsd start statsd listener (udp and tcp on the same address), samples are aggregated in memory
+// and flushed to storage on interval. Samples are written to tenant (empty - default tenant).
+func ListenStatsd(addr string, flushInterval time.Duration, tenant string, subnets []netip.Prefix, mh *metricHandlers) error {
+	if flushInterval <= 0 {
+		return fmt.Errorf("wrong statsd flush interval: %v", flushInterval)
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	return newStatsdServer(mh, tenant, subnets).serve(pc, l, flushInterval)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/retrier"
+	"github.com/sourcecd/monitoring/internal/storage"
+)
+
+func TestParseStatsdLine(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name   string
+		line   string
+		sample statsdSample
+		err    string
+	}{
+		{name: "counter", line: "requests:1|c", sample: statsdSample{name: "requests", mType: "c", value: 1, rate: 1}},
+		{name: "sample_rate", line: "requests:2|c|@0.1", sample: statsdSample{name: "requests", mType: "c", value: 2, rate: 0.1}},
+		{name: "gauge", line: "temp:-5|g", sample: statsdSample{name: "temp", mType: "g", value: -5, relative: true, rate: 1}},
+		{name: "gauge_absolute", line: "temp:5.5|g", sample: statsdSample{name: "temp", mType: "g", value: 5.5, rate: 1}},
+		{
+			name:   "timer_with_tags",
+			line:   "api.latency:320|ms|@0.5|#host:a,env:prod|c:container",
+			sample: statsdSample{name: "api.latency", mType: "ms", value: 320, rate: 0.5, labels: models.Labels{"host": "a", "env": "prod"}},
+		},
+		{name: "no_type", line: "requests:1", err: "missing metric type"},
+		{name: "no_value", line: "requests|c", err: "missing value of metric requests"},
+		{name: "set", line: "users:42|s", err: "metric users: unsupported type s"},
+		{name: "bad_value", line: "requests:abc|c", err: "metric requests: wrong value abc"},
+		{name: "bad_rate", line: "requests:1|c|@2", err: "metric requests: wrong sample rate 2"},
+		{name: "bad_tag", line: "requests:1|c|#host", err: "metric requests: wrong tag host"},
+		{name: "braces", line: "req{a}:1|c", err: "wrong metric name req{a}"},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseStatsdLine(tt.line)
+			if tt.err != "" {
+				require.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.sample, s)
+		})
+	}
+}
+
+func TestStatsdFlush(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	testStorage := storage.NewMemStorage()
+	require.NoError(t, testStorage.WriteMetric(ctx, metrictypes.GaugeType, "queue", metrictypes.Gauge(10)))
+	s := newStatsdServer(&metricHandlers{ctx: ctx, storage: testStorage, reqRetrier: retrier.NewRetrier()}, "", nil)
+
+	for _, line := range []string{
+		"requests:1|c", "requests:2|c|@0.5",
+		"queue:+5|g", "queue:-2|g",
+		"temp:3|g", "temp:+1|g", "temp:20|g",
+		"latency:20|ms", "latency:300|ms|@0.1",
+	} {
+		sample, err := parseStatsdLine(line)
+		require.NoError(t, err)
+		s.agg.add(sample)
+	}
+	require.NoError(t, s.flush(ctx))
+
+	c, err := testStorage.GetMetric(ctx, metrictypes.CounterType, "requests")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(5), c)
+	// relative changes are applied to stored value
+	g, err := testStorage.GetMetric(ctx, metrictypes.GaugeType, "queue")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(13), g)
+	g, err = testStorage.GetMetric(ctx, metrictypes.GaugeType, "temp")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(20), g)
+	h, err := testStorage.GetMetric(ctx, metrictypes.HistogramType, "latency")
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), h.(metrictypes.Histogram).Count)
+	require.InDelta(t, 3.02, h.(metrictypes.Histogram).Sum, 1e-9)
+
+	// aggregator is reset by flush
+	require.NoError(t, s.flush(ctx))
+	c, err = testStorage.GetMetric(ctx, metrictypes.CounterType, "requests")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(5), c)
+
+	// samples of listener tenant are written to tenant, relative changes are applied to tenant value
+	tctx := storage.WithTenant(ctx, "teamA")
+	require.NoError(t, testStorage.WriteMetric(tctx, metrictypes.GaugeType, "queue", metrictypes.Gauge(1)))
+	ts := newStatsdServer(&metricHandlers{ctx: ctx, storage: testStorage, reqRetrier: retrier.NewRetrier()}, "teamA", nil)
+	for _, line := range []string{"tenant_requests:1|c", "queue:+1|g"} {
+		sample, err := parseStatsdLine(line)
+		require.NoError(t, err)
+		ts.agg.add(sample)
+	}
+	require.NoError(t, ts.flush(ctx))
+	g, err = testStorage.GetMetric(tctx, metrictypes.GaugeType, "queue")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(2), g)
+	c, err = testStorage.GetMetric(tctx, metrictypes.CounterType, "tenant_requests")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(1), c)
+	_, err = testStorage.GetMetric(ctx, metrictypes.CounterType, "tenant_requests")
+	require.Error(t, err)
+	g, err = testStorage.GetMetric(ctx, metrictypes.GaugeType, "queue")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(13), g)
+}
+
+func TestStatsdServe(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	testStorage := storage.NewMemStorage()
+	s := newStatsdServer(&metricHandlers{ctx: ctx, storage: testStorage, reqRetrier: retrier.NewRetrier()}, "",
+		[]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() { done <- s.serve(pc, l, time.Hour) }()
+
+	udp, err := net.Dial("udp", pc.LocalAddr().String())
+	require.NoError(t, err)
+	defer udp.Close()
+	_, err = udp.Write([]byte("requests:1|c\nrequests:2|c\nbad\n"))
+	require.NoError(t, err)
+
+	tcp, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer tcp.Close()
+	_, err = tcp.Write([]byte("temp:21.5|g\nlatency:15|ms\n"))
+	require.NoError(t, err)
+
+	received := func() bool {
+		s.agg.Lock()
+		defer s.agg.Unlock()
+		return len(s.agg.counters) == 1 && len(s.agg.gauges) == 1 && len(s.agg.timers) == 1
+	}
+	require.Eventually(t, received, 5*time.Second, 10*time.Millisecond)
+
+	// samples are flushed on shutdown
+	cancel()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("statsd listener isn't stopped")
+	}
+	bg := context.Background()
+	c, err := testStorage.GetMetric(bg, metrictypes.CounterType, "requests")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(3), c)
+	g, err := testStorage.GetMetric(bg, metrictypes.GaugeType, "temp")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(21.5), g)
+	h, err := testStorage.GetMetric(bg, metrictypes.HistogramType, "latency")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), h.(metrictypes.Histogram).Count)
+}
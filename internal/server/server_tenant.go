@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/storage"
+)
+
+// Max length of tenant name (size of tenant column in postgres DB storage).
+const maxTenantName = 64
+
+// tenant type of authenticated tenant.
+type tenant struct {
+	name    string       // tenant name (storage partition)
+	limiter *rateLimiter // requests rate limit (nil - unlimited)
+}
+
+// tenantRegistry tenants by bearer tokens.
+type tenantRegistry struct {
+	byToken map[string]*tenant  // tenants by token
+	names   map[string]struct{} // registered tenant names
+}
+
+// rateLimiter token bucket of requests (bucket size is one second of rate).
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64          // requests per second
+	tokens float64          // available requests
+	last   time.Time        // time of last refill
+	now    func() time.Time // clock
+}
+
+// newRateLimiter init full bucket of rate requests per second.
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: rate, last: time.Now(), now: time.Now}
+}
+
+// allow take one request from bucket, false if bucket is empty.
+func (l *rateLimiter) allow() bool {
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// validTenantName check tenant name: latin letters, digits, '_', '-' and '.'.
+func validTenantName(name string) bool {
+	if name == "" || len(name) > maxTenantName {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTenants parse tenants config: name:token[:rps], ',' separate (empty - nil registry, single default tenant).
+func parseTenants(s string) (*tenantRegistry, error) {
+	if s == "" {
+		return nil, nil
+	}
+	reg := &tenantRegistry{byToken: make(map[string]*tenant), names: make(map[string]struct{})}
+	for _, v := range strings.Split(s, ",") {
+		parts := strings.Split(v, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("wrong tenant %q: expected name:token[:rps]", v)
+		}
+		name, token := parts[0], parts[1]
+		if !validTenantName(name) {
+			return nil, fmt.Errorf("wrong tenant name %q", name)
+		}
+		if token == "" {
+			return nil, fmt.Errorf("empty token of tenant %s", name)
+		}
+		if _, ok := reg.names[name]; ok {
+			return nil, fmt.Errorf("duplicate tenant %s", name)
+		}
+		if _, ok := reg.byToken[token]; ok {
+			return nil, fmt.Errorf("duplicate token of tenant %s", name)
+		}
+		t := &tenant{name: name}
+		if len(parts) == 3 {
+			rps, err := strconv.ParseFloat(parts[2], 64)
+			if err != nil || rps < 1 {
+				return nil, fmt.Errorf("wrong rate limit of tenant %s: %s", name, parts[2])
+			}
+			t.limiter = newRateLimiter(rps)
+		}
+		reg.names[name] = struct{}{}
+		reg.byToken[token] = t
+	}
+	return reg, nil
+}
+
+// checkTenant check tenant of server side writers (listeners, alert rules).
+// With registry tenant must be registered, because default tenant isn't readable by any token.
+func (reg *tenantRegistry) checkTenant(name string) error {
+	if name != "" && !validTenantName(name) {
+		return fmt.Errorf("wrong tenant name %q", name)
+	}
+	if reg == nil {
+		return nil
+	}
+	if _, ok := reg.names[name]; !ok {
+		return fmt.Errorf("tenant %q isn't registered", name)
+	}
+	return nil
+}
+
+// bearerToken get token from authorization header (or grpc metadata) value.
+// Token scheme of influxdb v2 clients (telegraf) is accepted too.
+func bearerToken(auth string) string {
+	for _, prefix := range []string{"Bearer ", "Token "} {
+		if len(auth) >= len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+			return strings.TrimSpace(auth[len(prefix):])
+		}
+	}
+	return ""
+}
+
+// authenticate return tenant name of token and take request from tenant rate limit.
+// Without registry all requests belong to default tenant.
+func (reg *tenantRegistry) authenticate(token string) (string, error) {
+	if reg == nil {
+		return "", nil
+	}
+	t, ok := reg.byToken[token]
+	if !ok {
+		return "", customerrors.ErrUnauthenticated
+	}
+	if t.limiter != nil && !t.limiter.allow() {
+		return "", fmt.Errorf("%w: %s", customerrors.ErrTenantLimit, t.name)
+	}
+	return t.name, nil
+}
+
+// tenantCheck middleware for authenticate tenant of request by bearer token (tenant is stored in request context).
+func (mh *metricHandlers) tenantCheck() func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, err := mh.tenants.authenticate(bearerToken(r.Header.Get("Authorization")))
+			if err != nil {
+				if errors.Is(err, customerrors.ErrTenantLimit) {
+					http.Error(w, err.Error(), http.StatusTooManyRequests)
+					return
+				}
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r.WithContext(storage.WithTenant(r.Context(), name)))
+		})
+	}
+}
+
+// requestCtx return handlers context of request tenant (storage methods are scoped by it).
+func (mh *metricHandlers) requestCtx(r *http.Request) context.Context {
+	return storage.WithTenant(mh.ctx, storage.TenantFromContext(r.Context()))
+}
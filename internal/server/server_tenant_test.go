@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/cryptandsign"
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/retrier"
+	"github.com/sourcecd/monitoring/internal/storage"
+)
+
+func TestParseTenants(t *testing.T) {
+	t.Parallel()
+	reg, err := parseTenants("")
+	require.NoError(t, err)
+	require.Nil(t, reg)
+	name, err := reg.authenticate("")
+	require.NoError(t, err)
+	require.Equal(t, "", name)
+
+	reg, err = parseTenants("teamA:tokenA,teamB:tokenB:10")
+	require.NoError(t, err)
+	require.Len(t, reg.byToken, 2)
+	require.Nil(t, reg.byToken["tokenA"].limiter)
+	require.Equal(t, 10.0, reg.byToken["tokenB"].limiter.rate)
+	name, err = reg.authenticate("tokenB")
+	require.NoError(t, err)
+	require.Equal(t, "teamB", name)
+	_, err = reg.authenticate("")
+	require.ErrorIs(t, err, customerrors.ErrUnauthenticated)
+
+	// default tenant isn't readable with registry
+	require.NoError(t, reg.checkTenant("teamA"))
+	require.Error(t, reg.checkTenant(""))
+	require.Error(t, reg.checkTenant("teamC"))
+	var noReg *tenantRegistry
+	require.NoError(t, noReg.checkTenant(""))
+	require.NoError(t, noReg.checkTenant("teamC"))
+	require.Error(t, noReg.checkTenant("team C"))
+
+	for _, v := range []string{
+		"teamA",
+		"teamA:tokenA:1:2",
+		"team/A:tokenA",
+		":tokenA",
+		"teamA:",
+		"teamA:tokenA,teamA:tokenB",
+		"teamA:tokenA,teamB:tokenA",
+		"teamA:tokenA:0",
+		"teamA:tokenA:fast",
+	} {
+		_, err := parseTenants(v)
+		require.Error(t, err, v)
+	}
+
+	require.Equal(t, "tokenA", bearerToken("Bearer tokenA"))
+	require.Equal(t, "tokenA", bearerToken("bearer tokenA"))
+	require.Equal(t, "tokenA", bearerToken("Token tokenA"))
+	require.Equal(t, "", bearerToken("Basic dXNlcjpwYXNz"))
+	require.Equal(t, "", bearerToken(""))
+}
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+	ts := time.Unix(1000, 0)
+	l := newRateLimiter(2)
+	l.last = ts
+	l.now = func() time.Time { return ts }
+
+	require.True(t, l.allow())
+	require.True(t, l.allow())
+	require.False(t, l.allow())
+	ts = ts.Add(500 * time.Millisecond)
+	require.True(t, l.allow())
+	require.False(t, l.allow())
+	// bucket isn't filled over one second of rate
+	ts = ts.Add(time.Minute)
+	require.True(t, l.allow())
+	require.True(t, l.allow())
+	require.False(t, l.allow())
+}
+
+func TestTenantAPI(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var keyenc, privkeypath string
+	tenants, err := parseTenants("teamA:tokenA,teamB:tokenB:1")
+	require.NoError(t, err)
+	testStorage := storage.NewMemStorage()
+	mh := &metricHandlers{
+		ctx:        ctx,
+		storage:    testStorage,
+		reqRetrier: retrier.NewRetrier(),
+		crypt:      cryptandsign.NewAsymmetricCryptRsa(),
+		tenants:    tenants,
+	}
+	ts := httptest.NewServer(chiRouter(mh, keyenc, privkeypath, nil))
+	t.Cleanup(func() { ts.Close() })
+
+	do := func(method, path, token string) (int, string) {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(b)
+	}
+
+	code, _ := do(http.MethodPost, "/update/gauge/Alloc/1", "")
+	require.Equal(t, http.StatusUnauthorized, code)
+	code, _ = do(http.MethodPost, "/update/gauge/Alloc/1", "wrong")
+	require.Equal(t, http.StatusUnauthorized, code)
+	code, _ = do(http.MethodPost, "/update/gauge/Alloc/1", "tokenA")
+	require.Equal(t, http.StatusOK, code)
+
+	// series of tenant aren't visible to other tenants
+	code, body := do(http.MethodGet, "/value/gauge/Alloc", "tokenA")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "1\n", body)
+	code, _ = do(http.MethodGet, "/value/gauge/Alloc", "tokenB")
+	require.Equal(t, http.StatusNotFound, code)
+	g, err := testStorage.GetMetric(storage.WithTenant(ctx, "teamA"), "gauge", "Alloc")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, g)
+	_, err = testStorage.GetMetric(ctx, "gauge", "Alloc")
+	require.ErrorIs(t, err, customerrors.ErrNoVal)
+
+	// rate limit of tenant (second request of teamB in same second)
+	code, _ = do(http.MethodGet, "/", "tokenB")
+	require.Equal(t, http.StatusTooManyRequests, code)
+	code, body = do(http.MethodGet, "/", "tokenA")
+	require.Equal(t, http.StatusOK, code)
+	require.Contains(t, body, "Alloc: 1")
+
+	// health check doesn't need token
+	code, _ = do(http.MethodGet, "/ping", "")
+	require.NotEqual(t, http.StatusUnauthorized, code)
+}
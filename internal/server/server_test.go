@@ -9,6 +9,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 
@@ -443,3 +444,254 @@ func TestSaveToFile(t *testing.T) {
 	m := storage.NewMemStorage()
 	saveToFile(m, f.Name(), 0)
 }
+
+func TestLabeledMetrics(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var keyenc, privkeypath string
+	testStorage := storage.NewMemStorage()
+	mh := &metricHandlers{
+		ctx:        ctx,
+		storage:    testStorage,
+		reqRetrier: retrier.NewRetrier(),
+		crypt:      cryptandsign.NewAsymmetricCryptRsa(),
+	}
+	ts := httptest.NewServer(chiRouter(mh, keyenc, privkeypath, nil))
+	t.Cleanup(func() { ts.Close() })
+
+	// json api with labels
+	resp, err := ts.Client().Post(ts.URL+"/update/", "application/json",
+		strings.NewReader(`{"id": "CPUutilization", "type": "gauge", "value": 5, "labels": {"host": "h1", "cpu": "0"}}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// url api with labels in metric name (labels order doesn't matter)
+	resp, err = ts.Client().Post(ts.URL+"/update/gauge/"+url.PathEscape(`CPUutilization{host="h1",cpu="1"}`)+"/7", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = ts.Client().Get(ts.URL + "/value/gauge/" + url.PathEscape(`CPUutilization{cpu="0",host="h1"}`))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "5\n", string(body))
+
+	resp, err = ts.Client().Post(ts.URL+"/value/", "application/json",
+		strings.NewReader(`{"id": "CPUutilization", "type": "gauge", "labels": {"cpu": "1", "host": "h1"}}`))
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.JSONEq(t, `{"id": "CPUutilization", "type": "gauge", "value": 7, "labels": {"cpu": "1", "host": "h1"}}`, string(body))
+
+	// series without labels is a different series
+	resp, err = ts.Client().Get(ts.URL + "/value/gauge/CPUutilization")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = ts.Client().Get(ts.URL + "/value/gauge/" + url.PathEscape(`CPUutilization{cpu=0}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// metric and label names can't contain series id delimiters
+	for _, body := range []string{
+		`{"id": "CPU utilization", "type": "gauge", "value": 5}`,
+		`{"id": "CPUutilization", "type": "gauge", "value": 5, "labels": {"cpu,host": "h1"}}`,
+		`{"id": "CPUutilization", "type": "counter", "delta": 5, "labels": {"cpu=": "0"}}`,
+	} {
+		resp, err = ts.Client().Post(ts.URL+"/update/", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+	}
+	resp, err = ts.Client().Post(ts.URL+"/update/gauge/"+url.PathEscape(`CPU,utilization{cpu="0"}`)+"/7", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, err = ts.Client().Post(ts.URL+"/updates/", "application/json",
+		strings.NewReader(`[{"id": "CPUutilization", "type": "gauge", "value": 9, "labels": {"cpu}": "0"}}, {"id": "Batch", "type": "gauge", "value": 9}]`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	// wrong metric of batch is skipped
+	series, err := testStorage.GetAllMetricsTxt(ctx)
+	require.NoError(t, err)
+	require.NotContains(t, series, "cpu}")
+	require.Contains(t, series, "Batch")
+}
+
+func TestHistogramMetricsAPI(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var keyenc, privkeypath string
+	mh := &metricHandlers{
+		ctx:        ctx,
+		storage:    storage.NewMemStorage(),
+		reqRetrier: retrier.NewRetrier(),
+		crypt:      cryptandsign.NewAsymmetricCryptRsa(),
+	}
+	ts := httptest.NewServer(chiRouter(mh, keyenc, privkeypath, nil))
+	t.Cleanup(func() { ts.Close() })
+
+	testCase := []struct {
+		name       string
+		request    string
+		body       string
+		statusCode int
+	}{
+		{
+			name:       "write",
+			request:    "/update/",
+			body:       `{"id": "latency", "type": "histogram", "histogram": {"bounds": [0.1, 1], "counts": [1, 2, 1], "sum": 3.5, "count": 4}}`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "merge",
+			request:    "/update/",
+			body:       `{"id": "latency", "type": "histogram", "histogram": {"bounds": [0.1, 1], "counts": [0, 4, 0], "sum": 2, "count": 4}}`,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "wrong-bounds",
+			request:    "/update/",
+			body:       `{"id": "latency", "type": "histogram", "histogram": {"bounds": [0.5], "counts": [1, 0], "sum": 0.1, "count": 1}}`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "inconsistent",
+			request:    "/update/",
+			body:       `{"id": "latency", "type": "histogram", "histogram": {"bounds": [0.1, 1], "counts": [1], "sum": 0.1, "count": 1}}`,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "no-value",
+			request:    "/update/",
+			body:       `{"id": "latency", "type": "histogram"}`,
+			statusCode: http.StatusBadRequest,
+		},
+	}
+	for _, v := range testCase {
+		t.Run(v.name, func(t *testing.T) {
+			resp, err := ts.Client().Post(ts.URL+v.request, "application/json", strings.NewReader(v.body))
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, v.statusCode, resp.StatusCode)
+		})
+	}
+
+	resp, err := ts.Client().Post(ts.URL+"/value/", "application/json", strings.NewReader(`{"id": "latency", "type": "histogram"}`))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.JSONEq(t, `{"id": "latency", "type": "histogram", "histogram": {"bounds": [0.1, 1], "counts": [1, 6, 1], "sum": 5.5, "count": 8,
+		"quantiles": {"p50": 0.55, "p90": 1, "p99": 1}}}`, string(body))
+
+	resp, err = ts.Client().Get(ts.URL + "/value/histogram/latency")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "count=8 sum=5.5 p50=0.55 p90=1 p99=1\n", string(body))
+
+	resp, err = ts.Client().Post(ts.URL+"/update/histogram/latency/1", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestDeleteMetricsAPI(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var keyenc, privkeypath string
+	testStorage := storage.NewMemStorage()
+	mh := &metricHandlers{
+		ctx:        ctx,
+		storage:    testStorage,
+		reqRetrier: retrier.NewRetrier(),
+		crypt:      cryptandsign.NewAsymmetricCryptRsa(),
+	}
+	ts := httptest.NewServer(chiRouter(mh, keyenc, privkeypath, nil))
+	t.Cleanup(func() { ts.Close() })
+
+	for _, name := range []string{"CPUutilization1", "CPUutilization2", `Load{host="old"}`} {
+		require.NoError(t, testStorage.WriteMetric(ctx, "gauge", name, metrictypes.Gauge(1)))
+	}
+	require.NoError(t, testStorage.WriteMetric(ctx, "counter", "CPUutilization1", metrictypes.Counter(1)))
+
+	testCase := []struct {
+		name       string
+		request    string
+		response   string
+		statusCode int
+	}{
+		{name: "pattern", request: "/value/gauge/CPUutilization*", response: "2\n", statusCode: http.StatusOK},
+		{name: "deleted", request: "/value/gauge/CPUutilization1", statusCode: http.StatusNotFound},
+		{name: "labeled", request: "/value/gauge/" + url.PathEscape(`Load{host="old"}`), response: "1\n", statusCode: http.StatusOK},
+		{name: "wrong-type", request: "/value/wrong/CPUutilization1", statusCode: http.StatusBadRequest},
+		{name: "wrong-name", request: "/value/gauge/" + url.PathEscape(`Load{host`), statusCode: http.StatusBadRequest},
+		{name: "other-type", request: "/value/counter/CPUutilization1", response: "1\n", statusCode: http.StatusOK},
+	}
+	for _, v := range testCase {
+		t.Run(v.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodDelete, ts.URL+v.request, nil)
+			require.NoError(t, err)
+			resp, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, v.statusCode, resp.StatusCode)
+			if v.response != "" {
+				b, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				require.Equal(t, v.response, string(b))
+			}
+		})
+	}
+	txt, err := testStorage.GetAllMetricsTxt(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "---Counters---\n---Gauge---\n", txt)
+
+	// delete is checked as write
+	require.NoError(t, testStorage.WriteMetric(ctx, "gauge", "CPUutilization1", metrictypes.Gauge(1)))
+	signed := httptest.NewServer(chiRouter(mh, "secret", privkeypath, nil))
+	t.Cleanup(func() { signed.Close() })
+	// signature of delete covers method and path, unsigned delete is rejected
+	for _, sign := range []string{"", "00", cryptandsign.RequestSign("secret", http.MethodDelete, "/value/gauge/CPUutilization2", nil)} {
+		req, err := http.NewRequest(http.MethodDelete, signed.URL+"/value/gauge/CPUutilization1", nil)
+		require.NoError(t, err)
+		if sign != "" {
+			req.Header.Set("HashSHA256", sign)
+		}
+		resp, err := signed.Client().Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+	req, err := http.NewRequest(http.MethodDelete, signed.URL+"/value/gauge/CPUutilization1", nil)
+	require.NoError(t, err)
+	req.Header.Set("HashSHA256", cryptandsign.RequestSign("secret", http.MethodDelete, "/value/gauge/CPUutilization1", nil))
+	resp, err := signed.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, testStorage.WriteMetric(ctx, "gauge", "CPUutilization1", metrictypes.Gauge(1)))
+
+	subnets, err := parseSubnetPrefixes("10.0.0.0/8")
+	require.NoError(t, err)
+	filtered := httptest.NewServer(chiRouter(mh, keyenc, privkeypath, subnets))
+	t.Cleanup(func() { filtered.Close() })
+	req, err = http.NewRequest(http.MethodDelete, filtered.URL+"/value/gauge/CPUutilization1", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Real-IP", "192.168.0.1")
+	resp, err = filtered.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_, err = testStorage.GetMetric(ctx, "gauge", "CPUutilization1")
+	require.NoError(t, err)
+}
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+// tenantAlerts saved alerts state of tenant (record of write-ahead log, snapshot and disk storage).
+type tenantAlerts struct {
+	Tenant string         `json:"tenant,omitempty"` // tenant of alerts
+	Alerts []models.Alert `json:"alerts"`           // alerts state
+}
+
+// setAlerts replace saved alerts state of tenant, empty state is dropped.
+func setAlerts(mp map[string][]models.Alert, ta tenantAlerts) {
+	if len(ta.Alerts) == 0 {
+		delete(mp, ta.Tenant)
+		return
+	}
+	mp[ta.Tenant] = ta.Alerts
+}
+
+// alertsOfTenant return copy of saved alerts state of tenant.
+func alertsOfTenant(mp map[string][]models.Alert, tenant string) []models.Alert {
+	return append([]models.Alert{}, mp[tenant]...)
+}
+
+// sortedAlerts return saved alerts state of all tenants sorted by tenant.
+func sortedAlerts(mp map[string][]models.Alert) []tenantAlerts {
+	res := make([]tenantAlerts, 0, len(mp))
+	for _, k := range sortedKeys(mp) {
+		res = append(res, tenantAlerts{Tenant: k, Alerts: mp[k]})
+	}
+	return res
+}
@@ -0,0 +1,1052 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+// Record kinds of disk storage segments.
+const (
+	diskRecordSample = "sample"   // written metric and metric state after write
+	diskRecordValue  = "value"    // metric state only (written by merge when samples are expired)
+	diskRecordRollup = "rollup"   // rollup sample built by compaction
+	diskRecordExpire = "expire"   // retention drop of old samples and rollups
+	diskRecordDelete = "delete"   // drop of series matched by id or pattern
+	diskRecordMeta   = "metadata" // registered metadata of metric names
+	diskRecordAlerts = "alerts"   // saved alerts state of tenant
+	diskRecordHeader = "header"   // first record of merged segment, it replaces all previous segments
+)
+
+// Disk storage limits and intervals.
+const (
+	diskMaxSegmentSize = 64 << 20    // active segment is sealed when it grows over this size
+	diskMergeInterval  = time.Minute // interval of background segments merge check
+	diskMergeMinSize   = 1 << 20     // storage smaller than this is not merged for garbage
+	diskMergeSegments  = 4           // sealed segments count which is always merged
+	diskMergeBuffer    = 1 << 20     // write buffer of merged segment
+)
+
+// ErrDiskClosed error for operations on closed disk storage.
+var ErrDiskClosed = errors.New("disk storage is closed")
+
+// diskRecord single record of segment file (json payload of frame).
+type diskRecord struct {
+	Kind       string            `json:"kind"`                 // record kind
+	Timestamp  time.Time         `json:"ts"`                   // time of write (bucket start for rollups)
+	Metric     *models.Metrics   `json:"metric,omitempty"`     // written metric (sample record)
+	State      *models.Metrics   `json:"state,omitempty"`      // metric value after write (sample and value records)
+	Rollup     *models.Sample    `json:"rollup,omitempty"`     // rollup sample (rollup record)
+	MType      string            `json:"type,omitempty"`       // rollup and delete metric type
+	Series     string            `json:"series,omitempty"`     // rollup series id (series id or pattern for delete)
+	Tenant     string            `json:"tenant,omitempty"`     // tenant of deleted series (delete record)
+	Resolution time.Duration     `json:"resolution,omitempty"` // rollup resolution
+	Expire     *diskExpire       `json:"expire,omitempty"`     // retention drop (expire record)
+	Metadata   []models.Metadata `json:"metadata,omitempty"`   // metadata of metric names (metadata record)
+	Alerts     *tenantAlerts     `json:"alerts,omitempty"`     // alerts state (alerts record)
+}
+
+// diskExpire retention drop parameters.
+type diskExpire struct {
+	History time.Time                   `json:"history"` // raw samples older than this are dropped (zero - kept)
+	Rollups map[time.Duration]time.Time `json:"rollups"` // rollups older than this are dropped, resolutions not listed are dropped at all
+}
+
+// diskKey series key of disk storage index.
+type diskKey struct {
+	mType  string // metric type
+	series string // series id
+}
+
+// diskSeries index entry of series: latest value in memory, history and rollups on disk.
+type diskSeries struct {
+	state    models.Metrics              // latest metric value
+	stateLoc diskLoc                     // record of latest value
+	samples  []diskLoc                   // raw history records (time ordered)
+	rollups  map[time.Duration][]diskLoc // rollup records by resolution (time ordered)
+}
+
+// DiskStorage embedded log-structured disk storage.
+// Every write is appended to active segment file, in-memory index of series is rebuilt from segments on open.
+// Sealed segments are merged in background: live records are rewritten to one segment, garbage is dropped.
+type DiskStorage struct {
+	dir            string                      // storage directory
+	fsync          string                      // fsync mode of active segment (same as write-ahead log modes)
+	segments       map[uint64]*diskSegment     // open segment files by number
+	active         *diskSegment                // segment for append
+	index          map[diskKey]*diskSeries     // series index
+	metadata       map[string]models.Metadata  // metadata by metric name (small, rewritten by every merge)
+	alerts         map[string][]models.Alert   // saved alerts state by tenant (small, rewritten by every merge)
+	rollupMarks    map[time.Duration]time.Time // end of last built rollup bucket by resolution
+	maxSegmentSize int64                       // size of segment rotation
+	now            func() time.Time            // clock for history timestamps
+	closed         bool                        // storage is closed
+	done           chan struct{}               // stop background jobs
+	wg             sync.WaitGroup              // background jobs
+	mergeMu        sync.Mutex                  // serializes segments merges
+	sync.RWMutex
+}
+
+// OpenDiskStorage open (or create) disk storage in directory and replay its segments.
+// Damaged tail of the last segment (torn write) is truncated, damage of other segments is an error.
+func OpenDiskStorage(dir, fsync string) (*DiskStorage, error) {
+	switch fsync {
+	case WALFsyncAlways, WALFsyncEverySec, WALFsyncNo:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrWrongWALFsync, fsync)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	// unfinished merges
+	tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range tmps {
+		if err := os.Remove(f); err != nil {
+			return nil, err
+		}
+	}
+
+	d := &DiskStorage{
+		dir:            dir,
+		fsync:          fsync,
+		segments:       make(map[uint64]*diskSegment),
+		index:          make(map[diskKey]*diskSeries),
+		metadata:       make(map[string]models.Metadata),
+		alerts:         make(map[string][]models.Alert),
+		rollupMarks:    make(map[time.Duration]time.Time),
+		maxSegmentSize: diskMaxSegmentSize,
+		now:            time.Now,
+		done:           make(chan struct{}),
+	}
+	if err := d.replay(); err != nil {
+		_ = d.closeSegments()
+		return nil, err
+	}
+
+	if fsync == WALFsyncEverySec {
+		d.wg.Add(1)
+		go d.syncLoop()
+	}
+	d.wg.Add(1)
+	go d.mergeLoop()
+	return d, nil
+}
+
+// replay open segments and rebuild index.
+// Segments older than the last merged one are left by crash during merge, they are removed.
+func (d *DiskStorage) replay() error {
+	seqs, err := listSegments(d.dir)
+	if err != nil {
+		return err
+	}
+	base := 0
+	for i := len(seqs) - 1; i > 0 && base == 0; i-- {
+		merged, err := d.isMerged(seqs[i])
+		if err != nil {
+			return err
+		}
+		if merged {
+			base = i
+		}
+	}
+	for _, seq := range seqs[:base] {
+		if err := os.Remove(segmentName(d.dir, seq)); err != nil {
+			return err
+		}
+	}
+	seqs = seqs[base:]
+
+	for i, seq := range seqs {
+		seg, err := openSegment(d.dir, seq)
+		if err != nil {
+			return err
+		}
+		d.segments[seq] = seg
+		valid, err := seg.scan(func(off int64, size uint32, payload []byte) error {
+			var rec diskRecord
+			if err := json.Unmarshal(payload, &rec); err != nil {
+				return fmt.Errorf("%w: %s", ErrDiskCorrupt, err.Error())
+			}
+			d.apply(rec, diskLoc{seg: seq, off: off, size: size, ts: rec.Timestamp.UnixNano()})
+			return nil
+		})
+		if err != nil {
+			if !errors.Is(err, ErrDiskCorrupt) || i != len(seqs)-1 {
+				return fmt.Errorf("segment %d: %w", seq, err)
+			}
+			log.Printf("disk storage: truncate damaged tail of segment %d at %d", seq, valid)
+			if err := seg.truncate(valid); err != nil {
+				return err
+			}
+		}
+		d.active = seg
+	}
+	if d.active == nil {
+		seg, err := openSegment(d.dir, 1)
+		if err != nil {
+			return err
+		}
+		d.segments[seg.seq] = seg
+		d.active = seg
+	}
+
+	// rollups are built up to the last stored bucket
+	for _, s := range d.index {
+		for res, locs := range s.rollups {
+			if len(locs) == 0 {
+				continue
+			}
+			if end := time.Unix(0, locs[len(locs)-1].ts).Add(res); end.After(d.rollupMarks[res]) {
+				d.rollupMarks[res] = end
+			}
+		}
+	}
+	return nil
+}
+
+// isMerged check that segment starts with merged segment header.
+func (d *DiskStorage) isMerged(seq uint64) (bool, error) {
+	seg, err := openSegment(d.dir, seq)
+	if err != nil {
+		return false, err
+	}
+	defer seg.f.Close()
+	payload, err := seg.first()
+	if err != nil {
+		// empty or damaged segment, damage is reported by replay
+		return false, nil
+	}
+	var rec diskRecord
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return false, nil
+	}
+	return rec.Kind == diskRecordHeader, nil
+}
+
+// series return index entry of series, entry is created if not exists (caller must hold write lock).
+func (d *DiskStorage) series(mType, series string) *diskSeries {
+	key := diskKey{mType: mType, series: series}
+	s, ok := d.index[key]
+	if !ok {
+		s = &diskSeries{rollups: make(map[time.Duration][]diskLoc)}
+		d.index[key] = s
+	}
+	return s
+}
+
+// apply change index by record written at location (caller must hold write lock).
+func (d *DiskStorage) apply(rec diskRecord, loc diskLoc) {
+	switch rec.Kind {
+	case diskRecordSample:
+		s := d.series(rec.State.MType, rec.State.SeriesID())
+		s.state, s.stateLoc = *rec.State, loc
+		s.samples = append(s.samples, loc)
+	case diskRecordValue:
+		s := d.series(rec.State.MType, rec.State.SeriesID())
+		s.state, s.stateLoc = *rec.State, loc
+	case diskRecordRollup:
+		s := d.series(rec.MType, rec.Series)
+		s.rollups[rec.Resolution] = append(s.rollups[rec.Resolution], loc)
+	case diskRecordExpire:
+		d.expire(*rec.Expire)
+	case diskRecordMeta:
+		for _, v := range rec.Metadata {
+			d.metadata[v.ID] = v
+		}
+	case diskRecordAlerts:
+		setAlerts(d.alerts, *rec.Alerts)
+	case diskRecordDelete:
+		match, err := seriesMatcher(WithTenant(context.Background(), rec.Tenant), rec.Series)
+		if err != nil {
+			log.Printf("disk storage: delete %s: %s", rec.Series, err.Error())
+			return
+		}
+		for k := range d.index {
+			if k.mType == rec.MType && match(k.series) {
+				delete(d.index, k)
+			}
+		}
+	}
+}
+
+// expire drop index locations of expired samples and rollups (caller must hold write lock).
+func (d *DiskStorage) expire(e diskExpire) {
+	for _, s := range d.index {
+		if !e.History.IsZero() {
+			s.samples = dropLocsBefore(s.samples, e.History)
+		}
+		for res, locs := range s.rollups {
+			before, ok := e.Rollups[res]
+			if !ok {
+				// resolution removed from policy
+				delete(s.rollups, res)
+				continue
+			}
+			if rest := dropLocsBefore(locs, before); len(rest) > 0 {
+				s.rollups[res] = rest
+			} else {
+				delete(s.rollups, res)
+			}
+		}
+	}
+}
+
+// dropLocsBefore return time ordered locations not older than cutoff (copy, so dropped locations can be freed).
+func dropLocsBefore(locs []diskLoc, cutoff time.Time) []diskLoc {
+	ts := cutoff.UnixNano()
+	start := sort.Search(len(locs), func(i int) bool { return locs[i].ts >= ts })
+	if start == 0 {
+		return locs
+	}
+	return append([]diskLoc(nil), locs[start:]...)
+}
+
+// locsInRange return time ordered locations between from and to (inclusive).
+func locsInRange(locs []diskLoc, from, to time.Time) []diskLoc {
+	f, t := from.UnixNano(), to.UnixNano()
+	start := sort.Search(len(locs), func(i int) bool { return locs[i].ts >= f })
+	end := sort.Search(len(locs), func(i int) bool { return locs[i].ts > t })
+	if start >= end {
+		return nil
+	}
+	return locs[start:end]
+}
+
+// appendRecords write records to active segment and apply them to index (caller must hold write lock).
+func (d *DiskStorage) appendRecords(recs []diskRecord) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	var frames []byte
+	locs := make([]diskLoc, len(recs))
+	for i, rec := range recs {
+		payload, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		start := len(frames)
+		frames = encodeFrame(frames, payload)
+		locs[i] = diskLoc{seg: d.active.seq, off: d.active.size + int64(start), size: uint32(len(frames) - start), ts: rec.Timestamp.UnixNano()}
+	}
+	if err := d.active.write(frames); err != nil {
+		return fmt.Errorf("disk storage write failed: %s", err.Error())
+	}
+	if d.fsync == WALFsyncAlways {
+		if err := d.active.f.Sync(); err != nil {
+			return fmt.Errorf("disk storage fsync failed: %s", err.Error())
+		}
+	}
+	for i := range recs {
+		d.apply(recs[i], locs[i])
+	}
+	if d.active.size >= d.maxSegmentSize {
+		// records are already written, so rotation error doesn't fail the write
+		if err := d.rotate(); err != nil {
+			log.Printf("disk storage: segment rotation failed: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// rotate seal active segment and open the next one (caller must hold write lock).
+func (d *DiskStorage) rotate() error {
+	if err := d.active.f.Sync(); err != nil {
+		return err
+	}
+	seg, err := openSegment(d.dir, d.active.seq+1)
+	if err != nil {
+		return err
+	}
+	d.segments[seg.seq] = seg
+	d.active = seg
+	return nil
+}
+
+// readRecord read record at location (caller must hold lock).
+func (d *DiskStorage) readRecord(loc diskLoc) (diskRecord, error) {
+	var rec diskRecord
+	seg, ok := d.segments[loc.seg]
+	if !ok {
+		return rec, fmt.Errorf("%w: segment %d not found", ErrDiskCorrupt, loc.seg)
+	}
+	payload, err := seg.read(loc)
+	if err != nil {
+		return rec, err
+	}
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return rec, fmt.Errorf("%w: %s", ErrDiskCorrupt, err.Error())
+	}
+	return rec, nil
+}
+
+// readSamples read history samples (raw or rollups) at locations (caller must hold lock).
+func (d *DiskStorage) readSamples(locs []diskLoc) ([]models.Sample, error) {
+	res := make([]models.Sample, 0, len(locs))
+	for _, loc := range locs {
+		rec, err := d.readRecord(loc)
+		if err != nil {
+			return nil, err
+		}
+		if rec.Rollup != nil {
+			res = append(res, *rec.Rollup)
+			continue
+		}
+		res = append(res, models.Sample{
+			Timestamp: rec.Timestamp,
+			Delta:     rec.Metric.Delta,
+			Value:     rec.Metric.Value,
+			Histogram: rec.Metric.Histogram,
+		})
+	}
+	return res, nil
+}
+
+// nextState return metric value after write of metric (caller must hold lock).
+// Pending states of not yet applied batch records are used before index.
+func (d *DiskStorage) nextState(v models.Metrics, pending map[diskKey]models.Metrics) (models.Metrics, error) {
+	key := diskKey{mType: v.MType, series: v.SeriesID()}
+	prev, ok := pending[key]
+	if !ok {
+		if s, found := d.index[key]; found {
+			prev, ok = s.state, true
+		}
+	}
+	state := models.Metrics{ID: v.ID, Labels: v.Labels, MType: v.MType}
+	// selecting metric type
+	switch v.MType {
+	case metrictypes.GaugeType:
+		value := *v.Value
+		state.Value = &value
+	case metrictypes.CounterType:
+		total := *v.Delta
+		if ok {
+			total += *prev.Delta
+		}
+		state.Delta = &total
+	case metrictypes.HistogramType:
+		h := metrictypes.Histogram(*v.Histogram).Clone()
+		if ok {
+			stored := metrictypes.Histogram(*prev.Histogram).Clone()
+			if err := stored.Merge(h); err != nil {
+				return state, err
+			}
+			h = stored
+		}
+		hm := models.Histogram(h)
+		state.Histogram = &hm
+	}
+	return state, nil
+}
+
+// Ping implementation Ping method of storage interface (disk storage).
+func (d *DiskStorage) Ping(ctx context.Context) error {
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		return ErrDiskClosed
+	}
+	return nil
+}
+
+// WriteMetric implementation WriteMetric method of storage interface (disk storage).
+func (d *DiskStorage) WriteMetric(ctx context.Context, mtype, name string, val interface{}) error {
+	metric, err := metricFromValue(mtype, name, val)
+	if err != nil {
+		return err
+	}
+	if metric.Labels, err = tenantLabels(TenantFromContext(ctx), metric.Labels); err != nil {
+		return err
+	}
+	if err := validateMetric(metric); err != nil {
+		return err
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.closed {
+		return ErrDiskClosed
+	}
+	state, err := d.nextState(metric, nil)
+	if err != nil {
+		return err
+	}
+	return d.appendRecords([]diskRecord{{Kind: diskRecordSample, Timestamp: d.now(), Metric: &metric, State: &state}})
+}
+
+// WriteBatchMetrics implementation WriteBatchMetrics method of storage interface (disk storage).
+// Accepted metrics of batch are written to segment with one write.
+func (d *DiskStorage) WriteBatchMetrics(ctx context.Context, metrics []models.Metrics) error {
+	metrics = tenantBatch(ctx, metrics)
+	d.Lock()
+	defer d.Unlock()
+	if d.closed {
+		return ErrDiskClosed
+	}
+	// all samples of one batch share the same timestamp
+	ts := d.now()
+	pending := make(map[diskKey]models.Metrics)
+	recs := make([]diskRecord, 0, len(metrics))
+	// i think we don't break all batch if one metric failed in batch (use continue)
+	for _, v := range metrics {
+		if v.ID == "" {
+			log.Printf("empty id of %s metric", v.MType)
+			continue
+		}
+		if err := validateMetric(v); err != nil {
+			log.Printf("metric %s: %s", v.ID, err.Error())
+			continue
+		}
+		state, err := d.nextState(v, pending)
+		if err != nil {
+			log.Printf("metric %s: %s", v.ID, err.Error())
+			continue
+		}
+		pending[diskKey{mType: v.MType, series: v.SeriesID()}] = state
+		metric := v
+		recs = append(recs, diskRecord{Kind: diskRecordSample, Timestamp: ts, Metric: &metric, State: &state})
+	}
+	return d.appendRecords(recs)
+}
+
+// GetMetric implementation GetMetric method of storage interface (disk storage).
+func (d *DiskStorage) GetMetric(ctx context.Context, mType, name string) (interface{}, error) {
+	name, err := tenantSeries(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		return nil, ErrDiskClosed
+	}
+	s, ok := d.index[diskKey{mType: mType, series: name}]
+	// selecting metric type
+	switch mType {
+	case metrictypes.GaugeType:
+		if ok {
+			return metrictypes.Gauge(*s.state.Value), nil
+		}
+	case metrictypes.CounterType:
+		if ok {
+			return metrictypes.Counter(*s.state.Delta), nil
+		}
+	case metrictypes.HistogramType:
+		if ok {
+			return metrictypes.Histogram(*s.state.Histogram).Clone(), nil
+		}
+	default:
+		return nil, customerrors.ErrBadMetricType
+	}
+	return nil, customerrors.ErrNoVal
+}
+
+// GetAllMetricsTxt implementation GetAllMetricsTxt method of storage interface (disk storage).
+func (d *DiskStorage) GetAllMetricsTxt(ctx context.Context) (string, error) {
+	vals, err := d.values()
+	if err != nil {
+		return "", err
+	}
+	return formatMetricsTxt(vals.ofTenant(TenantFromContext(ctx))), nil
+}
+
+// ScanMetrics implementation ScanMetrics method of storage interface (disk storage).
+func (d *DiskStorage) ScanMetrics(ctx context.Context, fn func(m models.Metrics) error) error {
+	vals, err := d.values()
+	if err != nil {
+		return err
+	}
+	return scanValues(vals.ofTenant(TenantFromContext(ctx)), fn)
+}
+
+// values method for get copy of current values of all series.
+func (d *DiskStorage) values() (memValues, error) {
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		return memValues{}, ErrDiskClosed
+	}
+	vals := newMemValues()
+	for k, s := range d.index {
+		// selecting metric type
+		switch k.mType {
+		case metrictypes.GaugeType:
+			vals.gauge[k.series] = metrictypes.Gauge(*s.state.Value)
+		case metrictypes.CounterType:
+			vals.counter[k.series] = metrictypes.Counter(*s.state.Delta)
+		case metrictypes.HistogramType:
+			vals.histogram[k.series] = metrictypes.Histogram(*s.state.Histogram)
+		}
+	}
+	return vals, nil
+}
+
+// GetMetricHistory implementation GetMetricHistory method of storage interface (disk storage).
+func (d *DiskStorage) GetMetricHistory(ctx context.Context, mType, name string, from, to time.Time) ([]models.Sample, error) {
+	name, err := tenantSeries(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	// selecting metric type
+	switch mType {
+	case metrictypes.GaugeType, metrictypes.CounterType, metrictypes.HistogramType:
+	default:
+		return nil, customerrors.ErrBadMetricType
+	}
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		return nil, ErrDiskClosed
+	}
+	s, ok := d.index[diskKey{mType: mType, series: name}]
+	if !ok {
+		return []models.Sample{}, nil
+	}
+	return d.readSamples(locsInRange(s.samples, from, to))
+}
+
+// GetMetricRollups implementation GetMetricRollups method of storage interface (disk storage).
+func (d *DiskStorage) GetMetricRollups(ctx context.Context, mType, name string, resolution time.Duration, from, to time.Time) ([]models.Sample, error) {
+	name, err := tenantSeries(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	// selecting metric type
+	switch mType {
+	case metrictypes.GaugeType, metrictypes.CounterType, metrictypes.HistogramType:
+	default:
+		return nil, customerrors.ErrBadMetricType
+	}
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		return nil, ErrDiskClosed
+	}
+	s, ok := d.index[diskKey{mType: mType, series: name}]
+	if !ok {
+		return []models.Sample{}, nil
+	}
+	return d.readSamples(locsInRange(s.rollups[resolution], from, to))
+}
+
+// Compact implementation Compact method of storage interface (disk storage).
+// Rollups and retention drop are written as records, disk space is freed by background segments merge.
+func (d *DiskStorage) Compact(ctx context.Context, policy RetentionPolicy, now time.Time) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.closed {
+		return ErrDiskClosed
+	}
+
+	for i := 1; i < len(policy); i++ {
+		res := policy[i].Resolution
+		mark, ok := d.rollupMarks[res]
+		if !ok {
+			mark = rollupOrigin
+		}
+		end := bucketStart(now, rollupOrigin, res)
+		if !end.After(mark) {
+			continue
+		}
+		var recs []diskRecord
+		for k, s := range d.index {
+			var source []diskLoc
+			if i == 1 {
+				if k.mType == metrictypes.HistogramType {
+					continue
+				}
+				source = s.samples
+			} else {
+				source = s.rollups[policy[i-1].Resolution]
+			}
+			// source samples from the last built bucket
+			source = locsInRange(source, mark, end.Add(-1))
+			if len(source) == 0 {
+				continue
+			}
+			samples, err := d.readSamples(source)
+			if err != nil {
+				return err
+			}
+			for _, r := range rollupSamples(samples, res, end) {
+				r := r
+				recs = append(recs, diskRecord{Kind: diskRecordRollup, Timestamp: r.Timestamp, MType: k.mType, Series: k.series, Resolution: res, Rollup: &r})
+			}
+		}
+		// next tier is built from these rollups
+		if err := d.appendRecords(recs); err != nil {
+			return err
+		}
+		d.rollupMarks[res] = end
+	}
+
+	expire := diskExpire{Rollups: make(map[time.Duration]time.Time, len(policy))}
+	if len(policy) > 0 {
+		expire.History = now.Add(-policy[0].Keep)
+	}
+	for _, t := range policy[min(1, len(policy)):] {
+		expire.Rollups[t.Resolution] = now.Add(-t.Keep)
+	}
+	return d.appendRecords([]diskRecord{{Kind: diskRecordExpire, Timestamp: now, Expire: &expire}})
+}
+
+// Delete implementation Delete method of storage interface (disk storage).
+// Series are dropped from index by delete record, disk space is freed by background segments merge.
+func (d *DiskStorage) Delete(ctx context.Context, mType, name string) (int, error) {
+	if err := checkMetricType(mType); err != nil {
+		return 0, err
+	}
+	match, err := seriesMatcher(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.closed {
+		return 0, ErrDiskClosed
+	}
+	n := 0
+	for k := range d.index {
+		if k.mType == mType && match(k.series) {
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, customerrors.ErrNoVal
+	}
+	if err := d.appendRecords([]diskRecord{{Kind: diskRecordDelete, Timestamp: d.now(), MType: mType, Series: name, Tenant: TenantFromContext(ctx)}}); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// WriteMetadata implementation WriteMetadata method of storage interface (disk storage).
+// Unchanged metadata (e.g. sent by agent again) isn't written.
+func (d *DiskStorage) WriteMetadata(ctx context.Context, meta []models.Metadata) error {
+	if err := validateMetadata(meta); err != nil {
+		return err
+	}
+	meta = tenantMetadata(ctx, meta)
+	d.Lock()
+	defer d.Unlock()
+	if d.closed {
+		return ErrDiskClosed
+	}
+	for _, v := range meta {
+		if d.metadata[v.ID] != v {
+			return d.appendRecords([]diskRecord{{Kind: diskRecordMeta, Timestamp: d.now(), Metadata: meta}})
+		}
+	}
+	return nil
+}
+
+// GetMetadata implementation GetMetadata method of storage interface (disk storage).
+func (d *DiskStorage) GetMetadata(ctx context.Context) ([]models.Metadata, error) {
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		return nil, ErrDiskClosed
+	}
+	return metadataOfTenant(d.metadata, TenantFromContext(ctx)), nil
+}
+
+// WriteAlerts implementation WriteAlerts method of storage interface (disk storage).
+func (d *DiskStorage) WriteAlerts(ctx context.Context, alerts []models.Alert) error {
+	ta := tenantAlerts{Tenant: TenantFromContext(ctx), Alerts: append([]models.Alert{}, alerts...)}
+	d.Lock()
+	defer d.Unlock()
+	if d.closed {
+		return ErrDiskClosed
+	}
+	return d.appendRecords([]diskRecord{{Kind: diskRecordAlerts, Timestamp: d.now(), Alerts: &ta}})
+}
+
+// GetAlerts implementation GetAlerts method of storage interface (disk storage).
+func (d *DiskStorage) GetAlerts(ctx context.Context) ([]models.Alert, error) {
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		return nil, ErrDiskClosed
+	}
+	return alertsOfTenant(d.alerts, TenantFromContext(ctx)), nil
+}
+
+// syncLoop periodic fsync of active segment (everysec mode).
+func (d *DiskStorage) syncLoop() {
+	defer d.wg.Done()
+	t := time.NewTicker(walFsyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-t.C:
+			d.RLock()
+			if err := d.active.f.Sync(); err != nil {
+				log.Printf("disk storage fsync: %s", err.Error())
+			}
+			d.RUnlock()
+		}
+	}
+}
+
+// mergeLoop periodic merge of segments with garbage.
+func (d *DiskStorage) mergeLoop() {
+	defer d.wg.Done()
+	t := time.NewTicker(diskMergeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-t.C:
+			if !d.needMerge() {
+				continue
+			}
+			if err := d.mergeSegments(); err != nil {
+				log.Printf("disk storage merge: %s", err.Error())
+			}
+		}
+	}
+}
+
+// needMerge check that sealed segments are many or most of stored records are garbage.
+func (d *DiskStorage) needMerge() bool {
+	d.RLock()
+	defer d.RUnlock()
+	var total, live int64
+	for _, seg := range d.segments {
+		total += seg.size
+	}
+	for _, s := range d.index {
+		live += int64(s.stateLoc.size)
+		for _, l := range s.samples {
+			live += int64(l.size)
+		}
+		for _, locs := range s.rollups {
+			for _, l := range locs {
+				live += int64(l.size)
+			}
+		}
+	}
+	return len(d.segments)-1 >= diskMergeSegments || (total >= diskMergeMinSize && live*2 < total)
+}
+
+// mergeSegments rewrite live records of sealed segments to one merged segment and remove sealed segments.
+// Merged segment is written without lock, writes go to new active segment meanwhile.
+func (d *DiskStorage) mergeSegments() error {
+	d.mergeMu.Lock()
+	defer d.mergeMu.Unlock()
+
+	// seal active segment and collect live records of sealed ones
+	d.Lock()
+	if d.closed {
+		d.Unlock()
+		return ErrDiskClosed
+	}
+	if err := d.rotate(); err != nil {
+		d.Unlock()
+		return err
+	}
+	sealed := make(map[uint64]*diskSegment, len(d.segments)-1)
+	var target uint64
+	for seq, seg := range d.segments {
+		if seg != d.active {
+			sealed[seq] = seg
+			target = max(target, seq)
+		}
+	}
+	var (
+		live   []diskLoc
+		values []diskRecord
+		valLoc []diskLoc
+	)
+	for _, s := range d.index {
+		for _, l := range s.samples {
+			if sealed[l.seg] != nil {
+				live = append(live, l)
+			}
+		}
+		for _, locs := range s.rollups {
+			for _, l := range locs {
+				if sealed[l.seg] != nil {
+					live = append(live, l)
+				}
+			}
+		}
+		// latest value record, which is not live sample
+		if sealed[s.stateLoc.seg] != nil && (len(s.samples) == 0 || s.samples[len(s.samples)-1] != s.stateLoc) {
+			state := s.state
+			values = append(values, diskRecord{Kind: diskRecordValue, Timestamp: time.Unix(0, s.stateLoc.ts), State: &state})
+			valLoc = append(valLoc, s.stateLoc)
+		}
+	}
+	// metadata and alerts records of sealed segments are replaced by one record (per tenant for alerts), later records are replayed after it
+	var meta [][]byte
+	if len(d.metadata) > 0 {
+		rec, err := json.Marshal(diskRecord{Kind: diskRecordMeta, Timestamp: d.now(), Metadata: sortedMetadata(d.metadata)})
+		if err != nil {
+			d.Unlock()
+			return err
+		}
+		meta = append(meta, rec)
+	}
+	for _, v := range sortedAlerts(d.alerts) {
+		v := v
+		rec, err := json.Marshal(diskRecord{Kind: diskRecordAlerts, Timestamp: d.now(), Alerts: &v})
+		if err != nil {
+			d.Unlock()
+			return err
+		}
+		meta = append(meta, rec)
+	}
+	d.Unlock()
+	// original order of records keeps samples time ordered on replay
+	sort.Slice(live, func(i, j int) bool {
+		if live[i].seg != live[j].seg {
+			return live[i].seg < live[j].seg
+		}
+		return live[i].off < live[j].off
+	})
+
+	f, err := os.CreateTemp(d.dir, "merge*.tmp")
+	if err != nil {
+		return err
+	}
+	merged := &diskSegment{seq: target, f: f}
+	done := false
+	defer func() {
+		if !done {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+	remap := make(map[diskLoc]diskLoc, len(live)+len(values))
+	var buf []byte
+	add := func(payload []byte, old diskLoc) error {
+		start := len(buf)
+		buf = encodeFrame(buf, payload)
+		remap[old] = diskLoc{seg: target, off: merged.size + int64(start), size: uint32(len(buf) - start), ts: old.ts}
+		if len(buf) >= diskMergeBuffer {
+			if err := merged.write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+		return nil
+	}
+	header, err := json.Marshal(diskRecord{Kind: diskRecordHeader, Timestamp: d.now()})
+	if err != nil {
+		return err
+	}
+	buf = encodeFrame(buf, header)
+	// sealed segments are not changed, so they are read without lock
+	for _, l := range live {
+		payload, err := sealed[l.seg].read(l)
+		if err != nil {
+			return err
+		}
+		if err := add(payload, l); err != nil {
+			return err
+		}
+	}
+	for i, rec := range values {
+		payload, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if err := add(payload, valLoc[i]); err != nil {
+			return err
+		}
+	}
+	for _, rec := range meta {
+		buf = encodeFrame(buf, rec)
+	}
+	if err := merged.write(buf); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	// replace sealed segments with merged one
+	d.Lock()
+	defer d.Unlock()
+	if d.closed {
+		return ErrDiskClosed
+	}
+	if err := os.Rename(f.Name(), segmentName(d.dir, target)); err != nil {
+		return err
+	}
+	done = true
+	for seq, seg := range sealed {
+		_ = seg.f.Close()
+		delete(d.segments, seq)
+		if seq != target {
+			if err := os.Remove(segmentName(d.dir, seq)); err != nil {
+				log.Printf("disk storage: remove segment %d: %s", seq, err.Error())
+			}
+		}
+	}
+	d.segments[target] = merged
+	// locations of records dropped meanwhile are not in index anymore
+	remapLocs := func(locs []diskLoc) {
+		for i, l := range locs {
+			if nl, ok := remap[l]; ok {
+				locs[i] = nl
+			}
+		}
+	}
+	for _, s := range d.index {
+		remapLocs(s.samples)
+		for _, locs := range s.rollups {
+			remapLocs(locs)
+		}
+		if nl, ok := remap[s.stateLoc]; ok {
+			s.stateLoc = nl
+		}
+	}
+	return syncDir(d.dir)
+}
+
+// closeSegments close all segment files (caller must hold write lock).
+func (d *DiskStorage) closeSegments() error {
+	var errs []error
+	for seq, seg := range d.segments {
+		errs = append(errs, seg.f.Close())
+		delete(d.segments, seq)
+	}
+	return errors.Join(errs...)
+}
+
+// Close stop background jobs, fsync and close segment files.
+func (d *DiskStorage) Close() error {
+	d.Lock()
+	if d.closed {
+		d.Unlock()
+		return nil
+	}
+	d.closed = true
+	d.Unlock()
+	close(d.done)
+	d.wg.Wait()
+
+	d.Lock()
+	defer d.Unlock()
+	if err := d.active.f.Sync(); err != nil {
+		return err
+	}
+	return d.closeSegments()
+}
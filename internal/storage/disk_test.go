@@ -0,0 +1,430 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+// openTestDisk open disk storage with fixed clock.
+func openTestDisk(t *testing.T, dir string, ts *time.Time) *DiskStorage {
+	d, err := OpenDiskStorage(dir, WALFsyncNo)
+	require.NoError(t, err)
+	d.now = func() time.Time { return *ts }
+	return d
+}
+
+func TestDiskStorage(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	ts := time.Unix(1000, 0)
+	d := openTestDisk(t, dir, &ts)
+
+	f := 0.5
+	dl := int64(2)
+	h := metrictypes.NewHistogram([]float64{1})
+	h.Observe(0.5)
+	for i := 0; i < 3; i++ {
+		ts = ts.Add(time.Minute)
+		require.NoError(t, d.WriteMetric(ctx, "gauge", "testGauge", metrictypes.Gauge(float64(i))))
+		require.NoError(t, d.WriteMetric(ctx, "counter", `testCounter{host="a"}`, metrictypes.Counter(1)))
+		require.NoError(t, d.WriteMetric(ctx, "histogram", "testHist", h))
+	}
+	require.NoError(t, d.WriteBatchMetrics(ctx, []models.Metrics{
+		{ID: "testGauge2", MType: "gauge", Value: &f},
+		{ID: "testCounter", Labels: models.Labels{"host": "a"}, MType: "counter", Delta: &dl},
+		{ID: "testCounter", Labels: models.Labels{"host": "a"}, MType: "counter", Delta: &dl},
+		{ID: "skipped", MType: "counter"},
+		{ID: "", MType: "gauge", Value: &f},
+	}))
+	// histogram bounds can't be changed
+	require.ErrorIs(t, d.WriteMetric(ctx, "histogram", "testHist", metrictypes.NewHistogram([]float64{2})), customerrors.ErrHistogramBounds)
+	require.ErrorIs(t, d.WriteMetric(ctx, "wrong", "testHist", metrictypes.Gauge(1)), customerrors.ErrWrongMetricType)
+
+	check := func(d *DiskStorage) {
+		c, err := d.GetMetric(ctx, "counter", `testCounter{host="a"}`)
+		require.NoError(t, err)
+		require.Equal(t, metrictypes.Counter(7), c)
+		g, err := d.GetMetric(ctx, "gauge", "testGauge")
+		require.NoError(t, err)
+		require.Equal(t, metrictypes.Gauge(2), g)
+		hist, err := d.GetMetric(ctx, "histogram", "testHist")
+		require.NoError(t, err)
+		require.Equal(t, uint64(3), hist.(metrictypes.Histogram).Count)
+		_, err = d.GetMetric(ctx, "counter", "testGauge")
+		require.ErrorIs(t, err, customerrors.ErrNoVal)
+		_, err = d.GetMetric(ctx, "wrong", "testGauge")
+		require.ErrorIs(t, err, customerrors.ErrBadMetricType)
+
+		samples, err := d.GetMetricHistory(ctx, "gauge", "testGauge", time.Unix(1100, 0), time.Unix(1200, 0))
+		require.NoError(t, err)
+		require.Len(t, samples, 2)
+		require.True(t, time.Unix(1120, 0).Equal(samples[0].Timestamp))
+		require.Equal(t, 1.0, *samples[0].Value)
+		samples, err = d.GetMetricHistory(ctx, "counter", `testCounter{host="a"}`, time.Unix(0, 0), ts)
+		require.NoError(t, err)
+		require.Len(t, samples, 5)
+		require.Equal(t, int64(2), *samples[4].Delta)
+		samples, err = d.GetMetricHistory(ctx, "gauge", "unknown", time.Unix(0, 0), ts)
+		require.NoError(t, err)
+		require.Empty(t, samples)
+		_, err = d.GetMetricHistory(ctx, "wrong", "testGauge", time.Unix(0, 0), ts)
+		require.ErrorIs(t, err, customerrors.ErrBadMetricType)
+
+		txt, err := d.GetAllMetricsTxt(ctx)
+		require.NoError(t, err)
+		require.Contains(t, txt, "testCounter{host=\"a\"}: 7\n")
+		require.Contains(t, txt, "testGauge2: 0.5\n")
+		require.Contains(t, txt, "---Histogram---\n")
+	}
+	check(d)
+
+	// index is rebuilt on open
+	require.NoError(t, d.Close())
+	require.ErrorIs(t, d.Ping(ctx), ErrDiskClosed)
+	require.ErrorIs(t, d.WriteMetric(ctx, "gauge", "testGauge", metrictypes.Gauge(1)), ErrDiskClosed)
+	d = openTestDisk(t, dir, &ts)
+	t.Cleanup(func() { d.Close() })
+	require.NoError(t, d.Ping(ctx))
+	check(d)
+}
+
+func TestDiskStorageDamage(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	ts := time.Unix(1000, 0)
+	d := openTestDisk(t, dir, &ts)
+	d.maxSegmentSize = 1
+	require.NoError(t, d.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(1)))
+	require.NoError(t, d.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(2)))
+	require.NoError(t, d.Close())
+	seqs, err := listSegments(dir)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2, 3}, seqs)
+
+	// torn write of the last segment is truncated
+	last, err := os.OpenFile(segmentName(dir, 2), os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = last.Write([]byte{10, 0, 0, 0, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, last.Close())
+	require.NoError(t, os.Remove(segmentName(dir, 3)))
+	d = openTestDisk(t, dir, &ts)
+	c, err := d.GetMetric(ctx, "counter", "testCounter")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(3), c)
+	require.NoError(t, d.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(3)))
+	require.NoError(t, d.Close())
+
+	// damage of sealed segment is an error
+	b, err := os.ReadFile(segmentName(dir, 1))
+	require.NoError(t, err)
+	b[len(b)-2] ^= 0xff
+	require.NoError(t, os.WriteFile(segmentName(dir, 1), b, 0o644))
+	_, err = OpenDiskStorage(dir, WALFsyncNo)
+	require.ErrorIs(t, err, ErrDiskCorrupt)
+
+	_, err = OpenDiskStorage(dir, "wrong")
+	require.ErrorIs(t, err, ErrWrongWALFsync)
+}
+
+func TestDiskStorageCompact(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	ts := time.Unix(0, 0)
+	d := openTestDisk(t, dir, &ts)
+	policy, err := ParseRetention("raw:1h,1m:2h,10m:24h")
+	require.NoError(t, err)
+
+	// gauge 0..29 and counter 1 every 20s (10 minutes)
+	for i := 0; i < 30; i++ {
+		ts = time.Unix(int64(i*20), 0)
+		require.NoError(t, d.WriteMetric(ctx, "gauge", "testGauge", metrictypes.Gauge(float64(i))))
+		require.NoError(t, d.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(1)))
+	}
+	require.NoError(t, d.Compact(ctx, policy, time.Unix(590, 0)))
+	require.NoError(t, d.Compact(ctx, policy, time.Unix(600, 0)))
+	g, err := d.GetMetricRollups(ctx, "gauge", "testGauge", time.Minute, time.Unix(0, 0), time.Unix(3600, 0))
+	require.NoError(t, err)
+	require.Len(t, g, 10)
+	require.True(t, time.Unix(60, 0).Equal(g[1].Timestamp))
+	require.Equal(t, 4.0, *g[1].Value)
+	require.Equal(t, 3.0, *g[1].Min)
+	require.Equal(t, 5.0, *g[1].Last)
+	g, err = d.GetMetricRollups(ctx, "gauge", "testGauge", 10*time.Minute, time.Unix(0, 0), time.Unix(3600, 0))
+	require.NoError(t, err)
+	require.Len(t, g, 1)
+	require.Equal(t, 14.5, *g[0].Value)
+	require.Equal(t, uint64(30), g[0].Count)
+
+	// raw samples and 1m rollups are expired, expiry is kept after reopen
+	require.NoError(t, d.Compact(ctx, policy, time.Unix(3*3600, 0)))
+	require.NoError(t, d.Close())
+	d = openTestDisk(t, dir, &ts)
+	t.Cleanup(func() { d.Close() })
+	h, err := d.GetMetricHistory(ctx, "gauge", "testGauge", time.Unix(0, 0), time.Unix(3600, 0))
+	require.NoError(t, err)
+	require.Empty(t, h)
+	g, err = d.GetMetricRollups(ctx, "gauge", "testGauge", time.Minute, time.Unix(0, 0), time.Unix(3600, 0))
+	require.NoError(t, err)
+	require.Empty(t, g)
+	c, err := d.GetMetricRollups(ctx, "counter", "testCounter", 10*time.Minute, time.Unix(0, 0), time.Unix(3600, 0))
+	require.NoError(t, err)
+	require.Len(t, c, 1)
+	require.Equal(t, int64(30), *c[0].Delta)
+	// rollup marks are restored, buckets are not built twice
+	require.NoError(t, d.Compact(ctx, policy, time.Unix(3*3600, 0)))
+	c, err = d.GetMetricRollups(ctx, "counter", "testCounter", 10*time.Minute, time.Unix(0, 0), time.Unix(3600, 0))
+	require.NoError(t, err)
+	require.Len(t, c, 1)
+	// latest values are not expired
+	v, err := d.GetMetric(ctx, "counter", "testCounter")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(30), v)
+}
+
+func TestDiskStorageMerge(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	ts := time.Unix(0, 0)
+	d := openTestDisk(t, dir, &ts)
+	policy, err := ParseRetention("raw:1h")
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		ts = time.Unix(int64(i*60), 0)
+		require.NoError(t, d.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(1)))
+		require.NoError(t, d.WriteMetric(ctx, "gauge", "testGauge", metrictypes.Gauge(float64(i))))
+	}
+	// gauge samples are expired, latest value is kept
+	require.NoError(t, d.WriteMetric(ctx, "gauge", "oldGauge", metrictypes.Gauge(1)))
+	ts = time.Unix(3*3600, 0)
+	require.NoError(t, d.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(1)))
+	require.NoError(t, d.Compact(ctx, policy, ts))
+	before := d.active.size
+	require.True(t, d.needMerge() || before < diskMergeMinSize)
+
+	require.NoError(t, d.mergeSegments())
+	seqs, err := listSegments(dir)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2}, seqs)
+	require.Less(t, d.segments[1].size, before)
+
+	check := func(d *DiskStorage, counter, samples int) {
+		c, err := d.GetMetric(ctx, "counter", "testCounter")
+		require.NoError(t, err)
+		require.Equal(t, metrictypes.Counter(counter), c)
+		g, err := d.GetMetric(ctx, "gauge", "oldGauge")
+		require.NoError(t, err)
+		require.Equal(t, metrictypes.Gauge(1), g)
+		h, err := d.GetMetricHistory(ctx, "counter", "testCounter", time.Unix(0, 0), ts)
+		require.NoError(t, err)
+		require.Len(t, h, samples)
+		require.True(t, ts.Equal(h[0].Timestamp))
+	}
+	check(d, 101, 1)
+
+	// writes after merge go to new segment
+	require.NoError(t, d.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(1)))
+	require.NoError(t, d.Close())
+	st, err := os.Stat(segmentName(dir, 2))
+	require.NoError(t, err)
+	require.Positive(t, st.Size())
+	d = openTestDisk(t, dir, &ts)
+	check(d, 102, 2)
+
+	// merged segment replaces segments left by crash before their removal
+	require.NoError(t, d.mergeSegments())
+	require.NoError(t, d.Close())
+	seqs, err = listSegments(dir)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 3}, seqs)
+	require.NoError(t, os.WriteFile(segmentName(dir, 1), []byte("garbage"), 0o644))
+	d = openTestDisk(t, dir, &ts)
+	t.Cleanup(func() { d.Close() })
+	check(d, 102, 2)
+	seqs, err = listSegments(dir)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 3}, seqs)
+}
+
+func TestDiskStorageDelete(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	ts := time.Unix(1000, 0)
+	d := openTestDisk(t, dir, &ts)
+
+	require.NoError(t, d.WriteMetric(ctx, "gauge", "CPUutilization1", metrictypes.Gauge(1)))
+	require.NoError(t, d.WriteMetric(ctx, "gauge", "CPUutilization2", metrictypes.Gauge(2)))
+	require.NoError(t, d.WriteMetric(ctx, "counter", "CPUutilization1", metrictypes.Counter(1)))
+	n, err := d.Delete(ctx, "gauge", "CPUutilization*")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	_, err = d.Delete(ctx, "gauge", "CPUutilization1")
+	require.ErrorIs(t, err, customerrors.ErrNoVal)
+	_, err = d.Delete(ctx, "wrong", "CPUutilization1")
+	require.ErrorIs(t, err, customerrors.ErrBadMetricType)
+
+	check := func(d *DiskStorage) {
+		_, err := d.GetMetric(ctx, "gauge", "CPUutilization2")
+		require.ErrorIs(t, err, customerrors.ErrNoVal)
+		h, err := d.GetMetricHistory(ctx, "gauge", "CPUutilization2", ts, ts)
+		require.NoError(t, err)
+		require.Empty(t, h)
+		c, err := d.GetMetric(ctx, "counter", "CPUutilization1")
+		require.NoError(t, err)
+		require.Equal(t, metrictypes.Counter(1), c)
+	}
+	check(d)
+
+	// delete record is replayed
+	require.NoError(t, d.Close())
+	d = openTestDisk(t, dir, &ts)
+	check(d)
+
+	// merge drops records of deleted series
+	require.NoError(t, d.mergeSegments())
+	require.NoError(t, d.Close())
+	d = openTestDisk(t, dir, &ts)
+	t.Cleanup(func() { d.Close() })
+	check(d)
+	txt, err := d.GetAllMetricsTxt(ctx)
+	require.NoError(t, err)
+	require.NotContains(t, txt, "CPUutilization2")
+
+	_, err = d.Delete(ctx, "gauge", "CPUutilization1")
+	require.ErrorIs(t, err, customerrors.ErrNoVal)
+}
+
+func TestDiskStorageMetadata(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	ts := time.Unix(1000, 0)
+	d := openTestDisk(t, dir, &ts)
+
+	meta := []models.Metadata{{ID: "TotalMemory", MType: "gauge", Unit: "bytes", Description: "Total amount of RAM"}}
+	require.NoError(t, d.WriteMetadata(ctx, meta))
+	size := d.active.size
+	// unchanged metadata isn't written
+	require.NoError(t, d.WriteMetadata(ctx, meta))
+	require.Equal(t, size, d.active.size)
+	require.ErrorIs(t, d.WriteMetadata(ctx, []models.Metadata{{ID: ""}}), customerrors.ErrWrongMetadata)
+
+	check := func(d *DiskStorage, want []models.Metadata) {
+		got, err := d.GetMetadata(ctx)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+	require.NoError(t, d.Close())
+	d = openTestDisk(t, dir, &ts)
+	check(d, meta)
+
+	// metadata is kept by merge, newer metadata wins
+	require.NoError(t, d.mergeSegments())
+	meta[0].Unit = "kilobytes"
+	require.NoError(t, d.WriteMetadata(ctx, meta))
+	require.NoError(t, d.Close())
+	d = openTestDisk(t, dir, &ts)
+	check(d, meta)
+	require.NoError(t, d.mergeSegments())
+	require.NoError(t, d.Close())
+	d = openTestDisk(t, dir, &ts)
+	t.Cleanup(func() { d.Close() })
+	check(d, meta)
+}
+
+func TestDiskStorageAlerts(t *testing.T) {
+	ctx := context.Background()
+	teamA := WithTenant(ctx, "teamA")
+	dir := t.TempDir()
+	ts := time.Unix(1000, 0)
+	d := openTestDisk(t, dir, &ts)
+
+	alerts := testAlerts()
+	require.NoError(t, d.WriteAlerts(ctx, alerts))
+	require.NoError(t, d.WriteAlerts(teamA, alerts[1:]))
+	check := func(d *DiskStorage, ctx context.Context, want []models.Alert) {
+		got, err := d.GetAlerts(ctx)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+	require.NoError(t, d.Close())
+	d = openTestDisk(t, dir, &ts)
+	check(d, ctx, alerts)
+	check(d, teamA, alerts[1:])
+
+	// alerts are kept by merge, newer state wins
+	require.NoError(t, d.mergeSegments())
+	require.NoError(t, d.WriteAlerts(ctx, alerts[:1]))
+	require.NoError(t, d.WriteAlerts(teamA, nil))
+	require.NoError(t, d.Close())
+	d = openTestDisk(t, dir, &ts)
+	check(d, ctx, alerts[:1])
+	check(d, teamA, []models.Alert{})
+	require.NoError(t, d.mergeSegments())
+	require.NoError(t, d.Close())
+	d = openTestDisk(t, dir, &ts)
+	t.Cleanup(func() { d.Close() })
+	check(d, ctx, alerts[:1])
+	check(d, teamA, []models.Alert{})
+}
+
+func TestDiskStorageTenants(t *testing.T) {
+	ctx := context.Background()
+	teamA := WithTenant(ctx, "teamA")
+	dir := t.TempDir()
+	ts := time.Unix(1000, 0)
+	d := openTestDisk(t, dir, &ts)
+
+	require.NoError(t, d.WriteMetric(ctx, "gauge", "Alloc", metrictypes.Gauge(1)))
+	require.NoError(t, d.WriteMetric(teamA, "gauge", "Alloc", metrictypes.Gauge(2)))
+	require.NoError(t, d.WriteMetric(teamA, "gauge", "Frees", metrictypes.Gauge(3)))
+	require.NoError(t, d.WriteMetadata(teamA, []models.Metadata{{ID: "Alloc", Unit: "bytes"}}))
+	// pattern delete of tenant doesn't touch series of default tenant
+	n, err := d.Delete(teamA, "gauge", "Frees*")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	check := func(d *DiskStorage) {
+		g, err := d.GetMetric(ctx, "gauge", "Alloc")
+		require.NoError(t, err)
+		require.Equal(t, metrictypes.Gauge(1), g)
+		g, err = d.GetMetric(teamA, "gauge", "Alloc")
+		require.NoError(t, err)
+		require.Equal(t, metrictypes.Gauge(2), g)
+		_, err = d.GetMetric(teamA, "gauge", "Frees")
+		require.ErrorIs(t, err, customerrors.ErrNoVal)
+		txt, err := d.GetAllMetricsTxt(ctx)
+		require.NoError(t, err)
+		require.Equal(t, "---Counters---\n---Gauge---\nAlloc: 1\n", txt)
+		meta, err := d.GetMetadata(teamA)
+		require.NoError(t, err)
+		require.Equal(t, []models.Metadata{{ID: "Alloc", Unit: "bytes"}}, meta)
+		meta, err = d.GetMetadata(ctx)
+		require.NoError(t, err)
+		require.Empty(t, meta)
+		var series []string
+		require.NoError(t, d.ScanMetrics(teamA, func(m models.Metrics) error {
+			series = append(series, m.MType+" "+m.SeriesID())
+			return nil
+		}))
+		require.Equal(t, []string{"gauge Alloc"}, series)
+	}
+	check(d)
+
+	require.NoError(t, d.Close())
+	d = openTestDisk(t, dir, &ts)
+	check(d)
+	require.NoError(t, d.mergeSegments())
+	require.NoError(t, d.Close())
+	d = openTestDisk(t, dir, &ts)
+	t.Cleanup(func() { d.Close() })
+	check(d)
+}
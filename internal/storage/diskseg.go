@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Segment files of disk storage.
+const (
+	diskSegmentExt    = ".seg" // segment file extension
+	diskFrameHeader   = 8      // record frame header: payload length and crc32 of payload (uint32 each)
+	diskMaxRecordSize = 64 << 20
+)
+
+// ErrDiskCorrupt error for damaged segment record.
+var ErrDiskCorrupt = errors.New("corrupt disk storage segment")
+
+// crc32 table of segment records.
+var diskCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// diskLoc location of record in segment files.
+type diskLoc struct {
+	seg  uint64 // segment number
+	off  int64  // record frame offset
+	size uint32 // record frame size
+	ts   int64  // record timestamp (unix nano), for range search
+}
+
+// diskSegment append-only segment file.
+type diskSegment struct {
+	seq  uint64   // segment number (order of replay)
+	f    *os.File // segment file
+	size int64    // size of valid records
+}
+
+// segmentName return segment file name.
+func segmentName(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d%s", seq, diskSegmentExt))
+}
+
+// listSegments return numbers of segment files in directory (sorted).
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), diskSegmentExt)
+		if !ok || e.IsDir() {
+			continue
+		}
+		seq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// openSegment open (or create) segment file for read and append.
+func openSegment(dir string, seq uint64) (*diskSegment, error) {
+	f, err := os.OpenFile(segmentName(dir, seq), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &diskSegment{seq: seq, f: f, size: st.Size()}, nil
+}
+
+// encodeFrame append record frame with payload to buffer.
+func encodeFrame(buf, payload []byte) []byte {
+	var header [diskFrameHeader]byte
+	binary.LittleEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.Checksum(payload, diskCRCTable))
+	buf = append(buf, header[:]...)
+	return append(buf, payload...)
+}
+
+// write append encoded frames at the end of segment.
+func (s *diskSegment) write(frames []byte) error {
+	if _, err := s.f.WriteAt(frames, s.size); err != nil {
+		return err
+	}
+	s.size += int64(len(frames))
+	return nil
+}
+
+// read return payload of record at location.
+func (s *diskSegment) read(loc diskLoc) ([]byte, error) {
+	frame := make([]byte, loc.size)
+	if _, err := s.f.ReadAt(frame, loc.off); err != nil {
+		return nil, err
+	}
+	return decodeFrame(frame)
+}
+
+// decodeFrame check frame and return its payload.
+func decodeFrame(frame []byte) ([]byte, error) {
+	if len(frame) < diskFrameHeader || int(binary.LittleEndian.Uint32(frame[:4])) != len(frame)-diskFrameHeader {
+		return nil, ErrDiskCorrupt
+	}
+	payload := frame[diskFrameHeader:]
+	if crc32.Checksum(payload, diskCRCTable) != binary.LittleEndian.Uint32(frame[4:8]) {
+		return nil, ErrDiskCorrupt
+	}
+	return payload, nil
+}
+
+// scan read all records of segment in order.
+// Returns size of valid records, reading stops on first damaged record with ErrDiskCorrupt.
+func (s *diskSegment) scan(fn func(off int64, size uint32, payload []byte) error) (int64, error) {
+	r := bufio.NewReader(io.NewSectionReader(s.f, 0, s.size))
+	var off int64
+	header := make([]byte, diskFrameHeader)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return off, nil
+			}
+			return off, ErrDiskCorrupt
+		}
+		n := binary.LittleEndian.Uint32(header[:4])
+		if n > diskMaxRecordSize {
+			return off, ErrDiskCorrupt
+		}
+		frame := make([]byte, diskFrameHeader+int(n))
+		copy(frame, header)
+		if _, err := io.ReadFull(r, frame[diskFrameHeader:]); err != nil {
+			return off, ErrDiskCorrupt
+		}
+		payload, err := decodeFrame(frame)
+		if err != nil {
+			return off, err
+		}
+		if err := fn(off, uint32(len(frame)), payload); err != nil {
+			return off, err
+		}
+		off += int64(len(frame))
+	}
+}
+
+// first return payload of the first segment record.
+func (s *diskSegment) first() ([]byte, error) {
+	header := make([]byte, diskFrameHeader)
+	if _, err := s.f.ReadAt(header, 0); err != nil {
+		return nil, ErrDiskCorrupt
+	}
+	n := binary.LittleEndian.Uint32(header[:4])
+	if n > diskMaxRecordSize {
+		return nil, ErrDiskCorrupt
+	}
+	return s.read(diskLoc{off: 0, size: diskFrameHeader + n})
+}
+
+// truncate drop damaged tail of segment.
+func (s *diskSegment) truncate(size int64) error {
+	if err := s.f.Truncate(size); err != nil {
+		return err
+	}
+	s.size = size
+	return s.f.Sync()
+}
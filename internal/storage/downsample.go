@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+// sampleAggregate accumulator of samples of one bucket.
+// Source samples may be raw or already aggregated (rollups), raw sample counts as one.
+type sampleAggregate struct {
+	sum      float64                // gauge values sum (weighted by raw samples count)
+	min      float64                // minimal gauge value
+	max      float64                // maximal gauge value
+	last     float64                // last gauge value
+	delta    int64                  // summed counter increments
+	hist     *metrictypes.Histogram // merged histogram observations
+	count    uint64                 // number of raw samples
+	n        int                    // number of added samples
+	isDelta  bool                   // counter samples
+	isHist   bool                   // histogram samples
+	hasValue bool                   // gauge samples
+}
+
+// add put time ordered sample to aggregate.
+func (a *sampleAggregate) add(s models.Sample) {
+	weight := s.Count
+	if weight == 0 {
+		weight = 1
+	}
+	switch {
+	case s.Histogram != nil:
+		h := metrictypes.Histogram(*s.Histogram)
+		if a.hist == nil {
+			c := h.Clone()
+			a.hist = &c
+		} else if err := a.hist.Merge(h); err != nil {
+			// buckets changed inside step, keep observations with previous bounds
+			return
+		}
+		a.isHist = true
+	case s.Delta != nil:
+		a.delta += *s.Delta
+		a.isDelta = true
+	case s.Value != nil:
+		minV, maxV, lastV := *s.Value, *s.Value, *s.Value
+		if s.Min != nil {
+			minV = *s.Min
+		}
+		if s.Max != nil {
+			maxV = *s.Max
+		}
+		if s.Last != nil {
+			lastV = *s.Last
+		}
+		if !a.hasValue || minV < a.min {
+			a.min = minV
+		}
+		if !a.hasValue || maxV > a.max {
+			a.max = maxV
+		}
+		a.last = lastV
+		a.sum += *s.Value * float64(weight)
+		a.hasValue = true
+	default:
+		return
+	}
+	a.count += weight
+	a.n++
+}
+
+// sample return aggregated sample stamped with ts.
+func (a *sampleAggregate) sample(ts time.Time) models.Sample {
+	sample := models.Sample{Timestamp: ts}
+	switch {
+	case a.isHist:
+		h := models.Histogram(*a.hist)
+		sample.Histogram = &h
+	case a.isDelta:
+		delta := a.delta
+		sample.Delta = &delta
+		sample.Count = a.count
+	default:
+		value, minV, maxV, lastV := a.sum/float64(a.count), a.min, a.max, a.last
+		sample.Value, sample.Min, sample.Max, sample.Last = &value, &minV, &maxV, &lastV
+		sample.Count = a.count
+	}
+	return sample
+}
+
+// bucketStart return start of step sized bucket containing ts, buckets are aligned to origin.
+func bucketStart(ts, origin time.Time, step time.Duration) time.Time {
+	// floor division, so samples before origin still fall into aligned buckets
+	offset := ts.Sub(origin)
+	n := offset / step
+	if offset < 0 && offset%step != 0 {
+		n--
+	}
+	return origin.Add(n * step)
+}
+
+// aggregateSamples aggregate time ordered samples to buckets of step size aligned to origin.
+func aggregateSamples(samples []models.Sample, origin time.Time, step time.Duration) []models.Sample {
+	res := make([]models.Sample, 0, len(samples))
+	var (
+		bucket time.Time
+		agg    sampleAggregate
+	)
+	for _, s := range samples {
+		b := bucketStart(s.Timestamp, origin, step)
+		if agg.n == 0 || !b.Equal(bucket) {
+			if agg.n > 0 {
+				res = append(res, agg.sample(bucket))
+			}
+			bucket, agg = b, sampleAggregate{}
+		}
+		agg.add(s)
+	}
+	if agg.n > 0 {
+		res = append(res, agg.sample(bucket))
+	}
+	return res
+}
+
+// Downsample aggregate time ordered samples to buckets of step size, aligned to from.
+// Gauge buckets keep average, min, max and last value, counter buckets keep summed increments,
+// histogram buckets keep merged observations. Rollup samples may be downsampled too.
+// Each resulting sample is stamped with the start time of its bucket.
+func Downsample(samples []models.Sample, from time.Time, step time.Duration) []models.Sample {
+	if step <= 0 || len(samples) == 0 {
+		return samples
+	}
+	return aggregateSamples(samples, from, step)
+}
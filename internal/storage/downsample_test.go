@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+func TestDownsample(t *testing.T) {
+	from := time.Unix(1000, 0)
+	v := []float64{1, 3, 5, 7}
+	d := []int64{1, 2, 3, 4}
+	var gauges, counters []models.Sample
+	for i := range v {
+		// samples at 0s, 20s, 60s, 80s
+		ts := from.Add(time.Duration(i*20+i/2*20) * time.Second)
+		gauges = append(gauges, models.Sample{Timestamp: ts, Value: &v[i]})
+		counters = append(counters, models.Sample{Timestamp: ts, Delta: &d[i]})
+	}
+
+	g := Downsample(gauges, from, time.Minute)
+	require.Len(t, g, 2)
+	require.Equal(t, from, g[0].Timestamp)
+	require.Equal(t, 2.0, *g[0].Value)
+	require.Equal(t, from.Add(time.Minute), g[1].Timestamp)
+	require.Equal(t, 6.0, *g[1].Value)
+	require.Equal(t, 5.0, *g[1].Min)
+	require.Equal(t, 7.0, *g[1].Max)
+	require.Equal(t, 7.0, *g[1].Last)
+	require.Equal(t, uint64(2), g[1].Count)
+
+	c := Downsample(counters, from, time.Minute)
+	require.Len(t, c, 2)
+	require.Equal(t, int64(3), *c[0].Delta)
+	require.Equal(t, int64(7), *c[1].Delta)
+
+	// no step - samples as is
+	require.Equal(t, gauges, Downsample(gauges, from, 0))
+}
+
+func TestDownsampleHistogram(t *testing.T) {
+	from := time.Unix(1000, 0)
+	var samples []models.Sample
+	for i := 0; i < 3; i++ {
+		h := metrictypes.NewHistogram([]float64{1})
+		h.Observe(float64(i))
+		hm := models.Histogram(h)
+		samples = append(samples, models.Sample{Timestamp: from.Add(time.Duration(i) * time.Second), Histogram: &hm})
+	}
+
+	res := Downsample(samples, from, time.Minute)
+	require.Len(t, res, 1)
+	require.Equal(t, uint64(3), res[0].Histogram.Count)
+	require.Equal(t, []uint64{2, 1}, res[0].Histogram.Counts)
+	// source samples are not changed
+	require.Equal(t, uint64(1), samples[0].Histogram.Count)
+}
+
+func TestDownsampleRollups(t *testing.T) {
+	from := time.Unix(0, 0)
+	v := []float64{2, 5}
+	minV := []float64{1, 4}
+	maxV := []float64{3, 9}
+	samples := []models.Sample{
+		{Timestamp: from, Value: &v[0], Min: &minV[0], Max: &maxV[0], Last: &maxV[0], Count: 1},
+		{Timestamp: from.Add(time.Minute), Value: &v[1], Min: &minV[1], Max: &maxV[1], Last: &minV[1], Count: 2},
+	}
+
+	// rollups average is weighted by raw samples count
+	res := Downsample(samples, from, time.Hour)
+	require.Len(t, res, 1)
+	require.Equal(t, 4.0, *res[0].Value)
+	require.Equal(t, 1.0, *res[0].Min)
+	require.Equal(t, 9.0, *res[0].Max)
+	require.Equal(t, 4.0, *res[0].Last)
+	require.Equal(t, uint64(3), res[0].Count)
+}
@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+// Default number of in-memory storage shards.
+const defaultMemShards = 64
+
+// memShard partition of in-memory storage, series are spread over shards by id hash.
+// Latest gauge and counter values are atomic cells, so they are read without locking.
+type memShard struct {
+	gauge            sync.Map                         // series id -> *atomic.Uint64 (gauge float bits)
+	counter          sync.Map                         // series id -> *atomic.Int64
+	histogram        map[string]metrictypes.Histogram // for save histogram metrics
+	gaugeHistory     map[string][]models.Sample       // timestamped gauge values
+	counterHistory   map[string][]models.Sample       // timestamped counter increments
+	histogramHistory map[string][]models.Sample       // timestamped histogram observations
+	rollups          map[rollupKey][]models.Sample    // aggregated history by resolution
+	sync.RWMutex                                      // guards writes, histograms, history and rollups
+}
+
+// rollupKey series rollups key of in-memory storage.
+type rollupKey struct {
+	mType      string        // metric type
+	series     string        // series id
+	resolution time.Duration // rollup step
+}
+
+// memValues latest metric values of in-memory storage.
+type memValues struct {
+	gauge     map[string]metrictypes.Gauge     // gauge values by series id
+	counter   map[string]metrictypes.Counter   // counter values by series id
+	histogram map[string]metrictypes.Histogram // histogram copies by series id
+}
+
+// newMemShard init empty shard.
+func newMemShard() *memShard {
+	return &memShard{
+		histogram:        make(map[string]metrictypes.Histogram),
+		gaugeHistory:     make(map[string][]models.Sample),
+		counterHistory:   make(map[string][]models.Sample),
+		histogramHistory: make(map[string][]models.Sample),
+		rollups:          make(map[rollupKey][]models.Sample),
+	}
+}
+
+// shardIndex return shard number of series (fnv-1a hash of series id), shards count is power of two.
+func shardIndex(series string, shards int) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(series); i++ {
+		h ^= uint32(series[i])
+		h *= 16777619
+	}
+	return int(h & uint32(shards-1))
+}
+
+// getGauge read latest gauge value without locking.
+func (s *memShard) getGauge(series string) (metrictypes.Gauge, bool) {
+	c, ok := s.gauge.Load(series)
+	if !ok {
+		return 0, false
+	}
+	return metrictypes.Gauge(math.Float64frombits(c.(*atomic.Uint64).Load())), true
+}
+
+// getCounter read latest counter value without locking.
+func (s *memShard) getCounter(series string) (metrictypes.Counter, bool) {
+	c, ok := s.counter.Load(series)
+	if !ok {
+		return 0, false
+	}
+	return metrictypes.Counter(c.(*atomic.Int64).Load()), true
+}
+
+// setGauge store gauge value (caller must hold write lock).
+func (s *memShard) setGauge(series string, v float64) {
+	if c, ok := s.gauge.Load(series); ok {
+		c.(*atomic.Uint64).Store(math.Float64bits(v))
+		return
+	}
+	c := &atomic.Uint64{}
+	c.Store(math.Float64bits(v))
+	s.gauge.Store(series, c)
+}
+
+// setCounter store counter value (caller must hold write lock).
+func (s *memShard) setCounter(series string, v int64) {
+	if c, ok := s.counter.Load(series); ok {
+		c.(*atomic.Int64).Store(v)
+		return
+	}
+	c := &atomic.Int64{}
+	c.Store(v)
+	s.counter.Store(series, c)
+}
+
+// addCounter add increment to counter value (caller must hold write lock).
+func (s *memShard) addCounter(series string, delta int64) {
+	if c, ok := s.counter.Load(series); ok {
+		c.(*atomic.Int64).Add(delta)
+		return
+	}
+	s.setCounter(series, delta)
+}
+
+// checkMetric check that metric can be applied to shard (caller must hold lock).
+func (s *memShard) checkMetric(v models.Metrics) error {
+	if err := validateMetric(v); err != nil {
+		return err
+	}
+	if v.MType == metrictypes.HistogramType {
+		if stored, ok := s.histogram[v.SeriesID()]; ok {
+			// merge with copy, stored histogram is not changed
+			c := stored.Clone()
+			return c.Merge(metrictypes.Histogram(*v.Histogram))
+		}
+	}
+	return nil
+}
+
+// applyMetric write checked metric to shard and history (caller must hold write lock).
+func (s *memShard) applyMetric(v models.Metrics, ts time.Time) {
+	series := v.SeriesID()
+	// selecting metric type
+	switch v.MType {
+	case metrictypes.GaugeType:
+		s.setGauge(series, *v.Value)
+		s.appendGaugeHistory(series, *v.Value, ts)
+	case metrictypes.CounterType:
+		s.addCounter(series, *v.Delta)
+		s.appendCounterHistory(series, *v.Delta, ts)
+	case metrictypes.HistogramType:
+		h := metrictypes.Histogram(*v.Histogram)
+		if err := s.mergeHistogram(series, h); err != nil {
+			log.Printf("histogram %s: %s", series, err.Error())
+			return
+		}
+		s.appendHistogramHistory(series, h, ts)
+	}
+}
+
+// restoreMetric set metric value from snapshot (caller must hold write lock).
+func (s *memShard) restoreMetric(v models.Metrics) {
+	// selecting metric type
+	switch v.MType {
+	case metrictypes.CounterType:
+		s.setCounter(v.SeriesID(), *v.Delta)
+	case metrictypes.GaugeType:
+		s.setGauge(v.SeriesID(), *v.Value)
+	case metrictypes.HistogramType:
+		s.histogram[v.SeriesID()] = metrictypes.Histogram(*v.Histogram)
+	}
+}
+
+// appendGaugeHistory record gauge value to history (caller must hold write lock).
+func (s *memShard) appendGaugeHistory(name string, value float64, ts time.Time) {
+	s.gaugeHistory[name] = append(s.gaugeHistory[name], models.Sample{Timestamp: ts, Value: &value})
+}
+
+// appendCounterHistory record counter increment to history (caller must hold write lock).
+func (s *memShard) appendCounterHistory(name string, delta int64, ts time.Time) {
+	s.counterHistory[name] = append(s.counterHistory[name], models.Sample{Timestamp: ts, Delta: &delta})
+}
+
+// appendHistogramHistory record histogram observations to history (caller must hold write lock).
+func (s *memShard) appendHistogramHistory(name string, h metrictypes.Histogram, ts time.Time) {
+	hm := models.Histogram(h.Clone())
+	s.histogramHistory[name] = append(s.histogramHistory[name], models.Sample{Timestamp: ts, Histogram: &hm})
+}
+
+// mergeHistogram validate histogram and sum its buckets with stored one (caller must hold write lock).
+func (s *memShard) mergeHistogram(name string, h metrictypes.Histogram) error {
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	stored, ok := s.histogram[name]
+	if !ok {
+		s.histogram[name] = h.Clone()
+		return nil
+	}
+	if err := stored.Merge(h); err != nil {
+		return err
+	}
+	s.histogram[name] = stored
+	return nil
+}
+
+// collect add latest shard values to vals, histograms are copied (caller must hold read lock).
+func (s *memShard) collect(vals *memValues) {
+	s.gauge.Range(func(k, v any) bool {
+		vals.gauge[k.(string)] = metrictypes.Gauge(math.Float64frombits(v.(*atomic.Uint64).Load()))
+		return true
+	})
+	s.counter.Range(func(k, v any) bool {
+		vals.counter[k.(string)] = metrictypes.Counter(v.(*atomic.Int64).Load())
+		return true
+	})
+	for k, v := range s.histogram {
+		vals.histogram[k] = v.Clone()
+	}
+}
+
+// matchSeries return ids of shard series of type matched by matcher (caller must hold lock).
+func (s *memShard) matchSeries(mType string, match func(series string) bool) []string {
+	var series []string
+	add := func(k any, _ any) bool {
+		if match(k.(string)) {
+			series = append(series, k.(string))
+		}
+		return true
+	}
+	// selecting metric type
+	switch mType {
+	case metrictypes.GaugeType:
+		s.gauge.Range(add)
+	case metrictypes.CounterType:
+		s.counter.Range(add)
+	case metrictypes.HistogramType:
+		for k := range s.histogram {
+			add(k, nil)
+		}
+	}
+	return series
+}
+
+// deleteSeries drop values, history and rollups of shard series (caller must hold write lock).
+func (s *memShard) deleteSeries(mType string, series []string) {
+	if len(series) == 0 {
+		return
+	}
+	deleted := make(map[string]struct{}, len(series))
+	for _, name := range series {
+		deleted[name] = struct{}{}
+		// selecting metric type
+		switch mType {
+		case metrictypes.GaugeType:
+			s.gauge.Delete(name)
+			delete(s.gaugeHistory, name)
+		case metrictypes.CounterType:
+			s.counter.Delete(name)
+			delete(s.counterHistory, name)
+		case metrictypes.HistogramType:
+			delete(s.histogram, name)
+			delete(s.histogramHistory, name)
+		}
+	}
+	for k := range s.rollups {
+		if _, ok := deleted[k.series]; ok && k.mType == mType {
+			delete(s.rollups, k)
+		}
+	}
+}
+
+// compact build shard rollups for ranges [marks[i], ends[i]) and drop expired samples (caller must hold write lock).
+func (s *memShard) compact(policy RetentionPolicy, marks, ends []time.Time, now time.Time) {
+	for i := 1; i < len(policy); i++ {
+		res, mark, end := policy[i].Resolution, marks[i], ends[i]
+		if !end.After(mark) {
+			continue
+		}
+		build := func(mType, series string, source []models.Sample) {
+			// source samples from the last built bucket
+			start := sort.Search(len(source), func(i int) bool { return !source[i].Timestamp.Before(mark) })
+			if rollups := rollupSamples(source[start:], res, end); len(rollups) > 0 {
+				key := rollupKey{mType: mType, series: series, resolution: res}
+				s.rollups[key] = append(s.rollups[key], rollups...)
+			}
+		}
+		if i == 1 {
+			for series, history := range s.gaugeHistory {
+				build(metrictypes.GaugeType, series, history)
+			}
+			for series, history := range s.counterHistory {
+				build(metrictypes.CounterType, series, history)
+			}
+		} else {
+			var sources []rollupKey
+			for k := range s.rollups {
+				if k.resolution == policy[i-1].Resolution {
+					sources = append(sources, k)
+				}
+			}
+			for _, k := range sources {
+				build(k.mType, k.series, s.rollups[k])
+			}
+		}
+	}
+
+	if len(policy) > 0 {
+		cutoff := now.Add(-policy[0].Keep)
+		for _, history := range []map[string][]models.Sample{s.gaugeHistory, s.counterHistory, s.histogramHistory} {
+			expireSamples(history, cutoff)
+		}
+	}
+	keep := make(map[time.Duration]time.Duration, len(policy))
+	for _, t := range policy[min(1, len(policy)):] {
+		keep[t.Resolution] = t.Keep
+	}
+	for k, rollups := range s.rollups {
+		t, ok := keep[k.resolution]
+		if !ok {
+			// resolution removed from policy
+			delete(s.rollups, k)
+			continue
+		}
+		if rest := dropBefore(rollups, now.Add(-t)); len(rest) > 0 {
+			s.rollups[k] = rest
+		} else {
+			delete(s.rollups, k)
+		}
+	}
+}
+
+// expireSamples drop series samples older than cutoff, empty series are removed.
+func expireSamples(history map[string][]models.Sample, cutoff time.Time) {
+	for series, samples := range history {
+		if rest := dropBefore(samples, cutoff); len(rest) > 0 {
+			history[series] = rest
+		} else {
+			delete(history, series)
+		}
+	}
+}
+
+// dropBefore return time ordered samples not older than cutoff (copy, so dropped samples can be freed).
+func dropBefore(samples []models.Sample, cutoff time.Time) []models.Sample {
+	start := sort.Search(len(samples), func(i int) bool { return !samples[i].Timestamp.Before(cutoff) })
+	if start == 0 {
+		return samples
+	}
+	return append([]models.Sample(nil), samples[start:]...)
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+func TestShardedMemStorage(t *testing.T) {
+	require.Len(t, NewShardedMemStorage(0).shards, 1)
+	require.Len(t, NewShardedMemStorage(5).shards, 8)
+	require.Len(t, NewMemStorage().shards, defaultMemShards)
+	// series always goes to the same shard
+	require.Equal(t, shardIndex("testCounter", 64), shardIndex("testCounter", 64))
+	require.Less(t, shardIndex("testCounter", 64), 64)
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	memStorage := NewShardedMemStorage(8)
+	const (
+		writers = 8
+		writes  = 200
+	)
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			d := int64(1)
+			v := float64(w)
+			for i := 0; i < writes; i++ {
+				require.NoError(t, memStorage.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(1)))
+				require.NoError(t, memStorage.WriteBatchMetrics(ctx, []models.Metrics{
+					{ID: fmt.Sprintf("testGauge%d", w), MType: "gauge", Value: &v},
+					{ID: fmt.Sprintf("testCounter%d", i%10), MType: "counter", Delta: &d},
+				}))
+				_, err := memStorage.GetMetric(ctx, "counter", "testCounter")
+				require.NoError(t, err)
+				_, err = memStorage.GetAllMetricsTxt(ctx)
+				require.NoError(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	c, err := memStorage.GetMetric(ctx, "counter", "testCounter")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(writers*writes), c)
+	c, err = memStorage.GetMetric(ctx, "counter", "testCounter3")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(writers*writes/10), c)
+	g, err := memStorage.GetMetric(ctx, "gauge", "testGauge5")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(5), g)
+	h, err := memStorage.GetMetricHistory(ctx, "counter", "testCounter", time.Unix(0, 0), time.Now())
+	require.NoError(t, err)
+	require.Len(t, h, writers*writes)
+}
+
+// benchBatch batch of gauges and counters of n series with prefix.
+func benchBatch(prefix string, n int) []models.Metrics {
+	metrics := make([]models.Metrics, 0, 2*n)
+	for i := 0; i < n; i++ {
+		v := float64(i)
+		d := int64(i)
+		metrics = append(metrics,
+			models.Metrics{ID: fmt.Sprintf("%sGauge%d", prefix, i), MType: "gauge", Value: &v},
+			models.Metrics{ID: fmt.Sprintf("%sCounter%d", prefix, i), MType: "counter", Delta: &d},
+		)
+	}
+	return metrics
+}
+
+// benchShards single shard (one lock for all series, as unsharded storage) and default sharding.
+var benchShards = []int{1, defaultMemShards}
+
+func BenchmarkParallelWriteBatch(b *testing.B) {
+	ctx := context.Background()
+	for _, shards := range benchShards {
+		b.Run(fmt.Sprintf("shards_%d", shards), func(b *testing.B) {
+			memStorage := NewShardedMemStorage(shards)
+			var (
+				mu    sync.Mutex
+				agent int
+			)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				// every goroutine is separate agent with own series
+				mu.Lock()
+				batch := benchBatch(fmt.Sprintf("agent%d", agent), 20)
+				agent++
+				mu.Unlock()
+				for pb.Next() {
+					if err := memStorage.WriteBatchMetrics(ctx, batch); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkParallelReadWrite(b *testing.B) {
+	ctx := context.Background()
+	for _, shards := range benchShards {
+		b.Run(fmt.Sprintf("shards_%d", shards), func(b *testing.B) {
+			memStorage := NewShardedMemStorage(shards)
+			require.NoError(b, memStorage.WriteBatchMetrics(ctx, benchBatch("bench", 100)))
+			var (
+				mu sync.Mutex
+				id int
+			)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				mu.Lock()
+				writer := id%4 == 0
+				name := fmt.Sprintf("benchCounter%d", id%100)
+				id++
+				mu.Unlock()
+				// one writer for three readers
+				for pb.Next() {
+					var err error
+					if writer {
+						err = memStorage.WriteMetric(ctx, "counter", name, metrictypes.Counter(1))
+					} else {
+						_, err = memStorage.GetMetric(ctx, "counter", name)
+					}
+					if err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGetAllMetricsTxt(b *testing.B) {
+	ctx := context.Background()
+	for _, shards := range benchShards {
+		b.Run(fmt.Sprintf("shards_%d", shards), func(b *testing.B) {
+			memStorage := NewShardedMemStorage(shards)
+			require.NoError(b, memStorage.WriteBatchMetrics(ctx, benchBatch("bench", 500)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := memStorage.GetAllMetricsTxt(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Schema migrations embedded in binary.
+// Every migration is a pair of files: NNNN_name.up.sql and NNNN_name.down.sql.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Sql queries for schema version tracking.
+// Advisory lock is held by the migrating session, so concurrent server starts are serialized.
+const (
+	migrationLockID            = 5243117301 // advisory lock key of schema migrations
+	lockMigrationsQuery        = `SELECT pg_advisory_lock($1)`
+	unlockMigrationsQuery      = `SELECT pg_advisory_unlock($1)`
+	populateSchemaVersionQuery = `create table if not exists schema_version ( version integer PRIMARY KEY,
+	name text NOT NULL, applied_at timestamptz NOT NULL DEFAULT now() )`
+	getSchemaVersionsQuery   = `SELECT version, applied_at FROM schema_version ORDER BY version`
+	insertSchemaVersionQuery = `INSERT INTO schema_version (version, name) VALUES ($1, $2)`
+	deleteSchemaVersionQuery = `DELETE FROM schema_version WHERE version = $1`
+)
+
+// Migration errors.
+var (
+	ErrMigrationFile    = errors.New("wrong migration file")
+	ErrUnknownMigration = errors.New("unknown migration applied")
+)
+
+// migrationFileRe migration file name format.
+var migrationFileRe = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration single schema change.
+type Migration struct {
+	Version int    // migration order number
+	Name    string // short description
+	Up      string // sql for apply
+	Down    string // sql for revert
+}
+
+// MigrationStatus state of migration in database.
+type MigrationStatus struct {
+	Version   int       // migration order number
+	Name      string    // short description (empty for migrations unknown to this binary)
+	Applied   bool      // migration is applied
+	AppliedAt time.Time // time of apply
+}
+
+// loadMigrations read migrations from file system sorted by version.
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, f := range files {
+		base := f[len("migrations/"):]
+		match := migrationFileRe.FindStringSubmatch(base)
+		if match == nil {
+			return nil, fmt.Errorf("%w: %s", ErrMigrationFile, base)
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrMigrationFile, base)
+		}
+		b, err := fs.ReadFile(fsys, f)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("%w: version %d has different names", ErrMigrationFile, version)
+		}
+		if match[3] == "up" {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("%w: version %d must have up and down files", ErrMigrationFile, m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// withMigrationLock run function on single connection holding migrations lock.
+// Function gets applied versions with apply time.
+func (p *PgDB) withMigrationLock(ctx context.Context, fn func(conn *sql.Conn, applied map[int]time.Time) error) error {
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, lockMigrationsQuery, migrationLockID); err != nil {
+		return fmt.Errorf("migrations lock failed: %s", err.Error())
+	}
+	defer func() {
+		// lock is released with session anyway, so error is only logged
+		if _, err := conn.ExecContext(context.Background(), unlockMigrationsQuery, migrationLockID); err != nil {
+			log.Printf("migrations unlock failed: %s", err.Error())
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, populateSchemaVersionQuery); err != nil {
+		return fmt.Errorf("populate schema version failed: %s", err.Error())
+	}
+	rows, err := conn.QueryContext(ctx, getSchemaVersionsQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version int
+			ts      time.Time
+		)
+		if err := rows.Scan(&version, &ts); err != nil {
+			return err
+		}
+		applied[version] = ts
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	return fn(conn, applied)
+}
+
+// runMigration execute migration sql and change schema version in one transaction.
+func runMigration(ctx context.Context, conn *sql.Conn, query, versionQuery string, versionArgs ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("can't start tx to db: %s", err.Error())
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, versionQuery, versionArgs...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MigrateUp apply all pending migrations.
+func (p *PgDB) MigrateUp(ctx context.Context) error {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return err
+	}
+	return p.withMigrationLock(ctx, func(conn *sql.Conn, applied map[int]time.Time) error {
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, m.Up, insertSchemaVersionQuery, m.Version, m.Name); err != nil {
+				return fmt.Errorf("migration %d_%s failed: %s", m.Version, m.Name, err.Error())
+			}
+			log.Printf("migration %d_%s applied", m.Version, m.Name)
+		}
+		return nil
+	})
+}
+
+// MigrateDown revert last applied migrations (steps count).
+func (p *PgDB) MigrateDown(ctx context.Context, steps int) error {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return err
+	}
+	byVersion := make(map[int]Migration, len(migrations))
+	for _, m := range migrations {
+		byVersion[m.Version] = m
+	}
+	return p.withMigrationLock(ctx, func(conn *sql.Conn, applied map[int]time.Time) error {
+		versions := make([]int, 0, len(applied))
+		for v := range applied {
+			versions = append(versions, v)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+		for i := 0; i < steps && i < len(versions); i++ {
+			m, ok := byVersion[versions[i]]
+			if !ok {
+				return fmt.Errorf("%w: %d", ErrUnknownMigration, versions[i])
+			}
+			if err := runMigration(ctx, conn, m.Down, deleteSchemaVersionQuery, m.Version); err != nil {
+				return fmt.Errorf("migration %d_%s revert failed: %s", m.Version, m.Name, err.Error())
+			}
+			log.Printf("migration %d_%s reverted", m.Version, m.Name)
+		}
+		return nil
+	})
+}
+
+// MigrationStatus list known and applied migrations sorted by version.
+func (p *PgDB) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+	var res []MigrationStatus
+	err = p.withMigrationLock(ctx, func(conn *sql.Conn, applied map[int]time.Time) error {
+		known := make(map[int]bool, len(migrations))
+		for _, m := range migrations {
+			ts, ok := applied[m.Version]
+			res = append(res, MigrationStatus{Version: m.Version, Name: m.Name, Applied: ok, AppliedAt: ts})
+			known[m.Version] = true
+		}
+		// applied by newer binary
+		for v, ts := range applied {
+			if !known[v] {
+				res = append(res, MigrationStatus{Version: v, Applied: true, AppliedAt: ts})
+			}
+		}
+		return nil
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].Version < res[j].Version })
+	return res, err
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	// versions are ordered without gaps
+	for i, m := range migrations {
+		require.Equal(t, i+1, m.Version)
+		require.NotEmpty(t, m.Up)
+		require.NotEmpty(t, m.Down)
+	}
+
+	_, err = loadMigrations(fstest.MapFS{
+		"migrations/0001_init.up.sql": {Data: []byte("select 1")},
+	})
+	require.ErrorIs(t, err, ErrMigrationFile)
+	_, err = loadMigrations(fstest.MapFS{
+		"migrations/init.sql": {Data: []byte("select 1")},
+	})
+	require.ErrorIs(t, err, ErrMigrationFile)
+	_, err = loadMigrations(fstest.MapFS{
+		"migrations/0001_init.up.sql":    {Data: []byte("select 1")},
+		"migrations/0001_other.down.sql": {Data: []byte("select 1")},
+	})
+	require.ErrorIs(t, err, ErrMigrationFile)
+}
+
+func TestMigrateDownStatus(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	p, err := NewPgDB("", db)
+	require.NoError(t, err)
+
+	migrations, err := loadMigrations(migrationFiles)
+	require.NoError(t, err)
+	last := migrations[len(migrations)-1]
+	prev := migrations[len(migrations)-2]
+	ts := time.Unix(1000, 0)
+	appliedRows := func() *sqlmock.Rows {
+		rows := sqlmock.NewRows([]string{"version", "applied_at"})
+		for _, m := range migrations {
+			rows.AddRow(m.Version, ts)
+		}
+		return rows
+	}
+
+	// two last migrations are reverted in reverse order
+	mock.ExpectExec(lockMigrationsQuery).WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(populateSchemaVersionQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(getSchemaVersionsQuery).WillReturnRows(appliedRows())
+	for _, m := range []Migration{last, prev} {
+		mock.ExpectBegin()
+		mock.ExpectExec(m.Down).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(deleteSchemaVersionQuery).WithArgs(m.Version).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+	}
+	mock.ExpectExec(unlockMigrationsQuery).WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	require.NoError(t, p.MigrateDown(ctx, 2))
+
+	// failed migration is rolled back, lock is released
+	mock.ExpectExec(lockMigrationsQuery).WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(populateSchemaVersionQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(getSchemaVersionsQuery).WillReturnRows(appliedRows())
+	mock.ExpectBegin()
+	mock.ExpectExec(last.Down).WillReturnError(sqlmock.ErrCancelled)
+	mock.ExpectRollback()
+	mock.ExpectExec(unlockMigrationsQuery).WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	require.Error(t, p.MigrateDown(ctx, 1))
+
+	// status shows pending and unknown (newer) migrations
+	rows := sqlmock.NewRows([]string{"version", "applied_at"})
+	for _, m := range migrations[:len(migrations)-1] {
+		rows.AddRow(m.Version, ts)
+	}
+	rows.AddRow(100, ts)
+	mock.ExpectExec(lockMigrationsQuery).WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(populateSchemaVersionQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(getSchemaVersionsQuery).WillReturnRows(rows)
+	mock.ExpectExec(unlockMigrationsQuery).WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	status, err := p.MigrationStatus(ctx)
+	require.NoError(t, err)
+	require.Len(t, status, len(migrations)+1)
+	require.True(t, status[0].Applied)
+	require.Equal(t, ts, status[0].AppliedAt)
+	require.False(t, status[len(migrations)-1].Applied)
+	require.Equal(t, MigrationStatus{Version: 100, Applied: true, AppliedAt: ts}, status[len(migrations)])
+
+	require.NoError(t, mock.ExpectationsWereMet())
+}
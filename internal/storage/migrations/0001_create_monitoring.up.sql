@@ -0,0 +1,2 @@
+create table if not exists monitoring ( id varchar(64) PRIMARY KEY, 
+mtype varchar(16), delta bigint, value double precision );
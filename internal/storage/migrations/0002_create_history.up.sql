@@ -0,0 +1,3 @@
+create table if not exists monitoring_history ( id varchar(64) NOT NULL, 
+mtype varchar(16) NOT NULL, ts timestamptz NOT NULL, delta bigint, value double precision );
+create index if not exists monitoring_history_series_ts on monitoring_history (id, mtype, ts);
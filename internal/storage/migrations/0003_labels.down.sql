@@ -0,0 +1,9 @@
+-- labeled series can't be stored without labels
+drop index if exists monitoring_history_series_ts;
+delete from monitoring_history where labels <> '';
+alter table monitoring_history drop column if exists labels;
+create index monitoring_history_series_ts on monitoring_history (id, mtype, ts);
+delete from monitoring where labels <> '';
+alter table monitoring drop constraint if exists monitoring_pkey;
+alter table monitoring drop column if exists labels;
+alter table monitoring add PRIMARY KEY (id);
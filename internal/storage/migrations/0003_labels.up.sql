@@ -0,0 +1,12 @@
+-- labels are stored in canonical form, series key is (id, labels)
+alter table monitoring add column if not exists labels text NOT NULL DEFAULT '';
+alter table monitoring_history add column if not exists labels text NOT NULL DEFAULT '';
+DO $$ BEGIN
+	IF NOT EXISTS (SELECT 1 FROM pg_index i JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		WHERE i.indrelid = 'monitoring'::regclass AND i.indisprimary AND a.attname = 'labels') THEN
+		ALTER TABLE monitoring DROP CONSTRAINT IF EXISTS monitoring_pkey;
+		ALTER TABLE monitoring ADD PRIMARY KEY (id, labels);
+	END IF;
+END $$;
+drop index if exists monitoring_history_series_ts;
+create index monitoring_history_series_ts on monitoring_history (id, labels, mtype, ts);
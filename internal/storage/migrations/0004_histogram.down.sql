@@ -0,0 +1,4 @@
+delete from monitoring where mtype = 'histogram';
+delete from monitoring_history where mtype = 'histogram';
+alter table monitoring drop column if exists histogram;
+alter table monitoring_history drop column if exists histogram;
@@ -0,0 +1,2 @@
+alter table monitoring add column if not exists histogram jsonb;
+alter table monitoring_history add column if not exists histogram jsonb;
@@ -0,0 +1,5 @@
+-- only one type of series with the same name and labels is kept
+delete from monitoring a using monitoring b where a.id = b.id and a.labels = b.labels and a.mtype > b.mtype;
+alter table monitoring drop constraint if exists monitoring_pkey;
+alter table monitoring add PRIMARY KEY (id, labels);
+alter table monitoring alter column mtype drop NOT NULL;
@@ -0,0 +1,11 @@
+-- metrics of different types with the same name are different series,
+-- old key is unique, so existing rows always satisfy the new one
+update monitoring set mtype = CASE WHEN value IS NOT NULL THEN 'gauge' ELSE 'counter' END WHERE mtype IS NULL;
+alter table monitoring alter column mtype set NOT NULL;
+DO $$ BEGIN
+	IF NOT EXISTS (SELECT 1 FROM pg_index i JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		WHERE i.indrelid = 'monitoring'::regclass AND i.indisprimary AND a.attname = 'mtype') THEN
+		ALTER TABLE monitoring DROP CONSTRAINT IF EXISTS monitoring_pkey;
+		ALTER TABLE monitoring ADD PRIMARY KEY (id, mtype, labels);
+	END IF;
+END $$;
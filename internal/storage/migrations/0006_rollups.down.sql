@@ -0,0 +1,2 @@
+drop index if exists monitoring_history_ts;
+drop table if exists monitoring_rollups;
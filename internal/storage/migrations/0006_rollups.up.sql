@@ -0,0 +1,8 @@
+-- aggregated history: gauges keep avg (value), min, max and last, counters keep summed delta,
+-- count is number of raw samples, resolution is rollup step in seconds
+create table if not exists monitoring_rollups ( id varchar(64) NOT NULL, labels text NOT NULL DEFAULT '',
+mtype varchar(16) NOT NULL, resolution bigint NOT NULL, ts timestamptz NOT NULL, delta bigint, value double precision,
+min double precision, max double precision, last double precision, count bigint NOT NULL,
+PRIMARY KEY (id, labels, mtype, resolution, ts) );
+create index if not exists monitoring_rollups_resolution_ts on monitoring_rollups (resolution, ts);
+create index if not exists monitoring_history_ts on monitoring_history (ts);
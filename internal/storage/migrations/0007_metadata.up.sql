@@ -0,0 +1,3 @@
+-- metadata of metric names (shared by all series of name), type is a hint of agent
+create table if not exists monitoring_metadata ( id varchar(64) PRIMARY KEY, mtype varchar(16) NOT NULL DEFAULT '',
+unit text NOT NULL DEFAULT '', description text NOT NULL DEFAULT '' );
@@ -0,0 +1,17 @@
+-- only series and metadata of default tenant are kept
+delete from monitoring where tenant <> '';
+delete from monitoring_history where tenant <> '';
+delete from monitoring_rollups where tenant <> '';
+delete from monitoring_metadata where tenant <> '';
+drop index if exists monitoring_history_series_ts;
+create index monitoring_history_series_ts on monitoring_history (id, labels, mtype, ts);
+alter table monitoring drop constraint if exists monitoring_pkey;
+alter table monitoring add PRIMARY KEY (id, mtype, labels);
+alter table monitoring_rollups drop constraint if exists monitoring_rollups_pkey;
+alter table monitoring_rollups add PRIMARY KEY (id, labels, mtype, resolution, ts);
+alter table monitoring_metadata drop constraint if exists monitoring_metadata_pkey;
+alter table monitoring_metadata add PRIMARY KEY (id);
+alter table monitoring drop column if exists tenant;
+alter table monitoring_history drop column if exists tenant;
+alter table monitoring_rollups drop column if exists tenant;
+alter table monitoring_metadata drop column if exists tenant;
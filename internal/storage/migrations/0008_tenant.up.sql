@@ -0,0 +1,13 @@
+-- series and metadata are partitioned by tenant, default tenant is empty string
+alter table monitoring add column if not exists tenant varchar(64) NOT NULL DEFAULT '';
+alter table monitoring_history add column if not exists tenant varchar(64) NOT NULL DEFAULT '';
+alter table monitoring_rollups add column if not exists tenant varchar(64) NOT NULL DEFAULT '';
+alter table monitoring_metadata add column if not exists tenant varchar(64) NOT NULL DEFAULT '';
+alter table monitoring drop constraint if exists monitoring_pkey;
+alter table monitoring add PRIMARY KEY (tenant, id, mtype, labels);
+alter table monitoring_rollups drop constraint if exists monitoring_rollups_pkey;
+alter table monitoring_rollups add PRIMARY KEY (tenant, id, labels, mtype, resolution, ts);
+alter table monitoring_metadata drop constraint if exists monitoring_metadata_pkey;
+alter table monitoring_metadata add PRIMARY KEY (tenant, id);
+drop index if exists monitoring_history_series_ts;
+create index monitoring_history_series_ts on monitoring_history (tenant, id, labels, mtype, ts);
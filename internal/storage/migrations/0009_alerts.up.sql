@@ -0,0 +1,3 @@
+-- saved alerts state of tenant (json array of alerts, replaced by every rules evaluation)
+create table if not exists monitoring_alerts ( tenant varchar(64) PRIMARY KEY, alerts jsonb NOT NULL DEFAULT '[]',
+updated_at timestamp with time zone NOT NULL DEFAULT now() );
@@ -0,0 +1,47 @@
+// mock tests are in external package: mocks import storage
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/sourcecd/monitoring/internal/storage"
+	"github.com/sourcecd/monitoring/mocks"
+)
+
+func TestAllGoMocks(t *testing.T) {
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	t.Cleanup(func() { ctrl.Finish() })
+
+	mDB := mocks.NewMockStoreMetrics(ctrl)
+
+	mDB.EXPECT().GetAllMetricsTxt(gomock.Any()).Return("test", nil)
+	mDB.EXPECT().GetMetric(gomock.Any(), gomock.Any(), gomock.Any()).Return(gomock.Any(), nil)
+	mDB.EXPECT().WriteBatchMetrics(gomock.Any(), gomock.Any()).Return(nil)
+	mDB.EXPECT().WriteMetric(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+	mDB.EXPECT().GetMetricHistory(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, nil)
+
+	mDB.GetAllMetricsTxt(ctx)
+	mDB.GetMetric(ctx, "test1", "test2")
+	mDB.WriteBatchMetrics(ctx, []models.Metrics{})
+	mDB.WriteMetric(ctx, "test3", "test4", "ok")
+	mDB.GetMetricHistory(ctx, "test5", "test6", time.Time{}, time.Time{})
+	mDB.EXPECT().GetMetricRollups(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, nil)
+	mDB.EXPECT().Compact(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+	mDB.GetMetricRollups(ctx, "test7", "test8", time.Minute, time.Time{}, time.Time{})
+	mDB.Compact(ctx, storage.RetentionPolicy{}, time.Time{})
+	mDB.EXPECT().Delete(gomock.Any(), gomock.Any(), gomock.Any()).Return(1, nil)
+	mDB.Delete(ctx, "test9", "test10")
+	mDB.EXPECT().WriteMetadata(gomock.Any(), gomock.Any()).Return(nil)
+	mDB.EXPECT().GetMetadata(gomock.Any()).Return(nil, nil)
+	mDB.WriteMetadata(ctx, []models.Metadata{})
+	mDB.GetMetadata(ctx)
+	mDB.EXPECT().WriteAlerts(gomock.Any(), gomock.Any()).Return(nil)
+	mDB.EXPECT().GetAlerts(gomock.Any()).Return(nil, nil)
+	mDB.WriteAlerts(ctx, []models.Alert{})
+	mDB.GetAlerts(ctx)
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"log"
+	"sort"
+
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+// pgSeries series key of postgres storage.
+type pgSeries struct {
+	id     string // metric name
+	labels string // canonical labels
+}
+
+// pgBatch metrics of one batch grouped for set-based upsert.
+type pgBatch struct {
+	gaugeIDs    []string                           // gauge names (in batch order)
+	gaugeLabels []string                           // gauge canonical labels
+	gaugeValues []float64                          // gauge values
+	counters    map[pgSeries]int64                 // counter deltas summed per series
+	histograms  map[pgSeries]metrictypes.Histogram // histograms merged per series
+}
+
+// newPgBatch init empty batch.
+func newPgBatch() *pgBatch {
+	return &pgBatch{
+		counters:   make(map[pgSeries]int64),
+		histograms: make(map[pgSeries]metrictypes.Histogram),
+	}
+}
+
+// add put metric to batch, wrong metrics are logged and skipped.
+func (b *pgBatch) add(v models.Metrics) {
+	if v.ID == "" {
+		log.Printf("empty id of %s metric", v.MType)
+		return
+	}
+	if err := validateMetric(v); err != nil {
+		log.Printf("metric %s: %s", v.ID, err.Error())
+		return
+	}
+	if err := models.ValidateSeries(v.ID, v.Labels); err != nil {
+		log.Printf("metric %q: %s", v.ID, err.Error())
+		return
+	}
+	if err := checkReservedLabels(v.Labels); err != nil {
+		log.Printf("metric %s: %s", v.ID, err.Error())
+		return
+	}
+	s := pgSeries{id: v.ID, labels: v.Labels.String()}
+	// selecting metric type
+	switch v.MType {
+	case metrictypes.GaugeType:
+		b.gaugeIDs = append(b.gaugeIDs, s.id)
+		b.gaugeLabels = append(b.gaugeLabels, s.labels)
+		b.gaugeValues = append(b.gaugeValues, *v.Value)
+	case metrictypes.CounterType:
+		b.counters[s] += *v.Delta
+	case metrictypes.HistogramType:
+		h := metrictypes.Histogram(*v.Histogram)
+		stored, ok := b.histograms[s]
+		if !ok {
+			b.histograms[s] = h.Clone()
+			return
+		}
+		if err := stored.Merge(h); err != nil {
+			log.Printf("histogram %s: %s", v.ID, err.Error())
+			return
+		}
+		b.histograms[s] = stored
+	}
+}
+
+// sortedSeries return series keys in (id, labels) order.
+func sortedSeries[V any](mp map[pgSeries]V) []pgSeries {
+	keys := make([]pgSeries, 0, len(mp))
+	for k := range mp {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].id != keys[j].id {
+			return keys[i].id < keys[j].id
+		}
+		return keys[i].labels < keys[j].labels
+	})
+	return keys
+}
+
+// counterArgs return counter statement arguments ordered by series.
+func (b *pgBatch) counterArgs() ([]string, []string, []int64) {
+	keys := sortedSeries(b.counters)
+	ids := make([]string, 0, len(keys))
+	labels := make([]string, 0, len(keys))
+	deltas := make([]int64, 0, len(keys))
+	for _, k := range keys {
+		ids = append(ids, k.id)
+		labels = append(labels, k.labels)
+		deltas = append(deltas, b.counters[k])
+	}
+	return ids, labels, deltas
+}
+
+// histogramSeries return histogram series ordered by key.
+func (b *pgBatch) histogramSeries() []pgSeries {
+	return sortedSeries(b.histograms)
+}
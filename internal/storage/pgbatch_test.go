@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/stretchr/testify/require"
+)
+
+// Benchmarks need real database, dsn example: host=localhost database=monitoring_test
+const benchDsnEnv = "TEST_DATABASE_DSN"
+
+func TestPgBatch(t *testing.T) {
+	d := int64(1)
+	v := float64(0.5)
+	h1 := models.Histogram(metrictypes.NewHistogram([]float64{1}))
+	h2 := models.Histogram(metrictypes.NewHistogram([]float64{2}))
+	b := newPgBatch()
+	for _, m := range []models.Metrics{
+		{ID: "b", MType: "counter", Delta: &d},
+		{ID: "a", MType: "counter", Delta: &d, Labels: models.Labels{"host": "h2"}},
+		{ID: "a", MType: "counter", Delta: &d, Labels: models.Labels{"host": "h1"}},
+		{ID: "b", MType: "counter", Delta: &d},
+		{ID: "g", MType: "gauge", Value: &v},
+		{ID: "h", MType: "histogram", Histogram: &h1},
+		{ID: "h", MType: "histogram", Histogram: &h2},
+		{ID: "", MType: "gauge", Value: &v},
+		{ID: "g", MType: "counter", Value: &v},
+		{ID: "w", MType: "wrong", Value: &v},
+	} {
+		b.add(m)
+	}
+
+	ids, labels, deltas := b.counterArgs()
+	require.Equal(t, []string{"a", "a", "b"}, ids)
+	require.Equal(t, []string{`{host="h1"}`, `{host="h2"}`, ""}, labels)
+	require.Equal(t, []int64{1, 1, 2}, deltas)
+	require.Equal(t, []string{"g"}, b.gaugeIDs)
+	// histogram with other bounds is skipped
+	require.Equal(t, []pgSeries{{id: "h"}}, b.histogramSeries())
+	require.Equal(t, []float64{1}, b.histograms[pgSeries{id: "h"}].Bounds)
+}
+
+// writeBatchRowByRow batch write with statement per metric (implementation before set-based upserts).
+func writeBatchRowByRow(ctx context.Context, p *PgDB, metrics []models.Metrics) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, v := range metrics {
+		switch v.MType {
+		case metrictypes.GaugeType:
+			if _, err := tx.StmtContext(ctx, p.insertGaugeStmt).ExecContext(ctx, v.ID, v.Labels.String(), v.MType, v.Value); err != nil {
+				return err
+			}
+		case metrictypes.CounterType:
+			if _, err := tx.StmtContext(ctx, p.insertCounterStmt).ExecContext(ctx, v.ID, v.Labels.String(), v.MType, v.Delta); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// benchMetrics batch of gauges and counters from several agents (counters repeat).
+func benchMetrics(size int) []models.Metrics {
+	metrics := make([]models.Metrics, 0, size)
+	for i := 0; i < size; i++ {
+		d := int64(i)
+		v := float64(i)
+		labels := models.Labels{"host": fmt.Sprintf("host%d", i%10)}
+		if i%2 == 0 {
+			metrics = append(metrics, models.Metrics{ID: fmt.Sprintf("benchGauge%d", i), MType: "gauge", Value: &v, Labels: labels})
+		} else {
+			metrics = append(metrics, models.Metrics{ID: fmt.Sprintf("benchCounter%d", i%100), MType: "counter", Delta: &d, Labels: labels})
+		}
+	}
+	return metrics
+}
+
+func BenchmarkWriteBatchMetricsPG(b *testing.B) {
+	dsn := os.Getenv(benchDsnEnv)
+	if dsn == "" {
+		b.Skipf("%s is not set", benchDsnEnv)
+	}
+	ctx := context.Background()
+	p, err := NewPgDB(dsn, nil)
+	require.NoError(b, err)
+	b.Cleanup(func() {
+		_, _ = p.db.ExecContext(ctx, `DELETE FROM monitoring WHERE id LIKE 'bench%'`)
+		_, _ = p.db.ExecContext(ctx, `DELETE FROM monitoring_history WHERE id LIKE 'bench%'`)
+		p.CloseDB()
+	})
+	require.NoError(b, p.PopulateDB(ctx))
+
+	for _, size := range []int{100, 1000, 5000} {
+		metrics := benchMetrics(size)
+		b.Run(fmt.Sprintf("row_by_row/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := writeBatchRowByRow(ctx, p, metrics); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("set_based/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := p.WriteBatchMetrics(ctx, metrics); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPgBatch(b *testing.B) {
+	metrics := benchMetrics(5000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		batch := newPgBatch()
+		for _, v := range metrics {
+			batch.add(v)
+		}
+		batch.counterArgs()
+	}
+}
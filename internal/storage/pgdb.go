@@ -4,9 +4,12 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 
@@ -15,29 +18,121 @@ import (
 	"github.com/sourcecd/monitoring/internal/models"
 )
 
-// Sql query for create monitoring table in postgres DB.
+// Sql queries for monitoring tables in postgres DB (schema is created by migrations, see migrations directory).
+// Labels are stored in canonical form (see models.Labels.String), so series key is (tenant, id, mtype, labels):
+// metrics of different types with the same name are different series (as in in-memory storage).
+// Tenant (see WithTenant) is the last parameter of series queries.
 const (
-	populateQuery = `create table if not exists monitoring ( id varchar(64) PRIMARY KEY, 
-	mtype varchar(16), delta bigint, value double precision )`
-
-	getGaugePrep      = `SELECT value FROM monitoring WHERE id = $1`
-	getCounterPrep    = `SELECT delta FROM monitoring WHERE id = $1`
-	getAllGaugePrep   = `SELECT id, value FROM monitoring WHERE mtype = 'gauge' ORDER BY id`
-	getAllCounterPrep = `SELECT id, delta FROM monitoring WHERE mtype = 'counter' ORDER BY id`
-	insertGaugePrep   = `INSERT INTO monitoring (id, mtype, value) VALUES ($1, $2, $3) ON CONFLICT (id) DO UPDATE SET value = $3`
-	insertCounterPrep = `INSERT INTO monitoring (id, mtype, delta) VALUES ($1, $2, $3) ON CONFLICT (id) 
-	DO UPDATE SET delta = $3 + (SELECT delta FROM monitoring WHERE id = $1)`
+	// series are listed in the same (byte) order as series ids in in-memory storage
+	getGaugePrep      = `SELECT value FROM monitoring WHERE id = $1 AND mtype = 'gauge' AND labels = $2 AND tenant = $3`
+	getCounterPrep    = `SELECT delta FROM monitoring WHERE id = $1 AND mtype = 'counter' AND labels = $2 AND tenant = $3`
+	getAllGaugePrep   = `SELECT id, labels, value FROM monitoring WHERE mtype = 'gauge' AND tenant = $1 ORDER BY id || labels COLLATE "C"`
+	getAllCounterPrep = `SELECT id, labels, delta FROM monitoring WHERE mtype = 'counter' AND tenant = $1 ORDER BY id || labels COLLATE "C"`
+	// every write also records a timestamped sample in monitoring_history (in the same statement)
+	insertGaugePrep = `WITH h AS (INSERT INTO monitoring_history (tenant, id, labels, mtype, ts, value) VALUES ($5, $1, $2, $3, now(), $4)) 
+	INSERT INTO monitoring (tenant, id, labels, mtype, value) VALUES ($5, $1, $2, $3, $4) ON CONFLICT (tenant, id, mtype, labels) DO UPDATE SET value = EXCLUDED.value`
+	insertCounterPrep = `WITH h AS (INSERT INTO monitoring_history (tenant, id, labels, mtype, ts, delta) VALUES ($5, $1, $2, $3, now(), $4)) 
+	INSERT INTO monitoring (tenant, id, labels, mtype, delta) VALUES ($5, $1, $2, $3, $4) ON CONFLICT (tenant, id, mtype, labels) 
+	DO UPDATE SET delta = monitoring.delta + EXCLUDED.delta`
+	getGaugeHistoryPrep = `SELECT ts, value FROM monitoring_history 
+	WHERE id = $1 AND labels = $2 AND mtype = 'gauge' AND ts >= $3 AND ts <= $4 AND tenant = $5 ORDER BY ts`
+	getCounterHistoryPrep = `SELECT ts, delta FROM monitoring_history 
+	WHERE id = $1 AND labels = $2 AND mtype = 'counter' AND ts >= $3 AND ts <= $4 AND tenant = $5 ORDER BY ts`
+
+	// histograms are merged by application: row is created (if not exists) and locked before merge
+	getHistogramPrep    = `SELECT histogram FROM monitoring WHERE id = $1 AND mtype = 'histogram' AND labels = $2 AND tenant = $3`
+	getAllHistogramPrep = `SELECT id, labels, histogram FROM monitoring WHERE mtype = 'histogram' AND tenant = $1 ORDER BY id || labels COLLATE "C"`
+	initHistogramPrep   = `INSERT INTO monitoring (tenant, id, labels, mtype) VALUES ($4, $1, $2, $3) ON CONFLICT (tenant, id, mtype, labels) DO NOTHING`
+	lockHistogramPrep   = `SELECT histogram FROM monitoring WHERE id = $1 AND mtype = 'histogram' AND labels = $2 AND tenant = $3 FOR UPDATE`
+	updateHistogramPrep = `WITH h AS (INSERT INTO monitoring_history (tenant, id, labels, mtype, ts, histogram) VALUES ($6, $1, $2, $3, now(), $5)) 
+	UPDATE monitoring SET histogram = $4 WHERE id = $1 AND mtype = $3 AND labels = $2 AND tenant = $6`
+	getHistogramHistoryPrep = `SELECT ts, histogram FROM monitoring_history 
+	WHERE id = $1 AND labels = $2 AND mtype = 'histogram' AND ts >= $3 AND ts <= $4 AND tenant = $5 ORDER BY ts`
+
+	// batch writes are set-based upserts of arrays ($1 ids, $2 labels, $3 values) in one round trip,
+	// rows are upserted in key order, so concurrent batches lock rows in the same order
+	// every gauge value is recorded to history, only the last one (by position in batch) is stored
+	insertGaugeBatchPrep = `WITH h AS (INSERT INTO monitoring_history (tenant, id, labels, mtype, ts, value) 
+	SELECT $4, id, labels, 'gauge', now(), value FROM unnest($1::varchar[], $2::text[], $3::double precision[]) AS t(id, labels, value)) 
+	INSERT INTO monitoring (tenant, id, labels, mtype, value) 
+	SELECT DISTINCT ON (id, labels) $4, id, labels, 'gauge', value 
+	FROM unnest($1::varchar[], $2::text[], $3::double precision[]) WITH ORDINALITY AS t(id, labels, value, n) ORDER BY id, labels, n DESC 
+	ON CONFLICT (tenant, id, mtype, labels) DO UPDATE SET value = EXCLUDED.value`
+	// counter deltas are pre-aggregated per series by application
+	insertCounterBatchPrep = `WITH h AS (INSERT INTO monitoring_history (tenant, id, labels, mtype, ts, delta) 
+	SELECT $4, id, labels, 'counter', now(), delta FROM unnest($1::varchar[], $2::text[], $3::bigint[]) AS t(id, labels, delta)) 
+	INSERT INTO monitoring (tenant, id, labels, mtype, delta) 
+	SELECT $4, id, labels, 'counter', delta FROM unnest($1::varchar[], $2::text[], $3::bigint[]) AS t(id, labels, delta) 
+	ON CONFLICT (tenant, id, mtype, labels) DO UPDATE SET delta = monitoring.delta + EXCLUDED.delta`
+
+	// rollups are built by compaction from history or from finer rollups (of all tenants),
+	// buckets are aligned to unix epoch ($1 resolution in seconds), source samples are taken before $2
+	// and after last built bucket of their series (series mark), so late samples of series aren't skipped
+	getRollupsPrep = `SELECT ts, delta, value, min, max, last, count FROM monitoring_rollups 
+	WHERE id = $1 AND labels = $2 AND mtype = $3 AND resolution = $4 AND ts >= $5 AND ts <= $6 AND tenant = $7 ORDER BY ts`
+	rollupHistoryQuery = `INSERT INTO monitoring_rollups (tenant, id, labels, mtype, resolution, ts, delta, value, min, max, last, count) 
+	SELECT h.tenant, h.id, h.labels, h.mtype, $1::bigint, to_timestamp(floor(extract(epoch FROM h.ts) / $1::bigint) * $1::bigint) AS bucket, 
+	sum(h.delta), avg(h.value), min(h.value), max(h.value), (array_agg(h.value ORDER BY h.ts DESC))[1], count(*) 
+	FROM monitoring_history h LEFT JOIN (SELECT tenant, id, labels, mtype, max(ts) AS mark FROM monitoring_rollups 
+	WHERE resolution = $1 GROUP BY tenant, id, labels, mtype) r ON h.tenant = r.tenant AND h.id = r.id AND h.labels = r.labels AND h.mtype = r.mtype 
+	WHERE h.mtype IN ('gauge', 'counter') AND h.ts < $2 AND (r.mark IS NULL OR h.ts >= r.mark + make_interval(secs => $1::bigint)) 
+	GROUP BY h.tenant, h.id, h.labels, h.mtype, bucket ON CONFLICT DO NOTHING`
+	rollupRollupsQuery = `INSERT INTO monitoring_rollups (tenant, id, labels, mtype, resolution, ts, delta, value, min, max, last, count) 
+	SELECT s.tenant, s.id, s.labels, s.mtype, $1::bigint, to_timestamp(floor(extract(epoch FROM s.ts) / $1::bigint) * $1::bigint) AS bucket, 
+	sum(s.delta), sum(s.value * s.count) / sum(s.count), min(s.min), max(s.max), (array_agg(s.last ORDER BY s.ts DESC))[1], sum(s.count) 
+	FROM monitoring_rollups s LEFT JOIN (SELECT tenant, id, labels, mtype, max(ts) AS mark FROM monitoring_rollups 
+	WHERE resolution = $1 GROUP BY tenant, id, labels, mtype) r ON s.tenant = r.tenant AND s.id = r.id AND s.labels = r.labels AND s.mtype = r.mtype 
+	WHERE s.resolution = $3 AND s.ts < $2 AND (r.mark IS NULL OR s.ts >= r.mark + make_interval(secs => $1::bigint)) 
+	GROUP BY s.tenant, s.id, s.labels, s.mtype, bucket ON CONFLICT DO NOTHING`
+	expireHistoryQuery      = `DELETE FROM monitoring_history WHERE ts < $1`
+	expireRollupsQuery      = `DELETE FROM monitoring_rollups WHERE resolution = $1 AND ts < $2`
+	expireOtherRollupsQuery = `DELETE FROM monitoring_rollups WHERE NOT (resolution = ANY($1::bigint[]))`
+
+	// series are matched by LIKE pattern of series id, history and rollups are deleted with series (in the same statement)
+	deleteSeriesPrep = `WITH d AS (DELETE FROM monitoring WHERE mtype = $1 AND (id || labels) LIKE $2 AND tenant = $3 RETURNING id, labels), 
+	h AS (DELETE FROM monitoring_history h USING d WHERE h.id = d.id AND h.labels = d.labels AND h.mtype = $1 AND h.tenant = $3), 
+	r AS (DELETE FROM monitoring_rollups r USING d WHERE r.id = d.id AND r.labels = d.labels AND r.mtype = $1 AND r.tenant = $3) 
+	SELECT count(*) FROM d`
+	// metadata of batch is deduplicated by name, so upsert never changes the same row twice
+	writeMetadataPrep = `INSERT INTO monitoring_metadata (tenant, id, mtype, unit, description) 
+	SELECT $5, * FROM unnest($1::varchar[], $2::varchar[], $3::text[], $4::text[]) 
+	ON CONFLICT (tenant, id) DO UPDATE SET mtype = EXCLUDED.mtype, unit = EXCLUDED.unit, description = EXCLUDED.description`
+	getMetadataPrep = `SELECT id, mtype, unit, description FROM monitoring_metadata WHERE tenant = $1 ORDER BY id COLLATE "C"`
+	writeAlertsPrep = `INSERT INTO monitoring_alerts (tenant, alerts, updated_at) VALUES ($1, $2, now()) 
+	ON CONFLICT (tenant) DO UPDATE SET alerts = EXCLUDED.alerts, updated_at = EXCLUDED.updated_at`
+	getAlertsPrep = `SELECT alerts FROM monitoring_alerts WHERE tenant = $1`
+
+	// all series of tenant in one cursor, series of metric name are consecutive
+	scanMetricsPrep = `SELECT mtype, id, labels, delta, value, histogram FROM monitoring 
+	WHERE tenant = $1 ORDER BY mtype, id COLLATE "C", labels COLLATE "C"`
 )
 
 // PgDB singleton type for connect and work with postgres DB.
 type PgDB struct {
-	db                *sql.DB
-	getGaugeStmt      *sql.Stmt
-	getCounterStmt    *sql.Stmt
-	getAllGaugeStmt   *sql.Stmt
-	getAllCounterStmt *sql.Stmt
-	insertGaugeStmt   *sql.Stmt
-	insertCounterStmt *sql.Stmt
+	db                 *sql.DB
+	getGaugeStmt       *sql.Stmt
+	getCounterStmt     *sql.Stmt
+	getAllGaugeStmt    *sql.Stmt
+	getAllCounterStmt  *sql.Stmt
+	insertGaugeStmt    *sql.Stmt
+	insertCounterStmt  *sql.Stmt
+	getGaugeHistStmt   *sql.Stmt
+	getCounterHistStmt *sql.Stmt
+	getHistogramStmt   *sql.Stmt
+	getAllHistStmt     *sql.Stmt
+	initHistStmt       *sql.Stmt
+	lockHistStmt       *sql.Stmt
+	updateHistStmt     *sql.Stmt
+	getHistHistStmt    *sql.Stmt
+	gaugeBatchStmt     *sql.Stmt
+	counterBatchStmt   *sql.Stmt
+	getRollupsStmt     *sql.Stmt
+	deleteSeriesStmt   *sql.Stmt
+	writeMetaStmt      *sql.Stmt
+	getMetaStmt        *sql.Stmt
+	scanMetricsStmt    *sql.Stmt
+	writeAlertsStmt    *sql.Stmt
+	getAlertsStmt      *sql.Stmt
 }
 
 // Prepare queries
@@ -64,6 +159,74 @@ func (p *PgDB) prepareStatements() error {
 		return err
 	}
 	p.insertCounterStmt, err = p.db.Prepare(insertCounterPrep)
+	if err != nil {
+		return err
+	}
+	p.getGaugeHistStmt, err = p.db.Prepare(getGaugeHistoryPrep)
+	if err != nil {
+		return err
+	}
+	p.getCounterHistStmt, err = p.db.Prepare(getCounterHistoryPrep)
+	if err != nil {
+		return err
+	}
+	p.getHistogramStmt, err = p.db.Prepare(getHistogramPrep)
+	if err != nil {
+		return err
+	}
+	p.getAllHistStmt, err = p.db.Prepare(getAllHistogramPrep)
+	if err != nil {
+		return err
+	}
+	p.initHistStmt, err = p.db.Prepare(initHistogramPrep)
+	if err != nil {
+		return err
+	}
+	p.lockHistStmt, err = p.db.Prepare(lockHistogramPrep)
+	if err != nil {
+		return err
+	}
+	p.updateHistStmt, err = p.db.Prepare(updateHistogramPrep)
+	if err != nil {
+		return err
+	}
+	p.getHistHistStmt, err = p.db.Prepare(getHistogramHistoryPrep)
+	if err != nil {
+		return err
+	}
+	p.gaugeBatchStmt, err = p.db.Prepare(insertGaugeBatchPrep)
+	if err != nil {
+		return err
+	}
+	p.counterBatchStmt, err = p.db.Prepare(insertCounterBatchPrep)
+	if err != nil {
+		return err
+	}
+	p.getRollupsStmt, err = p.db.Prepare(getRollupsPrep)
+	if err != nil {
+		return err
+	}
+	p.deleteSeriesStmt, err = p.db.Prepare(deleteSeriesPrep)
+	if err != nil {
+		return err
+	}
+	p.writeMetaStmt, err = p.db.Prepare(writeMetadataPrep)
+	if err != nil {
+		return err
+	}
+	p.getMetaStmt, err = p.db.Prepare(getMetadataPrep)
+	if err != nil {
+		return err
+	}
+	p.scanMetricsStmt, err = p.db.Prepare(scanMetricsPrep)
+	if err != nil {
+		return err
+	}
+	p.writeAlertsStmt, err = p.db.Prepare(writeAlertsPrep)
+	if err != nil {
+		return err
+	}
+	p.getAlertsStmt, err = p.db.Prepare(getAlertsPrep)
 	return err
 }
 
@@ -79,9 +242,9 @@ func NewPgDB(dsn string, edb *sql.DB) (*PgDB, error) {
 	return &PgDB{db: db}, nil
 }
 
-// PopulateDB method for create monitoring table.
+// PopulateDB method for apply schema migrations and prepare queries.
 func (p *PgDB) PopulateDB(ctx context.Context) error {
-	if _, err := p.db.ExecContext(ctx, populateQuery); err != nil {
+	if err := p.MigrateUp(ctx); err != nil {
 		return fmt.Errorf("populate failed: %s", err.Error())
 	}
 	if err := p.prepareStatements(); err != nil {
@@ -90,14 +253,35 @@ func (p *PgDB) PopulateDB(ctx context.Context) error {
 	return nil
 }
 
+// splitSeriesID split series id to metric name and canonical labels (db columns).
+func splitSeriesID(series string) (string, string, error) {
+	id, labels, err := models.ParseSeriesID(series)
+	if err != nil {
+		return "", "", err
+	}
+	if err := checkReservedLabels(labels); err != nil {
+		return "", "", err
+	}
+	return id, labels.String(), nil
+}
+
 // WriteMetric implementation WriteMetric method of storage interface (postgres DB storage).
 func (p *PgDB) WriteMetric(ctx context.Context, mtype, name string, val interface{}) error {
+	id, labels, err := splitSeriesID(name)
+	if err != nil {
+		return err
+	}
+	// label names are checked by parser
+	if !models.ValidName(id) {
+		return models.ErrWrongSeriesID
+	}
+	tenant := TenantFromContext(ctx)
 	// selecting metric type
 	switch mtype {
 	case metrictypes.GaugeType:
 		if metric, ok := val.(metrictypes.Gauge); ok {
 			//idempotency
-			if _, err := p.insertGaugeStmt.ExecContext(ctx, name, "gauge", metric); err != nil {
+			if _, err := p.insertGaugeStmt.ExecContext(ctx, id, labels, "gauge", metric, tenant); err != nil {
 				return fmt.Errorf("write gauge to db failed: %s", err.Error())
 			}
 			return nil
@@ -105,48 +289,102 @@ func (p *PgDB) WriteMetric(ctx context.Context, mtype, name string, val interfac
 		return customerrors.ErrWrongMetricValueType
 	case metrictypes.CounterType:
 		if metric, ok := val.(metrictypes.Counter); ok {
-			if _, err := p.insertCounterStmt.ExecContext(ctx, name, "counter", metric); err != nil {
+			if _, err := p.insertCounterStmt.ExecContext(ctx, id, labels, "counter", metric, tenant); err != nil {
 				return fmt.Errorf("write counter to db failed: %s", err.Error())
 			}
 			return nil
 		}
 		return customerrors.ErrWrongMetricValueType
+	case metrictypes.HistogramType:
+		if metric, ok := val.(metrictypes.Histogram); ok {
+			tx, err := p.db.BeginTx(ctx, nil)
+			if err != nil {
+				return fmt.Errorf("can't start tx to db: %s", err.Error())
+			}
+			defer tx.Rollback()
+			if err := p.writeHistogram(ctx, tx, tenant, id, labels, metric); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}
+		return customerrors.ErrWrongMetricValueType
 	default:
 		return customerrors.ErrWrongMetricType
 	}
 }
 
+// writeHistogram merge histogram with stored one inside transaction (row is locked till commit).
+func (p *PgDB) writeHistogram(ctx context.Context, tx *sql.Tx, tenant, id, labels string, h metrictypes.Histogram) error {
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	if _, err := tx.StmtContext(ctx, p.initHistStmt).ExecContext(ctx, id, labels, metrictypes.HistogramType, tenant); err != nil {
+		return fmt.Errorf("write histogram to db failed: %s", err.Error())
+	}
+	var stored []byte
+	if err := tx.StmtContext(ctx, p.lockHistStmt).QueryRowContext(ctx, id, labels, tenant).Scan(&stored); err != nil {
+		return fmt.Errorf("read histogram from db failed: %s", err.Error())
+	}
+	merged := h.Clone()
+	if stored != nil {
+		var sh models.Histogram
+		if err := json.Unmarshal(stored, &sh); err != nil {
+			return err
+		}
+		merged = metrictypes.Histogram(sh)
+		if err := merged.Merge(h); err != nil {
+			return err
+		}
+	}
+	mergedJSON, err := json.Marshal(models.Histogram(merged))
+	if err != nil {
+		return err
+	}
+	sampleJSON, err := json.Marshal(models.Histogram(h.Clone()))
+	if err != nil {
+		return err
+	}
+	if _, err := tx.StmtContext(ctx, p.updateHistStmt).ExecContext(ctx, id, labels, metrictypes.HistogramType, mergedJSON, sampleJSON, tenant); err != nil {
+		return fmt.Errorf("write histogram to db failed: %s", err.Error())
+	}
+	return nil
+}
+
 // WriteBatchMetrics implementation WriteBatchMetrics method of storage interface (postgres DB storage).
+// Gauges and counters are written by one statement per type, histograms are merged per series.
 func (p *PgDB) WriteBatchMetrics(ctx context.Context, metrics []models.Metrics) error {
+	// i think we don't break all batch if one metric failed in batch (skip it)
+	tenant := TenantFromContext(ctx)
+	batch := newPgBatch()
+	for _, v := range metrics {
+		batch.add(v)
+	}
+
 	tx, err := p.db.Begin()
 	if err != nil {
 		return fmt.Errorf("can't start tx to db: %s", err.Error())
 	}
 	defer tx.Rollback()
 
-	// i think we don't break all batch if one metric failed in batch (use continue)
-	for _, v := range metrics {
-		// selecting metric type
-		switch v.MType {
-		case metrictypes.GaugeType:
-			if v.Value == nil || v.ID == "" {
-				log.Println("empty id or nil value gauge metric")
-				continue
-			}
-			if _, err := tx.StmtContext(ctx, p.insertGaugeStmt).ExecContext(ctx, v.ID, v.MType, v.Value); err != nil {
-				return fmt.Errorf("write gauge to db failed: %s", err.Error())
-			}
-		case metrictypes.CounterType:
-			if v.Delta == nil || v.ID == "" {
-				log.Println("empty id or nil value counter metric")
+	if len(batch.gaugeIDs) > 0 {
+		if _, err := tx.StmtContext(ctx, p.gaugeBatchStmt).ExecContext(ctx, batch.gaugeIDs, batch.gaugeLabels, batch.gaugeValues, tenant); err != nil {
+			return fmt.Errorf("write gauge to db failed: %s", err.Error())
+		}
+	}
+	if len(batch.counters) > 0 {
+		ids, labels, deltas := batch.counterArgs()
+		if _, err := tx.StmtContext(ctx, p.counterBatchStmt).ExecContext(ctx, ids, labels, deltas, tenant); err != nil {
+			return fmt.Errorf("write counter to db failed: %s", err.Error())
+		}
+	}
+	for _, s := range batch.histogramSeries() {
+		if err := p.writeHistogram(ctx, tx, tenant, s.id, s.labels, batch.histograms[s]); err != nil {
+			// histogram is checked before any change, so the rest of batch can be written
+			if errors.Is(err, customerrors.ErrWrongHistogram) || errors.Is(err, customerrors.ErrHistogramBounds) {
+				log.Printf("histogram %s: %s", s.id, err.Error())
 				continue
 			}
-			if _, err := tx.StmtContext(ctx, p.insertCounterStmt).ExecContext(ctx, v.ID, v.MType, v.Delta); err != nil {
-				return fmt.Errorf("write counter to db failed: %s", err.Error())
-			}
-		default:
-			log.Println("wrong metric type")
-			continue
+			return err
 		}
 	}
 	return tx.Commit()
@@ -154,52 +392,148 @@ func (p *PgDB) WriteBatchMetrics(ctx context.Context, metrics []models.Metrics)
 
 // GetAllMetricsTxt implementation GetAllMetricsTxt method of storage interface (postgres DB storage).
 func (p *PgDB) GetAllMetricsTxt(ctx context.Context) (string, error) {
+	tenant := TenantFromContext(ctx)
 	s := "---Counters---\n"
-	var id string
+	var id, labels string
 	var delta int64
 	var value float64
 
-	rowsc, err := p.getAllCounterStmt.QueryContext(ctx)
+	rowsc, err := p.getAllCounterStmt.QueryContext(ctx, tenant)
 	if err != nil {
 		return "", err
 	}
 	defer rowsc.Close()
 	for rowsc.Next() {
-		if err := rowsc.Scan(&id, &delta); err != nil {
+		if err := rowsc.Scan(&id, &labels, &delta); err != nil {
 			return "", err
 		}
-		s += fmt.Sprintf("%v: %v\n", id, delta)
+		s += fmt.Sprintf("%v%v: %v\n", id, labels, delta)
 	}
 	if err := rowsc.Err(); err != nil {
 		return "", err
 	}
 	s += "---Gauge---\n"
-	rowsg, err := p.getAllGaugeStmt.QueryContext(ctx)
+	rowsg, err := p.getAllGaugeStmt.QueryContext(ctx, tenant)
 	if err != nil {
 		return "", err
 	}
 	defer rowsg.Close()
 	for rowsg.Next() {
-		if err := rowsg.Scan(&id, &value); err != nil {
+		if err := rowsg.Scan(&id, &labels, &value); err != nil {
 			return "", err
 		}
-		s += fmt.Sprintf("%v: %v\n", id, value)
+		s += fmt.Sprintf("%v%v: %v\n", id, labels, value)
 	}
 	if err := rowsg.Err(); err != nil {
 		return "", err
 	}
+	rowsh, err := p.getAllHistStmt.QueryContext(ctx, tenant)
+	if err != nil {
+		return "", err
+	}
+	defer rowsh.Close()
+	hs := ""
+	for rowsh.Next() {
+		var hj []byte
+		if err := rowsh.Scan(&id, &labels, &hj); err != nil {
+			return "", err
+		}
+		h, err := unmarshalHistogram(hj)
+		if err != nil {
+			return "", err
+		}
+		hs += fmt.Sprintf("%v%v: %v\n", id, labels, h)
+	}
+	if err := rowsh.Err(); err != nil {
+		return "", err
+	}
+	if hs != "" {
+		s += "---Histogram---\n" + hs
+	}
 
 	return s, nil
 }
 
+// ScanMetrics implementation ScanMetrics method of storage interface (postgres DB storage).
+// Rows are streamed from cursor, so all metrics aren't loaded to memory.
+func (p *PgDB) ScanMetrics(ctx context.Context, fn func(m models.Metrics) error) error {
+	rows, err := p.scanMetricsStmt.QueryContext(ctx, TenantFromContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			mtype, id, labels string
+			delta             sql.NullInt64
+			value             sql.NullFloat64
+			hj                []byte
+		)
+		if err := rows.Scan(&mtype, &id, &labels, &delta, &value, &hj); err != nil {
+			return err
+		}
+		_, l, err := models.ParseSeriesID(id + labels)
+		if err != nil {
+			return err
+		}
+		m := models.Metrics{MType: mtype, ID: id, Labels: l}
+		// selecting metric type
+		switch mtype {
+		case metrictypes.GaugeType:
+			if !value.Valid {
+				continue
+			}
+			m.Value = &value.Float64
+		case metrictypes.CounterType:
+			if !delta.Valid {
+				continue
+			}
+			m.Delta = &delta.Int64
+		case metrictypes.HistogramType:
+			// row of histogram is created before first merge
+			h, err := unmarshalHistogram(hj)
+			if errors.Is(err, customerrors.ErrNoVal) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			mh := models.Histogram(h)
+			m.Histogram = &mh
+		default:
+			continue
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// unmarshalHistogram decode histogram stored as json.
+func unmarshalHistogram(b []byte) (metrictypes.Histogram, error) {
+	var h models.Histogram
+	if b == nil {
+		return metrictypes.Histogram{}, customerrors.ErrNoVal
+	}
+	if err := json.Unmarshal(b, &h); err != nil {
+		return metrictypes.Histogram{}, err
+	}
+	return metrictypes.Histogram(h), nil
+}
+
 // GetMetric implementation GetMetric method of storage interface (postgres DB storage).
 func (p *PgDB) GetMetric(ctx context.Context, mType, name string) (interface{}, error) {
 	var value float64
 	var delta int64
+	id, labels, err := splitSeriesID(name)
+	if err != nil {
+		return nil, err
+	}
 	// selecting metric type
 	switch mType {
 	case metrictypes.GaugeType:
-		row := p.getGaugeStmt.QueryRowContext(ctx, name)
+		row := p.getGaugeStmt.QueryRowContext(ctx, id, labels, TenantFromContext(ctx))
 		if err := row.Scan(&value); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				return nil, customerrors.ErrNoVal
@@ -208,7 +542,7 @@ func (p *PgDB) GetMetric(ctx context.Context, mType, name string) (interface{},
 		}
 		return metrictypes.Gauge(value), nil
 	case metrictypes.CounterType:
-		row := p.getCounterStmt.QueryRowContext(ctx, name)
+		row := p.getCounterStmt.QueryRowContext(ctx, id, labels, TenantFromContext(ctx))
 		if err := row.Scan(&delta); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				return nil, customerrors.ErrNoVal
@@ -216,9 +550,280 @@ func (p *PgDB) GetMetric(ctx context.Context, mType, name string) (interface{},
 			return nil, err
 		}
 		return metrictypes.Counter(delta), nil
+	case metrictypes.HistogramType:
+		var hj []byte
+		row := p.getHistogramStmt.QueryRowContext(ctx, id, labels, TenantFromContext(ctx))
+		if err := row.Scan(&hj); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, customerrors.ErrNoVal
+			}
+			return nil, err
+		}
+		h, err := unmarshalHistogram(hj)
+		if err != nil {
+			return nil, err
+		}
+		return h, nil
+	default:
+		return nil, customerrors.ErrBadMetricType
+	}
+}
+
+// GetMetricHistory implementation GetMetricHistory method of storage interface (postgres DB storage).
+func (p *PgDB) GetMetricHistory(ctx context.Context, mType, name string, from, to time.Time) ([]models.Sample, error) {
+	var stmt *sql.Stmt
+	id, labels, err := splitSeriesID(name)
+	if err != nil {
+		return nil, err
+	}
+	// selecting metric type
+	switch mType {
+	case metrictypes.GaugeType:
+		stmt = p.getGaugeHistStmt
+	case metrictypes.CounterType:
+		stmt = p.getCounterHistStmt
+	case metrictypes.HistogramType:
+		stmt = p.getHistHistStmt
 	default:
 		return nil, customerrors.ErrBadMetricType
 	}
+
+	rows, err := stmt.QueryContext(ctx, id, labels, from, to, TenantFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []models.Sample{}
+	for rows.Next() {
+		var (
+			ts    time.Time
+			delta sql.NullInt64
+			value sql.NullFloat64
+		)
+		sample := models.Sample{}
+		switch mType {
+		case metrictypes.GaugeType:
+			if err := rows.Scan(&ts, &value); err != nil {
+				return nil, err
+			}
+			sample.Value = &value.Float64
+		case metrictypes.HistogramType:
+			var hj []byte
+			if err := rows.Scan(&ts, &hj); err != nil {
+				return nil, err
+			}
+			h, err := unmarshalHistogram(hj)
+			if err != nil {
+				return nil, err
+			}
+			hm := models.Histogram(h)
+			sample.Histogram = &hm
+		default:
+			if err := rows.Scan(&ts, &delta); err != nil {
+				return nil, err
+			}
+			sample.Delta = &delta.Int64
+		}
+		sample.Timestamp = ts
+		res = append(res, sample)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetMetricRollups implementation GetMetricRollups method of storage interface (postgres DB storage).
+func (p *PgDB) GetMetricRollups(ctx context.Context, mType, name string, resolution time.Duration, from, to time.Time) ([]models.Sample, error) {
+	id, labels, err := splitSeriesID(name)
+	if err != nil {
+		return nil, err
+	}
+	// selecting metric type
+	switch mType {
+	case metrictypes.GaugeType, metrictypes.CounterType, metrictypes.HistogramType:
+	default:
+		return nil, customerrors.ErrBadMetricType
+	}
+
+	rows, err := p.getRollupsStmt.QueryContext(ctx, id, labels, mType, int64(resolution/time.Second), from, to, TenantFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []models.Sample{}
+	for rows.Next() {
+		var (
+			delta                   sql.NullInt64
+			value, minV, maxV, last sql.NullFloat64
+		)
+		sample := models.Sample{}
+		if err := rows.Scan(&sample.Timestamp, &delta, &value, &minV, &maxV, &last, &sample.Count); err != nil {
+			return nil, err
+		}
+		if mType == metrictypes.CounterType {
+			sample.Delta = &delta.Int64
+		} else {
+			sample.Value, sample.Min, sample.Max, sample.Last = &value.Float64, &minV.Float64, &maxV.Float64, &last.Float64
+		}
+		res = append(res, sample)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Compact implementation Compact method of storage interface (postgres DB storage).
+func (p *PgDB) Compact(ctx context.Context, policy RetentionPolicy, now time.Time) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("can't start tx to db: %s", err.Error())
+	}
+	defer tx.Rollback()
+
+	resolutions := make([]int64, 0, len(policy))
+	for i := 1; i < len(policy); i++ {
+		res := int64(policy[i].Resolution / time.Second)
+		resolutions = append(resolutions, res)
+		// only closed buckets are built, marks of built buckets are kept per series
+		end := bucketStart(now, rollupOrigin, policy[i].Resolution)
+		if i == 1 {
+			_, err = tx.ExecContext(ctx, rollupHistoryQuery, res, end)
+		} else {
+			_, err = tx.ExecContext(ctx, rollupRollupsQuery, res, end, int64(policy[i-1].Resolution/time.Second))
+		}
+		if err != nil {
+			return fmt.Errorf("rollup %s failed: %s", policy[i].Resolution, err.Error())
+		}
+	}
+
+	if len(policy) > 0 {
+		if _, err := tx.ExecContext(ctx, expireHistoryQuery, now.Add(-policy[0].Keep)); err != nil {
+			return fmt.Errorf("expire history failed: %s", err.Error())
+		}
+	}
+	for i := 1; i < len(policy); i++ {
+		if _, err := tx.ExecContext(ctx, expireRollupsQuery, resolutions[i-1], now.Add(-policy[i].Keep)); err != nil {
+			return fmt.Errorf("expire rollups failed: %s", err.Error())
+		}
+	}
+	// resolutions removed from policy
+	if _, err := tx.ExecContext(ctx, expireOtherRollupsQuery, resolutions); err != nil {
+		return fmt.Errorf("expire rollups failed: %s", err.Error())
+	}
+	return tx.Commit()
+}
+
+// Escaper of LIKE special chars (backslash is default escape char).
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// seriesLikePattern convert series id or pattern to LIKE pattern of series id (id || labels).
+func seriesLikePattern(name string) (string, error) {
+	if !isSeriesPattern(name) {
+		id, labels, err := splitSeriesID(name)
+		if err != nil {
+			return "", err
+		}
+		return likeEscaper.Replace(id + labels), nil
+	}
+	return strings.NewReplacer("*", "%", "?", "_").Replace(likeEscaper.Replace(name)), nil
+}
+
+// Delete implementation Delete method of storage interface (postgres DB storage).
+func (p *PgDB) Delete(ctx context.Context, mType, name string) (int, error) {
+	if err := checkMetricType(mType); err != nil {
+		return 0, err
+	}
+	pattern, err := seriesLikePattern(name)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	if err := p.deleteSeriesStmt.QueryRowContext(ctx, mType, pattern, TenantFromContext(ctx)).Scan(&n); err != nil {
+		return 0, fmt.Errorf("delete from db failed: %s", err.Error())
+	}
+	if n == 0 {
+		return 0, customerrors.ErrNoVal
+	}
+	return n, nil
+}
+
+// WriteMetadata implementation WriteMetadata method of storage interface (postgres DB storage).
+func (p *PgDB) WriteMetadata(ctx context.Context, meta []models.Metadata) error {
+	if err := validateMetadata(meta); err != nil {
+		return err
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+	// the last metadata of name wins
+	byName := make(map[string]models.Metadata, len(meta))
+	for _, v := range meta {
+		byName[v.ID] = v
+	}
+	var ids, mtypes, units, descriptions []string
+	for _, v := range sortedMetadata(byName) {
+		ids = append(ids, v.ID)
+		mtypes = append(mtypes, v.MType)
+		units = append(units, v.Unit)
+		descriptions = append(descriptions, v.Description)
+	}
+	if _, err := p.writeMetaStmt.ExecContext(ctx, ids, mtypes, units, descriptions, TenantFromContext(ctx)); err != nil {
+		return fmt.Errorf("write metadata to db failed: %s", err.Error())
+	}
+	return nil
+}
+
+// GetMetadata implementation GetMetadata method of storage interface (postgres DB storage).
+func (p *PgDB) GetMetadata(ctx context.Context) ([]models.Metadata, error) {
+	rows, err := p.getMetaStmt.QueryContext(ctx, TenantFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	meta := []models.Metadata{}
+	for rows.Next() {
+		var v models.Metadata
+		if err := rows.Scan(&v.ID, &v.MType, &v.Unit, &v.Description); err != nil {
+			return nil, err
+		}
+		meta = append(meta, v)
+	}
+	return meta, rows.Err()
+}
+
+// WriteAlerts implementation WriteAlerts method of storage interface (postgres DB storage).
+func (p *PgDB) WriteAlerts(ctx context.Context, alerts []models.Alert) error {
+	if alerts == nil {
+		alerts = []models.Alert{}
+	}
+	b, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	if _, err := p.writeAlertsStmt.ExecContext(ctx, TenantFromContext(ctx), b); err != nil {
+		return fmt.Errorf("write alerts to db failed: %s", err.Error())
+	}
+	return nil
+}
+
+// GetAlerts implementation GetAlerts method of storage interface (postgres DB storage).
+func (p *PgDB) GetAlerts(ctx context.Context) ([]models.Alert, error) {
+	var b []byte
+	if err := p.getAlertsStmt.QueryRowContext(ctx, TenantFromContext(ctx)).Scan(&b); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return []models.Alert{}, nil
+		}
+		return nil, err
+	}
+	alerts := []models.Alert{}
+	if err := json.Unmarshal(b, &alerts); err != nil {
+		return nil, err
+	}
+	return alerts, nil
 }
 
 // Ping implementation Ping method of storage interface (postgres DB storage).
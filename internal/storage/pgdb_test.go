@@ -3,9 +3,14 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/sourcecd/monitoring/internal/customerrors"
 	"github.com/sourcecd/monitoring/internal/metrictypes"
 	"github.com/sourcecd/monitoring/internal/models"
 	"github.com/stretchr/testify/require"
@@ -18,22 +23,63 @@ var (
 	pgdb *PgDB
 )
 
+// arrayValueConverter pass slices (postgres arrays of batch statements) to sqlmock as is.
+type arrayValueConverter struct{}
+
+func (arrayValueConverter) ConvertValue(v any) (driver.Value, error) {
+	switch v.(type) {
+	case []string, []float64, []int64:
+		return v, nil
+	}
+	return driver.DefaultParameterConverter.ConvertValue(v)
+}
+
 func TestCreatePGDB(t *testing.T) {
 	ctx := context.Background()
-	db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	db, mock, err = sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual), sqlmock.ValueConverterOption(arrayValueConverter{}))
 	require.NoError(t, err)
 	//t.Cleanup(func() {db.Close()})
 
 	pgdb, err = NewPgDB("", db)
 	require.NoError(t, err)
 
-	mock.ExpectExec(populateQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+	migrations, err := loadMigrations(migrationFiles)
+	require.NoError(t, err)
+
+	// first migration is already applied
+	mock.ExpectExec(lockMigrationsQuery).WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(populateSchemaVersionQuery).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(getSchemaVersionsQuery).WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()))
+	for _, m := range migrations[1:] {
+		mock.ExpectBegin()
+		mock.ExpectExec(m.Up).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(insertSchemaVersionQuery).WithArgs(m.Version, m.Name).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+	}
+	mock.ExpectExec(unlockMigrationsQuery).WithArgs(migrationLockID).WillReturnResult(sqlmock.NewResult(0, 0))
 	mock.ExpectPrepare(getGaugePrep)
 	mock.ExpectPrepare(getCounterPrep)
 	mock.ExpectPrepare(getAllGaugePrep)
 	mock.ExpectPrepare(getAllCounterPrep)
 	mock.ExpectPrepare(insertGaugePrep)
 	mock.ExpectPrepare(insertCounterPrep)
+	mock.ExpectPrepare(getGaugeHistoryPrep)
+	mock.ExpectPrepare(getCounterHistoryPrep)
+	mock.ExpectPrepare(getHistogramPrep)
+	mock.ExpectPrepare(getAllHistogramPrep)
+	mock.ExpectPrepare(initHistogramPrep)
+	mock.ExpectPrepare(lockHistogramPrep)
+	mock.ExpectPrepare(updateHistogramPrep)
+	mock.ExpectPrepare(getHistogramHistoryPrep)
+	mock.ExpectPrepare(insertGaugeBatchPrep)
+	mock.ExpectPrepare(insertCounterBatchPrep)
+	mock.ExpectPrepare(getRollupsPrep)
+	mock.ExpectPrepare(deleteSeriesPrep)
+	mock.ExpectPrepare(writeMetadataPrep)
+	mock.ExpectPrepare(getMetadataPrep)
+	mock.ExpectPrepare(scanMetricsPrep)
+	mock.ExpectPrepare(writeAlertsPrep)
+	mock.ExpectPrepare(getAlertsPrep)
 
 	err = pgdb.PopulateDB(ctx)
 	require.NoError(t, err)
@@ -44,13 +90,20 @@ func TestCreatePGDB(t *testing.T) {
 func TestWriteMetricPG(t *testing.T) {
 	ctx := context.Background()
 
-	mock.ExpectExec(insertGaugePrep).WithArgs("testGauge", "gauge", 0.1).WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectExec(insertCounterPrep).WithArgs("testCounter", "counter", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(insertGaugePrep).WithArgs("testGauge", "", "gauge", 0.1, "").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(insertCounterPrep).WithArgs("testCounter", "", "counter", 1, "").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(insertGaugePrep).WithArgs("testGauge", `{host="h1"}`, "gauge", 0.2, "").WillReturnResult(sqlmock.NewResult(1, 1))
 
 	err = pgdb.WriteMetric(ctx, "gauge", "testGauge", metrictypes.Gauge(0.1))
 	require.NoError(t, err)
 	err = pgdb.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(1))
 	require.NoError(t, err)
+	err = pgdb.WriteMetric(ctx, "gauge", `testGauge{host="h1"}`, metrictypes.Gauge(0.2))
+	require.NoError(t, err)
+	err = pgdb.WriteMetric(ctx, "gauge", `testGauge{host=h1}`, metrictypes.Gauge(0.2))
+	require.ErrorIs(t, err, models.ErrWrongSeriesID)
+	err = pgdb.WriteMetric(ctx, "gauge", `test=Gauge{host="h1"}`, metrictypes.Gauge(0.2))
+	require.ErrorIs(t, err, models.ErrWrongSeriesID)
 
 	err = pgdb.WriteMetric(ctx, "gauge", "testGauge2", metrictypes.Gauge(0.1))
 	require.Error(t, err)
@@ -67,28 +120,103 @@ func TestWriteMetricPG(t *testing.T) {
 
 func TestWriteBatchMetricsPG(t *testing.T) {
 	ctx := context.Background()
-	d := int64(1)
-	v := float64(0.1)
+	d1, d2 := int64(1), int64(2)
+	v1, v2 := float64(0.1), float64(0.2)
+	h := metrictypes.NewHistogram([]float64{1})
+	h.Observe(0.5)
+	hm := models.Histogram(h)
 	m := []models.Metrics{
-		{
-			Delta: &d,
-			ID:    "testCounter1",
-			MType: "counter",
-		},
-		{
-			Value: &v,
-			ID:    "testGauge1",
-			MType: "gauge",
-		},
+		{Delta: &d1, ID: "testCounter1", MType: "counter"},
+		{Value: &v1, ID: "testGauge1", MType: "gauge", Labels: models.Labels{"cpu": "1"}},
+		{Delta: &d2, ID: "testCounter0", MType: "counter"},
+		{Delta: &d2, ID: "testCounter1", MType: "counter"},
+		{Value: &v2, ID: "testGauge1", MType: "gauge", Labels: models.Labels{"cpu": "1"}},
+		{Histogram: &hm, ID: "testHist1", MType: "histogram"},
+		{Histogram: &hm, ID: "testHist1", MType: "histogram"},
+		{ID: "testGauge2", MType: "gauge"},
+		{Value: &v1, MType: "gauge"},
 	}
 
+	// gauges are sent as is, counters are summed and sorted, histograms are merged
 	mock.ExpectBegin()
-	mock.ExpectExec(insertCounterPrep).WithArgs("testCounter1", "counter", 1).WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectExec(insertGaugePrep).WithArgs("testGauge1", "gauge", 0.1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(insertGaugeBatchPrep).WithArgs([]string{"testGauge1", "testGauge1"}, []string{`{cpu="1"}`, `{cpu="1"}`}, []float64{0.1, 0.2}, "").
+		WillReturnResult(sqlmock.NewResult(2, 2))
+	mock.ExpectExec(insertCounterBatchPrep).WithArgs([]string{"testCounter0", "testCounter1"}, []string{"", ""}, []int64{2, 3}, "").
+		WillReturnResult(sqlmock.NewResult(2, 2))
+	mock.ExpectExec(initHistogramPrep).WithArgs("testHist1", "", "histogram", "").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(lockHistogramPrep).WithArgs("testHist1", "", "").WillReturnRows(sqlmock.NewRows([]string{"histogram"}).AddRow(nil))
+	mock.ExpectExec(updateHistogramPrep).WithArgs("testHist1", "", "histogram",
+		[]byte(`{"bounds":[1],"counts":[2,0],"sum":1,"count":2}`),
+		[]byte(`{"bounds":[1],"counts":[2,0],"sum":1,"count":2}`), "").WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
 	err = pgdb.WriteBatchMetrics(ctx, m)
 	require.NoError(t, err)
+
+	// wrong histogram is skipped as in in-memory storage
+	mock.ExpectBegin()
+	mock.ExpectExec(insertGaugeBatchPrep).WithArgs([]string{"testGauge1"}, []string{""}, []float64{0.1}, "").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	err = pgdb.WriteBatchMetrics(ctx, []models.Metrics{
+		{ID: "testHist1", MType: "histogram", Histogram: &models.Histogram{Bounds: []float64{1}}},
+		{ID: "testGauge1", MType: "gauge", Value: &v1},
+	})
+	require.NoError(t, err)
+
+	// failed statement breaks batch
+	mock.ExpectBegin()
+	mock.ExpectExec(insertCounterBatchPrep).WithArgs([]string{"testCounter1"}, []string{""}, []int64{1}, "").WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+
+	err = pgdb.WriteBatchMetrics(ctx, []models.Metrics{{ID: "testCounter1", MType: "counter", Delta: &d1}})
+	require.Error(t, err)
+}
+
+func TestWriteHistogramPG(t *testing.T) {
+	ctx := context.Background()
+	h := metrictypes.NewHistogram([]float64{1, 2})
+	h.Observe(1.5)
+
+	// first write of series, nothing stored yet
+	mock.ExpectBegin()
+	mock.ExpectExec(initHistogramPrep).WithArgs("testHist", "", "histogram", "").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(lockHistogramPrep).WithArgs("testHist", "", "").WillReturnRows(sqlmock.NewRows([]string{"histogram"}).AddRow(nil))
+	mock.ExpectExec(updateHistogramPrep).WithArgs("testHist", "", "histogram",
+		[]byte(`{"bounds":[1,2],"counts":[0,1,0],"sum":1.5,"count":1}`),
+		[]byte(`{"bounds":[1,2],"counts":[0,1,0],"sum":1.5,"count":1}`), "").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	require.NoError(t, pgdb.WriteMetric(ctx, "histogram", "testHist", h))
+
+	// buckets are summed with stored histogram
+	mock.ExpectBegin()
+	mock.ExpectExec(initHistogramPrep).WithArgs("testHist", "", "histogram", "").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(lockHistogramPrep).WithArgs("testHist", "", "").
+		WillReturnRows(sqlmock.NewRows([]string{"histogram"}).AddRow([]byte(`{"bounds":[1,2],"counts":[0,1,0],"sum":1.5,"count":1}`)))
+	mock.ExpectExec(updateHistogramPrep).WithArgs("testHist", "", "histogram",
+		[]byte(`{"bounds":[1,2],"counts":[0,2,0],"sum":3,"count":2}`),
+		[]byte(`{"bounds":[1,2],"counts":[0,1,0],"sum":1.5,"count":1}`), "").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	require.NoError(t, pgdb.WriteMetric(ctx, "histogram", "testHist", h))
+
+	// different buckets can't be merged
+	mock.ExpectBegin()
+	mock.ExpectExec(initHistogramPrep).WithArgs("testHist", "", "histogram", "").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(lockHistogramPrep).WithArgs("testHist", "", "").
+		WillReturnRows(sqlmock.NewRows([]string{"histogram"}).AddRow([]byte(`{"bounds":[1,3],"counts":[0,1,0],"sum":1.5,"count":1}`)))
+	mock.ExpectRollback()
+	require.ErrorIs(t, pgdb.WriteMetric(ctx, "histogram", "testHist", h), customerrors.ErrHistogramBounds)
+
+	// invalid histogram is rejected before db request
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	require.ErrorIs(t, pgdb.WriteMetric(ctx, "histogram", "testHist", metrictypes.Histogram{Bounds: []float64{1}}), customerrors.ErrWrongHistogram)
+
+	mock.ExpectQuery(getHistogramPrep).WithArgs("testHist", "", "").
+		WillReturnRows(sqlmock.NewRows([]string{"histogram"}).AddRow([]byte(`{"bounds":[1,2],"counts":[0,2,0],"sum":3,"count":2}`)))
+	i, err := pgdb.GetMetric(ctx, "histogram", "testHist")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), i.(metrictypes.Histogram).Count)
 }
 
 func TestGetAllMetricsTxt(t *testing.T) {
@@ -98,10 +226,16 @@ func TestGetAllMetricsTxt(t *testing.T) {
 testCounter2: 1
 ---Gauge---
 testGauge2: 0.1
+testGauge2{cpu="0"}: 0.2
+---Histogram---
+testHist2: count=1 sum=0.5 p50=0.5 p90=0.9 p99=0.99
 `
 
-	mock.ExpectQuery(getAllCounterPrep).WillReturnRows(sqlmock.NewRows([]string{"id", "delta"}).AddRow("testCounter2", 1))
-	mock.ExpectQuery(getAllGaugePrep).WillReturnRows(sqlmock.NewRows([]string{"id", "value"}).AddRow("testGauge2", 0.1))
+	mock.ExpectQuery(getAllCounterPrep).WithArgs("").WillReturnRows(sqlmock.NewRows([]string{"id", "labels", "delta"}).AddRow("testCounter2", "", 1))
+	mock.ExpectQuery(getAllGaugePrep).WithArgs("").WillReturnRows(sqlmock.NewRows([]string{"id", "labels", "value"}).
+		AddRow("testGauge2", "", 0.1).AddRow("testGauge2", `{cpu="0"}`, 0.2))
+	mock.ExpectQuery(getAllHistogramPrep).WithArgs("").WillReturnRows(sqlmock.NewRows([]string{"id", "labels", "histogram"}).
+		AddRow("testHist2", "", []byte(`{"bounds":[1],"counts":[1,0],"sum":0.5,"count":1}`)))
 
 	st, err := pgdb.GetAllMetricsTxt(ctx)
 	require.NoError(t, err)
@@ -111,18 +245,216 @@ testGauge2: 0.1
 func TestGetMetric(t *testing.T) {
 	ctx := context.Background()
 
-	mock.ExpectQuery(getGaugePrep).WithArgs("testGauge3").WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow(0.1))
-	mock.ExpectQuery(getCounterPrep).WithArgs("testCounter3").WillReturnRows(sqlmock.NewRows([]string{"delta"}).AddRow(1))
+	mock.ExpectQuery(getGaugePrep).WithArgs("testGauge3", "", "").WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow(0.1))
+	mock.ExpectQuery(getCounterPrep).WithArgs("testCounter3", `{cpu="0"}`, "").WillReturnRows(sqlmock.NewRows([]string{"delta"}).AddRow(1))
 
 	i, err := pgdb.GetMetric(ctx, "gauge", "testGauge3")
 	require.NoError(t, err)
 	require.Equal(t, metrictypes.Gauge(0.1), i.(metrictypes.Gauge))
-	i, err = pgdb.GetMetric(ctx, "counter", "testCounter3")
+	i, err = pgdb.GetMetric(ctx, "counter", `testCounter3{cpu="0"}`)
 	require.NoError(t, err)
 	require.Equal(t, metrictypes.Counter(1), i.(metrictypes.Counter))
 
 	_, err = pgdb.GetMetric(ctx, "counter", "testCounter3")
 	require.Error(t, err)
+
+	// gauge name isn't visible as counter
+	mock.ExpectQuery(getCounterPrep).WithArgs("testGauge3", "", "").WillReturnRows(sqlmock.NewRows([]string{"delta"}))
+	_, err = pgdb.GetMetric(ctx, "counter", "testGauge3")
+	require.ErrorIs(t, err, customerrors.ErrNoVal)
+
+	// tenant of context is passed as tenant column, reserved label is rejected
+	tctx := WithTenant(ctx, "teamA")
+	mock.ExpectQuery(getGaugePrep).WithArgs("testGauge3", "", "teamA").WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow(0.2))
+	i, err = pgdb.GetMetric(tctx, "gauge", "testGauge3")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(0.2), i.(metrictypes.Gauge))
+	_, err = pgdb.GetMetric(tctx, "gauge", `testGauge3{__tenant__="teamB"}`)
+	require.ErrorIs(t, err, models.ErrWrongSeriesID)
+}
+
+func TestGetMetricHistoryPG(t *testing.T) {
+	ctx := context.Background()
+	from := time.Unix(100, 0)
+	to := time.Unix(200, 0)
+
+	mock.ExpectQuery(getGaugeHistoryPrep).WithArgs("testGauge4", "", from, to, "").
+		WillReturnRows(sqlmock.NewRows([]string{"ts", "value"}).AddRow(time.Unix(110, 0), 0.1).AddRow(time.Unix(120, 0), 0.2))
+	mock.ExpectQuery(getCounterHistoryPrep).WithArgs("testCounter4", "", from, to, "").
+		WillReturnRows(sqlmock.NewRows([]string{"ts", "delta"}).AddRow(time.Unix(110, 0), 1))
+
+	h, err := pgdb.GetMetricHistory(ctx, "gauge", "testGauge4", from, to)
+	require.NoError(t, err)
+	require.Len(t, h, 2)
+	require.Equal(t, time.Unix(110, 0), h[0].Timestamp)
+	require.Equal(t, 0.2, *h[1].Value)
+	h, err = pgdb.GetMetricHistory(ctx, "counter", "testCounter4", from, to)
+	require.NoError(t, err)
+	require.Len(t, h, 1)
+	require.Equal(t, int64(1), *h[0].Delta)
+
+	_, err = pgdb.GetMetricHistory(ctx, "wrong", "testCounter4", from, to)
+	require.ErrorIs(t, err, customerrors.ErrBadMetricType)
+}
+
+func TestGetMetricRollupsPG(t *testing.T) {
+	ctx := context.Background()
+	from := time.Unix(0, 0)
+	to := time.Unix(600, 0)
+
+	cols := []string{"ts", "delta", "value", "min", "max", "last", "count"}
+	mock.ExpectQuery(getRollupsPrep).WithArgs("testGauge5", "", "gauge", int64(60), from, to, "").
+		WillReturnRows(sqlmock.NewRows(cols).AddRow(time.Unix(60, 0), nil, 0.5, 0.1, 0.9, 0.3, 6))
+	mock.ExpectQuery(getRollupsPrep).WithArgs("testCounter5", "", "counter", int64(60), from, to, "").
+		WillReturnRows(sqlmock.NewRows(cols).AddRow(time.Unix(60, 0), 7, nil, nil, nil, nil, 3))
+
+	h, err := pgdb.GetMetricRollups(ctx, "gauge", "testGauge5", time.Minute, from, to)
+	require.NoError(t, err)
+	require.Len(t, h, 1)
+	require.Equal(t, 0.5, *h[0].Value)
+	require.Equal(t, 0.1, *h[0].Min)
+	require.Equal(t, 0.9, *h[0].Max)
+	require.Equal(t, 0.3, *h[0].Last)
+	require.Equal(t, uint64(6), h[0].Count)
+	h, err = pgdb.GetMetricRollups(ctx, "counter", "testCounter5", time.Minute, from, to)
+	require.NoError(t, err)
+	require.Len(t, h, 1)
+	require.Equal(t, int64(7), *h[0].Delta)
+	require.Nil(t, h[0].Value)
+
+	_, err = pgdb.GetMetricRollups(ctx, "wrong", "testCounter5", time.Minute, from, to)
+	require.ErrorIs(t, err, customerrors.ErrBadMetricType)
+}
+
+func TestCompactPG(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(7200+90, 0)
+	policy, err := ParseRetention("raw:1h,1m:2h,1h:24h")
+	require.NoError(t, err)
+
+	mock.ExpectBegin()
+	// 1m rollups are built from history till last closed bucket (after last bucket of each series)
+	mock.ExpectExec(rollupHistoryQuery).WithArgs(int64(60), time.Unix(7260, 0)).WillReturnResult(sqlmock.NewResult(0, 2))
+	// 1h rollups are built from 1m rollups
+	mock.ExpectExec(rollupRollupsQuery).WithArgs(int64(3600), time.Unix(7200, 0), int64(60)).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(expireHistoryQuery).WithArgs(now.Add(-time.Hour)).WillReturnResult(sqlmock.NewResult(0, 10))
+	mock.ExpectExec(expireRollupsQuery).WithArgs(int64(60), now.Add(-2*time.Hour)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(expireRollupsQuery).WithArgs(int64(3600), now.Add(-24*time.Hour)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(expireOtherRollupsQuery).WithArgs([]int64{60, 3600}).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	require.NoError(t, pgdb.Compact(ctx, policy, now))
+
+	// failed rollup rollbacks compaction
+	mock.ExpectBegin()
+	mock.ExpectExec(rollupHistoryQuery).WithArgs(int64(60), time.Unix(7260, 0)).WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+	require.ErrorContains(t, pgdb.Compact(ctx, policy, now), "rollup 1m0s failed")
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeletePG(t *testing.T) {
+	ctx := context.Background()
+
+	// single series id is escaped and canonicalized
+	mock.ExpectQuery(deleteSeriesPrep).WithArgs("gauge", `test\_gauge{a="1",b="2"}`, "").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	n, err := pgdb.Delete(ctx, "gauge", `test_gauge{b="2",a="1"}`)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	mock.ExpectQuery(deleteSeriesPrep).WithArgs("gauge", "CPUutilization%", "").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(4))
+	n, err = pgdb.Delete(ctx, "gauge", "CPUutilization*")
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+
+	mock.ExpectQuery(deleteSeriesPrep).WithArgs("counter", "test_", "").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	_, err = pgdb.Delete(ctx, "counter", "test?")
+	require.ErrorIs(t, err, customerrors.ErrNoVal)
+
+	_, err = pgdb.Delete(ctx, "wrong", "test")
+	require.ErrorIs(t, err, customerrors.ErrBadMetricType)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMetadataPG(t *testing.T) {
+	ctx := context.Background()
+
+	// batch is deduplicated and sorted by name
+	mock.ExpectExec(writeMetadataPrep).WithArgs(
+		[]string{"CPUutilization", "TotalMemory"}, []string{"gauge", "gauge"}, []string{"percent", "kilobytes"}, []string{"", ""}, "",
+	).WillReturnResult(sqlmock.NewResult(0, 2))
+	require.NoError(t, pgdb.WriteMetadata(ctx, []models.Metadata{
+		{ID: "TotalMemory", MType: "gauge", Unit: "bytes"},
+		{ID: "CPUutilization", MType: "gauge", Unit: "percent"},
+		{ID: "TotalMemory", MType: "gauge", Unit: "kilobytes"},
+	}))
+	require.ErrorIs(t, pgdb.WriteMetadata(ctx, []models.Metadata{{ID: "TotalMemory", MType: "wrong"}}), customerrors.ErrWrongMetadata)
+
+	mock.ExpectQuery(getMetadataPrep).WithArgs("").WillReturnRows(sqlmock.NewRows([]string{"id", "mtype", "unit", "description"}).
+		AddRow("CPUutilization", "gauge", "percent", "").AddRow("TotalMemory", "gauge", "bytes", "Total amount of RAM"))
+	meta, err := pgdb.GetMetadata(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []models.Metadata{
+		{ID: "CPUutilization", MType: "gauge", Unit: "percent"},
+		{ID: "TotalMemory", MType: "gauge", Unit: "bytes", Description: "Total amount of RAM"},
+	}, meta)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAlertsPG(t *testing.T) {
+	ctx := context.Background()
+	teamA := WithTenant(ctx, "teamA")
+	alerts := testAlerts()
+	b, err := json.Marshal(alerts)
+	require.NoError(t, err)
+
+	mock.ExpectExec(writeAlertsPrep).WithArgs("", b).WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, pgdb.WriteAlerts(ctx, alerts))
+	mock.ExpectExec(writeAlertsPrep).WithArgs("teamA", []byte("[]")).WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, pgdb.WriteAlerts(teamA, nil))
+	mock.ExpectExec(writeAlertsPrep).WithArgs("", b).WillReturnError(errors.New("connection refused"))
+	require.Error(t, pgdb.WriteAlerts(ctx, alerts))
+
+	mock.ExpectQuery(getAlertsPrep).WithArgs("").WillReturnRows(sqlmock.NewRows([]string{"alerts"}).AddRow(b))
+	got, err := pgdb.GetAlerts(ctx)
+	require.NoError(t, err)
+	require.Equal(t, alerts, got)
+	mock.ExpectQuery(getAlertsPrep).WithArgs("teamA").WillReturnRows(sqlmock.NewRows([]string{"alerts"}))
+	got, err = pgdb.GetAlerts(teamA)
+	require.NoError(t, err)
+	require.Empty(t, got)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestScanMetricsPG(t *testing.T) {
+	ctx := WithTenant(context.Background(), "teamA")
+
+	mock.ExpectQuery(scanMetricsPrep).WithArgs("teamA").WillReturnRows(sqlmock.NewRows([]string{"mtype", "id", "labels", "delta", "value", "histogram"}).
+		AddRow("counter", "PollCount", "", 5, nil, nil).
+		AddRow("gauge", "CPUutilization", `{cpu="0"}`, nil, 0.5, nil).
+		AddRow("histogram", "Latency", "", nil, nil, nil).
+		AddRow("histogram", "Latency", `{host="h1"}`, nil, nil, []byte(`{"bounds":[1],"counts":[1,0],"sum":0.5,"count":1}`)))
+	var metrics []models.Metrics
+	require.NoError(t, pgdb.ScanMetrics(ctx, func(m models.Metrics) error {
+		metrics = append(metrics, m)
+		return nil
+	}))
+	delta, value := int64(5), 0.5
+	require.Equal(t, []models.Metrics{
+		{MType: "counter", ID: "PollCount", Delta: &delta},
+		{MType: "gauge", ID: "CPUutilization", Labels: models.Labels{"cpu": "0"}, Value: &value},
+		{MType: "histogram", ID: "Latency", Labels: models.Labels{"host": "h1"}, Histogram: &models.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: 0.5, Count: 1}},
+	}, metrics)
+
+	// error of fn stops scan
+	mock.ExpectQuery(scanMetricsPrep).WithArgs("").WillReturnRows(sqlmock.NewRows([]string{"mtype", "id", "labels", "delta", "value", "histogram"}).
+		AddRow("counter", "PollCount", "", 5, nil, nil).AddRow("counter", "PollCount2", "", 5, nil, nil))
+	calls := 0
+	require.ErrorIs(t, pgdb.ScanMetrics(context.Background(), func(m models.Metrics) error {
+		calls++
+		return customerrors.ErrNoVal
+	}), customerrors.ErrNoVal)
+	require.Equal(t, 1, calls)
+	require.NoError(t, mock.ExpectationsWereMet())
 }
 
 func TestPingPG(t *testing.T) {
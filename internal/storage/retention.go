@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+// Name of raw samples tier in retention policy.
+const rawResolution = "raw"
+
+// ErrWrongRetention error for incorrect retention policy.
+var ErrWrongRetention = errors.New("wrong retention policy")
+
+// Rollups are aligned to unix epoch, so all storages build the same buckets.
+var rollupOrigin = time.Unix(0, 0)
+
+// RetentionTier history resolution and how long it is kept.
+type RetentionTier struct {
+	Resolution time.Duration // samples resolution (0 - raw samples)
+	Keep       time.Duration // samples older than keep are dropped
+}
+
+// RetentionPolicy history tiers from raw samples to coarsest rollups.
+// Each rollup tier is built from the previous one: gauges keep min/max/avg/last, counters keep summed deltas.
+// Histograms are not rolled up, they are kept as raw samples only.
+type RetentionPolicy []RetentionTier
+
+// RetentionForever retention policy value for keep raw samples forever (no compaction).
+const RetentionForever = "forever"
+
+// ParseRetention parse retention policy in format "raw:24h,1m:30d,1h:365d" (empty or "forever" - keep raw samples forever).
+func ParseRetention(s string) (RetentionPolicy, error) {
+	if s == "" || s == RetentionForever {
+		return nil, nil
+	}
+	var policy RetentionPolicy
+	for i, part := range strings.Split(s, ",") {
+		res, keep, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrWrongRetention, part)
+		}
+		tier := RetentionTier{}
+		var err error
+		if res != rawResolution {
+			if tier.Resolution, err = parseRetentionDuration(res); err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrWrongRetention, err.Error())
+			}
+		}
+		if tier.Keep, err = parseRetentionDuration(keep); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrWrongRetention, err.Error())
+		}
+
+		switch {
+		case i == 0 && tier.Resolution != 0:
+			return nil, fmt.Errorf("%w: first tier must be raw", ErrWrongRetention)
+		case i > 0 && tier.Resolution == 0:
+			return nil, fmt.Errorf("%w: only first tier may be raw", ErrWrongRetention)
+		case tier.Resolution%time.Second != 0:
+			return nil, fmt.Errorf("%w: resolution must be whole seconds", ErrWrongRetention)
+		}
+		if i > 0 {
+			prev := policy[i-1]
+			switch {
+			case tier.Resolution <= prev.Resolution || (prev.Resolution != 0 && tier.Resolution%prev.Resolution != 0):
+				return nil, fmt.Errorf("%w: resolution %s must be multiple of %s", ErrWrongRetention, tier.Resolution, prev.Resolution)
+			case tier.Keep <= prev.Keep:
+				return nil, fmt.Errorf("%w: coarser tier must be kept longer", ErrWrongRetention)
+			case prev.Keep < tier.Resolution:
+				// samples must be rolled up before drop
+				return nil, fmt.Errorf("%w: tier %s is dropped before rollup to %s", ErrWrongRetention, prev.Resolution, tier.Resolution)
+			}
+		}
+		policy = append(policy, tier)
+	}
+	return policy, nil
+}
+
+// parseRetentionDuration parse go duration or number of days (e.g. 30d).
+func parseRetentionDuration(s string) (time.Duration, error) {
+	var (
+		d   time.Duration
+		err error
+	)
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("non positive duration %s", s)
+	}
+	return d, nil
+}
+
+// Resolution choose stored resolution for range query (0 - raw samples).
+// The finest tier which still keeps from is used, coarser tier is used if it isn't coarser than step.
+func (p RetentionPolicy) Resolution(mType string, from, now time.Time, step time.Duration) time.Duration {
+	if len(p) == 0 || mType == metrictypes.HistogramType {
+		return 0
+	}
+	chosen := -1
+	for i, t := range p {
+		if from.Before(now.Add(-t.Keep)) {
+			continue
+		}
+		if chosen < 0 || t.Resolution <= step {
+			chosen = i
+		}
+	}
+	if chosen < 0 {
+		// begin of range is dropped from all tiers, coarsest tier keeps the most
+		chosen = len(p) - 1
+	}
+	return p[chosen].Resolution
+}
+
+// rollupSamples aggregate time ordered samples to complete rollup buckets (ending not later than end).
+func rollupSamples(samples []models.Sample, resolution time.Duration, end time.Time) []models.Sample {
+	n := len(samples)
+	for n > 0 && !samples[n-1].Timestamp.Before(end) {
+		n--
+	}
+	if n == 0 {
+		return nil
+	}
+	return aggregateSamples(samples[:n], rollupOrigin, resolution)
+}
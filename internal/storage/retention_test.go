@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+)
+
+func TestParseRetention(t *testing.T) {
+	policy, err := ParseRetention("raw:24h, 1m:30d,1h:365d")
+	require.NoError(t, err)
+	require.Equal(t, RetentionPolicy{
+		{Resolution: 0, Keep: 24 * time.Hour},
+		{Resolution: time.Minute, Keep: 30 * 24 * time.Hour},
+		{Resolution: time.Hour, Keep: 365 * 24 * time.Hour},
+	}, policy)
+
+	// empty policy - raw samples forever
+	policy, err = ParseRetention("")
+	require.NoError(t, err)
+	require.Empty(t, policy)
+	policy, err = ParseRetention(RetentionForever)
+	require.NoError(t, err)
+	require.Empty(t, policy)
+
+	for _, s := range []string{
+		"raw",                     // no keep
+		"1m:30d",                  // first tier isn't raw
+		"raw:24h,raw:30d",         // second raw tier
+		"raw:24h,1500ms:1d",       // fractional seconds
+		"raw:24h,1h:30d,1m:365d",  // finer resolution after coarser
+		"raw:24h,1m:30d,90s:365d", // not multiple of previous
+		"raw:24h,1m:12h",          // kept shorter than raw samples
+		"raw:30s,1m:30d",          // raw samples dropped before rollup
+		"raw:-1h",                 // negative keep
+		"raw:xd",                  // bad days
+	} {
+		_, err := ParseRetention(s)
+		require.ErrorIs(t, err, ErrWrongRetention, s)
+	}
+}
+
+func TestRetentionResolution(t *testing.T) {
+	policy, err := ParseRetention("raw:24h,1m:30d,1h:365d")
+	require.NoError(t, err)
+	now := time.Unix(1000*24*3600, 0)
+
+	// recent range - raw samples, unless step allows coarser tier
+	require.Equal(t, time.Duration(0), policy.Resolution("gauge", now.Add(-time.Hour), now, 0))
+	require.Equal(t, time.Minute, policy.Resolution("gauge", now.Add(-time.Hour), now, 5*time.Minute))
+	require.Equal(t, time.Hour, policy.Resolution("counter", now.Add(-time.Hour), now, 2*time.Hour))
+	// raw samples are dropped
+	require.Equal(t, time.Minute, policy.Resolution("gauge", now.Add(-48*time.Hour), now, 0))
+	require.Equal(t, time.Hour, policy.Resolution("gauge", now.Add(-60*24*time.Hour), now, 0))
+	// dropped from all tiers
+	require.Equal(t, time.Hour, policy.Resolution("gauge", now.Add(-400*24*time.Hour), now, 0))
+	// histograms and empty policy - raw samples only
+	require.Equal(t, time.Duration(0), policy.Resolution("histogram", now.Add(-48*time.Hour), now, time.Hour))
+	require.Equal(t, time.Duration(0), RetentionPolicy(nil).Resolution("gauge", now.Add(-48*time.Hour), now, time.Hour))
+}
+
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	memStorage := NewMemStorage()
+	ts := time.Unix(0, 0)
+	memStorage.now = func() time.Time { return ts }
+	policy, err := ParseRetention("raw:1h,1m:2h,10m:24h")
+	require.NoError(t, err)
+
+	// gauge 0..29 and counter 1 every 20s (10 minutes)
+	for i := 0; i < 30; i++ {
+		ts = time.Unix(int64(i*20), 0)
+		require.NoError(t, memStorage.WriteMetric(ctx, "gauge", "testGauge", metrictypes.Gauge(float64(i))))
+		require.NoError(t, memStorage.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(1)))
+	}
+
+	// only complete buckets are rolled up
+	require.NoError(t, memStorage.Compact(ctx, policy, time.Unix(590, 0)))
+	g, err := memStorage.GetMetricRollups(ctx, "gauge", "testGauge", time.Minute, time.Unix(0, 0), time.Unix(3600, 0))
+	require.NoError(t, err)
+	require.Len(t, g, 9)
+	require.Equal(t, time.Unix(60, 0), g[1].Timestamp)
+	require.Equal(t, 4.0, *g[1].Value)
+	require.Equal(t, 3.0, *g[1].Min)
+	require.Equal(t, 5.0, *g[1].Max)
+	require.Equal(t, 5.0, *g[1].Last)
+	require.Equal(t, uint64(3), g[1].Count)
+	g, err = memStorage.GetMetricRollups(ctx, "gauge", "testGauge", 10*time.Minute, time.Unix(0, 0), time.Unix(3600, 0))
+	require.NoError(t, err)
+	require.Empty(t, g)
+
+	// next compaction continues from last bucket
+	require.NoError(t, memStorage.Compact(ctx, policy, time.Unix(600, 0)))
+	g, err = memStorage.GetMetricRollups(ctx, "gauge", "testGauge", time.Minute, time.Unix(0, 0), time.Unix(3600, 0))
+	require.NoError(t, err)
+	require.Len(t, g, 10)
+	g, err = memStorage.GetMetricRollups(ctx, "gauge", "testGauge", 10*time.Minute, time.Unix(0, 0), time.Unix(3600, 0))
+	require.NoError(t, err)
+	require.Len(t, g, 1)
+	require.Equal(t, 14.5, *g[0].Value)
+	require.Equal(t, 0.0, *g[0].Min)
+	require.Equal(t, 29.0, *g[0].Max)
+	require.Equal(t, 29.0, *g[0].Last)
+	require.Equal(t, uint64(30), g[0].Count)
+	c, err := memStorage.GetMetricRollups(ctx, "counter", "testCounter", 10*time.Minute, time.Unix(0, 0), time.Unix(3600, 0))
+	require.NoError(t, err)
+	require.Len(t, c, 1)
+	require.Equal(t, int64(30), *c[0].Delta)
+
+	// raw samples and 1m rollups are expired, 10m rollups are kept
+	require.NoError(t, memStorage.Compact(ctx, policy, time.Unix(3*3600, 0)))
+	h, err := memStorage.GetMetricHistory(ctx, "gauge", "testGauge", time.Unix(0, 0), time.Unix(3600, 0))
+	require.NoError(t, err)
+	require.Empty(t, h)
+	g, err = memStorage.GetMetricRollups(ctx, "gauge", "testGauge", time.Minute, time.Unix(0, 0), time.Unix(3600, 0))
+	require.NoError(t, err)
+	require.Empty(t, g)
+	g, err = memStorage.GetMetricRollups(ctx, "gauge", "testGauge", 10*time.Minute, time.Unix(0, 0), time.Unix(3600, 0))
+	require.NoError(t, err)
+	require.Len(t, g, 1)
+
+	// resolution removed from policy
+	policy, err = ParseRetention("raw:1h,1m:2h")
+	require.NoError(t, err)
+	require.NoError(t, memStorage.Compact(ctx, policy, time.Unix(3*3600, 0)))
+	g, err = memStorage.GetMetricRollups(ctx, "gauge", "testGauge", 10*time.Minute, time.Unix(0, 0), time.Unix(3600, 0))
+	require.NoError(t, err)
+	require.Empty(t, g)
+
+	_, err = memStorage.GetMetricRollups(ctx, "wrong", "testGauge", time.Minute, time.Unix(0, 0), time.Unix(3600, 0))
+	require.Error(t, err)
+}
@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+// Current snapshot file format version (2 - metadata lines after metric lines, 3 - alerts lines after metadata lines).
+const snapshotVersion = 3
+
+// Snapshot errors.
+var (
+	ErrSnapshotVersion  = errors.New("unsupported snapshot version")
+	ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+	ErrSnapshotLine     = errors.New("corrupt snapshot line")
+	errEmptyMetricID    = errors.New("empty metric id")
+)
+
+// snapshotHeader first line of snapshot file.
+// Checksum is sha256 of all following lines (metrics, metadata and alerts in json line format).
+type snapshotHeader struct {
+	Version   int       `json:"version"`           // file format version
+	Timestamp time.Time `json:"ts"`                // snapshot time
+	WALSeq    uint64    `json:"wal_seq,omitempty"` // sequence number of last write-ahead log record in snapshot
+	Count     int       `json:"count"`             // number of metric, metadata and alerts lines
+	Checksum  string    `json:"checksum"`          // hex sha256 of metric, metadata and alerts lines
+}
+
+// snapshotMetadata metadata line of snapshot file.
+type snapshotMetadata struct {
+	Metadata *models.Metadata `json:"metadata"` // metric name metadata
+}
+
+// snapshotAlerts alerts line of snapshot file.
+type snapshotAlerts struct {
+	Alerts *tenantAlerts `json:"alerts"` // saved alerts state of tenant
+}
+
+// snapshotLine metric, metadata or alerts line of snapshot file (metadata and alerts lines have only own field).
+type snapshotLine struct {
+	models.Metrics
+	snapshotMetadata
+	snapshotAlerts
+}
+
+// SkippedLine snapshot line skipped by tolerant restore.
+type SkippedLine struct {
+	Line int   // line number in file (from 1)
+	Err  error // parse or validation error
+}
+
+// SnapshotReport result of snapshot restore.
+type SnapshotReport struct {
+	Version          int           // file format version (0 - legacy file without header)
+	Timestamp        time.Time     // snapshot time from header
+	WALSeq           uint64        // sequence number of last write-ahead log record in snapshot
+	Restored         int           // number of restored metrics
+	Skipped          []SkippedLine // corrupt lines (tolerant restore only)
+	ChecksumMismatch bool          // file content differs from header checksum (tolerant restore only)
+}
+
+// writeSnapshot write metrics, metadata and alerts to temporary file, fsync it and rename to fname.
+func writeSnapshot(fname string, ts time.Time, walSeq uint64, metrics []models.Metrics, meta []models.Metadata, alerts []tenantAlerts) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, v := range metrics {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+	for _, v := range meta {
+		v := v
+		if err := enc.Encode(snapshotMetadata{Metadata: &v}); err != nil {
+			return err
+		}
+	}
+	for _, v := range alerts {
+		v := v
+		if err := enc.Encode(snapshotAlerts{Alerts: &v}); err != nil {
+			return err
+		}
+	}
+	sum := sha256.Sum256(body.Bytes())
+	header, err := json.Marshal(snapshotHeader{
+		Version:   snapshotVersion,
+		Timestamp: ts,
+		WALSeq:    walSeq,
+		Count:     len(metrics) + len(meta) + len(alerts),
+		Checksum:  hex.EncodeToString(sum[:]),
+	})
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(fname)
+	f, err := os.CreateTemp(dir, filepath.Base(fname)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	// temporary file is removed on any error
+	done := false
+	defer func() {
+		if !done {
+			_ = f.Close()
+			_ = os.Remove(tmp)
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	if _, err := w.Write(append(header, '\n')); err != nil {
+		return err
+	}
+	if _, err := w.Write(body.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fname); err != nil {
+		return err
+	}
+	done = true
+	return syncDir(dir)
+}
+
+// syncDir fsync directory to persist rename.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	return d.Sync()
+}
+
+// readSnapshot read and verify snapshot file.
+// In strict mode any damage is an error, in tolerant mode damaged lines are skipped and reported.
+// Files without header (written by older versions) are read without checksum verification.
+func readSnapshot(fname string, tolerant bool) ([]models.Metrics, []models.Metadata, []tenantAlerts, *SnapshotReport, error) {
+	report := &SnapshotReport{}
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, nil, nil, report, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var (
+		header   *snapshotHeader
+		metrics  []models.Metrics
+		meta     []models.Metadata
+		alerts   []tenantAlerts
+		lineNum  int
+		checksum = sha256.New()
+	)
+	r := bufio.NewReader(f)
+	for {
+		line, rerr := r.ReadBytes('\n')
+		if rerr != nil && !errors.Is(rerr, io.EOF) {
+			return nil, nil, nil, report, rerr
+		}
+		if len(line) > 0 {
+			lineNum++
+			if lineNum == 1 {
+				if h, ok := parseSnapshotHeader(line); ok {
+					if h.Version > snapshotVersion {
+						return nil, nil, nil, report, fmt.Errorf("%w: %d", ErrSnapshotVersion, h.Version)
+					}
+					header = h
+					report.Version = h.Version
+					report.Timestamp = h.Timestamp
+					report.WALSeq = h.WALSeq
+					continue
+				}
+			}
+			checksum.Write(line)
+			sl, err := parseSnapshotLine(line)
+			switch {
+			case err != nil:
+				if !tolerant {
+					return nil, nil, nil, report, fmt.Errorf("%w %d: %w", ErrSnapshotLine, lineNum, err)
+				}
+				report.Skipped = append(report.Skipped, SkippedLine{Line: lineNum, Err: err})
+			case sl.Metadata != nil:
+				meta = append(meta, *sl.Metadata)
+			case sl.Alerts != nil:
+				alerts = append(alerts, *sl.Alerts)
+			default:
+				metrics = append(metrics, sl.Metrics)
+			}
+		}
+		if errors.Is(rerr, io.EOF) {
+			break
+		}
+	}
+
+	if header != nil && (hex.EncodeToString(checksum.Sum(nil)) != header.Checksum || len(metrics)+len(meta)+len(alerts)+len(report.Skipped) != header.Count) {
+		if !tolerant {
+			return nil, nil, nil, report, ErrSnapshotChecksum
+		}
+		report.ChecksumMismatch = true
+	}
+	report.Restored = len(metrics)
+	return metrics, meta, alerts, report, nil
+}
+
+// parseSnapshotHeader try to parse header line.
+func parseSnapshotHeader(line []byte) (*snapshotHeader, bool) {
+	h := &snapshotHeader{}
+	if err := json.Unmarshal(line, h); err != nil || h.Version == 0 {
+		return nil, false
+	}
+	return h, true
+}
+
+// parseSnapshotLine parse and validate metric, metadata or alerts line.
+func parseSnapshotLine(line []byte) (snapshotLine, error) {
+	var sl snapshotLine
+	if err := json.Unmarshal(line, &sl); err != nil {
+		return sl, err
+	}
+	if sl.Metadata != nil {
+		// metadata of tenant is saved with storage id
+		meta := *sl.Metadata
+		_, meta.ID = splitTenant(meta.ID)
+		return sl, validateMetadata([]models.Metadata{meta})
+	}
+	if sl.Alerts != nil {
+		return sl, nil
+	}
+	if sl.ID == "" {
+		return sl, errEmptyMetricID
+	}
+	return sl, validateMetric(sl.Metrics)
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotHeader(t *testing.T) {
+	dir := t.TempDir()
+	tmpFile := filepath.Join(dir, "metrics.json")
+
+	ctx := context.Background()
+	memStorage := NewMemStorage()
+	ts := time.Unix(1000, 0).UTC()
+	memStorage.now = func() time.Time { return ts }
+	require.NoError(t, memStorage.WriteMetric(ctx, "gauge", "testGauge", metrictypes.Gauge(0.1)))
+	require.NoError(t, memStorage.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(1)))
+	require.NoError(t, memStorage.SaveToFile(tmpFile))
+
+	// no temporary files left
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	b, err := os.ReadFile(tmpFile)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 3)
+	var h snapshotHeader
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &h))
+	require.Equal(t, snapshotVersion, h.Version)
+	require.Equal(t, 2, h.Count)
+	require.True(t, ts.Equal(h.Timestamp))
+
+	restored := NewMemStorage()
+	report, err := restored.ReadFromFileTolerant(tmpFile)
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Restored)
+	require.Empty(t, report.Skipped)
+	require.False(t, report.ChecksumMismatch)
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "metrics.json")
+
+	ctx := context.Background()
+	memStorage := NewMemStorage()
+	require.NoError(t, memStorage.WriteMetric(ctx, "gauge", "testGauge", metrictypes.Gauge(0.1)))
+	require.NoError(t, memStorage.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(1)))
+	require.NoError(t, memStorage.SaveToFile(tmpFile))
+
+	// line without value and torn last line
+	f, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"id":"noValue","type":"counter"}` + "\n" + `{"id":"torn","ty`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// strict restore fails and restores nothing
+	restored := NewMemStorage()
+	require.ErrorIs(t, restored.ReadFromFile(tmpFile), ErrSnapshotLine)
+	_, err = restored.GetMetric(ctx, "gauge", "testGauge")
+	require.Error(t, err)
+
+	// tolerant restore skips broken lines
+	report, err := restored.ReadFromFileTolerant(tmpFile)
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Restored)
+	require.Len(t, report.Skipped, 2)
+	require.Equal(t, 4, report.Skipped[0].Line)
+	require.Equal(t, 5, report.Skipped[1].Line)
+	require.True(t, report.ChecksumMismatch)
+	c, err := restored.GetMetric(ctx, "counter", "testCounter")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(1), c)
+}
+
+func TestSnapshotChecksum(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "metrics.json")
+
+	ctx := context.Background()
+	memStorage := NewMemStorage()
+	require.NoError(t, memStorage.WriteMetric(ctx, "gauge", "testGauge", metrictypes.Gauge(0.1)))
+	require.NoError(t, memStorage.WriteMetric(ctx, "gauge", "testGauge2", metrictypes.Gauge(0.2)))
+	require.NoError(t, memStorage.SaveToFile(tmpFile))
+
+	// valid json, changed value
+	b, err := os.ReadFile(tmpFile)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(tmpFile, []byte(strings.Replace(string(b), "0.2", "0.3", 1)), 0o644))
+	require.ErrorIs(t, NewMemStorage().ReadFromFile(tmpFile), ErrSnapshotChecksum)
+
+	// truncated file (last metric line lost)
+	lines := strings.SplitAfter(string(b), "\n")
+	require.NoError(t, os.WriteFile(tmpFile, []byte(lines[0]+lines[1]), 0o644))
+	require.ErrorIs(t, NewMemStorage().ReadFromFile(tmpFile), ErrSnapshotChecksum)
+	report, err := NewMemStorage().ReadFromFileTolerant(tmpFile)
+	require.NoError(t, err)
+	require.True(t, report.ChecksumMismatch)
+	require.Equal(t, 1, report.Restored)
+
+	// unknown format
+	require.NoError(t, os.WriteFile(tmpFile, []byte(`{"version":100}`+"\n"), 0o644))
+	require.ErrorIs(t, NewMemStorage().ReadFromFile(tmpFile), ErrSnapshotVersion)
+}
+
+func TestSnapshotLegacy(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "metrics.json")
+	legacy := `{"delta":5,"id":"testCounter","type":"counter"}` + "\n" + `{"value":0.5,"id":"testGauge","type":"gauge"}` + "\n"
+	require.NoError(t, os.WriteFile(tmpFile, []byte(legacy), 0o644))
+
+	ctx := context.Background()
+	restored := NewMemStorage()
+	report, err := restored.ReadFromFileTolerant(tmpFile)
+	require.NoError(t, err)
+	require.Equal(t, 0, report.Version)
+	require.Equal(t, 2, report.Restored)
+	c, err := restored.GetMetric(ctx, "counter", "testCounter")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(5), c)
+}
@@ -2,14 +2,15 @@
 package storage
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/sourcecd/monitoring/internal/customerrors"
 	"github.com/sourcecd/monitoring/internal/metrictypes"
@@ -17,19 +18,45 @@ import (
 )
 
 // StoreMetrics main metrics storage interface.
+// Metric name parameters are series ids: metric name with optional canonical labels (see models.SeriesID).
 type StoreMetrics interface {
 	WriteMetric(ctx context.Context, mType, name string, val interface{}) error // method for write single metric to storage
 	WriteBatchMetrics(ctx context.Context, metrics []models.Metrics) error      // method for write a lot of metrics to storage (batch)
 	GetAllMetricsTxt(ctx context.Context) (string, error)                       // method for fetch all metrics from storage
 	GetMetric(ctx context.Context, mType, name string) (interface{}, error)     // method for fetch metric value
 	Ping(ctx context.Context) error                                             // method for healthcheck storage
+	// method for fetch metric samples written between from and to (inclusive)
+	GetMetricHistory(ctx context.Context, mType, name string, from, to time.Time) ([]models.Sample, error)
+	// method for fetch metric rollups of resolution with bucket start between from and to (inclusive)
+	GetMetricRollups(ctx context.Context, mType, name string, resolution time.Duration, from, to time.Time) ([]models.Sample, error)
+	// method for build rollups and drop samples expired by retention policy
+	Compact(ctx context.Context, policy RetentionPolicy, now time.Time) error
+	// method for delete series of type matched by name (series id or pattern with '*' and '?' wildcards), returns deleted series count
+	Delete(ctx context.Context, mType, name string) (int, error)
+	// method for register metadata of metric names (replaces stored one)
+	WriteMetadata(ctx context.Context, meta []models.Metadata) error
+	// method for fetch metadata of all metric names (sorted by name)
+	GetMetadata(ctx context.Context) ([]models.Metadata, error)
+	// method for stream all metrics to fn sorted by type, metric name and labels (series of metric name are consecutive), error of fn stops scan
+	ScanMetrics(ctx context.Context, fn func(m models.Metrics) error) error
+	// method for save alerts state (replaces saved one)
+	WriteAlerts(ctx context.Context, alerts []models.Alert) error
+	// method for fetch saved alerts state
+	GetAlerts(ctx context.Context) ([]models.Alert, error)
 }
 
 // MemStorage in-memory storage.
+// Series are partitioned to shards by id hash, each shard has own lock, so writes of different series don't block each other.
+// Operations on whole storage (snapshot, restore, write-ahead log changes) lock all shards in order.
 type MemStorage struct {
-	gauge   map[string]metrictypes.Gauge   // for save gauge metrics
-	counter map[string]metrictypes.Counter // for save counter metrics
-	sync.RWMutex
+	shards      []*memShard                 // series partitions
+	rollupMarks map[time.Duration]time.Time // end of last built rollup bucket by resolution (guarded by compactMu)
+	compactMu   sync.Mutex                  // serializes compactions
+	now         func() time.Time            // clock for history timestamps
+	wal         *writeAheadLog              // write-ahead log (optional, changed with all shards locked)
+	metadata    map[string]models.Metadata  // metadata by metric name (changed with all shards locked, so it is consistent with snapshot)
+	alerts      map[string][]models.Alert   // saved alerts state by tenant (changed like metadata)
+	metaMu      sync.RWMutex                // guards metadata and alerts reads
 }
 
 // Ping implementation Ping method of storage interface (in-memory storage).
@@ -37,172 +64,769 @@ func (m *MemStorage) Ping(ctx context.Context) error {
 	return nil
 }
 
+// shardOf return shard of series.
+func (m *MemStorage) shardOf(series string) *memShard {
+	return m.shards[shardIndex(series, len(m.shards))]
+}
+
+// lockAll lock all shards for write.
+func (m *MemStorage) lockAll() {
+	for _, s := range m.shards {
+		s.Lock()
+	}
+}
+
+// unlockAll unlock all shards locked by lockAll.
+func (m *MemStorage) unlockAll() {
+	for _, s := range m.shards {
+		s.Unlock()
+	}
+}
+
+// rlockAll lock all shards for read.
+func (m *MemStorage) rlockAll() {
+	for _, s := range m.shards {
+		s.RLock()
+	}
+}
+
+// runlockAll unlock all shards locked by rlockAll.
+func (m *MemStorage) runlockAll() {
+	for _, s := range m.shards {
+		s.RUnlock()
+	}
+}
+
 // WriteMetric implementation WriteMetric method of storage interface (in-memory storage).
 func (m *MemStorage) WriteMetric(ctx context.Context, mtype, name string, val interface{}) error {
-	m.Lock()
-	defer m.Unlock()
+	metric, err := metricFromValue(mtype, name, val)
+	if err != nil {
+		return err
+	}
+	if metric.Labels, err = tenantLabels(TenantFromContext(ctx), metric.Labels); err != nil {
+		return err
+	}
+	s := m.shardOf(metric.SeriesID())
+	s.Lock()
+	defer s.Unlock()
+	if err := s.checkMetric(metric); err != nil {
+		return err
+	}
+	ts := m.now()
+	// write is acknowledged only after it is logged
+	if err := m.logWrite(ts, []models.Metrics{metric}); err != nil {
+		return err
+	}
+	s.applyMetric(metric, ts)
+	return nil
+}
+
+// WriteBatchMetrics implementation WriteBatchMetrics method of storage interface (in-memory storage).
+// Only shards of batch series are locked (in shard order, so concurrent batches don't deadlock).
+func (m *MemStorage) WriteBatchMetrics(ctx context.Context, metrics []models.Metrics) error {
+	metrics = tenantBatch(ctx, metrics)
+	shardOf := make([]int, len(metrics))
+	locked := make([]bool, len(m.shards))
+	for i, v := range metrics {
+		if v.ID == "" {
+			continue
+		}
+		shardOf[i] = shardIndex(v.SeriesID(), len(m.shards))
+		locked[shardOf[i]] = true
+	}
+	for i, s := range m.shards {
+		if locked[i] {
+			s.Lock()
+			defer s.Unlock()
+		}
+	}
+
+	// all samples of one batch share the same timestamp
+	ts := m.now()
+	accepted := make([]models.Metrics, 0, len(metrics))
+	acceptedShards := make([]*memShard, 0, len(metrics))
+	// i think we don't break all batch if one metric failed in batch (use continue)
+	for i, v := range metrics {
+		if v.ID == "" {
+			log.Printf("empty id of %s metric", v.MType)
+			continue
+		}
+		s := m.shards[shardOf[i]]
+		if err := s.checkMetric(v); err != nil {
+			log.Printf("metric %s: %s", v.ID, err.Error())
+			continue
+		}
+		accepted = append(accepted, v)
+		acceptedShards = append(acceptedShards, s)
+	}
+	// batch is acknowledged only after it is logged
+	if err := m.logWrite(ts, accepted); err != nil {
+		return err
+	}
+	for i, v := range accepted {
+		acceptedShards[i].applyMetric(v, ts)
+	}
+	return nil
+}
+
+// metricFromValue convert WriteMetric parameters to metric model.
+func metricFromValue(mtype, name string, val interface{}) (models.Metrics, error) {
+	id, labels, err := models.ParseSeriesID(name)
+	if err != nil {
+		return models.Metrics{}, err
+	}
+	if err := models.ValidateSeries(id, labels); err != nil {
+		return models.Metrics{}, err
+	}
+	metric := models.Metrics{ID: id, Labels: labels, MType: mtype}
 	// selecting metric type
 	switch mtype {
 	case metrictypes.GaugeType:
-		if metric, ok := val.(metrictypes.Gauge); ok {
-			m.gauge[name] = metric
-			return nil
+		v, ok := val.(metrictypes.Gauge)
+		if !ok {
+			return metric, customerrors.ErrWrongMetricValueType
 		}
-		return customerrors.ErrWrongMetricValueType
+		metric.Value = (*float64)(&v)
 	case metrictypes.CounterType:
-		if metric, ok := val.(metrictypes.Counter); ok {
-			m.counter[name] += metric
-			return nil
+		v, ok := val.(metrictypes.Counter)
+		if !ok {
+			return metric, customerrors.ErrWrongMetricValueType
 		}
-		return customerrors.ErrWrongMetricValueType
+		metric.Delta = (*int64)(&v)
+	case metrictypes.HistogramType:
+		v, ok := val.(metrictypes.Histogram)
+		if !ok {
+			return metric, customerrors.ErrWrongMetricValueType
+		}
+		h := models.Histogram(v.Clone())
+		metric.Histogram = &h
+	default:
+		return metric, customerrors.ErrWrongMetricType
+	}
+	return metric, nil
+}
+
+// validateMetric check metric type and value presence.
+func validateMetric(v models.Metrics) error {
+	// selecting metric type
+	switch v.MType {
+	case metrictypes.GaugeType:
+		if v.Value == nil {
+			return customerrors.ErrWrongMetricValueType
+		}
+	case metrictypes.CounterType:
+		if v.Delta == nil {
+			return customerrors.ErrWrongMetricValueType
+		}
+	case metrictypes.HistogramType:
+		if v.Histogram == nil {
+			return customerrors.ErrWrongMetricValueType
+		}
+		h := metrictypes.Histogram(*v.Histogram)
+		return h.Validate()
 	default:
 		return customerrors.ErrWrongMetricType
 	}
+	return nil
 }
 
-// WriteBatchMetrics implementation WriteBatchMetrics method of storage interface (in-memory storage).
-func (m *MemStorage) WriteBatchMetrics(ctx context.Context, metrics []models.Metrics) error {
-	m.Lock()
-	defer m.Unlock()
-	// i think we don't break all batch if one metric failed in batch (use continue)
-	for _, v := range metrics {
-		// selecting metric type
-		switch v.MType {
-		case metrictypes.GaugeType:
-			if v.Value == nil || v.ID == "" {
-				log.Println("empty id or nil value gauge metric")
-				continue
+// Wildcards of series pattern: any sequence of chars and any single char.
+const seriesWildcards = "*?"
+
+// isSeriesPattern check that name is series pattern, not single series id.
+func isSeriesPattern(name string) bool {
+	return strings.ContainsAny(name, seriesWildcards)
+}
+
+// seriesMatcher return matcher of context tenant storage series by name.
+// Pattern is matched with canonical series ids (without tenant label), other names are single series ids.
+func seriesMatcher(ctx context.Context, name string) (func(series string) bool, error) {
+	if !isSeriesPattern(name) {
+		series, err := tenantSeries(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return func(s string) bool { return s == series }, nil
+	}
+	tenant := TenantFromContext(ctx)
+	return func(s string) bool {
+		t, series := splitTenant(s)
+		return t == tenant && MatchSeriesPattern(name, series)
+	}, nil
+}
+
+// MatchSeriesPattern match series id (or metric name) with wildcard pattern (backtracking to the last '*').
+func MatchSeriesPattern(pattern, series string) bool {
+	p, s := []rune(pattern), []rune(series)
+	pi, si := 0, 0
+	star, mark := -1, 0
+	for si < len(s) {
+		switch {
+		case pi < len(p) && p[pi] == '*':
+			star, mark = pi, si
+			pi++
+		case pi < len(p) && (p[pi] == '?' || p[pi] == s[si]):
+			pi++
+			si++
+		case star >= 0:
+			// '*' takes one more char
+			mark++
+			pi, si = star+1, mark
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// checkMetricType check metric type of read and delete requests.
+func checkMetricType(mType string) error {
+	switch mType {
+	case metrictypes.GaugeType, metrictypes.CounterType, metrictypes.HistogramType:
+		return nil
+	}
+	return customerrors.ErrBadMetricType
+}
+
+// validateMetadata check metric name and type hint of metadata.
+func validateMetadata(meta []models.Metadata) error {
+	for _, v := range meta {
+		if v.ID == "" {
+			return fmt.Errorf("%w: empty metric name", customerrors.ErrWrongMetadata)
+		}
+		// metadata is shared by all series of name
+		if strings.ContainsAny(v.ID, "{}") {
+			return fmt.Errorf("%w: %s: metric name with labels", customerrors.ErrWrongMetadata, v.ID)
+		}
+		if v.MType != "" && checkMetricType(v.MType) != nil {
+			return fmt.Errorf("%w: %s: unknown type %s", customerrors.ErrWrongMetadata, v.ID, v.MType)
+		}
+	}
+	return nil
+}
+
+// sortedMetadata return metadata sorted by metric name.
+func sortedMetadata(mp map[string]models.Metadata) []models.Metadata {
+	meta := make([]models.Metadata, 0, len(mp))
+	for _, k := range sortedKeys(mp) {
+		meta = append(meta, mp[k])
+	}
+	return meta
+}
+
+// logWrite append accepted metrics to write-ahead log, if it is enabled (caller must hold lock of metrics shards).
+func (m *MemStorage) logWrite(ts time.Time, metrics []models.Metrics) error {
+	if m.wal == nil || len(metrics) == 0 {
+		return nil
+	}
+	if err := m.wal.append(walRecord{Timestamp: ts, Metrics: metrics}); err != nil {
+		return fmt.Errorf("write-ahead log failed: %s", err.Error())
+	}
+	return nil
+}
+
+// EnableWAL open write-ahead log, every accepted write is logged before it is acknowledged.
+// Log is replayed by ReadFromFile and truncated by SaveToFile.
+func (m *MemStorage) EnableWAL(fname, fsync string) error {
+	w, err := openWAL(fname, fsync)
+	if err != nil {
+		return err
+	}
+	m.lockAll()
+	defer m.unlockAll()
+	m.wal = w
+	return nil
+}
+
+// TruncateWAL drop all write-ahead log records (e.g. when saved data is not restored).
+func (m *MemStorage) TruncateWAL() error {
+	m.lockAll()
+	defer m.unlockAll()
+	if m.wal == nil {
+		return nil
+	}
+	return m.wal.truncate()
+}
+
+// CloseWAL close write-ahead log file.
+func (m *MemStorage) CloseWAL() error {
+	m.lockAll()
+	defer m.unlockAll()
+	if m.wal == nil {
+		return nil
+	}
+	err := m.wal.close()
+	m.wal = nil
+	return err
+}
+
+// replayWAL apply write-ahead log records after snapshot sequence number on top of current data
+// (caller must hold all shards and metadata write locks).
+func (m *MemStorage) replayWAL(after uint64) error {
+	if m.wal == nil {
+		return nil
+	}
+	return m.wal.replay(after, func(rec walRecord) {
+		for _, v := range rec.Metadata {
+			m.metadata[v.ID] = v
+		}
+		if rec.Alerts != nil {
+			setAlerts(m.alerts, *rec.Alerts)
+			return
+		}
+		if rec.Delete != nil {
+			match, err := seriesMatcher(WithTenant(context.Background(), rec.Delete.Tenant), rec.Delete.Name)
+			if err != nil {
+				log.Printf("wal: delete %s: %s", rec.Delete.Name, err.Error())
+				return
+			}
+			for _, s := range m.shards {
+				s.deleteSeries(rec.Delete.MType, s.matchSeries(rec.Delete.MType, match))
 			}
-			m.gauge[v.ID] = metrictypes.Gauge(*v.Value)
-		case metrictypes.CounterType:
-			if v.Delta == nil || v.ID == "" {
-				log.Println("empty id or nil value counter metric")
+			return
+		}
+		for _, v := range rec.Metrics {
+			s := m.shardOf(v.SeriesID())
+			if err := s.checkMetric(v); err != nil {
+				log.Printf("wal: metric %s: %s", v.ID, err.Error())
 				continue
 			}
-			m.counter[v.ID] += metrictypes.Counter(*v.Delta)
-		default:
-			log.Println("wrong metric type")
-			continue
+			s.applyMetric(v, rec.Timestamp)
+		}
+	})
+}
+
+// GetMetricHistory implementation GetMetricHistory method of storage interface (in-memory storage).
+func (m *MemStorage) GetMetricHistory(ctx context.Context, mType, name string, from, to time.Time) ([]models.Sample, error) {
+	name, err := tenantSeries(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	s := m.shardOf(name)
+	s.RLock()
+	defer s.RUnlock()
+	var history []models.Sample
+	// selecting metric type
+	switch mType {
+	case metrictypes.GaugeType:
+		history = s.gaugeHistory[name]
+	case metrictypes.CounterType:
+		history = s.counterHistory[name]
+	case metrictypes.HistogramType:
+		history = s.histogramHistory[name]
+	default:
+		return nil, customerrors.ErrBadMetricType
+	}
+	return samplesInRange(history, from, to), nil
+}
+
+// samplesInRange return copy of time ordered samples between from and to (inclusive).
+func samplesInRange(history []models.Sample, from, to time.Time) []models.Sample {
+	// samples are appended in time order, so binary search range bounds
+	start := sort.Search(len(history), func(i int) bool { return !history[i].Timestamp.Before(from) })
+	end := sort.Search(len(history), func(i int) bool { return history[i].Timestamp.After(to) })
+	if start >= end {
+		return []models.Sample{}
+	}
+	res := make([]models.Sample, end-start)
+	copy(res, history[start:end])
+	return res
+}
+
+// GetMetricRollups implementation GetMetricRollups method of storage interface (in-memory storage).
+func (m *MemStorage) GetMetricRollups(ctx context.Context, mType, name string, resolution time.Duration, from, to time.Time) ([]models.Sample, error) {
+	name, err := tenantSeries(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	// selecting metric type
+	switch mType {
+	case metrictypes.GaugeType, metrictypes.CounterType, metrictypes.HistogramType:
+	default:
+		return nil, customerrors.ErrBadMetricType
+	}
+	s := m.shardOf(name)
+	s.RLock()
+	defer s.RUnlock()
+	return samplesInRange(s.rollups[rollupKey{mType: mType, series: name, resolution: resolution}], from, to), nil
+}
+
+// Compact implementation Compact method of storage interface (in-memory storage).
+// Shards are compacted one by one, so writes to other shards are not blocked.
+func (m *MemStorage) Compact(ctx context.Context, policy RetentionPolicy, now time.Time) error {
+	m.compactMu.Lock()
+	defer m.compactMu.Unlock()
+
+	// rollup ranges are the same for all shards
+	marks := make([]time.Time, len(policy))
+	ends := make([]time.Time, len(policy))
+	for i := 1; i < len(policy); i++ {
+		marks[i] = m.rollupMarks[policy[i].Resolution]
+		ends[i] = bucketStart(now, rollupOrigin, policy[i].Resolution)
+	}
+	for _, s := range m.shards {
+		s.Lock()
+		s.compact(policy, marks, ends, now)
+		s.Unlock()
+	}
+	for i := 1; i < len(policy); i++ {
+		if ends[i].After(marks[i]) {
+			m.rollupMarks[policy[i].Resolution] = ends[i]
+		}
+	}
+	return nil
+}
+
+// Delete implementation Delete method of storage interface (in-memory storage).
+// Pattern can match series of any shard, so all shards are locked.
+func (m *MemStorage) Delete(ctx context.Context, mType, name string) (int, error) {
+	if err := checkMetricType(mType); err != nil {
+		return 0, err
+	}
+	match, err := seriesMatcher(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	m.lockAll()
+	defer m.unlockAll()
+	matched := make([][]string, len(m.shards))
+	n := 0
+	for i, s := range m.shards {
+		matched[i] = s.matchSeries(mType, match)
+		n += len(matched[i])
+	}
+	if n == 0 {
+		return 0, customerrors.ErrNoVal
+	}
+	// delete is acknowledged only after it is logged
+	if m.wal != nil {
+		if err := m.wal.append(walRecord{Timestamp: m.now(), Delete: &walDelete{MType: mType, Name: name, Tenant: TenantFromContext(ctx)}}); err != nil {
+			return 0, fmt.Errorf("write-ahead log failed: %s", err.Error())
+		}
+	}
+	for i, s := range m.shards {
+		s.deleteSeries(mType, matched[i])
+	}
+	return n, nil
+}
+
+// WriteMetadata implementation WriteMetadata method of storage interface (in-memory storage).
+// Metadata is logged and saved with snapshot, unchanged metadata (e.g. sent by agent again) isn't logged.
+func (m *MemStorage) WriteMetadata(ctx context.Context, meta []models.Metadata) error {
+	if err := validateMetadata(meta); err != nil {
+		return err
+	}
+	meta = tenantMetadata(ctx, meta)
+	m.metaMu.RLock()
+	changed := false
+	for _, v := range meta {
+		if m.metadata[v.ID] != v {
+			changed = true
+			break
+		}
+	}
+	m.metaMu.RUnlock()
+	if !changed {
+		return nil
+	}
+
+	m.lockAll()
+	defer m.unlockAll()
+	// metadata is acknowledged only after it is logged
+	if m.wal != nil {
+		if err := m.wal.append(walRecord{Timestamp: m.now(), Metadata: meta}); err != nil {
+			return fmt.Errorf("write-ahead log failed: %s", err.Error())
+		}
+	}
+	m.metaMu.Lock()
+	defer m.metaMu.Unlock()
+	for _, v := range meta {
+		m.metadata[v.ID] = v
+	}
+	return nil
+}
+
+// GetMetadata implementation GetMetadata method of storage interface (in-memory storage).
+func (m *MemStorage) GetMetadata(ctx context.Context) ([]models.Metadata, error) {
+	m.metaMu.RLock()
+	defer m.metaMu.RUnlock()
+	return metadataOfTenant(m.metadata, TenantFromContext(ctx)), nil
+}
+
+// WriteAlerts implementation WriteAlerts method of storage interface (in-memory storage).
+// Alerts state is logged and saved with snapshot.
+func (m *MemStorage) WriteAlerts(ctx context.Context, alerts []models.Alert) error {
+	ta := tenantAlerts{Tenant: TenantFromContext(ctx), Alerts: append([]models.Alert{}, alerts...)}
+	m.lockAll()
+	defer m.unlockAll()
+	// alerts state is acknowledged only after it is logged
+	if m.wal != nil {
+		if err := m.wal.append(walRecord{Timestamp: m.now(), Alerts: &ta}); err != nil {
+			return fmt.Errorf("write-ahead log failed: %s", err.Error())
 		}
 	}
+	m.metaMu.Lock()
+	defer m.metaMu.Unlock()
+	setAlerts(m.alerts, ta)
 	return nil
 }
 
+// GetAlerts implementation GetAlerts method of storage interface (in-memory storage).
+func (m *MemStorage) GetAlerts(ctx context.Context) ([]models.Alert, error) {
+	m.metaMu.RLock()
+	defer m.metaMu.RUnlock()
+	return alertsOfTenant(m.alerts, TenantFromContext(ctx)), nil
+}
+
 // GetMetric implementation GetMetric method of storage interface (in-memory storage).
+// Gauge and counter values are read without locking.
 func (m *MemStorage) GetMetric(ctx context.Context, mType, name string) (interface{}, error) {
-	m.RLock()
-	defer m.RUnlock()
+	name, err := tenantSeries(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	s := m.shardOf(name)
 	// selecting metric type
 	switch mType {
 	case metrictypes.GaugeType:
-		if v, ok := m.gauge[name]; ok {
+		if v, ok := s.getGauge(name); ok {
 			return v, nil
 		}
 	case metrictypes.CounterType:
-		if v, ok := m.counter[name]; ok {
+		if v, ok := s.getCounter(name); ok {
 			return v, nil
 		}
+	case metrictypes.HistogramType:
+		s.RLock()
+		defer s.RUnlock()
+		if v, ok := s.histogram[name]; ok {
+			return v.Clone(), nil
+		}
 	default:
 		return nil, customerrors.ErrBadMetricType
 	}
 	return nil, customerrors.ErrNoVal
 }
 
+// values collect latest values of all shards, each shard is locked for read in turn.
+func (m *MemStorage) values() memValues {
+	vals := newMemValues()
+	for _, s := range m.shards {
+		s.RLock()
+		s.collect(&vals)
+		s.RUnlock()
+	}
+	return vals
+}
+
+// newMemValues init empty values.
+func newMemValues() memValues {
+	return memValues{
+		gauge:     make(map[string]metrictypes.Gauge),
+		counter:   make(map[string]metrictypes.Counter),
+		histogram: make(map[string]metrictypes.Histogram),
+	}
+}
+
 // GetAllMetricsTxt implementation GetAllMetricsTxt method of storage interface (in-memory storage).
 func (m *MemStorage) GetAllMetricsTxt(ctx context.Context) (string, error) {
-	m.RLock()
-	defer m.RUnlock()
-	s := "---Counters---\n"
-	ck := make([]string, 0, len(m.counter))
-	for k := range m.counter {
-		ck = append(ck, k)
+	return formatMetricsTxt(m.values().ofTenant(TenantFromContext(ctx))), nil
+}
+
+// ScanMetrics implementation ScanMetrics method of storage interface (in-memory storage).
+func (m *MemStorage) ScanMetrics(ctx context.Context, fn func(m models.Metrics) error) error {
+	return scanValues(m.values().ofTenant(TenantFromContext(ctx)), fn)
+}
+
+// scanValues call fn for metric values sorted by type, metric name and labels.
+func scanValues(vals memValues, fn func(m models.Metrics) error) error {
+	metrics := make([]models.Metrics, 0, len(vals.counter)+len(vals.gauge)+len(vals.histogram))
+	for k, v := range vals.counter {
+		id, labels, _ := models.ParseSeriesID(k)
+		metrics = append(metrics, models.Metrics{MType: metrictypes.CounterType, ID: id, Labels: labels, Delta: (*int64)(&v)})
 	}
-	sort.Strings(ck)
-	for _, k := range ck {
-		s += fmt.Sprintf("%v: %v\n", k, m.counter[k])
+	for k, v := range vals.gauge {
+		id, labels, _ := models.ParseSeriesID(k)
+		metrics = append(metrics, models.Metrics{MType: metrictypes.GaugeType, ID: id, Labels: labels, Value: (*float64)(&v)})
 	}
-	s += "---Gauge---\n"
-	gk := make([]string, 0, len(m.gauge))
-	for k := range m.gauge {
-		gk = append(gk, k)
+	for k, v := range vals.histogram {
+		id, labels, _ := models.ParseSeriesID(k)
+		h := models.Histogram(v.Clone())
+		metrics = append(metrics, models.Metrics{MType: metrictypes.HistogramType, ID: id, Labels: labels, Histogram: &h})
 	}
-	sort.Strings(gk)
-	for _, k := range gk {
-		s += fmt.Sprintf("%v: %v\n", k, m.gauge[k])
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].MType != metrics[j].MType {
+			return metrics[i].MType < metrics[j].MType
+		}
+		if metrics[i].ID != metrics[j].ID {
+			return metrics[i].ID < metrics[j].ID
+		}
+		return metrics[i].Labels.String() < metrics[j].Labels.String()
+	})
+	for _, v := range metrics {
+		if err := fn(v); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return s, nil
+// formatMetricsTxt format metric values as text (sorted by series id).
+func formatMetricsTxt(vals memValues) string {
+	var b strings.Builder
+	b.WriteString("---Counters---\n")
+	for _, k := range sortedKeys(vals.counter) {
+		fmt.Fprintf(&b, "%v: %v\n", k, vals.counter[k])
+	}
+	b.WriteString("---Gauge---\n")
+	for _, k := range sortedKeys(vals.gauge) {
+		fmt.Fprintf(&b, "%v: %v\n", k, vals.gauge[k])
+	}
+	if len(vals.histogram) > 0 {
+		b.WriteString("---Histogram---\n")
+		for _, k := range sortedKeys(vals.histogram) {
+			fmt.Fprintf(&b, "%v: %v\n", k, vals.histogram[k])
+		}
+	}
+	return b.String()
 }
 
 // SaveToFile method for saving metrics data to file.
+// Snapshot is written to temporary file and atomically renamed, so crash never leaves partial file.
 func (m *MemStorage) SaveToFile(fname string) error {
-	f, err := os.Create(fname)
-	if err != nil {
-		return err
+	// all shards are locked, so snapshot is consistent with write-ahead log
+	m.rlockAll()
+	defer m.runlockAll()
+	vals := newMemValues()
+	for _, s := range m.shards {
+		s.collect(&vals)
 	}
 
-	m.RLock()
-	defer m.RUnlock()
-
-	defer func() {
-		_ = f.Close()
-	}()
-
-	enc := json.NewEncoder(f)
-
-	for k, v := range m.counter {
-		_ = enc.Encode(models.Metrics{
-			MType: metrictypes.CounterType,
-			ID:    k,
-			Delta: (*int64)(&v),
+	metrics := make([]models.Metrics, 0, len(vals.counter)+len(vals.gauge)+len(vals.histogram))
+	for _, k := range sortedKeys(vals.counter) {
+		v := vals.counter[k]
+		id, labels, _ := models.ParseSeriesID(k)
+		metrics = append(metrics, models.Metrics{
+			MType:  metrictypes.CounterType,
+			ID:     id,
+			Labels: labels,
+			Delta:  (*int64)(&v),
+		})
+	}
+	for _, k := range sortedKeys(vals.gauge) {
+		v := vals.gauge[k]
+		id, labels, _ := models.ParseSeriesID(k)
+		metrics = append(metrics, models.Metrics{
+			MType:  metrictypes.GaugeType,
+			ID:     id,
+			Labels: labels,
+			Value:  (*float64)(&v),
 		})
 	}
-	for k, v := range m.gauge {
-		_ = enc.Encode(models.Metrics{
-			MType: metrictypes.GaugeType,
-			ID:    k,
-			Value: (*float64)(&v),
+	for _, k := range sortedKeys(vals.histogram) {
+		h := models.Histogram(vals.histogram[k])
+		id, labels, _ := models.ParseSeriesID(k)
+		metrics = append(metrics, models.Metrics{
+			MType:     metrictypes.HistogramType,
+			ID:        id,
+			Labels:    labels,
+			Histogram: &h,
 		})
 	}
+	m.metaMu.RLock()
+	meta := sortedMetadata(m.metadata)
+	alerts := sortedAlerts(m.alerts)
+	m.metaMu.RUnlock()
+	var walSeq uint64
+	if m.wal != nil {
+		walSeq = m.wal.lastSeq()
+	}
+	if err := writeSnapshot(fname, m.now(), walSeq, metrics, meta, alerts); err != nil {
+		return err
+	}
+	// snapshot contains all logged writes (log is not changed while shards are locked)
+	if m.wal != nil {
+		return m.wal.truncate()
+	}
 	return nil
 }
 
 // ReadFromFile method for reading metrics data from file.
+// Any snapshot damage (bad checksum or line) is an error and nothing is restored.
+// Write-ahead log (if enabled) is replayed on top of the snapshot.
 func (m *MemStorage) ReadFromFile(fname string) error {
-	f, err := os.Open(fname)
-	if err != nil {
-		return err
-	}
-
-	m.Lock()
-	defer m.Unlock()
+	_, err := m.restore(fname, false)
+	return err
+}
 
-	defer func() {
-		_ = f.Close()
-	}()
+// ReadFromFileTolerant method for reading metrics data from damaged file.
+// Corrupt lines are skipped and reported, all valid metrics are restored.
+func (m *MemStorage) ReadFromFileTolerant(fname string) (*SnapshotReport, error) {
+	return m.restore(fname, true)
+}
 
-	scanner := bufio.NewScanner(f)
+// restore load snapshot and replay write-ahead log.
+func (m *MemStorage) restore(fname string, tolerant bool) (*SnapshotReport, error) {
+	m.lockAll()
+	defer m.unlockAll()
+	m.metaMu.Lock()
+	defer m.metaMu.Unlock()
 
-	for scanner.Scan() {
-		metric := &models.Metrics{}
-		if err := json.Unmarshal(scanner.Bytes(), metric); err != nil {
-			return err
-		}
-		// selecting metric type
-		switch metric.MType {
-		case metrictypes.CounterType:
-			m.counter[metric.ID] = metrictypes.Counter(*metric.Delta)
-		case metrictypes.GaugeType:
-			m.gauge[metric.ID] = metrictypes.Gauge(*metric.Value)
+	metrics, meta, alerts, report, err := readSnapshot(fname, tolerant)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && m.wal != nil {
+			// no snapshot yet, all writes are in log
+			return report, m.replayWAL(0)
 		}
+		return report, err
 	}
-	if err := scanner.Err(); err != nil {
-		return err
+	for _, metric := range metrics {
+		m.shardOf(metric.SeriesID()).restoreMetric(metric)
 	}
-	return nil
+	for _, v := range meta {
+		m.metadata[v.ID] = v
+	}
+	for _, v := range alerts {
+		setAlerts(m.alerts, v)
+	}
+	// records of snapshot are skipped, if log wasn't truncated after it
+	return report, m.replayWAL(report.WALSeq)
+}
+
+// sortedKeys return map keys in sorted order.
+func sortedKeys[V any](mp map[string]V) []string {
+	keys := make([]string, 0, len(mp))
+	for k := range mp {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
-// NewMemStorage init in-memory storage.
+// NewMemStorage init in-memory storage with default number of shards.
 func NewMemStorage() *MemStorage {
-	return &MemStorage{gauge: make(map[string]metrictypes.Gauge), counter: make(map[string]metrictypes.Counter)}
+	return NewShardedMemStorage(defaultMemShards)
+}
+
+// NewShardedMemStorage init in-memory storage with number of shards (rounded up to power of two).
+// Storage with one shard serializes all writes.
+func NewShardedMemStorage(shards int) *MemStorage {
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+	m := &MemStorage{
+		shards:      make([]*memShard, n),
+		rollupMarks: make(map[time.Duration]time.Time),
+		now:         time.Now,
+		metadata:    make(map[string]models.Metadata),
+		alerts:      make(map[string][]models.Alert),
+	}
+	for i := range m.shards {
+		m.shards[i] = newMemShard()
+	}
+	return m
 }
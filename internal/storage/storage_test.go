@@ -2,13 +2,14 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"testing"
+	"time"
 
-	"github.com/golang/mock/gomock"
+	"github.com/sourcecd/monitoring/internal/customerrors"
 	"github.com/sourcecd/monitoring/internal/metrictypes"
 	"github.com/sourcecd/monitoring/internal/models"
-	"github.com/sourcecd/monitoring/mocks"
 	"github.com/stretchr/testify/require"
 )
 
@@ -29,6 +30,118 @@ func TestFileWrite(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestLabeledSeries(t *testing.T) {
+	tmpFile := "test_save_labels_to_file.tmp"
+	t.Cleanup(func() { os.Remove(tmpFile) })
+
+	ctx := context.Background()
+	memStorage := NewMemStorage()
+	v1, v2 := 0.1, 0.2
+	err := memStorage.WriteBatchMetrics(ctx, []models.Metrics{
+		{ID: "CPUutilization", MType: "gauge", Value: &v1, Labels: models.Labels{"cpu": "0", "host": "h1"}},
+		{ID: "CPUutilization", MType: "gauge", Value: &v2, Labels: models.Labels{"cpu": "1", "host": "h1"}},
+	})
+	require.NoError(t, err)
+
+	// same name, different labels are different series
+	g, err := memStorage.GetMetric(ctx, "gauge", `CPUutilization{cpu="0",host="h1"}`)
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(0.1), g)
+	g, err = memStorage.GetMetric(ctx, "gauge", `CPUutilization{cpu="1",host="h1"}`)
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(0.2), g)
+	_, err = memStorage.GetMetric(ctx, "gauge", "CPUutilization")
+	require.ErrorIs(t, err, customerrors.ErrNoVal)
+
+	// labels survive snapshot
+	require.NoError(t, memStorage.SaveToFile(tmpFile))
+	restored := NewMemStorage()
+	require.NoError(t, restored.ReadFromFile(tmpFile))
+	g, err = restored.GetMetric(ctx, "gauge", `CPUutilization{cpu="1",host="h1"}`)
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(0.2), g)
+}
+
+func TestTypeNamespaces(t *testing.T) {
+	ctx := context.Background()
+	memStorage := NewMemStorage()
+
+	// same name in different types are different series
+	require.NoError(t, memStorage.WriteMetric(ctx, "gauge", "test", metrictypes.Gauge(0.5)))
+	require.NoError(t, memStorage.WriteMetric(ctx, "counter", "test", metrictypes.Counter(2)))
+	g, err := memStorage.GetMetric(ctx, "gauge", "test")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(0.5), g)
+	c, err := memStorage.GetMetric(ctx, "counter", "test")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(2), c)
+	_, err = memStorage.GetMetric(ctx, "histogram", "test")
+	require.ErrorIs(t, err, customerrors.ErrNoVal)
+
+	// series ids are canonicalized as in postgres storage
+	require.NoError(t, memStorage.WriteMetric(ctx, "gauge", `test{b="2",a="1"}`, metrictypes.Gauge(1)))
+	g, err = memStorage.GetMetric(ctx, "gauge", `test{a="1",b="2"}`)
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(1), g)
+	h, err := memStorage.GetMetricHistory(ctx, "gauge", `test{b="2",a="1"}`, time.Unix(0, 0), time.Now())
+	require.NoError(t, err)
+	require.Len(t, h, 1)
+
+	require.ErrorIs(t, memStorage.WriteMetric(ctx, "gauge", `test{a=1}`, metrictypes.Gauge(1)), models.ErrWrongSeriesID)
+	require.ErrorIs(t, memStorage.WriteMetric(ctx, "gauge", `te,st{a="1"}`, metrictypes.Gauge(1)), models.ErrWrongSeriesID)
+	require.NoError(t, memStorage.WriteBatchMetrics(ctx, []models.Metrics{{ID: "te st", MType: "gauge", Value: new(float64)}}))
+	_, err = memStorage.GetMetric(ctx, "gauge", "te st")
+	require.ErrorIs(t, err, customerrors.ErrNoVal)
+	_, err = memStorage.GetMetric(ctx, "gauge", `test{a=1}`)
+	require.ErrorIs(t, err, models.ErrWrongSeriesID)
+}
+
+func TestHistogramMetrics(t *testing.T) {
+	tmpFile := "test_save_hist_to_file.tmp"
+	t.Cleanup(func() { os.Remove(tmpFile) })
+
+	ctx := context.Background()
+	memStorage := NewMemStorage()
+
+	h := metrictypes.NewHistogram([]float64{1, 2})
+	h.Observe(0.5)
+	require.NoError(t, memStorage.WriteMetric(ctx, "histogram", "testHist", h))
+	hm := models.Histogram(h)
+	require.NoError(t, memStorage.WriteBatchMetrics(ctx, []models.Metrics{{ID: "testHist", MType: "histogram", Histogram: &hm}}))
+
+	// buckets are summed
+	v, err := memStorage.GetMetric(ctx, "histogram", "testHist")
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 0, 0}, v.(metrictypes.Histogram).Counts)
+	require.Equal(t, uint64(2), v.(metrictypes.Histogram).Count)
+
+	// stored histogram isn't changed by caller
+	v.(metrictypes.Histogram).Counts[0] = 100
+	v, err = memStorage.GetMetric(ctx, "histogram", "testHist")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), v.(metrictypes.Histogram).Counts[0])
+
+	require.ErrorIs(t, memStorage.WriteMetric(ctx, "histogram", "testHist", metrictypes.NewHistogram([]float64{5})), customerrors.ErrHistogramBounds)
+	require.ErrorIs(t, memStorage.WriteMetric(ctx, "histogram", "testHist", metrictypes.Histogram{}), customerrors.ErrWrongHistogram)
+	require.ErrorIs(t, memStorage.WriteMetric(ctx, "histogram", "testHist", 0.1), customerrors.ErrWrongMetricValueType)
+
+	hist, err := memStorage.GetMetricHistory(ctx, "histogram", "testHist", time.Unix(0, 0), time.Now())
+	require.NoError(t, err)
+	require.Len(t, hist, 2)
+	require.Equal(t, uint64(1), hist[1].Histogram.Count)
+
+	all, err := memStorage.GetAllMetricsTxt(ctx)
+	require.NoError(t, err)
+	require.Contains(t, all, "---Histogram---\ntestHist: count=2 sum=1 p50=0.5 p90=0.9 p99=0.99\n")
+
+	require.NoError(t, memStorage.SaveToFile(tmpFile))
+	restored := NewMemStorage()
+	require.NoError(t, restored.ReadFromFile(tmpFile))
+	v, err = restored.GetMetric(ctx, "histogram", "testHist")
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), v.(metrictypes.Histogram).Count)
+}
+
 func TestPing(t *testing.T) {
 	ctx := context.Background()
 	memStorage := NewMemStorage()
@@ -58,20 +171,264 @@ func TestWriteBatchMetrics(t *testing.T) {
 	require.NoError(t, err)
 }
 
-func TestAllGoMocks(t *testing.T) {
+func TestGetMetricHistory(t *testing.T) {
 	ctx := context.Background()
-	ctrl := gomock.NewController(t)
-	t.Cleanup(func() { ctrl.Finish() })
+	memStorage := NewMemStorage()
+	ts := time.Unix(1000, 0)
+	memStorage.now = func() time.Time { return ts }
+
+	d := int64(2)
+	f := float64(0.3)
+	for i := 0; i < 3; i++ {
+		ts = ts.Add(time.Minute)
+		require.NoError(t, memStorage.WriteMetric(ctx, "gauge", "testGauge", metrictypes.Gauge(float64(i))))
+		require.NoError(t, memStorage.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(1)))
+	}
+	ts = ts.Add(time.Minute)
+	err := memStorage.WriteBatchMetrics(ctx, []models.Metrics{
+		{ID: "testGauge", MType: "gauge", Value: &f},
+		{ID: "testCounter", MType: "counter", Delta: &d},
+	})
+	require.NoError(t, err)
+
+	// full range
+	h, err := memStorage.GetMetricHistory(ctx, "gauge", "testGauge", time.Unix(0, 0), ts)
+	require.NoError(t, err)
+	require.Len(t, h, 4)
+	require.Equal(t, 0.3, *h[3].Value)
+	require.Equal(t, ts, h[3].Timestamp)
+
+	// inclusive bounds
+	h, err = memStorage.GetMetricHistory(ctx, "counter", "testCounter", time.Unix(1120, 0), time.Unix(1180, 0))
+	require.NoError(t, err)
+	require.Len(t, h, 2)
+	require.Equal(t, int64(1), *h[0].Delta)
+
+	// current value is not changed by history
+	c, err := memStorage.GetMetric(ctx, "counter", "testCounter")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(5), c)
+
+	h, err = memStorage.GetMetricHistory(ctx, "gauge", "testGauge", time.Unix(0, 0), time.Unix(1000, 0))
+	require.NoError(t, err)
+	require.Empty(t, h)
+
+	_, err = memStorage.GetMetricHistory(ctx, "wrong", "testGauge", time.Unix(0, 0), ts)
+	require.ErrorIs(t, err, customerrors.ErrBadMetricType)
+}
+
+func TestMatchSeriesPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		series  string
+		want    bool
+	}{
+		{"CPUutilization*", "CPUutilization1", true},
+		{"CPUutilization*", "CPUutilization", true},
+		{"CPUutilization*", "cpuUtilization1", false},
+		{"CPUutilization?", "CPUutilization12", false},
+		{"*{host=\"old\"}", `load{host="old"}`, true},
+		{"*{host=\"old\"}", `load{host="new"}`, false},
+		{"a*b*c", "axxbyybzc", true},
+		{"a*b*c", "axxcyyb", false},
+		{"*", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+"/"+tt.series, func(t *testing.T) {
+			require.Equal(t, tt.want, MatchSeriesPattern(tt.pattern, tt.series))
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+	memStorage := NewMemStorage()
+	policy, err := ParseRetention("raw:1h,1m:24h")
+	require.NoError(t, err)
+	ts := time.Unix(0, 0)
+	memStorage.now = func() time.Time { return ts }
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, memStorage.WriteMetric(ctx, "gauge", fmt.Sprintf("CPUutilization%d", i), metrictypes.Gauge(i)))
+	}
+	require.NoError(t, memStorage.WriteMetric(ctx, "counter", "CPUutilization1", metrictypes.Counter(1)))
+	require.NoError(t, memStorage.WriteMetric(ctx, "gauge", `Load{host="a",dc="1"}`, metrictypes.Gauge(1)))
+	require.NoError(t, memStorage.Compact(ctx, policy, time.Unix(120, 0)))
+	r, err := memStorage.GetMetricRollups(ctx, "gauge", "CPUutilization1", time.Minute, ts, time.Unix(120, 0))
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+
+	// single series id in any labels order
+	n, err := memStorage.Delete(ctx, "gauge", `Load{host="a",dc="1"}`)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	// pattern deletes series of one type with history and rollups
+	n, err = memStorage.Delete(ctx, "gauge", "CPUutilization*")
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	_, err = memStorage.GetMetric(ctx, "gauge", "CPUutilization1")
+	require.ErrorIs(t, err, customerrors.ErrNoVal)
+	h, err := memStorage.GetMetricHistory(ctx, "gauge", "CPUutilization1", ts, ts)
+	require.NoError(t, err)
+	require.Empty(t, h)
+	r, err = memStorage.GetMetricRollups(ctx, "gauge", "CPUutilization1", time.Minute, ts, time.Unix(120, 0))
+	require.NoError(t, err)
+	require.Empty(t, r)
+	c, err := memStorage.GetMetric(ctx, "counter", "CPUutilization1")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(1), c)
+
+	_, err = memStorage.Delete(ctx, "gauge", "CPUutilization*")
+	require.ErrorIs(t, err, customerrors.ErrNoVal)
+	_, err = memStorage.Delete(ctx, "wrong", "CPUutilization*")
+	require.ErrorIs(t, err, customerrors.ErrBadMetricType)
+	_, err = memStorage.Delete(ctx, "gauge", "Load{host")
+	require.ErrorIs(t, err, models.ErrWrongSeriesID)
+
+	// deleted series can be written again
+	require.NoError(t, memStorage.WriteMetric(ctx, "gauge", "CPUutilization1", metrictypes.Gauge(5)))
+	g, err := memStorage.GetMetric(ctx, "gauge", "CPUutilization1")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(5), g)
+}
+
+func TestMetadata(t *testing.T) {
+	dir := t.TempDir()
+	tmpFile := dir + "/metrics.json"
+	walFile := dir + "/metrics.wal"
+	ctx := context.Background()
+	memStorage := NewMemStorage()
+	require.NoError(t, memStorage.EnableWAL(walFile, WALFsyncNo))
+
+	meta := []models.Metadata{
+		{ID: "TotalMemory", MType: "gauge", Unit: "bytes", Description: "Total amount of RAM"},
+		{ID: "CPUutilization", MType: "gauge", Unit: "percent"},
+	}
+	require.NoError(t, memStorage.WriteMetadata(ctx, meta))
+	require.ErrorIs(t, memStorage.WriteMetadata(ctx, []models.Metadata{{Unit: "bytes"}}), customerrors.ErrWrongMetadata)
+	require.ErrorIs(t, memStorage.WriteMetadata(ctx, []models.Metadata{{ID: "x", MType: "wrong"}}), customerrors.ErrWrongMetadata)
+	got, err := memStorage.GetMetadata(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []models.Metadata{meta[1], meta[0]}, got)
+
+	// saved with snapshot
+	require.NoError(t, memStorage.SaveToFile(tmpFile))
+	// unchanged metadata isn't logged
+	require.NoError(t, memStorage.WriteMetadata(ctx, meta[:1]))
+	st, err := os.Stat(walFile)
+	require.NoError(t, err)
+	require.Zero(t, st.Size())
+	// changed after snapshot, restored from log
+	require.NoError(t, memStorage.WriteMetadata(ctx, []models.Metadata{{ID: "TotalMemory", MType: "gauge", Unit: "kilobytes"}}))
+	require.NoError(t, memStorage.CloseWAL())
+
+	restored := NewMemStorage()
+	require.NoError(t, restored.EnableWAL(walFile, WALFsyncNo))
+	t.Cleanup(func() { restored.CloseWAL() })
+	report, err := restored.ReadFromFileTolerant(tmpFile)
+	require.NoError(t, err)
+	require.False(t, report.ChecksumMismatch)
+	require.Empty(t, report.Skipped)
+	got, err = restored.GetMetadata(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []models.Metadata{meta[1], {ID: "TotalMemory", MType: "gauge", Unit: "kilobytes"}}, got)
+}
+
+// testAlerts alerts state of storage tests.
+func testAlerts() []models.Alert {
+	fired := time.Unix(1700000060, 0).UTC()
+	return []models.Alert{
+		{
+			ActiveAt: time.Unix(1700000000, 0).UTC(),
+			FiredAt:  &fired,
+			Labels:   models.Labels{"alertname": "HighCPU", "host": "a"},
+			Rule:     "HighCPU",
+			State:    models.AlertFiring,
+			Value:    95,
+		},
+		{ActiveAt: time.Unix(1700000030, 0).UTC(), Labels: models.Labels{"alertname": "HighLoad"}, Rule: "HighLoad", State: models.AlertPending, Value: 2},
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	dir := t.TempDir()
+	tmpFile := dir + "/metrics.json"
+	walFile := dir + "/metrics.wal"
+	ctx := context.Background()
+	teamA := WithTenant(ctx, "teamA")
+	memStorage := NewMemStorage()
+	require.NoError(t, memStorage.EnableWAL(walFile, WALFsyncNo))
+
+	alerts := testAlerts()
+	got, err := memStorage.GetAlerts(ctx)
+	require.NoError(t, err)
+	require.Empty(t, got)
+	require.NoError(t, memStorage.WriteAlerts(ctx, alerts))
+	require.NoError(t, memStorage.WriteAlerts(teamA, alerts[1:]))
+	got, err = memStorage.GetAlerts(ctx)
+	require.NoError(t, err)
+	require.Equal(t, alerts, got)
+
+	// saved with snapshot, changed after snapshot state is restored from log
+	require.NoError(t, memStorage.SaveToFile(tmpFile))
+	require.NoError(t, memStorage.WriteAlerts(ctx, alerts[:1]))
+	require.NoError(t, memStorage.CloseWAL())
+
+	restored := NewMemStorage()
+	require.NoError(t, restored.EnableWAL(walFile, WALFsyncNo))
+	t.Cleanup(func() { restored.CloseWAL() })
+	report, err := restored.ReadFromFileTolerant(tmpFile)
+	require.NoError(t, err)
+	require.False(t, report.ChecksumMismatch)
+	require.Empty(t, report.Skipped)
+	got, err = restored.GetAlerts(ctx)
+	require.NoError(t, err)
+	require.Equal(t, alerts[:1], got)
+	got, err = restored.GetAlerts(teamA)
+	require.NoError(t, err)
+	require.Equal(t, alerts[1:], got)
+
+	// empty state is dropped
+	require.NoError(t, restored.WriteAlerts(teamA, nil))
+	got, err = restored.GetAlerts(teamA)
+	require.NoError(t, err)
+	require.Empty(t, got)
+}
+
+func TestScanMetrics(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	memStorage := NewMemStorage()
+	h := metrictypes.NewHistogram([]float64{1})
+	h.Observe(0.5)
+	require.NoError(t, memStorage.WriteMetric(ctx, "gauge", `Alloc{host="h1"}`, metrictypes.Gauge(2)))
+	require.NoError(t, memStorage.WriteMetric(ctx, "gauge", "Alloc2", metrictypes.Gauge(3)))
+	require.NoError(t, memStorage.WriteMetric(ctx, "gauge", "Alloc", metrictypes.Gauge(1)))
+	require.NoError(t, memStorage.WriteMetric(ctx, "counter", "PollCount", metrictypes.Counter(5)))
+	require.NoError(t, memStorage.WriteMetric(ctx, "histogram", "Latency", h))
+	require.NoError(t, memStorage.WriteMetric(WithTenant(ctx, "teamA"), "gauge", "Alloc", metrictypes.Gauge(4)))
 
-	mDB := mocks.NewMockStoreMetrics(ctrl)
+	// series of metric name are consecutive, series of other tenants are skipped
+	var series []string
+	require.NoError(t, memStorage.ScanMetrics(ctx, func(m models.Metrics) error {
+		series = append(series, m.MType+" "+m.SeriesID())
+		return nil
+	}))
+	require.Equal(t, []string{"counter PollCount", "gauge Alloc", `gauge Alloc{host="h1"}`, "gauge Alloc2", "histogram Latency"}, series)
 
-	mDB.EXPECT().GetAllMetricsTxt(gomock.Any()).Return("test", nil)
-	mDB.EXPECT().GetMetric(gomock.Any(), gomock.Any(), gomock.Any()).Return(gomock.Any(), nil)
-	mDB.EXPECT().WriteBatchMetrics(gomock.Any(), gomock.Any()).Return(nil)
-	mDB.EXPECT().WriteMetric(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil)
+	var metrics []models.Metrics
+	require.NoError(t, memStorage.ScanMetrics(WithTenant(ctx, "teamA"), func(m models.Metrics) error {
+		metrics = append(metrics, m)
+		return nil
+	}))
+	v := 4.0
+	require.Equal(t, []models.Metrics{{MType: "gauge", ID: "Alloc", Value: &v}}, metrics)
 
-	mDB.GetAllMetricsTxt(ctx)
-	mDB.GetMetric(ctx, "test1", "test2")
-	mDB.WriteBatchMetrics(ctx, []models.Metrics{})
-	mDB.WriteMetric(ctx, "test3", "test4", "ok")
+	calls := 0
+	require.ErrorIs(t, memStorage.ScanMetrics(ctx, func(m models.Metrics) error {
+		calls++
+		return customerrors.ErrNoVal
+	}), customerrors.ErrNoVal)
+	require.Equal(t, 1, calls)
 }
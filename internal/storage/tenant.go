@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+// tenantLabel reserved label, which partitions series of tenants in in-memory and disk storages
+// (series of default tenant have no such label, postgres DB storage has tenant column instead).
+const tenantLabel = "__tenant__"
+
+// tenantCtxKey type of context key of tenant.
+type tenantCtxKey struct{}
+
+// WithTenant return context of tenant requests: storage methods read and write only series and metadata of this tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantCtxKey{}, tenant)
+}
+
+// TenantFromContext return tenant of context (empty string - default tenant).
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantCtxKey{}).(string)
+	return tenant
+}
+
+// checkReservedLabels check that labels of written or requested series don't include reserved tenant label.
+func checkReservedLabels(labels models.Labels) error {
+	if _, ok := labels[tenantLabel]; ok {
+		return fmt.Errorf("%w: label %s is reserved", models.ErrWrongSeriesID, tenantLabel)
+	}
+	return nil
+}
+
+// tenantLabels return labels of tenant series (labels of caller aren't changed).
+func tenantLabels(tenant string, labels models.Labels) (models.Labels, error) {
+	if err := checkReservedLabels(labels); err != nil {
+		return nil, err
+	}
+	if tenant == "" {
+		return labels, nil
+	}
+	res := make(models.Labels, len(labels)+1)
+	for k, v := range labels {
+		res[k] = v
+	}
+	res[tenantLabel] = tenant
+	return res, nil
+}
+
+// tenantSeries return storage series id of context tenant series.
+func tenantSeries(ctx context.Context, series string) (string, error) {
+	id, labels, err := models.ParseSeriesID(series)
+	if err != nil {
+		return "", err
+	}
+	labels, err = tenantLabels(TenantFromContext(ctx), labels)
+	if err != nil {
+		return "", err
+	}
+	return models.SeriesID(id, labels), nil
+}
+
+// tenantBatch return batch metrics with labels of context tenant, metrics with wrong names or reserved label are skipped.
+func tenantBatch(ctx context.Context, metrics []models.Metrics) []models.Metrics {
+	tenant := TenantFromContext(ctx)
+	res := make([]models.Metrics, 0, len(metrics))
+	for _, v := range metrics {
+		// metrics without id are skipped by storage
+		if v.ID != "" {
+			if err := models.ValidateSeries(v.ID, v.Labels); err != nil {
+				log.Printf("metric %q: %s", v.ID, err.Error())
+				continue
+			}
+		}
+		labels, err := tenantLabels(tenant, v.Labels)
+		if err != nil {
+			log.Printf("metric %s: %s", v.ID, err.Error())
+			continue
+		}
+		v.Labels = labels
+		res = append(res, v)
+	}
+	return res
+}
+
+// splitTenant return tenant and series id without tenant label of storage series.
+func splitTenant(series string) (string, string) {
+	// fast path: most of series belong to default tenant
+	if !strings.Contains(series, tenantLabel+`="`) {
+		return "", series
+	}
+	id, labels, err := models.ParseSeriesID(series)
+	if err != nil {
+		return "", series
+	}
+	tenant, ok := labels[tenantLabel]
+	if !ok {
+		return "", series
+	}
+	delete(labels, tenantLabel)
+	return tenant, models.SeriesID(id, labels)
+}
+
+// tenantMetadata return metadata with storage ids of context tenant (metric names are validated, see validateMetadata).
+func tenantMetadata(ctx context.Context, meta []models.Metadata) []models.Metadata {
+	tenant := TenantFromContext(ctx)
+	if tenant == "" {
+		return meta
+	}
+	res := make([]models.Metadata, 0, len(meta))
+	for _, v := range meta {
+		v.ID = models.SeriesID(v.ID, models.Labels{tenantLabel: tenant})
+		res = append(res, v)
+	}
+	return res
+}
+
+// ofTenant return values of tenant series with series ids without tenant label.
+func (vals memValues) ofTenant(tenant string) memValues {
+	res := newMemValues()
+	for k, v := range vals.gauge {
+		if t, series := splitTenant(k); t == tenant {
+			res.gauge[series] = v
+		}
+	}
+	for k, v := range vals.counter {
+		if t, series := splitTenant(k); t == tenant {
+			res.counter[series] = v
+		}
+	}
+	for k, v := range vals.histogram {
+		if t, series := splitTenant(k); t == tenant {
+			res.histogram[series] = v
+		}
+	}
+	return res
+}
+
+// metadataOfTenant return metadata of tenant (sorted by name) from metadata of all tenants by storage id.
+func metadataOfTenant(mp map[string]models.Metadata, tenant string) []models.Metadata {
+	meta := []models.Metadata{}
+	for k, v := range mp {
+		t, name := splitTenant(k)
+		if t != tenant {
+			continue
+		}
+		v.ID = name
+		meta = append(meta, v)
+	}
+	sort.Slice(meta, func(i, j int) bool { return meta[i].ID < meta[j].ID })
+	return meta
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+func TestTenantSeries(t *testing.T) {
+	ctx := context.Background()
+	tctx := WithTenant(ctx, "teamA")
+	require.Equal(t, "", TenantFromContext(ctx))
+	require.Equal(t, "teamA", TenantFromContext(tctx))
+
+	s, err := tenantSeries(ctx, `Alloc{host="h1"}`)
+	require.NoError(t, err)
+	require.Equal(t, `Alloc{host="h1"}`, s)
+	s, err = tenantSeries(tctx, `Alloc{host="h1"}`)
+	require.NoError(t, err)
+	require.Equal(t, `Alloc{__tenant__="teamA",host="h1"}`, s)
+	_, err = tenantSeries(ctx, `Alloc{__tenant__="teamA"}`)
+	require.ErrorIs(t, err, models.ErrWrongSeriesID)
+
+	tenant, series := splitTenant(s)
+	require.Equal(t, "teamA", tenant)
+	require.Equal(t, `Alloc{host="h1"}`, series)
+	tenant, series = splitTenant(`Alloc{host="h1"}`)
+	require.Equal(t, "", tenant)
+	require.Equal(t, `Alloc{host="h1"}`, series)
+
+	// labels of caller are not changed, metrics with reserved label are skipped
+	v := 1.0
+	labels := models.Labels{"host": "h1"}
+	batch := tenantBatch(tctx, []models.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &v, Labels: labels},
+		{ID: "Alloc", MType: "gauge", Value: &v, Labels: models.Labels{tenantLabel: "teamB"}},
+	})
+	require.Len(t, batch, 1)
+	require.Equal(t, models.Labels{"host": "h1", tenantLabel: "teamA"}, batch[0].Labels)
+	require.Equal(t, models.Labels{"host": "h1"}, labels)
+}
+
+func TestTenantIsolation(t *testing.T) {
+	walFile := "test_wal_tenant.tmp"
+	snapFile := "test_snapshot_tenant.tmp"
+	t.Cleanup(func() {
+		os.Remove(walFile)
+		os.Remove(snapFile)
+	})
+	ctx := context.Background()
+	teamA := WithTenant(ctx, "teamA")
+	teamB := WithTenant(ctx, "teamB")
+
+	m := NewMemStorage()
+	require.NoError(t, m.EnableWAL(walFile, WALFsyncAlways))
+	require.NoError(t, m.WriteMetric(ctx, "gauge", "Alloc", metrictypes.Gauge(1)))
+	require.NoError(t, m.WriteMetric(teamA, "gauge", "Alloc", metrictypes.Gauge(2)))
+	require.NoError(t, m.WriteBatchMetrics(teamB, []models.Metrics{{ID: "Alloc", MType: "gauge", Value: func(v float64) *float64 { return &v }(3)}}))
+	require.NoError(t, m.WriteMetadata(teamA, []models.Metadata{{ID: "Alloc", Unit: "bytes"}}))
+	require.ErrorIs(t, m.WriteMetadata(teamA, []models.Metadata{{ID: `Alloc{__tenant__="teamB"}`}}), customerrors.ErrWrongMetadata)
+	require.ErrorIs(t, m.WriteMetric(teamA, "gauge", `Alloc{__tenant__="teamB"}`, metrictypes.Gauge(4)), models.ErrWrongSeriesID)
+
+	check := func(m *MemStorage) {
+		for tctx, want := range map[context.Context]metrictypes.Gauge{ctx: 1, teamA: 2, teamB: 3} {
+			g, err := m.GetMetric(tctx, "gauge", "Alloc")
+			require.NoError(t, err)
+			require.Equal(t, want, g)
+		}
+		txt, err := m.GetAllMetricsTxt(teamA)
+		require.NoError(t, err)
+		require.Equal(t, "---Counters---\n---Gauge---\nAlloc: 2\n", txt)
+		meta, err := m.GetMetadata(teamA)
+		require.NoError(t, err)
+		require.Equal(t, []models.Metadata{{ID: "Alloc", Unit: "bytes"}}, meta)
+		meta, err = m.GetMetadata(teamB)
+		require.NoError(t, err)
+		require.Empty(t, meta)
+	}
+	check(m)
+
+	// snapshot keeps tenants, pattern delete of tenant is logged with tenant
+	require.NoError(t, m.SaveToFile(snapFile))
+	n, err := m.Delete(teamB, "gauge", "*")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.NoError(t, m.WriteMetric(teamB, "gauge", "Alloc", metrictypes.Gauge(3)))
+	require.NoError(t, m.CloseWAL())
+
+	restored := NewMemStorage()
+	require.NoError(t, restored.EnableWAL(walFile, WALFsyncNo))
+	t.Cleanup(func() { restored.CloseWAL() })
+	require.NoError(t, restored.ReadFromFile(snapFile))
+	check(restored)
+	h, err := restored.GetMetricHistory(teamB, "gauge", "Alloc", m.now().Add(-time.Hour), m.now())
+	require.NoError(t, err)
+	require.Len(t, h, 1)
+}
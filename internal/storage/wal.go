@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sourcecd/monitoring/internal/models"
+)
+
+// Fsync modes of write-ahead log.
+const (
+	WALFsyncAlways   = "always"   // fsync after every record, no acknowledged write is lost
+	WALFsyncEverySec = "everysec" // fsync once per second, up to one second of writes may be lost on power failure
+	WALFsyncNo       = "no"       // never fsync, flushing is left to operating system
+)
+
+// Interval of background fsync in everysec mode.
+const walFsyncInterval = time.Second
+
+// ErrWrongWALFsync error for unknown fsync mode.
+var ErrWrongWALFsync = errors.New("wrong wal fsync mode")
+
+// walRecord type of single write-ahead log record (one accepted write, delete, metadata or alerts state change).
+type walRecord struct {
+	Seq       uint64            `json:"seq,omitempty"`      // record sequence number (increases across restarts)
+	Timestamp time.Time         `json:"ts"`                 // time of write
+	Metrics   []models.Metrics  `json:"metrics"`            // accepted metrics
+	Delete    *walDelete        `json:"delete,omitempty"`   // deleted series (delete record)
+	Metadata  []models.Metadata `json:"metadata,omitempty"` // registered metadata (metadata record)
+	Alerts    *tenantAlerts     `json:"alerts,omitempty"`   // saved alerts state (alerts record)
+}
+
+// walDelete deleted series of write-ahead log record.
+type walDelete struct {
+	MType  string `json:"type"`             // metric type
+	Name   string `json:"name"`             // series id or pattern
+	Tenant string `json:"tenant,omitempty"` // tenant of deleted series
+}
+
+// writeAheadLog append-only log of accepted metric writes (json line per record).
+type writeAheadLog struct {
+	f     *os.File
+	w     *bufio.Writer
+	fsync string
+	seq   uint64 // sequence number of last record
+	done  chan struct{}
+	wg    sync.WaitGroup
+	sync.Mutex
+}
+
+// openWAL open (or create) write-ahead log file for append.
+func openWAL(fname, fsync string) (*writeAheadLog, error) {
+	switch fsync {
+	case WALFsyncAlways, WALFsyncEverySec, WALFsyncNo:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrWrongWALFsync, fsync)
+	}
+	f, err := os.OpenFile(fname, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	w := &writeAheadLog{
+		f:     f,
+		w:     bufio.NewWriter(f),
+		fsync: fsync,
+		done:  make(chan struct{}),
+	}
+	if fsync == WALFsyncEverySec {
+		w.wg.Add(1)
+		go w.syncLoop()
+	}
+	return w, nil
+}
+
+// syncLoop periodic fsync of log file (everysec mode).
+func (w *writeAheadLog) syncLoop() {
+	defer w.wg.Done()
+	t := time.NewTicker(walFsyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-t.C:
+			w.Lock()
+			if err := w.f.Sync(); err != nil {
+				log.Printf("wal fsync: %s", err.Error())
+			}
+			w.Unlock()
+		}
+	}
+}
+
+// append write record to log, record is flushed to file before return.
+// Sequence number is unix time in nanoseconds (or next number, if clock is behind), so numbers of
+// records increase after restart too and records of new log are never older than previous snapshot.
+func (w *writeAheadLog) append(rec walRecord) error {
+	w.Lock()
+	defer w.Unlock()
+	rec.Seq = max(w.seq+1, uint64(time.Now().UnixNano()))
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	w.seq = rec.Seq
+	if _, err := w.w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	if w.fsync == WALFsyncAlways {
+		return w.f.Sync()
+	}
+	return nil
+}
+
+// lastSeq return sequence number of last record.
+func (w *writeAheadLog) lastSeq() uint64 {
+	w.Lock()
+	defer w.Unlock()
+	return w.seq
+}
+
+// replay read log records after sequence number and pass them to apply function.
+// Records up to sequence number are already in snapshot (crash between snapshot and log truncate),
+// broken records (e.g. torn last line after crash) are skipped.
+func (w *writeAheadLog) replay(after uint64, apply func(rec walRecord)) error {
+	w.Lock()
+	defer w.Unlock()
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(w.f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			var rec walRecord
+			switch jerr := json.Unmarshal(line, &rec); {
+			case jerr != nil:
+				log.Printf("wal: skip broken record: %s", jerr.Error())
+			case rec.Seq != 0 && rec.Seq <= after:
+			default:
+				w.seq = max(w.seq, rec.Seq)
+				apply(rec)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// truncate drop all log records (after successful snapshot).
+func (w *writeAheadLog) truncate() error {
+	w.Lock()
+	defer w.Unlock()
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	if w.fsync != WALFsyncNo {
+		return w.f.Sync()
+	}
+	return nil
+}
+
+// close stop background fsync and close log file.
+func (w *writeAheadLog) close() error {
+	close(w.done)
+	w.wg.Wait()
+	w.Lock()
+	defer w.Unlock()
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	return w.f.Close()
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sourcecd/monitoring/internal/customerrors"
+	"github.com/sourcecd/monitoring/internal/metrictypes"
+	"github.com/sourcecd/monitoring/internal/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWALReplay(t *testing.T) {
+	tmpFile := "test_wal_snapshot.tmp"
+	walFile := "test_wal_replay.tmp"
+	t.Cleanup(func() {
+		os.Remove(tmpFile)
+		os.Remove(walFile)
+	})
+
+	ctx := context.Background()
+	memStorage := NewMemStorage()
+	require.NoError(t, memStorage.EnableWAL(walFile, WALFsyncAlways))
+
+	require.NoError(t, memStorage.WriteMetric(ctx, "gauge", "testGauge", metrictypes.Gauge(0.1)))
+	require.NoError(t, memStorage.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(1)))
+
+	// snapshot drops logged records
+	require.NoError(t, memStorage.SaveToFile(tmpFile))
+	st, err := os.Stat(walFile)
+	require.NoError(t, err)
+	require.Zero(t, st.Size())
+
+	ts := time.Unix(1000, 0)
+	memStorage.now = func() time.Time { return ts }
+	d := int64(2)
+	require.NoError(t, memStorage.WriteMetric(ctx, "gauge", "testGauge", metrictypes.Gauge(0.2)))
+	require.NoError(t, memStorage.WriteBatchMetrics(ctx, []models.Metrics{
+		{ID: "testCounter", MType: "counter", Delta: &d},
+		{ID: "skipped", MType: "counter"},
+	}))
+	require.NoError(t, memStorage.CloseWAL())
+
+	// crash after last snapshot: snapshot + log
+	restored := NewMemStorage()
+	require.NoError(t, restored.EnableWAL(walFile, WALFsyncNo))
+	t.Cleanup(func() { restored.CloseWAL() })
+	require.NoError(t, restored.ReadFromFile(tmpFile))
+
+	g, err := restored.GetMetric(ctx, "gauge", "testGauge")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(0.2), g)
+	c, err := restored.GetMetric(ctx, "counter", "testCounter")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(3), c)
+
+	// history keeps original write time
+	h, err := restored.GetMetricHistory(ctx, "counter", "testCounter", ts, ts)
+	require.NoError(t, err)
+	require.Len(t, h, 1)
+	require.Equal(t, int64(2), *h[0].Delta)
+}
+
+func TestWALSnapshotBeforeTruncate(t *testing.T) {
+	tmpFile := "test_wal_crash_snapshot.tmp"
+	walFile := "test_wal_crash.tmp"
+	t.Cleanup(func() {
+		os.Remove(tmpFile)
+		os.Remove(walFile)
+	})
+
+	ctx := context.Background()
+	memStorage := NewMemStorage()
+	require.NoError(t, memStorage.EnableWAL(walFile, WALFsyncAlways))
+	require.NoError(t, memStorage.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(5)))
+	logged, err := os.ReadFile(walFile)
+	require.NoError(t, err)
+
+	// crash between snapshot rename and log truncate: log still has records of snapshot
+	require.NoError(t, memStorage.SaveToFile(tmpFile))
+	require.NoError(t, memStorage.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(1)))
+	require.NoError(t, memStorage.CloseWAL())
+	after, err := os.ReadFile(walFile)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(walFile, append(logged, after...), 0o644))
+
+	restored := NewMemStorage()
+	require.NoError(t, restored.EnableWAL(walFile, WALFsyncNo))
+	t.Cleanup(func() { restored.CloseWAL() })
+	require.NoError(t, restored.ReadFromFile(tmpFile))
+	c, err := restored.GetMetric(ctx, "counter", "testCounter")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(6), c)
+
+	// sequence numbers of new records continue after replayed ones
+	require.Greater(t, restored.wal.lastSeq(), uint64(0))
+	seq := restored.wal.lastSeq()
+	require.NoError(t, restored.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(1)))
+	require.Greater(t, restored.wal.lastSeq(), seq)
+}
+
+func TestWALWithoutSnapshot(t *testing.T) {
+	walFile := "test_wal_nosnapshot.tmp"
+	t.Cleanup(func() { os.Remove(walFile) })
+
+	ctx := context.Background()
+	memStorage := NewMemStorage()
+	require.NoError(t, memStorage.EnableWAL(walFile, WALFsyncEverySec))
+	require.NoError(t, memStorage.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(5)))
+	require.NoError(t, memStorage.CloseWAL())
+
+	// torn last record
+	f, err := os.OpenFile(walFile, os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"ts":"2024-01-01T00:00:00Z","metrics":[{"id":"test`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	restored := NewMemStorage()
+	require.NoError(t, restored.EnableWAL(walFile, WALFsyncNo))
+	t.Cleanup(func() { restored.CloseWAL() })
+	require.NoError(t, restored.ReadFromFile("test_wal_not_exists.tmp"))
+
+	c, err := restored.GetMetric(ctx, "counter", "testCounter")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Counter(5), c)
+
+	// log is used for new writes after replay
+	require.NoError(t, restored.TruncateWAL())
+	require.NoError(t, restored.WriteMetric(ctx, "counter", "testCounter", metrictypes.Counter(1)))
+	b, err := os.ReadFile(walFile)
+	require.NoError(t, err)
+	require.Contains(t, string(b), `"delta":1`)
+}
+
+func TestWALDelete(t *testing.T) {
+	walFile := "test_wal_delete.tmp"
+	t.Cleanup(func() { os.Remove(walFile) })
+
+	ctx := context.Background()
+	memStorage := NewMemStorage()
+	require.NoError(t, memStorage.EnableWAL(walFile, WALFsyncAlways))
+	require.NoError(t, memStorage.WriteMetric(ctx, "gauge", "testGauge1", metrictypes.Gauge(1)))
+	require.NoError(t, memStorage.WriteMetric(ctx, "gauge", "testGauge2", metrictypes.Gauge(2)))
+	require.NoError(t, memStorage.WriteMetric(ctx, "gauge", "otherGauge", metrictypes.Gauge(3)))
+	n, err := memStorage.Delete(ctx, "gauge", "testGauge*")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.NoError(t, memStorage.WriteMetric(ctx, "gauge", "testGauge2", metrictypes.Gauge(4)))
+	require.NoError(t, memStorage.CloseWAL())
+
+	// deleted series are not restored by replay, writes after delete are
+	restored := NewMemStorage()
+	require.NoError(t, restored.EnableWAL(walFile, WALFsyncNo))
+	t.Cleanup(func() { restored.CloseWAL() })
+	require.NoError(t, restored.ReadFromFile("test_wal_not_exists.tmp"))
+	_, err = restored.GetMetric(ctx, "gauge", "testGauge1")
+	require.ErrorIs(t, err, customerrors.ErrNoVal)
+	g, err := restored.GetMetric(ctx, "gauge", "testGauge2")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(4), g)
+	g, err = restored.GetMetric(ctx, "gauge", "otherGauge")
+	require.NoError(t, err)
+	require.Equal(t, metrictypes.Gauge(3), g)
+}
+
+func TestWALWrongFsync(t *testing.T) {
+	memStorage := NewMemStorage()
+	require.ErrorIs(t, memStorage.EnableWAL("test_wal_wrong.tmp", "sometimes"), ErrWrongWALFsync)
+	_, err := os.Stat("test_wal_wrong.tmp")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -7,10 +7,12 @@ package mocks
 import (
 	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 
 	models "github.com/sourcecd/monitoring/internal/models"
+	storage "github.com/sourcecd/monitoring/internal/storage"
 )
 
 // MockStoreMetrics is a mock of StoreMetrics interface.
@@ -36,6 +38,50 @@ func (m *MockStoreMetrics) EXPECT() *MockStoreMetricsMockRecorder {
 	return m.recorder
 }
 
+// Compact mocks base method.
+func (m *MockStoreMetrics) Compact(arg0 context.Context, arg1 storage.RetentionPolicy, arg2 time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Compact", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Compact indicates an expected call of Compact.
+func (mr *MockStoreMetricsMockRecorder) Compact(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Compact", reflect.TypeOf((*MockStoreMetrics)(nil).Compact), arg0, arg1, arg2)
+}
+
+// Delete mocks base method.
+func (m *MockStoreMetrics) Delete(arg0 context.Context, arg1, arg2 string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", arg0, arg1, arg2)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockStoreMetricsMockRecorder) Delete(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockStoreMetrics)(nil).Delete), arg0, arg1, arg2)
+}
+
+// GetAlerts mocks base method.
+func (m *MockStoreMetrics) GetAlerts(arg0 context.Context) ([]models.Alert, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAlerts", arg0)
+	ret0, _ := ret[0].([]models.Alert)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAlerts indicates an expected call of GetAlerts.
+func (mr *MockStoreMetricsMockRecorder) GetAlerts(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAlerts", reflect.TypeOf((*MockStoreMetrics)(nil).GetAlerts), arg0)
+}
+
 // GetAllMetricsTxt mocks base method.
 func (m *MockStoreMetrics) GetAllMetricsTxt(arg0 context.Context) (string, error) {
 	m.ctrl.T.Helper()
@@ -51,6 +97,21 @@ func (mr *MockStoreMetricsMockRecorder) GetAllMetricsTxt(arg0 interface{}) *gomo
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAllMetricsTxt", reflect.TypeOf((*MockStoreMetrics)(nil).GetAllMetricsTxt), arg0)
 }
 
+// GetMetadata mocks base method.
+func (m *MockStoreMetrics) GetMetadata(arg0 context.Context) ([]models.Metadata, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMetadata", arg0)
+	ret0, _ := ret[0].([]models.Metadata)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetMetadata indicates an expected call of GetMetadata.
+func (mr *MockStoreMetricsMockRecorder) GetMetadata(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMetadata", reflect.TypeOf((*MockStoreMetrics)(nil).GetMetadata), arg0)
+}
+
 // GetMetric mocks base method.
 func (m *MockStoreMetrics) GetMetric(arg0 context.Context, arg1, arg2 string) (interface{}, error) {
 	m.ctrl.T.Helper()
@@ -66,6 +127,36 @@ func (mr *MockStoreMetricsMockRecorder) GetMetric(arg0, arg1, arg2 interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMetric", reflect.TypeOf((*MockStoreMetrics)(nil).GetMetric), arg0, arg1, arg2)
 }
 
+// GetMetricHistory mocks base method.
+func (m *MockStoreMetrics) GetMetricHistory(arg0 context.Context, arg1, arg2 string, arg3, arg4 time.Time) ([]models.Sample, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMetricHistory", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].([]models.Sample)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetMetricHistory indicates an expected call of GetMetricHistory.
+func (mr *MockStoreMetricsMockRecorder) GetMetricHistory(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMetricHistory", reflect.TypeOf((*MockStoreMetrics)(nil).GetMetricHistory), arg0, arg1, arg2, arg3, arg4)
+}
+
+// GetMetricRollups mocks base method.
+func (m *MockStoreMetrics) GetMetricRollups(arg0 context.Context, arg1, arg2 string, arg3 time.Duration, arg4, arg5 time.Time) ([]models.Sample, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMetricRollups", arg0, arg1, arg2, arg3, arg4, arg5)
+	ret0, _ := ret[0].([]models.Sample)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetMetricRollups indicates an expected call of GetMetricRollups.
+func (mr *MockStoreMetricsMockRecorder) GetMetricRollups(arg0, arg1, arg2, arg3, arg4, arg5 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMetricRollups", reflect.TypeOf((*MockStoreMetrics)(nil).GetMetricRollups), arg0, arg1, arg2, arg3, arg4, arg5)
+}
+
 // Ping mocks base method.
 func (m *MockStoreMetrics) Ping(arg0 context.Context) error {
 	m.ctrl.T.Helper()
@@ -80,6 +171,34 @@ func (mr *MockStoreMetricsMockRecorder) Ping(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Ping", reflect.TypeOf((*MockStoreMetrics)(nil).Ping), arg0)
 }
 
+// ScanMetrics mocks base method.
+func (m *MockStoreMetrics) ScanMetrics(arg0 context.Context, arg1 func(models.Metrics) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ScanMetrics", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ScanMetrics indicates an expected call of ScanMetrics.
+func (mr *MockStoreMetricsMockRecorder) ScanMetrics(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ScanMetrics", reflect.TypeOf((*MockStoreMetrics)(nil).ScanMetrics), arg0, arg1)
+}
+
+// WriteAlerts mocks base method.
+func (m *MockStoreMetrics) WriteAlerts(arg0 context.Context, arg1 []models.Alert) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WriteAlerts", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// WriteAlerts indicates an expected call of WriteAlerts.
+func (mr *MockStoreMetricsMockRecorder) WriteAlerts(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteAlerts", reflect.TypeOf((*MockStoreMetrics)(nil).WriteAlerts), arg0, arg1)
+}
+
 // WriteBatchMetrics mocks base method.
 func (m *MockStoreMetrics) WriteBatchMetrics(arg0 context.Context, arg1 []models.Metrics) error {
 	m.ctrl.T.Helper()
@@ -94,6 +213,20 @@ func (mr *MockStoreMetricsMockRecorder) WriteBatchMetrics(arg0, arg1 interface{}
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteBatchMetrics", reflect.TypeOf((*MockStoreMetrics)(nil).WriteBatchMetrics), arg0, arg1)
 }
 
+// WriteMetadata mocks base method.
+func (m *MockStoreMetrics) WriteMetadata(arg0 context.Context, arg1 []models.Metadata) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WriteMetadata", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// WriteMetadata indicates an expected call of WriteMetadata.
+func (mr *MockStoreMetricsMockRecorder) WriteMetadata(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WriteMetadata", reflect.TypeOf((*MockStoreMetrics)(nil).WriteMetadata), arg0, arg1)
+}
+
 // WriteMetric mocks base method.
 func (m *MockStoreMetrics) WriteMetric(arg0 context.Context, arg1, arg2 string, arg3 interface{}) error {
 	m.ctrl.T.Helper()
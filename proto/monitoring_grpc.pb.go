@@ -19,7 +19,9 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	Monitoring_SendMetrics_FullMethodName = "/monitoring.Monitoring/SendMetrics"
+	Monitoring_SendMetrics_FullMethodName   = "/monitoring.Monitoring/SendMetrics"
+	Monitoring_DeleteMetrics_FullMethodName = "/monitoring.Monitoring/DeleteMetrics"
+	Monitoring_SendMetadata_FullMethodName  = "/monitoring.Monitoring/SendMetadata"
 )
 
 // MonitoringClient is the client API for Monitoring service.
@@ -27,6 +29,8 @@ const (
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type MonitoringClient interface {
 	SendMetrics(ctx context.Context, in *MetricsRequest, opts ...grpc.CallOption) (*MetricResponse, error)
+	DeleteMetrics(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	SendMetadata(ctx context.Context, in *MetadataRequest, opts ...grpc.CallOption) (*MetricResponse, error)
 }
 
 type monitoringClient struct {
@@ -47,11 +51,33 @@ func (c *monitoringClient) SendMetrics(ctx context.Context, in *MetricsRequest,
 	return out, nil
 }
 
+func (c *monitoringClient) DeleteMetrics(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, Monitoring_DeleteMetrics_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *monitoringClient) SendMetadata(ctx context.Context, in *MetadataRequest, opts ...grpc.CallOption) (*MetricResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MetricResponse)
+	err := c.cc.Invoke(ctx, Monitoring_SendMetadata_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // MonitoringServer is the server API for Monitoring service.
 // All implementations must embed UnimplementedMonitoringServer
 // for forward compatibility.
 type MonitoringServer interface {
 	SendMetrics(context.Context, *MetricsRequest) (*MetricResponse, error)
+	DeleteMetrics(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	SendMetadata(context.Context, *MetadataRequest) (*MetricResponse, error)
 	mustEmbedUnimplementedMonitoringServer()
 }
 
@@ -65,6 +91,12 @@ type UnimplementedMonitoringServer struct{}
 func (UnimplementedMonitoringServer) SendMetrics(context.Context, *MetricsRequest) (*MetricResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method SendMetrics not implemented")
 }
+func (UnimplementedMonitoringServer) DeleteMetrics(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteMetrics not implemented")
+}
+func (UnimplementedMonitoringServer) SendMetadata(context.Context, *MetadataRequest) (*MetricResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendMetadata not implemented")
+}
 func (UnimplementedMonitoringServer) mustEmbedUnimplementedMonitoringServer() {}
 func (UnimplementedMonitoringServer) testEmbeddedByValue()                    {}
 
@@ -104,6 +136,42 @@ func _Monitoring_SendMetrics_Handler(srv interface{}, ctx context.Context, dec f
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Monitoring_DeleteMetrics_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MonitoringServer).DeleteMetrics(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Monitoring_DeleteMetrics_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MonitoringServer).DeleteMetrics(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Monitoring_SendMetadata_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MetadataRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MonitoringServer).SendMetadata(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Monitoring_SendMetadata_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MonitoringServer).SendMetadata(ctx, req.(*MetadataRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Monitoring_ServiceDesc is the grpc.ServiceDesc for Monitoring service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -115,6 +183,14 @@ var Monitoring_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "SendMetrics",
 			Handler:    _Monitoring_SendMetrics_Handler,
 		},
+		{
+			MethodName: "DeleteMetrics",
+			Handler:    _Monitoring_DeleteMetrics_Handler,
+		},
+		{
+			MethodName: "SendMetadata",
+			Handler:    _Monitoring_SendMetadata_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/monitoring.proto",